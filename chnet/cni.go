@@ -0,0 +1,89 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ccheshirecat/nomad-driver-ch/chnet/cni"
+	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
+	"github.com/hashicorp/nomad/client/lib/nsutil"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// cniTimeout bounds each invocation of a CNI plugin chain.
+const cniTimeout = time.Minute
+
+// cniNetworkBuild completes the configuration of a VM attached to a network
+// by CNI plugins. The virtualizer has already run the plugins, as the guest
+// needs its address before booting, so this only reports the address and
+// caches the attachment for teardown. The network policy, including any
+// port mapping, is the responsibility of the plugins.
+func (c *Controller) cniNetworkBuild(req *net.VMStartedBuildRequest) (*net.VMStartedBuildResponse, error) {
+	if len(req.GuestIPs) == 0 || req.GuestIPs[0] == "" {
+		return nil, fmt.Errorf("virtualizer did not provide the address of VM %s", req.DomainName)
+	}
+
+	c.logger.Info("successfully configured CNI network",
+		"vm", req.DomainName, "network", req.CNI.Network, "ip", req.GuestIPs[0])
+
+	return &net.VMStartedBuildResponse{
+		DriverNetwork: &drivers.DriverNetwork{
+			IP: req.GuestIPs[0],
+		},
+		TeardownSpec: &net.TeardownSpec{
+			CNI: req.CNI,
+		},
+	}, nil
+}
+
+// teardownCNI deletes a CNI attachment using the cached configuration and
+// result, then removes the network namespace if it was created for the VM.
+// The namespace is kept when the plugins fail, so the deletion can be retried.
+func (c *Controller) teardownCNI(attachment *net.CNIAttachment) error {
+	if attachment == nil {
+		return nil
+	}
+
+	list, err := cni.ParseNetworkList(attachment.Config)
+	if err != nil {
+		return fmt.Errorf("invalid cached CNI config of network %q: %w", attachment.Network, err)
+	}
+
+	// Plugins are told the namespace no longer exists by an empty path, so
+	// they still release resources held outside of it, such as addresses.
+	rt := &cni.RuntimeConf{
+		ContainerID: attachment.ContainerID,
+		NetNS:       attachment.NetNS,
+		IfName:      attachment.IfName,
+		Args:        attachment.Args,
+	}
+	nsExists := nsutil.IsNSorErr(attachment.NetNS) == nil
+	if !nsExists {
+		rt.NetNS = ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cniTimeout)
+	defer cancel()
+
+	client := cni.New(c.networkConfig.CNIPath, c.networkConfig.CNIConfigDir)
+	if err := client.Del(ctx, list, rt, attachment.Result); err != nil {
+		return fmt.Errorf("failed to detach from CNI network %q: %w", attachment.Network, err)
+	}
+
+	if attachment.OwnsNetNS && nsExists {
+		if err := nsutil.UnmountNS(attachment.NetNS); err != nil {
+			return fmt.Errorf("failed to remove network namespace %q: %w", attachment.NetNS, err)
+		}
+	}
+
+	c.logger.Debug("successfully detached from CNI network",
+		"network", attachment.Network, "container_id", attachment.ContainerID)
+
+	return nil
+}
@@ -0,0 +1,291 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+// Package cni invokes CNI plugins to attach VM interfaces to networks. It
+// implements the plugin side of the CNI specification needed by the driver:
+// loading network configuration lists, executing plugin chains and parsing
+// their results.
+package cni
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	// DefaultPath is the directory CNI plugins are searched for when no path
+	// is configured, matching the Nomad client default.
+	DefaultPath = "/opt/cni/bin"
+
+	// DefaultConfigDir is the directory CNI network configurations are loaded
+	// from when no directory is configured, matching the Nomad client default.
+	DefaultConfigDir = "/opt/cni/config"
+
+	commandAdd = "ADD"
+	commandDel = "DEL"
+)
+
+// ErrNetworkNotFound is returned when no configuration file within the
+// configuration directory defines the requested network.
+var ErrNetworkNotFound = errors.New("CNI network not found")
+
+// NetworkList is a parsed CNI network configuration list. Single plugin
+// configuration files are converted to a list holding one plugin.
+type NetworkList struct {
+	CNIVersion string
+	Name       string
+	Plugins    []map[string]any
+
+	// Bytes is the configuration list as JSON, which is cached so plugins can
+	// be deleted using the configuration they were added with.
+	Bytes []byte
+}
+
+// RuntimeConf is the runtime information passed to plugins when attaching or
+// detaching an interface.
+type RuntimeConf struct {
+	ContainerID string
+	NetNS       string
+	IfName      string
+	Args        map[string]string
+}
+
+// Client invokes the CNI plugins found within its plugin directories.
+type Client struct {
+	paths     []string
+	configDir string
+}
+
+// New returns a client which searches the colon separated list of
+// directories in path for plugins, and loads network configurations from
+// configDir. Empty values use DefaultPath and DefaultConfigDir.
+func New(path, configDir string) *Client {
+	if path == "" {
+		path = DefaultPath
+	}
+	if configDir == "" {
+		configDir = DefaultConfigDir
+	}
+	return &Client{
+		paths:     filepath.SplitList(path),
+		configDir: configDir,
+	}
+}
+
+// LoadNetwork returns the configuration list of the named network. Files are
+// read from the configuration directory in lexical order, so when several
+// define the same network, the first wins.
+func (c *Client) LoadNetwork(name string) (*NetworkList, error) {
+	entries, err := os.ReadDir(c.configDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CNI config directory: %w", err)
+	}
+
+	var files []string
+	for _, entry := range entries {
+		switch filepath.Ext(entry.Name()) {
+		case ".conflist", ".conf", ".json":
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(c.configDir, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CNI config %q: %w", file, err)
+		}
+		list, err := ParseNetworkList(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CNI config %q: %w", file, err)
+		}
+		if list.Name == name {
+			return list, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %q in %s", ErrNetworkNotFound, name, c.configDir)
+}
+
+// ParseNetworkList parses a CNI configuration list, or a single plugin
+// configuration which is converted to a list.
+func ParseNetworkList(b []byte) (*NetworkList, error) {
+	var raw map[string]any
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+
+	list := &NetworkList{}
+	list.Name, _ = raw["name"].(string)
+	list.CNIVersion, _ = raw["cniVersion"].(string)
+	if list.Name == "" {
+		return nil, errors.New("missing network name")
+	}
+
+	if plugins, ok := raw["plugins"]; ok {
+		items, ok := plugins.([]any)
+		if !ok {
+			return nil, errors.New("plugins must be a list")
+		}
+		for i, item := range items {
+			plugin, ok := item.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("plugin %d must be an object", i)
+			}
+			list.Plugins = append(list.Plugins, plugin)
+		}
+	} else {
+		list.Plugins = []map[string]any{raw}
+	}
+
+	if len(list.Plugins) == 0 {
+		return nil, errors.New("no plugins configured")
+	}
+	for i, plugin := range list.Plugins {
+		if t, _ := plugin["type"].(string); t == "" {
+			return nil, fmt.Errorf("plugin %d is missing type", i)
+		}
+	}
+
+	normalised, err := json.Marshal(map[string]any{
+		"cniVersion": list.CNIVersion,
+		"name":       list.Name,
+		"plugins":    list.Plugins,
+	})
+	if err != nil {
+		return nil, err
+	}
+	list.Bytes = normalised
+
+	return list, nil
+}
+
+// Add executes the plugins of the network in order, passing each the result
+// of the previous one, and returns the result of the last.
+func (c *Client) Add(ctx context.Context, list *NetworkList, rt *RuntimeConf) (*Result, error) {
+	var prevResult []byte
+
+	for _, plugin := range list.Plugins {
+		out, err := c.exec(ctx, commandAdd, list, plugin, rt, prevResult)
+		if err != nil {
+			return nil, err
+		}
+		prevResult = out
+	}
+
+	return ParseResult(prevResult)
+}
+
+// Del executes the plugins of the network in reverse order, passing each the
+// result returned by Add when known. Plugins are expected to succeed when
+// the interface no longer exists, so Del may be retried.
+func (c *Client) Del(ctx context.Context, list *NetworkList, rt *RuntimeConf, prevResult []byte) error {
+	for _, plugin := range slices.Backward(list.Plugins) {
+		if _, err := c.exec(ctx, commandDel, list, plugin, rt, prevResult); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exec runs a single plugin and returns its output.
+func (c *Client) exec(ctx context.Context, command string, list *NetworkList, plugin map[string]any,
+	rt *RuntimeConf, prevResult []byte) ([]byte, error) {
+
+	pluginType, _ := plugin["type"].(string)
+
+	bin, err := c.findPlugin(pluginType)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := make(map[string]any, len(plugin)+3)
+	for k, v := range plugin {
+		conf[k] = v
+	}
+	conf["name"] = list.Name
+	conf["cniVersion"] = list.CNIVersion
+	if len(prevResult) > 0 {
+		conf["prevResult"] = json.RawMessage(prevResult)
+	}
+	stdin, err := json.Marshal(conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config of CNI plugin %q: %w", pluginType, err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, bin)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(),
+		"CNI_COMMAND="+command,
+		"CNI_CONTAINERID="+rt.ContainerID,
+		"CNI_NETNS="+rt.NetNS,
+		"CNI_IFNAME="+rt.IfName,
+		"CNI_ARGS="+encodeArgs(rt.Args),
+		"CNI_PATH="+strings.Join(c.paths, string(filepath.ListSeparator)),
+	)
+
+	if err := cmd.Run(); err != nil {
+		var pluginErr Error
+		if jsonErr := json.Unmarshal(stdout.Bytes(), &pluginErr); jsonErr == nil && pluginErr.Msg != "" {
+			return nil, fmt.Errorf("CNI plugin %q failed (%s): %w", pluginType, strings.ToLower(command), &pluginErr)
+		}
+		return nil, fmt.Errorf("CNI plugin %q failed (%s): %w (stderr: %s)",
+			pluginType, strings.ToLower(command), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// findPlugin returns the path of the plugin binary within the first plugin
+// directory containing it.
+func (c *Client) findPlugin(pluginType string) (string, error) {
+	if strings.ContainsRune(pluginType, filepath.Separator) {
+		return "", fmt.Errorf("invalid CNI plugin type %q", pluginType)
+	}
+	for _, dir := range c.paths {
+		bin := filepath.Join(dir, pluginType)
+		if info, err := os.Stat(bin); err == nil && !info.IsDir() {
+			return bin, nil
+		}
+	}
+	return "", fmt.Errorf("failed to find CNI plugin %q in %s", pluginType, strings.Join(c.paths, ", "))
+}
+
+// encodeArgs encodes the arguments in the CNI_ARGS format, sorted by key so
+// the plugin input is stable.
+func encodeArgs(args map[string]string) string {
+	pairs := make([]string, 0, len(args))
+	for k, v := range args {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ";")
+}
+
+// Error is the error returned by a plugin on its output.
+type Error struct {
+	Code    uint   `json:"code"`
+	Msg     string `json:"msg"`
+	Details string `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Details != "" {
+		return fmt.Sprintf("%s (code %d): %s", e.Msg, e.Code, e.Details)
+	}
+	return fmt.Sprintf("%s (code %d)", e.Msg, e.Code)
+}
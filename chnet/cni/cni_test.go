@@ -0,0 +1,194 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cni
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/shoenig/test/must"
+)
+
+// stubPlugin records each invocation within the plugin directory and, on
+// ADD, writes the result file named after the plugin.
+const stubPlugin = `#!/bin/sh
+dir=$(dirname "$0")
+name=$(basename "$0")
+cat > "$dir/$name.$CNI_COMMAND.stdin"
+echo "$name $CNI_COMMAND $CNI_CONTAINERID $CNI_NETNS $CNI_IFNAME $CNI_ARGS" >> "$dir/calls"
+if [ "$CNI_COMMAND" = ADD ]; then cat "$dir/$name.result"; fi
+`
+
+const failingPlugin = `#!/bin/sh
+echo '{"code": 7, "msg": "no addresses left", "details": "pool exhausted"}'
+exit 1
+`
+
+const vethResult = `{
+  "cniVersion": "1.0.0",
+  "interfaces": [
+    {"name": "veth1234", "mac": "aa:aa:aa:aa:aa:aa"},
+    {"name": "eth0", "mac": "02:00:00:00:00:01", "sandbox": "/var/run/netns/vm"}
+  ],
+  "ips": [{"interface": 1, "address": "10.22.0.5/24", "gateway": "10.22.0.1"}],
+  "dns": {"nameservers": ["10.22.0.1"]}
+}`
+
+const tapResult = `{
+  "cniVersion": "1.0.0",
+  "interfaces": [
+    {"name": "veth1234", "mac": "aa:aa:aa:aa:aa:aa"},
+    {"name": "eth0", "mac": "02:00:00:00:00:01", "sandbox": "/var/run/netns/vm"},
+    {"name": "tap0", "mac": "02:00:00:00:00:02", "sandbox": "/var/run/netns/vm"}
+  ],
+  "ips": [{"interface": 1, "address": "10.22.0.5/24", "gateway": "10.22.0.1"}],
+  "dns": {"nameservers": ["10.22.0.1"]}
+}`
+
+func writeFile(t *testing.T, path, content string, perm os.FileMode) {
+	t.Helper()
+	must.NoError(t, os.WriteFile(path, []byte(content), perm))
+}
+
+func TestClient_AddDel(t *testing.T) {
+	binDir, confDir := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(binDir, "veth"), stubPlugin, 0755)
+	writeFile(t, filepath.Join(binDir, "veth.result"), vethResult, 0644)
+	writeFile(t, filepath.Join(binDir, "tap"), stubPlugin, 0755)
+	writeFile(t, filepath.Join(binDir, "tap.result"), tapResult, 0644)
+
+	writeFile(t, filepath.Join(confDir, "10-other.conf"),
+		`{"cniVersion": "1.0.0", "name": "other", "type": "veth"}`, 0644)
+	writeFile(t, filepath.Join(confDir, "20-vms.conflist"), `{
+  "cniVersion": "1.0.0",
+  "name": "vms",
+  "plugins": [{"type": "veth", "mtu": 1400}, {"type": "tap"}]
+}`, 0644)
+
+	c := New("/nonexistent"+string(filepath.ListSeparator)+binDir, confDir)
+
+	_, err := c.LoadNetwork("missing")
+	must.ErrorIs(t, err, ErrNetworkNotFound)
+
+	list, err := c.LoadNetwork("vms")
+	must.NoError(t, err)
+	must.Eq(t, "vms", list.Name)
+	must.Len(t, 2, list.Plugins)
+
+	// The cached bytes can be parsed back into the same list.
+	cached, err := ParseNetworkList(list.Bytes)
+	must.NoError(t, err)
+	must.Eq(t, list.Plugins, cached.Plugins)
+
+	rt := &RuntimeConf{
+		ContainerID: "nomad-task-1",
+		NetNS:       "/var/run/netns/vm",
+		IfName:      "eth0",
+		Args:        map[string]string{"K8S_POD_NAME": "web", "IgnoreUnknown": "true"},
+	}
+
+	res, err := c.Add(context.Background(), list, rt)
+	must.NoError(t, err)
+	must.Eq(t, "1.0.0", res.CNIVersion)
+	must.Eq(t, []string{"10.22.0.1"}, res.DNS.Nameservers)
+
+	// The second plugin receives the network name and version, its own
+	// configuration and the result of the first.
+	var conf map[string]any
+	b, err := os.ReadFile(filepath.Join(binDir, "tap.ADD.stdin"))
+	must.NoError(t, err)
+	must.NoError(t, json.Unmarshal(b, &conf))
+	must.Eq(t, "vms", conf["name"])
+	must.Eq(t, "1.0.0", conf["cniVersion"])
+	must.Eq(t, "tap", conf["type"])
+	must.MapContainsKey(t, conf, "prevResult")
+
+	b, err = os.ReadFile(filepath.Join(binDir, "veth.ADD.stdin"))
+	must.NoError(t, err)
+	must.StrNotContains(t, string(b), "prevResult")
+	must.StrContains(t, string(b), `"mtu":1400`)
+
+	vm, err := res.VMInterface("eth0", "/var/run/netns/vm")
+	must.NoError(t, err)
+	must.Eq(t, &VMInterface{
+		TAP:     "tap0",
+		MAC:     "02:00:00:00:00:01",
+		Address: netip.MustParsePrefix("10.22.0.5/24"),
+		Gateway: netip.MustParseAddr("10.22.0.1"),
+	}, vm)
+
+	// Deletion runs the plugins in reverse, passing the cached result.
+	must.NoError(t, c.Del(context.Background(), cached, rt, res.Raw))
+
+	b, err = os.ReadFile(filepath.Join(binDir, "veth.DEL.stdin"))
+	must.NoError(t, err)
+	must.NoError(t, json.Unmarshal(b, &conf))
+	prev, err := json.Marshal(conf["prevResult"])
+	must.NoError(t, err)
+	must.StrContains(t, string(prev), "tap0")
+
+	calls, err := os.ReadFile(filepath.Join(binDir, "calls"))
+	must.NoError(t, err)
+	must.Eq(t, []string{
+		"veth ADD nomad-task-1 /var/run/netns/vm eth0 IgnoreUnknown=true;K8S_POD_NAME=web",
+		"tap ADD nomad-task-1 /var/run/netns/vm eth0 IgnoreUnknown=true;K8S_POD_NAME=web",
+		"tap DEL nomad-task-1 /var/run/netns/vm eth0 IgnoreUnknown=true;K8S_POD_NAME=web",
+		"veth DEL nomad-task-1 /var/run/netns/vm eth0 IgnoreUnknown=true;K8S_POD_NAME=web",
+	}, strings.Split(strings.TrimSpace(string(calls)), "\n"))
+}
+
+func TestClient_Errors(t *testing.T) {
+	binDir := t.TempDir()
+	writeFile(t, filepath.Join(binDir, "ipam"), failingPlugin, 0755)
+
+	c := New(binDir, t.TempDir())
+	rt := &RuntimeConf{ContainerID: "nomad-task-1", NetNS: "/var/run/netns/vm", IfName: "eth0"}
+
+	list, err := ParseNetworkList([]byte(`{"cniVersion": "1.0.0", "name": "vms", "type": "ipam"}`))
+	must.NoError(t, err)
+	_, err = c.Add(context.Background(), list, rt)
+	must.ErrorContains(t, err, `CNI plugin "ipam" failed (add): no addresses left (code 7): pool exhausted`)
+
+	list, err = ParseNetworkList([]byte(`{"cniVersion": "1.0.0", "name": "vms", "type": "bridge"}`))
+	must.NoError(t, err)
+	_, err = c.Add(context.Background(), list, rt)
+	must.ErrorContains(t, err, `failed to find CNI plugin "bridge"`)
+
+	_, err = ParseNetworkList([]byte(`{"cniVersion": "1.0.0", "name": "vms", "plugins": []}`))
+	must.ErrorContains(t, err, "no plugins configured")
+	_, err = ParseNetworkList([]byte(`{"cniVersion": "1.0.0", "type": "bridge"}`))
+	must.ErrorContains(t, err, "missing network name")
+}
+
+func TestResult_VMInterface(t *testing.T) {
+	// A tap plugin alone addresses the guest through the TAP itself.
+	res, err := ParseResult([]byte(vethResult))
+	must.NoError(t, err)
+	vm, err := res.VMInterface("eth0", "/var/run/netns/vm")
+	must.NoError(t, err)
+	must.Eq(t, "eth0", vm.TAP)
+	must.Eq(t, "", vm.MAC)
+	must.Eq(t, "10.22.0.5/24", vm.Address.String())
+
+	// Results predating version 0.3.0 only carry the ip4 field.
+	res, err = ParseResult([]byte(`{"cniVersion": "0.2.0", "ip4": {"ip": "10.22.0.7/16", "gateway": "10.22.0.1"}}`))
+	must.NoError(t, err)
+	vm, err = res.VMInterface("eth0", "/var/run/netns/vm")
+	must.NoError(t, err)
+	must.Eq(t, "10.22.0.7/16", vm.Address.String())
+	must.Eq(t, "10.22.0.1", vm.Gateway.String())
+
+	res, err = ParseResult([]byte(`{"cniVersion": "1.0.0", "ips": [{"address": "fd00::5/64"}]}`))
+	must.NoError(t, err)
+	_, err = res.VMInterface("eth0", "/var/run/netns/vm")
+	must.ErrorContains(t, err, "no IPv4 address")
+
+	_, err = ParseResult(nil)
+	must.ErrorContains(t, err, "no result")
+}
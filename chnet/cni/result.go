@@ -0,0 +1,151 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cni
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// Result is the result returned by the last plugin of a network, covering
+// the fields used by the driver. Versions 0.3.0 and later are supported
+// natively, and the "ip4" field of earlier versions is converted.
+type Result struct {
+	CNIVersion string      `json:"cniVersion"`
+	Interfaces []Interface `json:"interfaces"`
+	IPs        []IPConfig  `json:"ips"`
+	DNS        DNS         `json:"dns"`
+
+	// Raw is the result as returned by the plugin, which is passed to the
+	// plugins when the network is deleted.
+	Raw []byte `json:"-"`
+}
+
+// Interface is an interface created by a plugin. Sandbox is the network
+// namespace path of interfaces created within the namespace.
+type Interface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac"`
+	Sandbox string `json:"sandbox"`
+}
+
+// IPConfig is an address assigned by a plugin. Interface is the index within
+// the result interfaces the address belongs to, if known.
+type IPConfig struct {
+	Interface *int   `json:"interface"`
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway"`
+}
+
+// DNS is the resolver configuration returned by a plugin.
+type DNS struct {
+	Nameservers []string `json:"nameservers"`
+	Domain      string   `json:"domain"`
+	Search      []string `json:"search"`
+}
+
+// ParseResult parses the result written by a plugin.
+func ParseResult(b []byte) (*Result, error) {
+	if len(b) == 0 {
+		return nil, errors.New("CNI plugin returned no result")
+	}
+
+	var r struct {
+		Result
+		IP4 *struct {
+			IP      string `json:"ip"`
+			Gateway string `json:"gateway"`
+		} `json:"ip4"`
+	}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("failed to parse CNI result: %w", err)
+	}
+
+	if r.IP4 != nil && len(r.IPs) == 0 {
+		r.IPs = []IPConfig{{Address: r.IP4.IP, Gateway: r.IP4.Gateway}}
+	}
+
+	res := r.Result
+	res.Raw = b
+	return &res, nil
+}
+
+// VMInterface is the addressing of a VM attached to a network through a TAP
+// created by the plugins.
+type VMInterface struct {
+	// TAP is the name of the TAP device within the network namespace.
+	TAP string
+
+	// MAC is the address the guest must use, or empty if any address can be
+	// used.
+	MAC string
+
+	// Address is the guest address and prefix, and Gateway its default
+	// gateway, if any.
+	Address netip.Prefix
+	Gateway netip.Addr
+}
+
+// VMInterface returns the addressing of a VM attached by a tap-capable chain.
+// Two chain layouts are supported:
+//
+//   - A plugin, such as "tap", creates the TAP named ifName, which the
+//     guest is addressed through.
+//   - A plugin creates the interface named ifName, such as a veth, and a
+//     later plugin, such as "tc-redirect-tap", creates a TAP mirroring it.
+//     The guest then takes over the MAC and address of ifName.
+func (r *Result) VMInterface(ifName, netns string) (*VMInterface, error) {
+	ifIndex, tapIndex := -1, -1
+	for i, iface := range r.Interfaces {
+		if iface.Sandbox != netns {
+			continue
+		}
+		if iface.Name == ifName {
+			ifIndex = i
+		} else {
+			tapIndex = i
+		}
+	}
+
+	vm := &VMInterface{TAP: ifName}
+	if tapIndex >= 0 {
+		vm.TAP = r.Interfaces[tapIndex].Name
+		if ifIndex >= 0 {
+			vm.MAC = r.Interfaces[ifIndex].Mac
+		}
+	}
+
+	// Prefer an IPv4 address of the interface, then any IPv4 address, as
+	// older plugins do not always reference the interface.
+	var chosen *IPConfig
+	for i, ip := range r.IPs {
+		prefix, err := netip.ParsePrefix(ip.Address)
+		if err != nil || !prefix.Addr().Is4() {
+			continue
+		}
+		if ip.Interface != nil && *ip.Interface == ifIndex && ifIndex >= 0 {
+			chosen = &r.IPs[i]
+			break
+		}
+		if chosen == nil {
+			chosen = &r.IPs[i]
+		}
+	}
+	if chosen == nil {
+		return nil, errors.New("CNI result contains no IPv4 address")
+	}
+
+	vm.Address, _ = netip.ParsePrefix(chosen.Address)
+	if chosen.Gateway != "" {
+		gw, err := netip.ParseAddr(chosen.Gateway)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gateway %q in CNI result: %w", chosen.Gateway, err)
+		}
+		vm.Gateway = gw
+	}
+
+	return vm, nil
+}
@@ -0,0 +1,67 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
+	"github.com/hashicorp/go-hclog"
+	"github.com/shoenig/test/must"
+)
+
+func TestController_CNI(t *testing.T) {
+	// The stub plugin records the namespace and result it is deleted with.
+	binDir := t.TempDir()
+	must.NoError(t, os.WriteFile(filepath.Join(binDir, "stub"), []byte(`#!/bin/sh
+dir=$(dirname "$0")
+echo "$CNI_COMMAND $CNI_CONTAINERID netns=$CNI_NETNS" >> "$dir/calls"
+cat > "$dir/stdin"
+`), 0755))
+
+	c := &Controller{
+		logger:        hclog.NewNullLogger(),
+		networkConfig: &domain.Network{CNIPath: binDir},
+	}
+
+	attachment := &net.CNIAttachment{
+		Network:     "vms",
+		ContainerID: "nomad-task-1",
+		IfName:      "eth0",
+		NetNS:       filepath.Join(t.TempDir(), "missing"),
+		OwnsNetNS:   true,
+		Config:      []byte(`{"cniVersion": "1.0.0", "name": "vms", "plugins": [{"type": "stub"}]}`),
+		Result:      []byte(`{"cniVersion": "1.0.0", "ips": [{"address": "10.22.0.5/24"}]}`),
+	}
+
+	resp, err := c.VMStartedBuild(&net.VMStartedBuildRequest{
+		DomainName: "nomad-task-1",
+		GuestIPs:   []string{"10.22.0.5"},
+		CNI:        attachment,
+	})
+	must.NoError(t, err)
+	must.Eq(t, "10.22.0.5", resp.DriverNetwork.IP)
+	must.Eq(t, attachment, resp.TeardownSpec.CNI)
+
+	// The namespace no longer exists, so the plugins are told so.
+	_, err = c.VMTerminatedTeardown(&net.VMTerminatedTeardownRequest{TeardownSpec: resp.TeardownSpec})
+	must.NoError(t, err)
+
+	calls, err := os.ReadFile(filepath.Join(binDir, "calls"))
+	must.NoError(t, err)
+	must.Eq(t, "DEL nomad-task-1 netns=\n", string(calls))
+	stdin, err := os.ReadFile(filepath.Join(binDir, "stdin"))
+	must.NoError(t, err)
+	must.StrContains(t, string(stdin), `"prevResult":{"cniVersion":"1.0.0","ips":[{"address":"10.22.0.5/24"}]}`)
+
+	// A failing plugin fails the teardown, so it is retried.
+	must.NoError(t, os.WriteFile(filepath.Join(binDir, "stub"), []byte("#!/bin/sh\nexit 1\n"), 0755))
+	_, err = c.VMTerminatedTeardown(&net.VMTerminatedTeardownRequest{TeardownSpec: resp.TeardownSpec})
+	must.ErrorContains(t, err, `failed to detach from CNI network "vms"`)
+}
@@ -15,13 +15,18 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/ccheshirecat/nomad-driver-ch/chnet/dhcp"
+	"github.com/ccheshirecat/nomad-driver-ch/chnet/proxy"
+	"github.com/ccheshirecat/nomad-driver-ch/chnet/resolver"
 	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
 	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/nomad/client/lib/nsutil"
 	"github.com/hashicorp/nomad/plugins/drivers"
 	"github.com/hashicorp/nomad/plugins/shared/structs"
 )
@@ -62,10 +67,49 @@ type Controller struct {
 	logger        hclog.Logger
 	networkConfig *domain.Network
 
+	// networks are the named networks configured within the driver, in
+	// addition to the driver network.
+	networks domain.NamedNetworks
+
 	// interfaceByIPGetter is the function that queries the host using the
 	// passed IP address and identifies the interface it is assigned to. It is
 	// a field within the controller to aid testing.
 	interfaceByIPGetter
+
+	// firewall is the backend used to manage port forwarding and firewall
+	// rules. It is nil when no backend could be initialized.
+	firewall firewallBackend
+
+	// proxies are the running userspace port forwarding proxies, keyed by
+	// protocol and listen address. proxyLock guards access to them.
+	proxies   map[string]*proxy.Proxy
+	proxyLock sync.Mutex
+
+	// dhcpListener opens the socket used by the embedded DHCP server.
+	dhcpListener
+
+	// commandRunner runs the host commands used to configure network
+	// isolation.
+	commandRunner
+
+	// isolationSupported indicates ebtables was found and configured during
+	// Init. isolationLock serializes changes to the shared ebtables chains.
+	isolationSupported bool
+	isolationLock      sync.Mutex
+
+	// resolverListener opens the sockets used by the embedded DNS resolver.
+	resolverListener
+
+	// resolver is the embedded DNS resolver, which is only running when
+	// enabled within the driver configuration. resolverLock guards access to
+	// it.
+	resolver     *resolver.Server
+	resolverLock sync.Mutex
+
+	// dhcpServer is the embedded DHCP server, which is only running when
+	// enabled within the driver configuration. dhcpLock guards access to it.
+	dhcpServer *dhcp.Server
+	dhcpLock   sync.Mutex
 }
 
 // interfaceByIPGetter is the function signature used to identify the host's
@@ -76,11 +120,15 @@ type interfaceByIPGetter func(ip stdnet.IP) (string, error)
 
 // NewController returns a Controller which implements the net.Net interface
 // for Cloud Hypervisor networking.
-func NewController(logger hclog.Logger, networkConfig *domain.Network) *Controller {
+func NewController(logger hclog.Logger, networkConfig *domain.Network, networks domain.NamedNetworks) *Controller {
 	return &Controller{
 		logger:              logger.Named("chnet"),
 		networkConfig:       networkConfig,
+		networks:            networks,
 		interfaceByIPGetter: getInterfaceByIP,
+		dhcpListener:        dhcp.ListenInterface,
+		resolverListener:    resolver.Listen,
+		commandRunner:       runCommand,
 	}
 }
 
@@ -101,6 +149,24 @@ func (c *Controller) Fingerprint(attr map[string]*structs.Attribute) {
 	bridgeNameKey := net.FingerprintAttributeKeyPrefix + bridgeName + ".bridge_name"
 	attr[bridgeNameKey] = structs.NewStringAttribute(bridgeName)
 
+	// Advertise whether the embedded DHCP server is answering on the bridge.
+	c.dhcpLock.Lock()
+	dhcpRunning := c.dhcpServer != nil
+	c.dhcpLock.Unlock()
+	attr[net.FingerprintAttributeKeyPrefix+bridgeName+".dhcp_server"] = structs.NewBoolAttribute(dhcpRunning)
+
+	// Likewise for the embedded DNS resolver.
+	attr[net.FingerprintAttributeKeyPrefix+bridgeName+".dns_server"] = structs.NewBoolAttribute(c.resolverDomain() != "")
+
+	// Advertise the bridges VMs can be tagged onto VLANs of, so jobs can be
+	// constrained to them.
+	attr[net.FingerprintAttributeKeyPrefix+bridgeName+".vlan_filtering"] = structs.NewBoolAttribute(false)
+	for _, bridge := range vlanAwareBridges() {
+		attr[net.FingerprintAttributeKeyPrefix+bridge+".vlan_filtering"] = structs.NewBoolAttribute(true)
+	}
+
+	c.fingerprintNamedNetworks(attr)
+
 	c.logger.Debug("network fingerprint complete", "bridge", bridgeName, "state", state)
 }
 
@@ -126,75 +192,105 @@ func (c *Controller) getBridgeState(bridgeName string) string {
 }
 
 // Init performs any initialization work needed by the network sub-system
-// prior to being used by the driver. This sets up the required iptables
-// chains for port forwarding.
+// prior to being used by the driver. This sets up the required firewall
+// and ebtables chains for port forwarding and isolation, the NAT rules of
+// named networks, and starts the embedded DNS resolver and DHCP server if
+// enabled.
 func (c *Controller) Init() error {
-	return c.ensureIPTables()
+	if err := c.ensureFirewall(); err != nil {
+		return err
+	}
+	if err := c.ensurePortForwarding(); err != nil {
+		return err
+	}
+	if err := c.ensureNAT(); err != nil {
+		return err
+	}
+	if err := c.ensureEbtables(); err != nil {
+		return err
+	}
+	if err := c.ensureResolver(); err != nil {
+		return err
+	}
+	return c.ensureDHCPServer()
 }
 
-// ensureIPTables is responsible for ensuring the local host machine iptables
-// are configured with the chains and rules needed by the driver.
+// ensureFirewall is responsible for selecting the firewall backend and
+// ensuring the local host machine is configured with the chains and rules
+// needed by the driver.
 //
 // On a new machine, this function creates the "NOMAD_CH_PRT" and "NOMAD_CH_FW"
 // chains. The "NOMAD_CH_PRT" chain then has a jump rule added to the "nat"
 // table; the "NOMAD_CH_FW" chain has a jump rule added to the "filter" table.
-func (c *Controller) ensureIPTables() error {
-	ipt, err := iptables.New()
+func (c *Controller) ensureFirewall() error {
+	fw, err := newFirewallBackend(c.logger, c.networkConfig.FirewallBackend)
 	if err != nil {
-		// In test environments or systems without iptables, skip network setup
-		// Port forwarding will not work, but basic VM functionality will
-		c.logger.Warn("iptables not available, skipping network setup", "error", err)
+		// An explicitly configured backend must be available. Otherwise, the
+		// driver can still run VMs, but any task requiring port forwarding
+		// or firewall rules will fail to start.
+		if c.networkConfig.FirewallBackend != "" && c.networkConfig.FirewallBackend != FirewallBackendAuto {
+			return fmt.Errorf("failed to initialize %q firewall backend: %w", c.networkConfig.FirewallBackend, err)
+		}
+		c.logger.Warn("no firewall backend available, port forwarding and firewall rules are disabled", "error", err)
 		return nil
 	}
+	c.logger.Info("using firewall backend", "backend", fw.Name())
 
+	if err := c.ensureFirewallChains(fw); err != nil {
+		return err
+	}
+
+	c.firewall = fw
+	return nil
+}
+
+// ensureFirewallChains creates the "NOMAD_CH_PRT" and "NOMAD_CH_FW" chains,
+// along with the rules jumping to them, if they do not already exist.
+func (c *Controller) ensureFirewallChains(fw firewallBackend) error {
 	// Ensure the NAT prerouting chain is available and create the jump rule if
 	// needed.
-	natCreated, err := ensureIPTablesChain(ipt, iptablesNATTableName, preroutingIPTablesChainName)
+	natCreated, err := ensureFirewallChain(fw, iptablesNATTableName, preroutingIPTablesChainName)
 	if err != nil {
-		return fmt.Errorf("failed to create iptables chain %q: %w",
-			preroutingIPTablesChainName, err)
+		return fmt.Errorf("failed to create %s chain %q: %w",
+			fw.Name(), preroutingIPTablesChainName, err)
 	}
 	if natCreated {
-		if err := ipt.Insert(iptablesNATTableName, "PREROUTING", 1, []string{"-j", preroutingIPTablesChainName}...); err != nil {
+		if err := fw.Insert(iptablesNATTableName, "PREROUTING", 1, []string{"-j", preroutingIPTablesChainName}...); err != nil {
 			return err
 		}
-		c.logger.Info("successfully created NAT prerouting iptables chain",
-			"name", preroutingIPTablesChainName)
+		c.logger.Info("successfully created NAT prerouting chain",
+			"name", preroutingIPTablesChainName, "backend", fw.Name())
 	}
 
 	// Ensure the filter forward chain is available and create the jump rule if
 	// needed.
-	filterCreated, err := ensureIPTablesChain(ipt, iptablesFilterTableName, forwardIPTablesChainName)
+	filterCreated, err := ensureFirewallChain(fw, iptablesFilterTableName, forwardIPTablesChainName)
 	if err != nil {
-		return fmt.Errorf("failed to create iptables chain %q: %w",
-			forwardIPTablesChainName, err)
+		return fmt.Errorf("failed to create %s chain %q: %w",
+			fw.Name(), forwardIPTablesChainName, err)
 	}
 	if filterCreated {
-		if err := ipt.Insert(iptablesFilterTableName, "FORWARD", 1, []string{"-j", forwardIPTablesChainName}...); err != nil {
+		if err := fw.Insert(iptablesFilterTableName, "FORWARD", 1, []string{"-j", forwardIPTablesChainName}...); err != nil {
 			return err
 		}
-		c.logger.Info("successfully created filter forward iptables chain",
-			"name", forwardIPTablesChainName)
+		c.logger.Info("successfully created filter forward chain",
+			"name", forwardIPTablesChainName, "backend", fw.Name())
 	}
 
 	return nil
 }
 
-// ensureIPTablesChain creates an iptables chain if it doesn't exist
-func ensureIPTablesChain(ipt *iptables.IPTables, table, chain string) (bool, error) {
-	// List and iterate the currently configured iptables chains, so we can
-	// identify whether the chain already exist.
-	chains, err := ipt.ListChains(table)
+// ensureFirewallChain creates a chain if it doesn't exist
+func ensureFirewallChain(fw firewallBackend, table, chain string) (bool, error) {
+	exists, err := fw.ChainExists(table, chain)
 	if err != nil {
 		return false, err
 	}
-	for _, ch := range chains {
-		if ch == chain {
-			return false, nil
-		}
+	if exists {
+		return false, nil
 	}
 
-	err = ipt.NewChain(table, chain)
+	err = fw.NewChain(table, chain)
 
 	// The error returned needs to be carefully checked as an exit code of 1
 	// indicates the chain exists. This might happen when another routine has
@@ -215,6 +311,12 @@ func (c *Controller) VMStartedBuild(req *net.VMStartedBuildRequest) (*net.VMStar
 	if req == nil {
 		return nil, errors.New("net controller: no request provided")
 	}
+	if req.CNI != nil {
+		return c.cniNetworkBuild(req)
+	}
+	if req.NetNS != "" {
+		return c.groupNetworkBuild(req)
+	}
 	if req.NetConfig == nil || req.Resources == nil {
 		return &net.VMStartedBuildResponse{}, nil
 	}
@@ -232,6 +334,25 @@ func (c *Controller) VMStartedBuild(req *net.VMStartedBuildRequest) (*net.VMStar
 	}
 	netInterface := netConfig[0]
 
+	// VMs attached directly to a host interface sit on its network, so
+	// there is nothing to configure on the host. Their address is only known
+	// when reported by the virtualizer or configured statically.
+	if kind, vtap := netInterface.Vtap(); vtap != nil {
+		c.logger.Debug("network interface attached to host interface",
+			"domain", req.DomainName, "kind", kind, "parent", vtap.Parent)
+
+		var driverNetwork *drivers.DriverNetwork
+		if len(req.GuestIPs) > 0 && req.GuestIPs[0] != "" {
+			driverNetwork = &drivers.DriverNetwork{IP: req.GuestIPs[0]}
+		} else if vtap.StaticIP != "" {
+			driverNetwork = &drivers.DriverNetwork{IP: vtap.StaticIP}
+		}
+		return &net.VMStartedBuildResponse{
+			DriverNetwork: driverNetwork,
+			TeardownSpec:  &net.TeardownSpec{},
+		}, nil
+	}
+
 	// Debug logging to see what network configuration we actually have
 	c.logger.Debug("network interface configuration", "domain", req.DomainName, "netInterface", fmt.Sprintf("%+v", netInterface))
 	if netInterface.Bridge != nil {
@@ -241,11 +362,22 @@ func (c *Controller) VMStartedBuild(req *net.VMStartedBuildRequest) (*net.VMStar
 		c.logger.Debug("no bridge configuration found in network interface", "domain", req.DomainName)
 	}
 
-	// Determine which bridge to use - from task config if specified, otherwise from driver config
+	// Determine which bridge to use - from task config if specified, then
+	// from the group or named network, otherwise from driver config
 	var bridgeName string
 	if netInterface.Bridge != nil && netInterface.Bridge.Name != "" {
 		bridgeName = netInterface.Bridge.Name
 		c.logger.Debug("using bridge from task configuration", "bridge", bridgeName)
+	} else if req.GroupNetwork != nil {
+		bridgeName = req.GroupNetwork.Bridge
+		c.logger.Debug("using bridge from group network", "bridge", bridgeName, "alloc_id", req.GroupNetwork.AllocID)
+	} else if netInterface.Bridge != nil && netInterface.Bridge.Network != "" {
+		network, ok := c.networks.Get(netInterface.Bridge.Network)
+		if !ok {
+			return nil, fmt.Errorf("network %q is not configured within the driver", netInterface.Bridge.Network)
+		}
+		bridgeName = network.Bridge
+		c.logger.Debug("using bridge from named network", "bridge", bridgeName, "network", network.Name)
 	} else {
 		bridgeName = c.networkConfig.Bridge
 		c.logger.Debug("using bridge from driver configuration", "bridge", bridgeName)
@@ -261,6 +393,12 @@ func (c *Controller) VMStartedBuild(req *net.VMStartedBuildRequest) (*net.VMStar
 			return nil, fmt.Errorf("bridge interface %s does not exist - this should have been created during installation", bridgeName)
 		}
 		c.logger.Debug("bridge interface exists", "bridge", bridgeName)
+
+		if req.GroupNetwork != nil {
+			if err := c.ensureGroupNAT(req.GroupNetwork); err != nil {
+				return nil, err
+			}
+		}
 	} else {
 		c.logger.Error("bridge name is empty - this indicates a configuration parsing issue", "domain", req.DomainName)
 		c.logger.Error("check your task configuration for network_interface.bridge.name", "domain", req.DomainName)
@@ -279,41 +417,108 @@ func (c *Controller) VMStartedBuild(req *net.VMStartedBuildRequest) (*net.VMStar
 		ipAddr = netInterface.Bridge.StaticIP
 		c.logger.Debug("using static IP from task configuration", "ip", ipAddr)
 	} else {
-		// DHCP case - try to get IP from dnsmasq lease file as a fallback for
-		// legacy environments
-		mac := c.generateDeterministicMAC(req.DomainName)
-		c.logger.Debug("generated deterministic MAC for DHCP", "mac", mac, "vm", req.DomainName)
+		// DHCP case - look the address up from the lease tables, preferring
+		// the embedded server over a host managed dnsmasq instance.
+		if len(req.Hwaddrs) == 0 || req.Hwaddrs[0] == "" {
+			return nil, fmt.Errorf("virtualizer did not provide IP or MAC address for VM %s", req.DomainName)
+		}
+		mac := req.Hwaddrs[0]
+		c.logger.Debug("looking up DHCP lease", "mac", mac, "vm", req.DomainName)
 
-		// Viper uses static IP allocation, not DHCP. Skip DHCP lease lookup and use GuestIPs directly.
-		if len(req.GuestIPs) > 0 && req.GuestIPs[0] != "" {
-			ipAddr = req.GuestIPs[0]
-			c.logger.Info("using IP from virtualizer (static allocation)", "ip", ipAddr, "vm", req.DomainName)
-		} else {
-			c.logger.Error("no IP address provided by virtualizer", "vm", req.DomainName)
-			return nil, fmt.Errorf("virtualizer did not provide IP address for VM %s", req.DomainName)
+		leaseIP, err := c.lookupDHCPLeaseByMAC(mac)
+		if err != nil {
+			c.logger.Error("no IP address provided by virtualizer", "vm", req.DomainName, "error", err)
+			return nil, fmt.Errorf("virtualizer did not provide IP address for VM %s: %w", req.DomainName, err)
 		}
+		ipAddr = leaseIP
+	}
+
+	// Hand the address to the embedded DHCP server, if running, before
+	// anything else so the guest can pick it up as soon as possible.
+	dhcpReservation, err := c.reserveDHCPAddress(req, netInterface.Bridge, bridgeName, ipAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve DHCP address: %w", err)
 	}
 
-	// Configure iptables rules for port forwarding
-	teardownRules, err := c.configureIPTables(req.Resources, netInterface.Bridge, ipAddr)
+	// Make the VM resolvable by its hostname via the embedded DNS resolver.
+	// The VM is still started when its hostname cannot be registered, as it
+	// remains reachable by its address.
+	dnsRecord, err := c.registerDNSRecord(req.Hostname, ipAddr)
 	if err != nil {
+		c.logger.Warn("unable to register DNS record for VM",
+			"vm", req.DomainName, "hostname", req.Hostname, "error", err)
+	}
+
+	// Configure port forwarding, using either firewall NAT rules or the
+	// userspace proxy.
+	var (
+		teardownRules [][]string
+		portProxies   []net.PortProxy
+	)
+	if c.portForwardingMode() == PortForwardingProxy {
+		portProxies, err = c.configurePortProxies(req.Resources, netInterface.Bridge, ipAddr)
+	} else {
+		teardownRules, err = c.configureIPTables(req.Resources, netInterface.Bridge, ipAddr)
+	}
+	if err != nil {
+		c.releaseDHCPAddress(dhcpReservation)
+		c.deregisterDNSRecord(dnsRecord)
 		return nil, fmt.Errorf("failed to configure port mapping: %w", err)
 	}
 
+	// Restrict the traffic the VM can send and receive, if configured.
+	firewallRules, firewallChains, err := c.configureFirewall(c.firewall, req.DomainName, netInterface.Bridge, ipAddr)
+	if err != nil {
+		c.releaseDHCPAddress(dhcpReservation)
+		c.deregisterDNSRecord(dnsRecord)
+		_, _ = c.VMTerminatedTeardown(&net.VMTerminatedTeardownRequest{
+			TeardownSpec: &net.TeardownSpec{
+				IPTablesRules:   teardownRules,
+				FirewallBackend: c.firewallName(),
+				PortProxies:     portProxies,
+			},
+		})
+		return nil, fmt.Errorf("failed to configure firewall: %w", err)
+	}
+	teardownRules = append(firewallRules, teardownRules...)
+
+	// Enforce the isolation policy, if any, which also restricts the addresses
+	// the guest can send from.
+	ebtablesRules, ebtablesChains, err := c.configureIsolation(req, netInterface.Bridge, ipAddr)
+	if err != nil {
+		c.releaseDHCPAddress(dhcpReservation)
+		c.deregisterDNSRecord(dnsRecord)
+		_, _ = c.VMTerminatedTeardown(&net.VMTerminatedTeardownRequest{
+			TeardownSpec: &net.TeardownSpec{
+				IPTablesRules:   teardownRules,
+				IPTablesChains:  firewallChains,
+				FirewallBackend: c.firewallName(),
+				PortProxies:     portProxies,
+			},
+		})
+		return nil, fmt.Errorf("failed to configure network isolation: %w", err)
+	}
+
 	return &net.VMStartedBuildResponse{
 		DriverNetwork: &drivers.DriverNetwork{
 			IP: ipAddr,
 		},
 		TeardownSpec: &net.TeardownSpec{
-			IPTablesRules: teardownRules,
-			// No DHCP reservation for CH since we use static IPs
-			DHCPReservation: "",
+			IPTablesRules:   teardownRules,
+			IPTablesChains:  firewallChains,
+			FirewallBackend: c.firewallName(),
+			PortProxies:     portProxies,
+			DHCPLease:       dhcpReservation,
 			Network:         bridgeName,
+			DNSRecord:       dnsRecord,
+			EbtablesRules:   ebtablesRules,
+			EbtablesChains:  ebtablesChains,
+			GroupNetwork:    req.GroupNetwork,
 		},
 	}, nil
 }
 
-// configureIPTables is responsible for adding the iptables entries to enable
+// configureIPTables is responsible for adding the firewall entries to enable
 // port mapping. The function will perform this action for all configured ports
 // within the network interface configuration.
 //
@@ -325,13 +530,12 @@ func (c *Controller) configureIPTables(res *drivers.Resources, cfg *net.NetworkI
 	// Initialize teardown rules slice
 	var teardownRules [][]string
 
-	ipt, err := iptables.New()
-	if err != nil {
-		// In environments without iptables, skip port forwarding setup
-		// Basic VM functionality will still work
-		c.logger.Warn("iptables not available, skipping port forwarding setup", "error", err)
+	if cfg == nil || len(cfg.Ports) == 0 {
 		return teardownRules, nil
 	}
+	if c.firewall == nil {
+		return nil, errNoFirewallBackend
+	}
 
 	// Create lookup mapping for ip:interface-name, so we can cache reads of
 	// this and not have to perform the translation each time.
@@ -352,6 +556,7 @@ func (c *Controller) configureIPTables(res *drivers.Resources, cfg *net.NetworkI
 		// host.
 		iface, ok := interfaceMapping[reservedPort.HostIP]
 		if !ok {
+			var err error
 			iface, err = c.interfaceByIPGetter(stdnet.ParseIP(reservedPort.HostIP))
 			if err != nil {
 				return nil, fmt.Errorf("failed to identify IP interface: %w", err)
@@ -375,7 +580,7 @@ func (c *Controller) configureIPTables(res *drivers.Resources, cfg *net.NetworkI
 			"--to-destination", fmt.Sprintf("%s:%v", ip, reservedPort.To),
 		}
 
-		if err := ipt.Append(preRouteArgs[0], preRouteArgs[1], preRouteArgs[2:]...); err != nil {
+		if err := c.firewall.Append(preRouteArgs[0], preRouteArgs[1], preRouteArgs[2:]...); err != nil {
 			return nil, err
 		}
 
@@ -397,7 +602,7 @@ func (c *Controller) configureIPTables(res *drivers.Resources, cfg *net.NetworkI
 			"-j", "ACCEPT",
 		}
 
-		if err := ipt.Append(filterArgs[0], filterArgs[1], filterArgs[2:]...); err != nil {
+		if err := c.firewall.Append(filterArgs[0], filterArgs[1], filterArgs[2:]...); err != nil {
 			return nil, err
 		}
 
@@ -448,19 +653,77 @@ func (c *Controller) VMTerminatedTeardown(req *net.VMTerminatedTeardownRequest)
 		return &net.VMTerminatedTeardownResponse{}, nil
 	}
 
-	ipt, err := iptables.New()
-	if err != nil {
-		// In environments without iptables, skip network teardown
-		// This is not ideal but allows the system to continue
-		c.logger.Warn("iptables not available, skipping network teardown", "error", err)
-		return &net.VMTerminatedTeardownResponse{}, nil
+	// Remove the embedded DHCP server reservation and DNS record first, as
+	// they must be released even without iptables. These cannot fail, so do
+	// not contribute to any error.
+	c.releaseDHCPAddress(req.TeardownSpec.DHCPLease)
+	if mac := req.TeardownSpec.DHCPReservation; mac != "" && req.TeardownSpec.DHCPLease == nil {
+		c.releaseDHCPAddress(&net.DHCPReservation{MAC: mac})
 	}
+	c.deregisterDNSRecord(req.TeardownSpec.DNSRecord)
 
 	// Collect all the errors, so we provide the operator with enough
 	// information to manually tidy if needed.
 	var mErr multierror.Error
 
-	// Iterate the teardown rules and delete them from iptables. Do not halt
+	if err := c.teardownIsolation(req.TeardownSpec.EbtablesRules, req.TeardownSpec.EbtablesChains); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
+	}
+
+	if err := c.stopPortProxies(req.TeardownSpec.PortProxies); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
+	}
+
+	if err := c.teardownCNI(req.TeardownSpec.CNI); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
+	}
+
+	if err := c.teardownGroupNAT(req.TeardownSpec.GroupNetwork, req.TeardownSpec.FirewallBackend); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
+	}
+
+	if len(req.TeardownSpec.IPTablesRules) == 0 && len(req.TeardownSpec.IPTablesChains) == 0 {
+		return &net.VMTerminatedTeardownResponse{}, mErr.ErrorOrNil()
+	}
+
+	// Rules added within an allocation network namespace are removed along
+	// with it, so only need deleting while it exists, e.g. when the task is
+	// restarting.
+	if netns := req.TeardownSpec.NetNS; netns != "" {
+		if nsutil.IsNSorErr(netns) != nil {
+			return &net.VMTerminatedTeardownResponse{}, mErr.ErrorOrNil()
+		}
+		err := nsutil.WithNetNSPath(netns, func(nsutil.NetNS) error {
+			fw, err := newFirewallBackend(c.logger, req.TeardownSpec.FirewallBackend)
+			if err != nil {
+				return err
+			}
+			c.deleteTeardownRules(fw, req.TeardownSpec, &mErr)
+			return nil
+		})
+		if err != nil {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("failed to delete rules within network namespace %q: %w", netns, err))
+		}
+		return &net.VMTerminatedTeardownResponse{}, mErr.ErrorOrNil()
+	}
+
+	// The rules must be removed by the backend which created them, which may
+	// differ from the current one if the driver configuration has changed.
+	fw, err := c.firewallBackendFor(req.TeardownSpec.FirewallBackend)
+	if err != nil {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("failed to initialize firewall backend: %w", err))
+		return &net.VMTerminatedTeardownResponse{}, mErr.ErrorOrNil()
+	}
+
+	c.deleteTeardownRules(fw, req.TeardownSpec, &mErr)
+
+	return &net.VMTerminatedTeardownResponse{}, mErr.ErrorOrNil()
+}
+
+// deleteTeardownRules deletes the firewall rules and chains within the
+// teardown spec, collecting any errors.
+func (c *Controller) deleteTeardownRules(fw firewallBackend, spec *net.TeardownSpec, mErr *multierror.Error) {
+	// Iterate the teardown rules and delete them from the firewall. Do not halt
 	// the loop if we encounter an error, track it and plough forward, so we
 	// attempt to clean up as much as possible.
 	//
@@ -470,18 +733,56 @@ func (c *Controller) VMTerminatedTeardown(req *net.VMTerminatedTeardownRequest)
 	// stop/kill call until all work is completed successfully. If we return an
 	// error if the rule is not found, we can never recover from partial
 	// failures.
-	for _, iptablesRule := range req.TeardownSpec.IPTablesRules {
-		if err := ipt.DeleteIfExists(iptablesRule[0], iptablesRule[1], iptablesRule[2:]...); err != nil {
+	for _, iptablesRule := range spec.IPTablesRules {
+		if err := fw.DeleteIfExists(iptablesRule[0], iptablesRule[1], iptablesRule[2:]...); err != nil {
 			mErr.Errors = append(
 				mErr.Errors,
-				fmt.Errorf("failed to delete iptables %q entry in %q chain: %w",
-					iptablesRule[0], iptablesRule[1], err))
+				fmt.Errorf("failed to delete %s %q entry in %q chain: %w",
+					fw.Name(), iptablesRule[0], iptablesRule[1], err))
 		}
 	}
 
-	// No DHCP reservation cleanup needed for Cloud Hypervisor since we use static IPs
+	// Remove the VM's own chains now nothing jumps to them. A chain which
+	// no longer exists is not an error.
+	for _, chain := range spec.IPTablesChains {
+		if err := fw.ClearAndDeleteChain(chain[0], chain[1]); err != nil {
+			mErr.Errors = append(
+				mErr.Errors,
+				fmt.Errorf("failed to delete %s %q chain in %q table: %w",
+					fw.Name(), chain[1], chain[0], err))
+		}
+	}
+}
 
-	return &net.VMTerminatedTeardownResponse{}, mErr.ErrorOrNil()
+// VMRecovered restores the configuration held in memory for a VM recovered
+// after a driver restart. This covers the userspace port forwarding proxies,
+// the embedded DHCP server reservation and the embedded DNS resolver record;
+// everything else is held by the host.
+func (c *Controller) VMRecovered(req *net.VMRecoveredRequest) (*net.VMRecoveredResponse, error) {
+	if req == nil || req.TeardownSpec == nil {
+		return &net.VMRecoveredResponse{}, nil
+	}
+
+	var mErr multierror.Error
+
+	for _, spec := range req.TeardownSpec.PortProxies {
+		if err := c.startPortProxy(spec); err != nil {
+			mErr.Errors = append(mErr.Errors,
+				fmt.Errorf("failed to restore %s proxy on %q: %w", spec.Protocol, spec.ListenAddr, err))
+		}
+	}
+
+	if err := c.restoreDHCPReservation(req.TeardownSpec.DHCPLease); err != nil {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("failed to restore DHCP reservation: %w", err))
+	}
+
+	if record := req.TeardownSpec.DNSRecord; record != nil {
+		if _, err := c.registerDNSRecord(record.Hostname, record.IP); err != nil {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("failed to restore DNS record: %w", err))
+		}
+	}
+
+	return &net.VMRecoveredResponse{}, mErr.ErrorOrNil()
 }
 
 func ipv4ToUint32(addr netip.Addr) uint32 {
@@ -498,24 +799,14 @@ func uint32ToIPv4(val uint32) netip.Addr {
 	})
 }
 
-// generateDeterministicMAC generates a deterministic MAC address from domain name
-// This ensures consistent MAC assignment for the same domain
-func (c *Controller) generateDeterministicMAC(domainName string) string {
-	// Use a simple hash-based approach to generate a deterministic MAC
-	// This ensures the same domain name always gets the same MAC address
-	hash := 0
-	for _, char := range domainName {
-		hash = hash*31 + int(char)
+// lookupDHCPLeaseByMAC looks up the IP address for a given MAC, consulting the
+// embedded DHCP server first and then the dnsmasq lease file.
+func (c *Controller) lookupDHCPLeaseByMAC(mac string) (string, error) {
+	if ip, ok := c.lookupEmbeddedDHCPLease(mac); ok {
+		c.logger.Debug("found active embedded DHCP lease", "ip", ip, "mac", mac)
+		return ip, nil
 	}
 
-	// Generate MAC with 52:54:00 prefix (QEMU/KVM range)
-	// Use the hash to generate the last 3 bytes
-	return fmt.Sprintf("52:54:00:%02x:%02x:%02x",
-		byte(hash>>16), byte(hash>>8), byte(hash))
-}
-
-// lookupDHCPLeaseByMAC looks up the IP address for a given MAC in dnsmasq lease file
-func (c *Controller) lookupDHCPLeaseByMAC(mac string) (string, error) {
 	leaseFile := defaultDnsmasqLeaseFile
 
 	// Read the dnsmasq lease file
@@ -20,7 +20,7 @@ type Controller struct {
 }
 
 // NewController returns a stub controller for non-Linux platforms
-func NewController(logger hclog.Logger, networkConfig *domain.Network) *Controller {
+func NewController(logger hclog.Logger, networkConfig *domain.Network, networks domain.NamedNetworks) *Controller {
 	return &Controller{
 		logger: logger.Named("chnet-stub"),
 	}
@@ -45,3 +45,8 @@ func (c *Controller) VMStartedBuild(req *net.VMStartedBuildRequest) (*net.VMStar
 func (c *Controller) VMTerminatedTeardown(req *net.VMTerminatedTeardownRequest) (*net.VMTerminatedTeardownResponse, error) {
 	return nil, fmt.Errorf("Cloud Hypervisor networking is only supported on Linux")
 }
+
+// VMRecovered is not supported on non-Linux platforms
+func (c *Controller) VMRecovered(req *net.VMRecoveredRequest) (*net.VMRecoveredResponse, error) {
+	return nil, fmt.Errorf("Cloud Hypervisor networking is only supported on Linux")
+}
@@ -0,0 +1,190 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	"fmt"
+	stdnet "net"
+	"net/netip"
+	"time"
+
+	"github.com/ccheshirecat/nomad-driver-ch/chnet/dhcp"
+	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
+)
+
+// dhcpListener is the function signature used to open the DHCP server socket
+// on the named interface. It is a field within the controller to aid testing.
+type dhcpListener func(iface string) (stdnet.PacketConn, error)
+
+// ensureDHCPServer starts the embedded DHCP server on the configured bridge
+// when enabled within the driver configuration. It is safe to call multiple
+// times; a running server is left untouched.
+func (c *Controller) ensureDHCPServer() error {
+	cfg := c.networkConfig.DHCP
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+
+	c.dhcpLock.Lock()
+	defer c.dhcpLock.Unlock()
+
+	if c.dhcpServer != nil {
+		return nil
+	}
+
+	leaseTime := dhcp.DefaultLeaseTime
+	if cfg.LeaseTime != "" {
+		d, err := time.ParseDuration(cfg.LeaseTime)
+		if err != nil {
+			return fmt.Errorf("invalid dhcp lease_time %q: %w", cfg.LeaseTime, err)
+		}
+		leaseTime = d
+	}
+
+	subnet, err := netip.ParsePrefix(c.networkConfig.SubnetCIDR)
+	if err != nil {
+		return fmt.Errorf("invalid subnet_cidr %q: %w", c.networkConfig.SubnetCIDR, err)
+	}
+	gateway, err := netip.ParseAddr(c.networkConfig.Gateway)
+	if err != nil {
+		return fmt.Errorf("invalid gateway %q: %w", c.networkConfig.Gateway, err)
+	}
+
+	// Point guests at the embedded DNS resolver when it is running, which
+	// requires it to have been started first.
+	dnsServers := parseAddrs(net.DefaultNameservers)
+	domainName := c.resolverDomain()
+	if domainName != "" {
+		dnsServers = []netip.Addr{gateway}
+	}
+
+	srv, err := dhcp.NewServer(c.logger, dhcp.Config{
+		ServerIP:   gateway,
+		Subnet:     subnet.Masked(),
+		Router:     gateway,
+		DNS:        dnsServers,
+		DomainName: domainName,
+		LeaseTime:  leaseTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	conn, err := c.dhcpListener(c.networkConfig.Bridge)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := srv.Serve(conn); err != nil {
+			c.logger.Error("embedded DHCP server stopped", "bridge", c.networkConfig.Bridge, "error", err)
+		}
+	}()
+
+	c.dhcpServer = srv
+	c.logger.Info("started embedded DHCP server",
+		"bridge", c.networkConfig.Bridge, "server_ip", gateway, "lease_time", leaseTime)
+
+	return nil
+}
+
+// reserveDHCPAddress registers the address assigned to the VM with the
+// embedded DHCP server, so guests which ignore the cloud-init network
+// configuration can still obtain it. The returned reservation is to be stored
+// within the teardown spec; it is nil when no reservation was made.
+func (c *Controller) reserveDHCPAddress(req *net.VMStartedBuildRequest,
+	cfg *net.NetworkInterfaceBridgeConfig, bridge, ip string) (*net.DHCPReservation, error) {
+
+	c.dhcpLock.Lock()
+	srv := c.dhcpServer
+	c.dhcpLock.Unlock()
+
+	// The server only listens on the driver bridge, so VMs attached to other
+	// bridges cannot reach it.
+	if srv == nil || bridge != c.networkConfig.Bridge || len(req.Hwaddrs) == 0 || req.Hwaddrs[0] == "" {
+		return nil, nil
+	}
+
+	res := &net.DHCPReservation{
+		MAC:      req.Hwaddrs[0],
+		IP:       ip,
+		Hostname: req.Hostname,
+	}
+	if cfg != nil {
+		res.DNS = cfg.DNS
+	}
+
+	if err := c.restoreDHCPReservation(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// restoreDHCPReservation registers the reservation with the embedded DHCP
+// server, which is used to restore the reservations of recovered VMs, as the
+// server ignores requests from clients without one.
+func (c *Controller) restoreDHCPReservation(res *net.DHCPReservation) error {
+	c.dhcpLock.Lock()
+	srv := c.dhcpServer
+	c.dhcpLock.Unlock()
+
+	if srv == nil || res == nil {
+		return nil
+	}
+
+	addr, err := netip.ParseAddr(res.IP)
+	if err != nil {
+		return fmt.Errorf("invalid guest IP %q: %w", res.IP, err)
+	}
+
+	return srv.Reserve(dhcp.Reservation{
+		MAC:      res.MAC,
+		IP:       addr,
+		Hostname: res.Hostname,
+		DNS:      parseAddrs(res.DNS),
+	})
+}
+
+// releaseDHCPAddress removes the reservation, and any lease, registered for
+// the VM.
+func (c *Controller) releaseDHCPAddress(res *net.DHCPReservation) {
+	c.dhcpLock.Lock()
+	srv := c.dhcpServer
+	c.dhcpLock.Unlock()
+
+	if srv == nil || res == nil {
+		return
+	}
+	srv.Unreserve(res.MAC)
+}
+
+// lookupEmbeddedDHCPLease returns the address leased to the MAC by the
+// embedded DHCP server.
+func (c *Controller) lookupEmbeddedDHCPLease(mac string) (string, bool) {
+	c.dhcpLock.Lock()
+	srv := c.dhcpServer
+	c.dhcpLock.Unlock()
+
+	if srv == nil {
+		return "", false
+	}
+	lease, ok := srv.Lease(mac)
+	if !ok {
+		return "", false
+	}
+	return lease.IP.String(), true
+}
+
+// parseAddrs converts a list of IP strings, skipping any which are invalid.
+func parseAddrs(addrs []string) []netip.Addr {
+	out := make([]netip.Addr, 0, len(addrs))
+	for _, a := range addrs {
+		if addr, err := netip.ParseAddr(a); err == nil {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
@@ -0,0 +1,16 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !linux
+
+package dhcp
+
+import (
+	"errors"
+	stdnet "net"
+)
+
+// ListenInterface is not supported on non-Linux platforms
+func ListenInterface(name string) (stdnet.PacketConn, error) {
+	return nil, errors.New("dhcp: binding to an interface is only supported on Linux")
+}
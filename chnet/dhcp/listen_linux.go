@@ -0,0 +1,44 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package dhcp
+
+import (
+	"context"
+	"fmt"
+	stdnet "net"
+	"syscall"
+)
+
+// ListenInterface opens the DHCP server port bound to the named interface, so
+// requests arriving on other interfaces are never seen and broadcast replies
+// leave via the interface rather than the default route.
+func ListenInterface(name string) (stdnet.PacketConn, error) {
+	var sockErr error
+
+	lc := stdnet.ListenConfig{
+		Control: func(_, _ string, rc syscall.RawConn) error {
+			err := rc.Control(func(fd uintptr) {
+				if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); sockErr != nil {
+					return
+				}
+				if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); sockErr != nil {
+					return
+				}
+				sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	conn, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf("0.0.0.0:%d", ServerPort))
+	if err != nil {
+		return nil, fmt.Errorf("dhcp: failed to listen on interface %s: %w", name, err)
+	}
+	return conn, nil
+}
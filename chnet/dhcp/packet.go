@@ -0,0 +1,248 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package dhcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	stdnet "net"
+	"net/netip"
+)
+
+const (
+	// bootRequest and bootReply are the BOOTP op codes used by clients and
+	// servers respectively.
+	bootRequest = 1
+	bootReply   = 2
+
+	// hwTypeEthernet is the hardware address type for 10Mb ethernet, which is
+	// the only type the server answers.
+	hwTypeEthernet = 1
+
+	// headerLen is the length of the fixed BOOTP header, excluding the magic
+	// cookie and the options which follow it.
+	headerLen = 236
+
+	// flagBroadcast is the bit within the flags field a client sets when it
+	// cannot receive unicast replies before it is configured.
+	flagBroadcast = 0x8000
+)
+
+// magicCookie prefixes the options section of every DHCP message.
+var magicCookie = [4]byte{99, 130, 83, 99}
+
+// MessageType is the value carried within the DHCP message type option.
+type MessageType byte
+
+const (
+	MessageTypeDiscover MessageType = 1
+	MessageTypeOffer    MessageType = 2
+	MessageTypeRequest  MessageType = 3
+	MessageTypeDecline  MessageType = 4
+	MessageTypeAck      MessageType = 5
+	MessageTypeNak      MessageType = 6
+	MessageTypeRelease  MessageType = 7
+	MessageTypeInform   MessageType = 8
+)
+
+func (m MessageType) String() string {
+	switch m {
+	case MessageTypeDiscover:
+		return "DISCOVER"
+	case MessageTypeOffer:
+		return "OFFER"
+	case MessageTypeRequest:
+		return "REQUEST"
+	case MessageTypeDecline:
+		return "DECLINE"
+	case MessageTypeAck:
+		return "ACK"
+	case MessageTypeNak:
+		return "NAK"
+	case MessageTypeRelease:
+		return "RELEASE"
+	case MessageTypeInform:
+		return "INFORM"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", byte(m))
+	}
+}
+
+// Option codes used by the server, as defined in RFC 2132.
+const (
+	optPad           = 0
+	optSubnetMask    = 1
+	optRouter        = 3
+	optDNS           = 6
+	optHostname      = 12
+	optDomainName    = 15
+	optRequestedIP   = 50
+	optLeaseTime     = 51
+	optMessageType   = 53
+	optServerID      = 54
+	optRenewalTime   = 58
+	optRebindingTime = 59
+	optEnd           = 255
+)
+
+// Packet is a decoded DHCPv4 message. Only the fields the server needs are
+// exposed; the options are kept raw and keyed by their code.
+type Packet struct {
+	Op      byte
+	XID     uint32
+	Secs    uint16
+	Flags   uint16
+	CIAddr  netip.Addr
+	YIAddr  netip.Addr
+	SIAddr  netip.Addr
+	GIAddr  netip.Addr
+	CHAddr  stdnet.HardwareAddr
+	Options map[byte][]byte
+}
+
+// ParsePacket decodes a DHCPv4 message from its wire format.
+func ParsePacket(b []byte) (*Packet, error) {
+	if len(b) < headerLen+len(magicCookie) {
+		return nil, errors.New("dhcp: packet too short")
+	}
+	if [4]byte(b[headerLen:headerLen+4]) != magicCookie {
+		return nil, errors.New("dhcp: missing magic cookie")
+	}
+	if b[1] != hwTypeEthernet || b[2] != 6 {
+		return nil, fmt.Errorf("dhcp: unsupported hardware type %d/%d", b[1], b[2])
+	}
+
+	p := &Packet{
+		Op:      b[0],
+		XID:     binary.BigEndian.Uint32(b[4:8]),
+		Secs:    binary.BigEndian.Uint16(b[8:10]),
+		Flags:   binary.BigEndian.Uint16(b[10:12]),
+		CIAddr:  netip.AddrFrom4([4]byte(b[12:16])),
+		YIAddr:  netip.AddrFrom4([4]byte(b[16:20])),
+		SIAddr:  netip.AddrFrom4([4]byte(b[20:24])),
+		GIAddr:  netip.AddrFrom4([4]byte(b[24:28])),
+		CHAddr:  stdnet.HardwareAddr(append([]byte{}, b[28:34]...)),
+		Options: make(map[byte][]byte),
+	}
+
+	opts := b[headerLen+4:]
+	for i := 0; i < len(opts); {
+		code := opts[i]
+		switch code {
+		case optPad:
+			i++
+			continue
+		case optEnd:
+			return p, nil
+		}
+		if i+1 >= len(opts) {
+			return nil, fmt.Errorf("dhcp: truncated option %d", code)
+		}
+		length := int(opts[i+1])
+		if i+2+length > len(opts) {
+			return nil, fmt.Errorf("dhcp: truncated option %d", code)
+		}
+		// Options may be split across multiple entries (RFC 3396), so
+		// concatenate rather than overwrite.
+		p.Options[code] = append(p.Options[code], opts[i+2:i+2+length]...)
+		i += 2 + length
+	}
+
+	return p, nil
+}
+
+// Marshal encodes the packet into its wire format.
+func (p *Packet) Marshal() []byte {
+	b := make([]byte, headerLen, headerLen+312)
+	b[0] = p.Op
+	b[1] = hwTypeEthernet
+	b[2] = 6
+	binary.BigEndian.PutUint32(b[4:8], p.XID)
+	binary.BigEndian.PutUint16(b[8:10], p.Secs)
+	binary.BigEndian.PutUint16(b[10:12], p.Flags)
+	putAddr(b[12:16], p.CIAddr)
+	putAddr(b[16:20], p.YIAddr)
+	putAddr(b[20:24], p.SIAddr)
+	putAddr(b[24:28], p.GIAddr)
+	copy(b[28:44], p.CHAddr)
+
+	b = append(b, magicCookie[:]...)
+
+	// Always lead with the message type, which some clients expect to be the
+	// first option in the list.
+	if v, ok := p.Options[optMessageType]; ok {
+		b = appendOption(b, optMessageType, v)
+	}
+	for code := 1; code < optEnd; code++ {
+		if code == optMessageType {
+			continue
+		}
+		if v, ok := p.Options[byte(code)]; ok {
+			b = appendOption(b, byte(code), v)
+		}
+	}
+	b = append(b, optEnd)
+
+	// Pad to the minimum BOOTP message size, as some clients drop shorter
+	// replies.
+	for len(b) < 300 {
+		b = append(b, optPad)
+	}
+
+	return b
+}
+
+// MessageType returns the DHCP message type option of the packet, or zero if
+// it is not present.
+func (p *Packet) MessageType() MessageType {
+	if v := p.Options[optMessageType]; len(v) == 1 {
+		return MessageType(v[0])
+	}
+	return 0
+}
+
+// addrOption returns the IPv4 address held within the given option, if it is
+// present and well-formed.
+func (p *Packet) addrOption(code byte) (netip.Addr, bool) {
+	v := p.Options[code]
+	if len(v) != 4 {
+		return netip.Addr{}, false
+	}
+	return netip.AddrFrom4([4]byte(v)), true
+}
+
+func appendOption(b []byte, code byte, v []byte) []byte {
+	// Values longer than 255 bytes are split across consecutive options as
+	// described in RFC 3396.
+	for len(v) > 255 {
+		b = append(b, code, 255)
+		b = append(b, v[:255]...)
+		v = v[255:]
+	}
+	b = append(b, code, byte(len(v)))
+	return append(b, v...)
+}
+
+func putAddr(b []byte, addr netip.Addr) {
+	if addr.Is4() {
+		a := addr.As4()
+		copy(b, a[:])
+	}
+}
+
+func addrBytes(addrs ...netip.Addr) []byte {
+	b := make([]byte, 0, 4*len(addrs))
+	for _, addr := range addrs {
+		a := addr.As4()
+		b = append(b, a[:]...)
+	}
+	return b
+}
+
+func uint32Bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
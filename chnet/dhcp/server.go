@@ -0,0 +1,408 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+// Package dhcp implements a minimal DHCPv4 server which hands out addresses
+// that have already been assigned by the driver's IPAM. It never allocates
+// addresses itself; clients without a reservation are ignored, so it can
+// safely share a bridge with other DHCP servers for unknown MACs.
+package dhcp
+
+import (
+	"errors"
+	"fmt"
+	stdnet "net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// ServerPort and ClientPort are the well known UDP ports used by DHCPv4.
+	ServerPort = 67
+	ClientPort = 68
+
+	// DefaultLeaseTime is the lease duration used when the configuration
+	// does not specify one.
+	DefaultLeaseTime = time.Hour
+
+	// maxPacketSize is the largest DHCP message the server will read.
+	maxPacketSize = 1500
+)
+
+// Config is the static configuration of the server which applies to every
+// lease it hands out.
+type Config struct {
+
+	// ServerIP is the address of the server on the served network. It is
+	// used as the server identifier option and must be set.
+	ServerIP netip.Addr
+
+	// Subnet is the network served, and provides the subnet mask option.
+	Subnet netip.Prefix
+
+	// Router is the default gateway handed to clients. If invalid, the
+	// option is not sent.
+	Router netip.Addr
+
+	// DNS is the default list of nameservers handed to clients.
+	DNS []netip.Addr
+
+	// DomainName is the optional DNS domain name option.
+	DomainName string
+
+	// LeaseTime is the lease duration handed to clients.
+	LeaseTime time.Duration
+}
+
+// Reservation binds a client hardware address to the address assigned to it
+// by the driver.
+type Reservation struct {
+	MAC      string
+	IP       netip.Addr
+	Hostname string
+
+	// DNS overrides the server's default nameservers for this client when
+	// not empty.
+	DNS []netip.Addr
+}
+
+// Lease is an address which has been acknowledged to a client.
+type Lease struct {
+	MAC      string
+	IP       netip.Addr
+	Hostname string
+	Expires  time.Time
+}
+
+// Server is an embedded DHCPv4 server. It is safe for concurrent use.
+type Server struct {
+	logger hclog.Logger
+	config Config
+
+	lock         sync.RWMutex
+	reservations map[string]Reservation
+	leases       map[string]Lease
+	conn         stdnet.PacketConn
+
+	// now is the clock used for lease expiry; it is a field to aid testing.
+	now func() time.Time
+}
+
+// NewServer validates the configuration and returns a server ready to be
+// passed a connection via Serve.
+func NewServer(logger hclog.Logger, cfg Config) (*Server, error) {
+	if !cfg.ServerIP.Is4() {
+		return nil, fmt.Errorf("dhcp: server IP %q must be a valid IPv4 address", cfg.ServerIP)
+	}
+	if !cfg.Subnet.IsValid() || !cfg.Subnet.Addr().Is4() {
+		return nil, fmt.Errorf("dhcp: subnet %q must be a valid IPv4 prefix", cfg.Subnet)
+	}
+	if cfg.LeaseTime <= 0 {
+		cfg.LeaseTime = DefaultLeaseTime
+	}
+
+	return &Server{
+		logger:       logger.Named("dhcp"),
+		config:       cfg,
+		reservations: make(map[string]Reservation),
+		leases:       make(map[string]Lease),
+		now:          time.Now,
+	}, nil
+}
+
+// Reserve registers the address a client should be given. Any existing
+// reservation for the MAC is replaced.
+func (s *Server) Reserve(r Reservation) error {
+	mac, err := normalizeMAC(r.MAC)
+	if err != nil {
+		return err
+	}
+	if !r.IP.Is4() {
+		return fmt.Errorf("dhcp: reservation for %s has invalid address %q", mac, r.IP)
+	}
+	if !s.config.Subnet.Contains(r.IP) {
+		return fmt.Errorf("dhcp: reservation address %s is outside subnet %s", r.IP, s.config.Subnet)
+	}
+	r.MAC = mac
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for other, res := range s.reservations {
+		if other != mac && res.IP == r.IP {
+			return fmt.Errorf("dhcp: address %s is already reserved for %s", r.IP, other)
+		}
+	}
+
+	// A changed address invalidates whatever the client was previously
+	// acknowledged.
+	if lease, ok := s.leases[mac]; ok && lease.IP != r.IP {
+		delete(s.leases, mac)
+	}
+
+	s.reservations[mac] = r
+	s.logger.Debug("added reservation", "mac", mac, "ip", r.IP, "hostname", r.Hostname)
+	return nil
+}
+
+// Unreserve removes the reservation and any lease for the MAC. Removing an
+// unknown MAC is not an error, so teardown can be safely retried.
+func (s *Server) Unreserve(mac string) {
+	mac, err := normalizeMAC(mac)
+	if err != nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.reservations, mac)
+	delete(s.leases, mac)
+}
+
+// Lease returns the active lease held by the MAC, if any.
+func (s *Server) Lease(mac string) (Lease, bool) {
+	mac, err := normalizeMAC(mac)
+	if err != nil {
+		return Lease{}, false
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	lease, ok := s.leases[mac]
+	if !ok || !lease.Expires.After(s.now()) {
+		return Lease{}, false
+	}
+	return lease, true
+}
+
+// Leases returns all active leases sorted by address.
+func (s *Server) Leases() []Lease {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	now := s.now()
+	leases := make([]Lease, 0, len(s.leases))
+	for _, lease := range s.leases {
+		if lease.Expires.After(now) {
+			leases = append(leases, lease)
+		}
+	}
+	slices.SortFunc(leases, func(a, b Lease) int { return a.IP.Compare(b.IP) })
+	return leases
+}
+
+// Serve reads requests from the connection and answers them until the
+// connection is closed. It returns nil when stopped via Close.
+func (s *Server) Serve(conn stdnet.PacketConn) error {
+	s.lock.Lock()
+	s.conn = conn
+	s.lock.Unlock()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, stdnet.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("dhcp: failed to read request: %w", err)
+		}
+
+		req, err := ParsePacket(buf[:n])
+		if err != nil {
+			s.logger.Trace("ignoring malformed packet", "error", err)
+			continue
+		}
+
+		reply := s.handle(req)
+		if reply == nil {
+			continue
+		}
+
+		if _, err := conn.WriteTo(reply.Marshal(), replyAddr(req, reply)); err != nil {
+			s.logger.Warn("failed to send reply", "type", reply.MessageType(),
+				"mac", req.CHAddr.String(), "error", err)
+		}
+	}
+}
+
+// Close stops the server by closing its connection.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// handle builds the reply for a request, or returns nil if the request
+// should be ignored.
+func (s *Server) handle(req *Packet) *Packet {
+	if req.Op != bootRequest {
+		return nil
+	}
+
+	mac := req.CHAddr.String()
+	msgType := req.MessageType()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	res, reserved := s.reservations[mac]
+
+	switch msgType {
+	case MessageTypeDiscover:
+		if !reserved {
+			s.logger.Trace("ignoring discover from unknown client", "mac", mac)
+			return nil
+		}
+		s.logger.Debug("offering address", "mac", mac, "ip", res.IP)
+		return s.reply(req, MessageTypeOffer, res)
+
+	case MessageTypeRequest:
+		// A server identifier for a different server means the client has
+		// selected another offer.
+		if id, ok := req.addrOption(optServerID); ok && id != s.config.ServerIP {
+			return nil
+		}
+		if !reserved {
+			return nil
+		}
+
+		requested, ok := req.addrOption(optRequestedIP)
+		if !ok {
+			requested = req.CIAddr
+		}
+		if requested != res.IP {
+			s.logger.Debug("rejecting request for unreserved address",
+				"mac", mac, "requested", requested, "reserved", res.IP)
+			return s.nak(req)
+		}
+
+		s.leases[mac] = Lease{
+			MAC:      mac,
+			IP:       res.IP,
+			Hostname: res.Hostname,
+			Expires:  s.now().Add(s.config.LeaseTime),
+		}
+		s.logger.Debug("acknowledged lease", "mac", mac, "ip", res.IP)
+		return s.reply(req, MessageTypeAck, res)
+
+	case MessageTypeRelease:
+		delete(s.leases, mac)
+		s.logger.Debug("released lease", "mac", mac)
+		return nil
+
+	case MessageTypeDecline:
+		delete(s.leases, mac)
+		s.logger.Warn("client declined address, it may be in use elsewhere",
+			"mac", mac, "ip", res.IP)
+		return nil
+
+	case MessageTypeInform:
+		if !reserved {
+			return nil
+		}
+		reply := s.reply(req, MessageTypeAck, res)
+		reply.YIAddr = netip.IPv4Unspecified()
+		delete(reply.Options, optLeaseTime)
+		delete(reply.Options, optRenewalTime)
+		delete(reply.Options, optRebindingTime)
+		return reply
+
+	default:
+		return nil
+	}
+}
+
+// reply builds an OFFER or ACK carrying the reservation's configuration.
+func (s *Server) reply(req *Packet, msgType MessageType, res Reservation) *Packet {
+	reply := s.newReply(req, msgType)
+	reply.YIAddr = res.IP
+
+	leaseSecs := uint32(s.config.LeaseTime / time.Second)
+	reply.Options[optLeaseTime] = uint32Bytes(leaseSecs)
+	reply.Options[optRenewalTime] = uint32Bytes(leaseSecs / 2)
+	reply.Options[optRebindingTime] = uint32Bytes(leaseSecs / 8 * 7)
+
+	mask := stdnet.CIDRMask(s.config.Subnet.Bits(), 32)
+	reply.Options[optSubnetMask] = []byte(mask)
+
+	if s.config.Router.Is4() {
+		reply.Options[optRouter] = addrBytes(s.config.Router)
+	}
+
+	dns := s.config.DNS
+	if len(res.DNS) > 0 {
+		dns = res.DNS
+	}
+	if dns = slices.DeleteFunc(slices.Clone(dns), func(a netip.Addr) bool { return !a.Is4() }); len(dns) > 0 {
+		reply.Options[optDNS] = addrBytes(dns...)
+	}
+
+	if res.Hostname != "" {
+		reply.Options[optHostname] = []byte(res.Hostname)
+	}
+	if s.config.DomainName != "" {
+		reply.Options[optDomainName] = []byte(s.config.DomainName)
+	}
+
+	return reply
+}
+
+func (s *Server) nak(req *Packet) *Packet {
+	reply := s.newReply(req, MessageTypeNak)
+	// NAKs must be broadcast when the client has no address to receive
+	// them on.
+	reply.Flags |= flagBroadcast
+	return reply
+}
+
+func (s *Server) newReply(req *Packet, msgType MessageType) *Packet {
+	return &Packet{
+		Op:     bootReply,
+		XID:    req.XID,
+		Flags:  req.Flags,
+		CIAddr: req.CIAddr,
+		YIAddr: netip.IPv4Unspecified(),
+		SIAddr: s.config.ServerIP,
+		GIAddr: req.GIAddr,
+		CHAddr: req.CHAddr,
+		Options: map[byte][]byte{
+			optMessageType: {byte(msgType)},
+			optServerID:    addrBytes(s.config.ServerIP),
+		},
+	}
+}
+
+// replyAddr determines where a reply should be sent according to the rules
+// of RFC 2131 section 4.1. Unicasting to the offered address would require
+// populating the ARP cache by hand, so unconfigured clients are always
+// answered via broadcast.
+func replyAddr(req, reply *Packet) stdnet.Addr {
+	if req.GIAddr.Is4() && !req.GIAddr.IsUnspecified() {
+		return &stdnet.UDPAddr{IP: req.GIAddr.AsSlice(), Port: ServerPort}
+	}
+	if reply.MessageType() != MessageTypeNak && req.CIAddr.Is4() && !req.CIAddr.IsUnspecified() {
+		return &stdnet.UDPAddr{IP: req.CIAddr.AsSlice(), Port: ClientPort}
+	}
+	return &stdnet.UDPAddr{IP: stdnet.IPv4bcast, Port: ClientPort}
+}
+
+func normalizeMAC(mac string) (string, error) {
+	hw, err := stdnet.ParseMAC(strings.TrimSpace(mac))
+	if err != nil {
+		return "", fmt.Errorf("dhcp: invalid MAC address %q: %w", mac, err)
+	}
+	return hw.String(), nil
+}
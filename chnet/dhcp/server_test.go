@@ -0,0 +1,236 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package dhcp
+
+import (
+	stdnet "net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/shoenig/test/must"
+)
+
+// memPacketConn is an in-memory net.PacketConn which lets tests inject
+// requests and capture the server's replies.
+type memPacketConn struct {
+	in     chan []byte
+	out    chan sentPacket
+	closed chan struct{}
+}
+
+type sentPacket struct {
+	data []byte
+	addr stdnet.Addr
+}
+
+func newMemPacketConn() *memPacketConn {
+	return &memPacketConn{
+		in:     make(chan []byte, 8),
+		out:    make(chan sentPacket, 8),
+		closed: make(chan struct{}),
+	}
+}
+
+func (m *memPacketConn) ReadFrom(b []byte) (int, stdnet.Addr, error) {
+	select {
+	case data := <-m.in:
+		return copy(b, data), &stdnet.UDPAddr{IP: stdnet.IPv4zero, Port: ClientPort}, nil
+	case <-m.closed:
+		return 0, nil, stdnet.ErrClosed
+	}
+}
+
+func (m *memPacketConn) WriteTo(b []byte, addr stdnet.Addr) (int, error) {
+	m.out <- sentPacket{data: append([]byte{}, b...), addr: addr}
+	return len(b), nil
+}
+
+func (m *memPacketConn) Close() error                     { close(m.closed); return nil }
+func (m *memPacketConn) LocalAddr() stdnet.Addr           { return &stdnet.UDPAddr{Port: ServerPort} }
+func (m *memPacketConn) SetDeadline(time.Time) error      { return nil }
+func (m *memPacketConn) SetReadDeadline(time.Time) error  { return nil }
+func (m *memPacketConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (m *memPacketConn) exchange(t *testing.T, p *Packet) *sentPacket {
+	t.Helper()
+	m.in <- p.Marshal()
+	select {
+	case sent := <-m.out:
+		return &sent
+	case <-time.After(200 * time.Millisecond):
+		return nil
+	}
+}
+
+func testServer(t *testing.T) (*Server, *memPacketConn) {
+	t.Helper()
+
+	srv, err := NewServer(hclog.NewNullLogger(), Config{
+		ServerIP:  netip.MustParseAddr("192.168.254.1"),
+		Subnet:    netip.MustParsePrefix("192.168.254.0/24"),
+		Router:    netip.MustParseAddr("192.168.254.1"),
+		DNS:       []netip.Addr{netip.MustParseAddr("192.168.254.1")},
+		LeaseTime: 10 * time.Minute,
+	})
+	must.NoError(t, err)
+
+	conn := newMemPacketConn()
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(conn) }()
+
+	t.Cleanup(func() {
+		must.NoError(t, srv.Close())
+		must.NoError(t, <-done)
+	})
+
+	return srv, conn
+}
+
+func clientPacket(t *testing.T, msgType MessageType, mac string, opts map[byte][]byte) *Packet {
+	t.Helper()
+
+	hw, err := stdnet.ParseMAC(mac)
+	must.NoError(t, err)
+
+	p := &Packet{
+		Op:      bootRequest,
+		XID:     0xdeadbeef,
+		Flags:   flagBroadcast,
+		CIAddr:  netip.IPv4Unspecified(),
+		YIAddr:  netip.IPv4Unspecified(),
+		SIAddr:  netip.IPv4Unspecified(),
+		GIAddr:  netip.IPv4Unspecified(),
+		CHAddr:  hw,
+		Options: map[byte][]byte{optMessageType: {byte(msgType)}},
+	}
+	for k, v := range opts {
+		p.Options[k] = v
+	}
+	return p
+}
+
+func TestServer_DiscoverRequest(t *testing.T) {
+	srv, conn := testServer(t)
+
+	mac := "02:00:00:aa:bb:cc"
+	ip := netip.MustParseAddr("192.168.254.10")
+	must.NoError(t, srv.Reserve(Reservation{MAC: mac, IP: ip, Hostname: "nomad-web"}))
+
+	sent := conn.exchange(t, clientPacket(t, MessageTypeDiscover, mac, nil))
+	must.NotNil(t, sent)
+	must.Eq(t, "255.255.255.255:68", sent.addr.String())
+
+	offer, err := ParsePacket(sent.data)
+	must.NoError(t, err)
+	must.Eq(t, MessageTypeOffer, offer.MessageType())
+	must.Eq(t, ip, offer.YIAddr)
+	must.Eq(t, uint32(0xdeadbeef), offer.XID)
+	must.Eq(t, []byte{255, 255, 255, 0}, offer.Options[optSubnetMask])
+	must.Eq(t, []byte{192, 168, 254, 1}, offer.Options[optRouter])
+	must.Eq(t, []byte{192, 168, 254, 1}, offer.Options[optDNS])
+	must.Eq(t, "nomad-web", string(offer.Options[optHostname]))
+
+	// The lease only becomes visible once the client has requested it.
+	_, ok := srv.Lease(mac)
+	must.False(t, ok)
+
+	sent = conn.exchange(t, clientPacket(t, MessageTypeRequest, mac, map[byte][]byte{
+		optRequestedIP: addrBytes(ip),
+		optServerID:    addrBytes(netip.MustParseAddr("192.168.254.1")),
+	}))
+	must.NotNil(t, sent)
+
+	ack, err := ParsePacket(sent.data)
+	must.NoError(t, err)
+	must.Eq(t, MessageTypeAck, ack.MessageType())
+	must.Eq(t, ip, ack.YIAddr)
+	must.Eq(t, uint32Bytes(600), ack.Options[optLeaseTime])
+
+	lease, ok := srv.Lease("02:00:00:AA:BB:CC")
+	must.True(t, ok)
+	must.Eq(t, ip, lease.IP)
+	must.Eq(t, "nomad-web", lease.Hostname)
+	must.Len(t, 1, srv.Leases())
+
+	// Removing the reservation drops the lease too.
+	srv.Unreserve(mac)
+	_, ok = srv.Lease(mac)
+	must.False(t, ok)
+}
+
+func TestServer_Ignored(t *testing.T) {
+	srv, conn := testServer(t)
+
+	must.NoError(t, srv.Reserve(Reservation{
+		MAC: "02:00:00:aa:bb:cc",
+		IP:  netip.MustParseAddr("192.168.254.10"),
+	}))
+
+	// Clients without a reservation are left for other servers.
+	must.Nil(t, conn.exchange(t, clientPacket(t, MessageTypeDiscover, "02:00:00:11:22:33", nil)))
+
+	// Requests addressed to a different server are not answered.
+	must.Nil(t, conn.exchange(t, clientPacket(t, MessageTypeRequest, "02:00:00:aa:bb:cc", map[byte][]byte{
+		optRequestedIP: addrBytes(netip.MustParseAddr("192.168.254.10")),
+		optServerID:    addrBytes(netip.MustParseAddr("192.168.254.2")),
+	})))
+}
+
+func TestServer_RequestWrongAddress(t *testing.T) {
+	srv, conn := testServer(t)
+
+	mac := "02:00:00:aa:bb:cc"
+	must.NoError(t, srv.Reserve(Reservation{MAC: mac, IP: netip.MustParseAddr("192.168.254.10")}))
+
+	sent := conn.exchange(t, clientPacket(t, MessageTypeRequest, mac, map[byte][]byte{
+		optRequestedIP: addrBytes(netip.MustParseAddr("192.168.254.99")),
+	}))
+	must.NotNil(t, sent)
+	must.Eq(t, "255.255.255.255:68", sent.addr.String())
+
+	nak, err := ParsePacket(sent.data)
+	must.NoError(t, err)
+	must.Eq(t, MessageTypeNak, nak.MessageType())
+
+	_, ok := srv.Lease(mac)
+	must.False(t, ok)
+}
+
+func TestServer_Reserve(t *testing.T) {
+	srv, err := NewServer(hclog.NewNullLogger(), Config{
+		ServerIP: netip.MustParseAddr("192.168.254.1"),
+		Subnet:   netip.MustParsePrefix("192.168.254.0/24"),
+	})
+	must.NoError(t, err)
+
+	must.ErrorContains(t, srv.Reserve(Reservation{MAC: "nope", IP: netip.MustParseAddr("192.168.254.10")}),
+		"invalid MAC address")
+	must.ErrorContains(t, srv.Reserve(Reservation{MAC: "02:00:00:00:00:01", IP: netip.MustParseAddr("10.0.0.1")}),
+		"outside subnet")
+
+	must.NoError(t, srv.Reserve(Reservation{MAC: "02:00:00:00:00:01", IP: netip.MustParseAddr("192.168.254.10")}))
+	must.ErrorContains(t, srv.Reserve(Reservation{MAC: "02:00:00:00:00:02", IP: netip.MustParseAddr("192.168.254.10")}),
+		"already reserved")
+}
+
+func TestPacket_RoundTrip(t *testing.T) {
+	p := clientPacket(t, MessageTypeDiscover, "02:00:00:aa:bb:cc", map[byte][]byte{
+		optHostname: []byte("a-very-long-hostname"),
+	})
+
+	b := p.Marshal()
+	must.GreaterEq(t, 300, len(b))
+
+	parsed, err := ParsePacket(b)
+	must.NoError(t, err)
+	must.Eq(t, p.XID, parsed.XID)
+	must.Eq(t, p.CHAddr, parsed.CHAddr)
+	must.Eq(t, MessageTypeDiscover, parsed.MessageType())
+	must.Eq(t, "a-very-long-hostname", string(parsed.Options[optHostname]))
+
+	_, err = ParsePacket(b[:100])
+	must.ErrorContains(t, err, "too short")
+}
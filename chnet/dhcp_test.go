@@ -0,0 +1,116 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	stdnet "net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/ccheshirecat/nomad-driver-ch/chnet/dhcp"
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
+	"github.com/hashicorp/go-hclog"
+	"github.com/shoenig/test/must"
+	"github.com/shoenig/test/wait"
+)
+
+func TestController_DHCPReservation(t *testing.T) {
+	srv, err := dhcp.NewServer(hclog.NewNullLogger(), dhcp.Config{
+		ServerIP: netip.MustParseAddr("192.168.1.1"),
+		Subnet:   netip.MustParsePrefix("192.168.1.0/24"),
+		Router:   netip.MustParseAddr("192.168.1.1"),
+	})
+	must.NoError(t, err)
+
+	c := &Controller{
+		logger:        hclog.NewNullLogger(),
+		networkConfig: &domain.Network{Bridge: "br0"},
+		dhcpServer:    srv,
+	}
+
+	req := &net.VMStartedBuildRequest{
+		Hostname: "web",
+		Hwaddrs:  []string{"52:54:00:12:34:56"},
+	}
+	res, err := c.reserveDHCPAddress(req, &net.NetworkInterfaceBridgeConfig{DNS: []string{"1.1.1.1"}}, "br0", "192.168.1.10")
+	must.NoError(t, err)
+	must.Eq(t, &net.DHCPReservation{
+		MAC:      "52:54:00:12:34:56",
+		IP:       "192.168.1.10",
+		Hostname: "web",
+		DNS:      []string{"1.1.1.1"},
+	}, res)
+
+	// VMs attached to other bridges cannot reach the server.
+	other, err := c.reserveDHCPAddress(req, nil, "br1", "192.168.1.11")
+	must.NoError(t, err)
+	must.Nil(t, other)
+
+	// The guest is leased the reserved address once it requests it.
+	conn := serveDHCP(t, srv)
+	requestDHCPLease(t, srv, conn, res.MAC, res.IP)
+
+	// Releasing the reservation drops the lease of the guest.
+	c.releaseDHCPAddress(res)
+	_, ok := srv.Lease(res.MAC)
+	must.False(t, ok)
+	must.SliceEmpty(t, srv.Leases())
+
+	// The reservation is restored when the VM is recovered by a restarted
+	// driver, whose server has none.
+	_, err = c.VMRecovered(&net.VMRecoveredRequest{TeardownSpec: &net.TeardownSpec{DHCPLease: res}})
+	must.NoError(t, err)
+	requestDHCPLease(t, srv, conn, res.MAC, res.IP)
+}
+
+// serveDHCP serves the DHCP server on a loopback socket, returning the
+// connection requests are sent from.
+func serveDHCP(t *testing.T, srv *dhcp.Server) stdnet.Conn {
+	t.Helper()
+
+	pc, err := stdnet.ListenPacket("udp4", "127.0.0.1:0")
+	must.NoError(t, err)
+	go func() { _ = srv.Serve(pc) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	conn, err := stdnet.Dial("udp4", pc.LocalAddr().String())
+	must.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// requestDHCPLease requests the address for the MAC as a guest would, and
+// waits for the server to lease it.
+func requestDHCPLease(t *testing.T, srv *dhcp.Server, conn stdnet.Conn, mac, ip string) {
+	t.Helper()
+
+	hw, err := stdnet.ParseMAC(mac)
+	must.NoError(t, err)
+	addr := netip.MustParseAddr(ip)
+
+	// The reply is broadcast, so only the lease table is checked.
+	req := &dhcp.Packet{
+		Op:     1,
+		CIAddr: netip.IPv4Unspecified(),
+		YIAddr: netip.IPv4Unspecified(),
+		SIAddr: netip.IPv4Unspecified(),
+		GIAddr: netip.IPv4Unspecified(),
+		CHAddr: hw,
+		Options: map[byte][]byte{
+			53: {byte(dhcp.MessageTypeRequest)},
+			50: addr.AsSlice(),
+		},
+	}
+	_, err = conn.Write(req.Marshal())
+	must.NoError(t, err)
+
+	must.Wait(t, wait.InitialSuccess(wait.BoolFunc(func() bool {
+		lease, ok := srv.Lease(mac)
+		return ok && lease.IP == addr
+	}), wait.Timeout(time.Second)))
+}
@@ -0,0 +1,128 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	"fmt"
+	stdnet "net"
+	"net/netip"
+	"slices"
+
+	"github.com/ccheshirecat/nomad-driver-ch/chnet/resolver"
+	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
+)
+
+// resolverListener is the function signature used to open the UDP and TCP
+// sockets of the embedded DNS resolver. It is a field within the controller
+// to aid testing.
+type resolverListener func(addr string) (stdnet.PacketConn, stdnet.Listener, error)
+
+// ensureResolver starts the embedded DNS resolver on the bridge gateway when
+// enabled within the driver configuration. It is safe to call multiple times;
+// a running resolver is left untouched.
+func (c *Controller) ensureResolver() error {
+	if !c.networkConfig.ResolverEnabled() {
+		return nil
+	}
+	cfg := c.networkConfig.DNS
+
+	c.resolverLock.Lock()
+	defer c.resolverLock.Unlock()
+
+	if c.resolver != nil {
+		return nil
+	}
+
+	gateway, err := netip.ParseAddr(c.networkConfig.Gateway)
+	if err != nil {
+		return fmt.Errorf("invalid gateway %q: %w", c.networkConfig.Gateway, err)
+	}
+	listenAddr := netip.AddrPortFrom(gateway, 53).String()
+
+	upstreams := cfg.Upstreams
+	if len(upstreams) == 0 {
+		upstreams, err = resolver.UpstreamsFromResolvConf(resolver.DefaultResolvConf)
+		if err != nil {
+			c.logger.Warn("no DNS upstreams available, only VM records will be answered", "error", err)
+		}
+	}
+
+	// Forwarding to ourselves would loop until the query times out.
+	upstreams = slices.DeleteFunc(slices.Clone(upstreams), func(u string) bool {
+		addr, err := resolver.ParseUpstream(u)
+		return err == nil && addr == listenAddr
+	})
+
+	srv, err := resolver.NewServer(c.logger, resolver.Config{
+		Domain:    cfg.Domain,
+		Upstreams: upstreams,
+	})
+	if err != nil {
+		return err
+	}
+
+	pc, l, err := c.resolverListener(listenAddr)
+	if err != nil {
+		return err
+	}
+	if err := srv.Serve(pc, l); err != nil {
+		return err
+	}
+
+	c.resolver = srv
+	c.logger.Info("started embedded DNS resolver",
+		"address", listenAddr, "domain", srv.Domain(), "upstreams", upstreams)
+
+	return nil
+}
+
+// registerDNSRecord adds the VM's hostname to the embedded DNS resolver, if
+// running. The returned record is to be stored within the teardown spec; it
+// is nil when no record was registered.
+func (c *Controller) registerDNSRecord(hostname, ip string) (*net.DNSRecord, error) {
+	c.resolverLock.Lock()
+	srv := c.resolver
+	c.resolverLock.Unlock()
+
+	if srv == nil || hostname == "" {
+		return nil, nil
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, fmt.Errorf("invalid guest IP %q: %w", ip, err)
+	}
+	if err := srv.Register(hostname, addr); err != nil {
+		return nil, err
+	}
+	return &net.DNSRecord{Hostname: hostname, IP: ip}, nil
+}
+
+// deregisterDNSRecord removes a record previously added by registerDNSRecord.
+func (c *Controller) deregisterDNSRecord(record *net.DNSRecord) {
+	c.resolverLock.Lock()
+	srv := c.resolver
+	c.resolverLock.Unlock()
+
+	if srv == nil || record == nil {
+		return
+	}
+	if addr, err := netip.ParseAddr(record.IP); err == nil {
+		srv.Deregister(record.Hostname, addr)
+	}
+}
+
+// resolverDomain returns the domain served by the embedded DNS resolver, or
+// an empty string if it is not running.
+func (c *Controller) resolverDomain() string {
+	c.resolverLock.Lock()
+	defer c.resolverLock.Unlock()
+
+	if c.resolver == nil {
+		return ""
+	}
+	return c.resolver.Domain()
+}
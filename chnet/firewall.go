@@ -0,0 +1,171 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
+)
+
+const (
+	// egressIPTablesChainPrefix and ingressIPTablesChainPrefix prefix the
+	// per-VM chains within the filter table which hold the firewall rules for
+	// traffic sent and received by a VM respectively. They are jumped to from
+	// the "NOMAD_CH_FW" chain.
+	egressIPTablesChainPrefix  = "NOMAD_CH_EG_"
+	ingressIPTablesChainPrefix = "NOMAD_CH_IN_"
+)
+
+// firewallChainNames returns the names of the per-VM firewall chains. The
+// names are derived from a hash, as iptables limits chain names to 28
+// characters.
+func firewallChainNames(domainName string) (string, string) {
+	sum := sha256.Sum256([]byte(domainName))
+	id := hex.EncodeToString(sum[:])[:12]
+	return egressIPTablesChainPrefix + id, ingressIPTablesChainPrefix + id
+}
+
+// configureFirewall creates the per-VM firewall chains and the rules which
+// jump to them. The returned rules and chains should be stored within the
+// teardown spec; the rules must be deleted before the chains.
+func (c *Controller) configureFirewall(fw firewallBackend, domainName string, cfg *net.NetworkInterfaceBridgeConfig, ip string) ([][]string, [][]string, error) {
+	if cfg == nil || cfg.Firewall == nil {
+		return nil, nil, nil
+	}
+
+	egressChain, ingressChain := firewallChainNames(domainName)
+	chainRules, jumpRules, chains, err := buildFirewallRules(cfg.Firewall, ip, egressChain, ingressChain)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(chains) == 0 {
+		return nil, nil, nil
+	}
+
+	if fw == nil {
+		return nil, nil, errNoFirewallBackend
+	}
+
+	// Populate the chains before jumping to them, so the VM is never briefly
+	// unrestricted or cut off entirely.
+	for _, chain := range chains {
+		if err := fw.ClearChain(chain[0], chain[1]); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, rule := range chainRules {
+		if err := fw.Append(rule[0], rule[1], rule[2:]...); err != nil {
+			c.deleteFirewall(fw, nil, chains)
+			return nil, nil, err
+		}
+	}
+
+	// The jumps must precede the port forwarding rules within the shared
+	// chain, as those accept new connections from any source.
+	for i, rule := range jumpRules {
+		if err := fw.Insert(rule[0], rule[1], 1, rule[2:]...); err != nil {
+			c.deleteFirewall(fw, jumpRules[:i], chains)
+			return nil, nil, err
+		}
+	}
+
+	c.logger.Info("successfully configured firewall rules",
+		"ip", ip, "egress_chain", egressChain, "ingress_chain", ingressChain)
+
+	return jumpRules, chains, nil
+}
+
+// deleteFirewall removes partially configured firewall rules and chains.
+func (c *Controller) deleteFirewall(fw firewallBackend, rules, chains [][]string) {
+	for _, rule := range rules {
+		if err := fw.DeleteIfExists(rule[0], rule[1], rule[2:]...); err != nil {
+			c.logger.Error("failed to delete firewall rule, manual cleanup needed", "rule", rule, "error", err)
+		}
+	}
+	for _, chain := range chains {
+		if err := fw.ClearAndDeleteChain(chain[0], chain[1]); err != nil {
+			c.logger.Error("failed to delete firewall chain, manual cleanup needed", "chain", chain[1], "error", err)
+		}
+	}
+}
+
+// buildFirewallRules compiles the firewall configuration into iptables rules.
+// It returns the rules within the per-VM chains, the rules jumping to them
+// from the shared forward chain and the chains themselves. Each chain entry is
+// the table followed by the chain name. A direction without any restriction
+// does not get a chain.
+func buildFirewallRules(cfg *net.NetworkInterfaceFirewallConfig, ip, egressChain, ingressChain string) (
+	chainRules, jumpRules, chains [][]string, err error) {
+
+	established := []string{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "RETURN"}
+
+	if len(cfg.EgressCIDRs) > 0 || len(cfg.EgressPorts) > 0 {
+		var dests [][]string
+		for _, cidr := range cfg.EgressCIDRs {
+			prefix, err := net.ParseFirewallCIDR(cidr)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			dests = append(dests, []string{"-d", prefix.String()})
+		}
+		if len(dests) == 0 {
+			dests = [][]string{nil}
+		}
+
+		var ports [][]string
+		for _, p := range cfg.EgressPorts {
+			port, err := net.ParseFirewallPort(p)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			dport := fmt.Sprintf("%d", port.Start)
+			if port.End != port.Start {
+				dport = fmt.Sprintf("%d:%d", port.Start, port.End)
+			}
+			for _, proto := range port.Protocols {
+				ports = append(ports, []string{"-p", proto, "-m", proto, "--dport", dport})
+			}
+		}
+		if len(ports) == 0 {
+			ports = [][]string{nil}
+		}
+
+		chainRules = append(chainRules, append([]string{iptablesFilterTableName, egressChain}, established...))
+		for _, dest := range dests {
+			for _, port := range ports {
+				rule := []string{iptablesFilterTableName, egressChain}
+				rule = append(rule, dest...)
+				rule = append(rule, port...)
+				chainRules = append(chainRules, append(rule, "-j", "RETURN"))
+			}
+		}
+		chainRules = append(chainRules, []string{iptablesFilterTableName, egressChain, "-j", "DROP"})
+
+		jumpRules = append(jumpRules, []string{iptablesFilterTableName, forwardIPTablesChainName, "-s", ip, "-j", egressChain})
+		chains = append(chains, []string{iptablesFilterTableName, egressChain})
+	}
+
+	if len(cfg.IngressCIDRs) > 0 {
+		chainRules = append(chainRules, append([]string{iptablesFilterTableName, ingressChain}, established...))
+		for _, cidr := range cfg.IngressCIDRs {
+			prefix, err := net.ParseFirewallCIDR(cidr)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			chainRules = append(chainRules,
+				[]string{iptablesFilterTableName, ingressChain, "-s", prefix.String(), "-j", "RETURN"})
+		}
+		chainRules = append(chainRules, []string{iptablesFilterTableName, ingressChain, "-j", "DROP"})
+
+		jumpRules = append(jumpRules, []string{iptablesFilterTableName, forwardIPTablesChainName, "-d", ip, "-j", ingressChain})
+		chains = append(chains, []string{iptablesFilterTableName, ingressChain})
+	}
+
+	return chainRules, jumpRules, chains, nil
+}
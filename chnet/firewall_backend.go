@@ -0,0 +1,146 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// FirewallBackendAuto selects the backend matching the firewall tooling
+	// in use on the host.
+	FirewallBackendAuto = "auto"
+
+	// FirewallBackendIPTables manages rules using the iptables binary.
+	FirewallBackendIPTables = "iptables"
+
+	// FirewallBackendNFTables manages rules natively via nftables netlink.
+	FirewallBackendNFTables = "nftables"
+)
+
+// errNoFirewallBackend is returned when a task requires firewall rules but
+// no backend could be initialized.
+var errNoFirewallBackend = errors.New("no firewall backend available, iptables or nftables is required")
+
+// firewallBackend is the interface the controller uses to manage host
+// firewall rules. Rules are always expressed as iptables arguments, whichever
+// backend applies them, so the rules stored within a teardown spec have the
+// same format for all backends.
+type firewallBackend interface {
+
+	// Name returns the backend identifier, which is recorded within the
+	// teardown spec.
+	Name() string
+
+	ChainExists(table, chain string) (bool, error)
+	NewChain(table, chain string) error
+	ClearChain(table, chain string) error
+	ClearAndDeleteChain(table, chain string) error
+
+	Insert(table, chain string, pos int, rulespec ...string) error
+	Append(table, chain string, rulespec ...string) error
+	DeleteIfExists(table, chain string, rulespec ...string) error
+}
+
+// iptablesBackend implements firewallBackend using the iptables binary.
+type iptablesBackend struct {
+	*iptables.IPTables
+}
+
+func newIPTablesBackend() (firewallBackend, error) {
+	ipt, err := iptables.New()
+	if err != nil {
+		return nil, err
+	}
+	return &iptablesBackend{IPTables: ipt}, nil
+}
+
+func (b *iptablesBackend) Name() string { return FirewallBackendIPTables }
+
+// newFirewallBackend returns the named backend. Auto mode prefers iptables
+// when it is in legacy mode or the host already holds iptables-nft tables,
+// so rules sit alongside those of other tools which would otherwise be able
+// to drop the traffic; nftables is used otherwise.
+func newFirewallBackend(logger hclog.Logger, name string) (firewallBackend, error) {
+	switch name {
+	case FirewallBackendIPTables:
+		return newIPTablesBackend()
+	case FirewallBackendNFTables:
+		return newNFTablesBackend()
+	case "", FirewallBackendAuto:
+	default:
+		return nil, fmt.Errorf("invalid firewall backend %q: must be %q, %q or %q",
+			name, FirewallBackendAuto, FirewallBackendIPTables, FirewallBackendNFTables)
+	}
+
+	iptablesMode := detectIPTablesMode()
+
+	nft, nftErr := newNFTablesBackend()
+	if nftErr != nil {
+		logger.Debug("nftables not available", "error", nftErr)
+	}
+
+	switch {
+	case iptablesMode == "legacy",
+		iptablesMode == "nf_tables" && (nft == nil || nft.(*nftablesBackend).hasIPTablesTables()):
+		if ipt, err := newIPTablesBackend(); err == nil {
+			return ipt, nil
+		} else if nft == nil {
+			return nil, err
+		}
+	}
+
+	if nft == nil {
+		return nil, nftErr
+	}
+	return nft, nil
+}
+
+// detectIPTablesMode returns the operating mode of the host's iptables
+// binary, "legacy" or "nf_tables", or an empty string if it is not
+// available.
+func detectIPTablesMode() string {
+	path, err := exec.LookPath("iptables")
+	if err != nil {
+		return ""
+	}
+	out, err := exec.Command(path, "--version").Output()
+	if err != nil {
+		return ""
+	}
+	if strings.Contains(string(out), "nf_tables") {
+		return "nf_tables"
+	}
+	return "legacy"
+}
+
+// firewallBackendFor returns the backend which created the rules within a
+// teardown spec. Specs written before backends were recorded always used
+// iptables.
+func (c *Controller) firewallBackendFor(name string) (firewallBackend, error) {
+	if name == "" {
+		name = FirewallBackendIPTables
+	}
+	if c.firewall != nil && c.firewall.Name() == name {
+		return c.firewall, nil
+	}
+	return newFirewallBackend(c.logger, name)
+}
+
+// firewallName returns the name of the current firewall backend, for
+// recording within teardown specs.
+func (c *Controller) firewallName() string {
+	if c.firewall == nil {
+		return ""
+	}
+	return c.firewall.Name()
+}
@@ -0,0 +1,551 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// nftablesTablePrefix prefixes the nftables tables created by the driver.
+	// Each iptables table used within a rule maps to its own nftables table,
+	// e.g. rules for the "nat" table are held within "nomad-ch-nat".
+	nftablesTablePrefix = "nomad-ch-"
+
+	// nftablesRuleTagPrefix prefixes the comment attached to each rule, which
+	// identifies the rule for deletion.
+	nftablesRuleTagPrefix = "nomad-ch:"
+)
+
+// nftablesBaseChain describes how an iptables built-in chain is created as an
+// nftables base chain.
+type nftablesBaseChain struct {
+	hook     *nftables.ChainHook
+	priority *nftables.ChainPriority
+	typ      nftables.ChainType
+}
+
+// nftablesBaseChains maps the iptables built-in chains the driver uses, keyed
+// by table and then chain, onto their nftables equivalents.
+var nftablesBaseChains = map[string]map[string]nftablesBaseChain{
+	iptablesNATTableName: {
+		"PREROUTING":  {nftables.ChainHookPrerouting, nftables.ChainPriorityNATDest, nftables.ChainTypeNAT},
+		"OUTPUT":      {nftables.ChainHookOutput, nftables.ChainPriorityNATDest, nftables.ChainTypeNAT},
+		"POSTROUTING": {nftables.ChainHookPostrouting, nftables.ChainPriorityNATSource, nftables.ChainTypeNAT},
+	},
+	iptablesFilterTableName: {
+		"INPUT":   {nftables.ChainHookInput, nftables.ChainPriorityFilter, nftables.ChainTypeFilter},
+		"FORWARD": {nftables.ChainHookForward, nftables.ChainPriorityFilter, nftables.ChainTypeFilter},
+		"OUTPUT":  {nftables.ChainHookOutput, nftables.ChainPriorityFilter, nftables.ChainTypeFilter},
+	},
+}
+
+// nftablesBackend implements firewallBackend natively via nftables netlink.
+// Rules are translated from their iptables arguments, and tagged with a hash
+// of those arguments so they can be found again for deletion.
+type nftablesBackend struct {
+	lock sync.Mutex
+	conn *nftables.Conn
+}
+
+func newNFTablesBackend() (firewallBackend, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open nftables connection: %w", err)
+	}
+
+	// Listing tables confirms the kernel supports nftables and that we have
+	// the permissions needed to use it.
+	if _, err := conn.ListTablesOfFamily(nftables.TableFamilyIPv4); err != nil {
+		return nil, fmt.Errorf("failed to query nftables: %w", err)
+	}
+
+	return &nftablesBackend{conn: conn}, nil
+}
+
+func (b *nftablesBackend) Name() string { return FirewallBackendNFTables }
+
+// hasIPTablesTables reports whether iptables-nft has created its tables,
+// indicating the host firewall is managed through iptables.
+func (b *nftablesBackend) hasIPTablesTables() bool {
+	tables, err := b.conn.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		return false
+	}
+	for _, t := range tables {
+		if t.Name == iptablesFilterTableName || t.Name == iptablesNATTableName {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *nftablesBackend) table(table string) *nftables.Table {
+	return &nftables.Table{Name: nftablesTablePrefix + table, Family: nftables.TableFamilyIPv4}
+}
+
+func (b *nftablesBackend) chain(table, chain string) *nftables.Chain {
+	c := &nftables.Chain{Name: chain, Table: b.table(table)}
+	if base, ok := nftablesBaseChains[table][chain]; ok {
+		policy := nftables.ChainPolicyAccept
+		c.Hooknum = base.hook
+		c.Priority = base.priority
+		c.Type = base.typ
+		c.Policy = &policy
+	}
+	return c
+}
+
+// ensureChain queues the creation of the table and chain. Both operations are
+// no-ops when they already exist.
+func (b *nftablesBackend) ensureChain(table, chain string) *nftables.Chain {
+	b.conn.AddTable(b.table(table))
+	return b.conn.AddChain(b.chain(table, chain))
+}
+
+func (b *nftablesBackend) ChainExists(table, chain string) (bool, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.chainExists(table, chain)
+}
+
+func (b *nftablesBackend) chainExists(table, chain string) (bool, error) {
+	chains, err := b.conn.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range chains {
+		if c.Table.Name == nftablesTablePrefix+table && c.Name == chain {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (b *nftablesBackend) NewChain(table, chain string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	exists, err := b.chainExists(table, chain)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("nftables chain %q already exists in table %q", chain, table)
+	}
+	b.ensureChain(table, chain)
+	return b.conn.Flush()
+}
+
+func (b *nftablesBackend) ClearChain(table, chain string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.conn.FlushChain(b.ensureChain(table, chain))
+	return b.conn.Flush()
+}
+
+func (b *nftablesBackend) ClearAndDeleteChain(table, chain string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	exists, err := b.chainExists(table, chain)
+	if err != nil || !exists {
+		return err
+	}
+	c := b.chain(table, chain)
+	b.conn.FlushChain(c)
+	b.conn.DelChain(c)
+	return b.conn.Flush()
+}
+
+func (b *nftablesBackend) Insert(table, chain string, pos int, rulespec ...string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	rule, err := b.rule(table, chain, rulespec)
+	if err != nil {
+		return err
+	}
+	rule.Chain = b.ensureChain(table, chain)
+
+	if pos <= 1 {
+		b.conn.InsertRule(rule)
+		return b.conn.Flush()
+	}
+
+	// Rules are positioned relative to the handle of an existing rule, so
+	// add the rule after the one currently preceding the position.
+	if err := b.conn.Flush(); err != nil {
+		return err
+	}
+	rules, err := b.conn.GetRules(rule.Table, rule.Chain)
+	if err != nil {
+		return err
+	}
+	if pos-2 < len(rules) {
+		rule.Position = rules[pos-2].Handle
+	}
+	b.conn.AddRule(rule)
+	return b.conn.Flush()
+}
+
+func (b *nftablesBackend) Append(table, chain string, rulespec ...string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	rule, err := b.rule(table, chain, rulespec)
+	if err != nil {
+		return err
+	}
+	rule.Chain = b.ensureChain(table, chain)
+	b.conn.AddRule(rule)
+	return b.conn.Flush()
+}
+
+func (b *nftablesBackend) DeleteIfExists(table, chain string, rulespec ...string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	exists, err := b.chainExists(table, chain)
+	if err != nil || !exists {
+		return err
+	}
+
+	rules, err := b.conn.GetRules(b.table(table), b.chain(table, chain))
+	if err != nil {
+		return err
+	}
+
+	tag := nftablesRuleTag(table, chain, rulespec)
+	for _, r := range rules {
+		if comment, ok := userdata.GetString(r.UserData, userdata.TypeComment); ok && comment == tag {
+			if err := b.conn.DelRule(r); err != nil {
+				return err
+			}
+			return b.conn.Flush()
+		}
+	}
+	return nil
+}
+
+// rule translates the iptables arguments into an nftables rule.
+func (b *nftablesBackend) rule(table, chain string, rulespec []string) (*nftables.Rule, error) {
+	exprs, err := nftablesExprs(rulespec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to translate rule %q: %w", strings.Join(rulespec, " "), err)
+	}
+	return &nftables.Rule{
+		Table:    b.table(table),
+		Exprs:    exprs,
+		UserData: userdata.AppendString(nil, userdata.TypeComment, nftablesRuleTag(table, chain, rulespec)),
+	}, nil
+}
+
+// nftablesRuleTag returns the comment identifying a rule. A hash is used as
+// nftables limits the length of comments.
+func nftablesRuleTag(table, chain string, rulespec []string) string {
+	sum := sha256.Sum256([]byte(table + "\x00" + chain + "\x00" + strings.Join(rulespec, "\x00")))
+	return nftablesRuleTagPrefix + hex.EncodeToString(sum[:16])
+}
+
+// nftablesExprs translates iptables arguments into nftables expressions. Only
+// the matches and targets used by the driver are supported; anything else is
+// an error rather than being silently dropped.
+func nftablesExprs(rulespec []string) ([]expr.Any, error) {
+	var (
+		exprs   []expr.Any
+		verdict []expr.Any
+		negate  bool
+	)
+
+	next := func(i *int) (string, error) {
+		*i++
+		if *i >= len(rulespec) {
+			return "", fmt.Errorf("missing value for %q", rulespec[*i-1])
+		}
+		return rulespec[*i], nil
+	}
+	op := func() expr.CmpOp {
+		if negate {
+			return expr.CmpOpNeq
+		}
+		return expr.CmpOpEq
+	}
+
+	for i := 0; i < len(rulespec); i++ {
+		arg := rulespec[i]
+
+		if arg == "!" {
+			negate = true
+			continue
+		}
+
+		switch arg {
+		case "-i", "-o":
+			v, err := next(&i)
+			if err != nil {
+				return nil, err
+			}
+			key := expr.MetaKeyIIFNAME
+			if arg == "-o" {
+				key = expr.MetaKeyOIFNAME
+			}
+			exprs = append(exprs,
+				&expr.Meta{Key: key, Register: 1},
+				&expr.Cmp{Op: op(), Register: 1, Data: ifnameBytes(v)},
+			)
+
+		case "-s", "-d":
+			v, err := next(&i)
+			if err != nil {
+				return nil, err
+			}
+			prefix, err := parseIPv4Prefix(v)
+			if err != nil {
+				return nil, err
+			}
+			offset := uint32(12)
+			if arg == "-d" {
+				offset = 16
+			}
+			exprs = append(exprs, &expr.Payload{
+				DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: 4,
+			})
+			if prefix.Bits() < 32 {
+				mask := prefixMask(prefix.Bits())
+				exprs = append(exprs, &expr.Bitwise{
+					SourceRegister: 1, DestRegister: 1, Len: 4, Mask: mask, Xor: make([]byte, 4),
+				})
+			}
+			exprs = append(exprs, &expr.Cmp{Op: op(), Register: 1, Data: prefix.Addr().AsSlice()})
+
+		case "-p":
+			v, err := next(&i)
+			if err != nil {
+				return nil, err
+			}
+			var proto byte
+			switch v {
+			case "tcp":
+				proto = unix.IPPROTO_TCP
+			case "udp":
+				proto = unix.IPPROTO_UDP
+			default:
+				return nil, fmt.Errorf("unsupported protocol %q", v)
+			}
+			exprs = append(exprs,
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: op(), Register: 1, Data: []byte{proto}},
+			)
+
+		case "-m":
+			// Match extensions are implied by the options which follow them.
+			v, err := next(&i)
+			if err != nil {
+				return nil, err
+			}
+			switch v {
+			case "tcp", "udp", "state", "conntrack":
+			default:
+				return nil, fmt.Errorf("unsupported match %q", v)
+			}
+
+		case "--dport", "--sport":
+			v, err := next(&i)
+			if err != nil {
+				return nil, err
+			}
+			offset := uint32(2)
+			if arg == "--sport" {
+				offset = 0
+			}
+			exprs = append(exprs, &expr.Payload{
+				DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: offset, Len: 2,
+			})
+			start, end, isRange := strings.Cut(v, ":")
+			from, err := portBytes(start)
+			if err != nil {
+				return nil, err
+			}
+			if !isRange {
+				exprs = append(exprs, &expr.Cmp{Op: op(), Register: 1, Data: from})
+				break
+			}
+			to, err := portBytes(end)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, &expr.Range{Op: op(), Register: 1, FromData: from, ToData: to})
+
+		case "--state", "--ctstate":
+			v, err := next(&i)
+			if err != nil {
+				return nil, err
+			}
+			var bits uint32
+			for _, state := range strings.Split(v, ",") {
+				switch state {
+				case "NEW":
+					bits |= expr.CtStateBitNEW
+				case "ESTABLISHED":
+					bits |= expr.CtStateBitESTABLISHED
+				case "RELATED":
+					bits |= expr.CtStateBitRELATED
+				case "INVALID":
+					bits |= expr.CtStateBitINVALID
+				case "UNTRACKED":
+					bits |= expr.CtStateBitUNTRACKED
+				default:
+					return nil, fmt.Errorf("unsupported conntrack state %q", state)
+				}
+			}
+			cmpOp := expr.CmpOpNeq
+			if negate {
+				cmpOp = expr.CmpOpEq
+			}
+			exprs = append(exprs,
+				&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+				&expr.Bitwise{
+					SourceRegister: 1, DestRegister: 1, Len: 4,
+					Mask: binaryutil.NativeEndian.PutUint32(bits), Xor: make([]byte, 4),
+				},
+				&expr.Cmp{Op: cmpOp, Register: 1, Data: make([]byte, 4)},
+			)
+
+		case "-j":
+			v, err := next(&i)
+			if err != nil {
+				return nil, err
+			}
+			switch v {
+			case "ACCEPT":
+				verdict = []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}}
+			case "DROP":
+				verdict = []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}}
+			case "RETURN":
+				verdict = []expr.Any{&expr.Verdict{Kind: expr.VerdictReturn}}
+			case "MASQUERADE":
+				verdict = []expr.Any{&expr.Masq{}}
+			case "DNAT", "SNAT":
+				// The target address follows as its own option.
+				verdict = nil
+				natType, opt := expr.NATTypeDestNAT, "--to-destination"
+				if v == "SNAT" {
+					natType, opt = expr.NATTypeSourceNAT, "--to-source"
+				}
+				if i+1 >= len(rulespec) || rulespec[i+1] != opt {
+					return nil, fmt.Errorf("%s target requires %s", v, opt)
+				}
+				i++
+				to, err := next(&i)
+				if err != nil {
+					return nil, err
+				}
+				natExprs, err := natTargetExprs(natType, to)
+				if err != nil {
+					return nil, err
+				}
+				verdict = natExprs
+			default:
+				if strings.HasPrefix(v, "-") {
+					return nil, fmt.Errorf("invalid target %q", v)
+				}
+				verdict = []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: v}}
+			}
+
+		default:
+			return nil, fmt.Errorf("unsupported option %q", arg)
+		}
+
+		negate = false
+	}
+
+	if negate {
+		return nil, fmt.Errorf("dangling negation")
+	}
+
+	return append(exprs, verdict...), nil
+}
+
+// natTargetExprs returns the expressions loading the "ADDR[:PORT]" target
+// into registers and performing the NAT.
+func natTargetExprs(natType expr.NATType, to string) ([]expr.Any, error) {
+	host, port, hasPort := strings.Cut(to, ":")
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !addr.Is4() {
+		return nil, fmt.Errorf("invalid NAT address %q", to)
+	}
+
+	exprs := []expr.Any{&expr.Immediate{Register: 1, Data: addr.AsSlice()}}
+	nat := &expr.NAT{Type: natType, Family: unix.NFPROTO_IPV4, RegAddrMin: 1}
+
+	if hasPort {
+		b, err := portBytes(port)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, &expr.Immediate{Register: 2, Data: b})
+		nat.RegProtoMin = 2
+		nat.Specified = true
+	}
+
+	return append(exprs, nat), nil
+}
+
+// ifnameBytes returns the comparison data for an interface name. A trailing
+// "+" is a wildcard, as with iptables, so only the prefix is compared.
+func ifnameBytes(name string) []byte {
+	if prefix, ok := strings.CutSuffix(name, "+"); ok {
+		return []byte(prefix)
+	}
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
+
+func parseIPv4Prefix(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		addr, addrErr := netip.ParseAddr(s)
+		if addrErr != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid address %q", s)
+		}
+		prefix = netip.PrefixFrom(addr, 32)
+	}
+	if !prefix.Addr().Is4() {
+		return netip.Prefix{}, fmt.Errorf("invalid address %q: only IPv4 is supported", s)
+	}
+	return prefix.Masked(), nil
+}
+
+func prefixMask(bits int) []byte {
+	mask := make([]byte, 4)
+	for i := 0; i < bits; i++ {
+		mask[i/8] |= 0x80 >> (i % 8)
+	}
+	return mask
+}
+
+func portBytes(s string) ([]byte, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", s)
+	}
+	return binaryutil.BigEndian.PutUint16(uint16(port)), nil
+}
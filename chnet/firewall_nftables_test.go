@@ -0,0 +1,85 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"github.com/shoenig/test/must"
+	"golang.org/x/sys/unix"
+)
+
+func Test_nftablesExprs(t *testing.T) {
+	exprs, err := nftablesExprs([]string{
+		"-d", "10.0.0.5", "-i", "eth0", "-p", "tcp", "-m", "tcp", "--dport", "8080",
+		"-j", "DNAT", "--to-destination", "192.168.254.10:80",
+	})
+	must.NoError(t, err)
+	must.Eq(t, []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{10, 0, 0, 5}},
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte("eth0\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")},
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x1f, 0x90}},
+		&expr.Immediate{Register: 1, Data: []byte{192, 168, 254, 10}},
+		&expr.Immediate{Register: 2, Data: []byte{0, 80}},
+		&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1, RegProtoMin: 2, Specified: true},
+	}, exprs)
+
+	exprs, err = nftablesExprs([]string{"!", "-s", "10.0.0.0/8", "-o", "tap+", "--dport", "8000:8100", "-j", "RETURN"})
+	must.NoError(t, err)
+	must.Eq(t, []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: []byte{255, 0, 0, 0}, Xor: []byte{0, 0, 0, 0}},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{10, 0, 0, 0}},
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte("tap")},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Range{Op: expr.CmpOpEq, Register: 1, FromData: []byte{0x1f, 0x40}, ToData: []byte{0x1f, 0xa4}},
+		&expr.Verdict{Kind: expr.VerdictReturn},
+	}, exprs)
+
+	// Jumps to driver chains and conntrack state.
+	exprs, err = nftablesExprs([]string{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "NOMAD_CH_FW"})
+	must.NoError(t, err)
+	must.Len(t, 4, exprs)
+	must.Eq(t, expr.Any(&expr.Verdict{Kind: expr.VerdictJump, Chain: "NOMAD_CH_FW"}), exprs[3])
+
+	// Every rule the driver builds for the per-VM firewall must translate.
+	chainRules, jumpRules, _, err := buildFirewallRules(testFirewallConfig(), "192.168.254.10", "EG", "IN")
+	must.NoError(t, err)
+	for _, rule := range append(chainRules, jumpRules...) {
+		_, err := nftablesExprs(rule[2:])
+		must.NoError(t, err, must.Sprint(rule))
+	}
+}
+
+func Test_nftablesExprs_Invalid(t *testing.T) {
+	for _, rulespec := range [][]string{
+		{"-p", "icmp", "-j", "ACCEPT"},
+		{"-m", "comment", "--comment", "x", "-j", "ACCEPT"},
+		{"-s", "fd00::/8", "-j", "DROP"},
+		{"-j", "DNAT"},
+		{"--dport", "70000", "-j", "ACCEPT"},
+		{"-d"},
+		{"-j", "ACCEPT", "!"},
+	} {
+		_, err := nftablesExprs(rulespec)
+		must.Error(t, err, must.Sprint(rulespec))
+	}
+}
+
+func Test_nftablesRuleTag(t *testing.T) {
+	tag := nftablesRuleTag("filter", "NOMAD_CH_FW", []string{"-d", "192.168.254.10", "-j", "ACCEPT"})
+	must.StrHasPrefix(t, nftablesRuleTagPrefix, tag)
+	must.Eq(t, tag, nftablesRuleTag("filter", "NOMAD_CH_FW", []string{"-d", "192.168.254.10", "-j", "ACCEPT"}))
+	must.NotEq(t, tag, nftablesRuleTag("filter", "NOMAD_CH_FW", []string{"-d", "192.168.254.11", "-j", "ACCEPT"}))
+	must.NotEq(t, tag, nftablesRuleTag("nat", "NOMAD_CH_FW", []string{"-d", "192.168.254.10", "-j", "ACCEPT"}))
+}
@@ -0,0 +1,156 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
+	"github.com/hashicorp/go-hclog"
+	"github.com/shoenig/test/must"
+)
+
+func testFirewallConfig() *net.NetworkInterfaceFirewallConfig {
+	return &net.NetworkInterfaceFirewallConfig{
+		EgressCIDRs:  []string{"10.0.0.0/8", "192.168.1.10"},
+		EgressPorts:  []string{"443/tcp", "8000-8100"},
+		IngressCIDRs: []string{"172.16.0.0/12"},
+	}
+}
+
+// fakeFirewall implements firewallBackend, tracking the rules within each
+// chain.
+type fakeFirewall struct {
+	chains map[string][]string
+}
+
+func newFakeFirewall() *fakeFirewall {
+	return &fakeFirewall{chains: map[string][]string{}}
+}
+
+func (f *fakeFirewall) Name() string { return "fake" }
+
+func (f *fakeFirewall) ChainExists(table, chain string) (bool, error) {
+	_, ok := f.chains[table+"/"+chain]
+	return ok, nil
+}
+
+func (f *fakeFirewall) NewChain(table, chain string) error {
+	f.chains[table+"/"+chain] = nil
+	return nil
+}
+
+func (f *fakeFirewall) ClearChain(table, chain string) error {
+	return f.NewChain(table, chain)
+}
+
+func (f *fakeFirewall) ClearAndDeleteChain(table, chain string) error {
+	delete(f.chains, table+"/"+chain)
+	return nil
+}
+
+func (f *fakeFirewall) Insert(table, chain string, _ int, rulespec ...string) error {
+	key := table + "/" + chain
+	f.chains[key] = append([]string{strings.Join(rulespec, " ")}, f.chains[key]...)
+	return nil
+}
+
+func (f *fakeFirewall) Append(table, chain string, rulespec ...string) error {
+	key := table + "/" + chain
+	f.chains[key] = append(f.chains[key], strings.Join(rulespec, " "))
+	return nil
+}
+
+func (f *fakeFirewall) DeleteIfExists(table, chain string, rulespec ...string) error {
+	key := table + "/" + chain
+	rules := f.chains[key]
+	for i, r := range rules {
+		if r == strings.Join(rulespec, " ") {
+			f.chains[key] = append(rules[:i], rules[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func TestController_configureFirewall(t *testing.T) {
+	fw := newFakeFirewall()
+	c := &Controller{logger: hclog.NewNullLogger(), firewall: fw}
+	cfg := &net.NetworkInterfaceBridgeConfig{Name: "br0", Firewall: testFirewallConfig()}
+
+	rules, chains, err := c.configureFirewall(c.firewall, "nomad-task-1", cfg, "192.168.254.10")
+	must.NoError(t, err)
+	must.Len(t, 2, rules)
+	must.Len(t, 2, chains)
+	must.Len(t, 2, fw.chains["filter/"+forwardIPTablesChainName])
+
+	// Teardown uses the backend recorded within the spec.
+	_, err = c.VMTerminatedTeardown(&net.VMTerminatedTeardownRequest{
+		TeardownSpec: &net.TeardownSpec{IPTablesRules: rules, IPTablesChains: chains, FirewallBackend: fw.Name()},
+	})
+	must.NoError(t, err)
+	must.Eq(t, map[string][]string{"filter/" + forwardIPTablesChainName: {}}, fw.chains)
+
+	// Without a backend, rules cannot be silently skipped.
+	c.firewall = nil
+	_, _, err = c.configureFirewall(c.firewall, "nomad-task-1", cfg, "192.168.254.10")
+	must.ErrorIs(t, err, errNoFirewallBackend)
+	_, err = c.configureIPTables(nil, &net.NetworkInterfaceBridgeConfig{Ports: []string{"http"}}, "192.168.254.10")
+	must.ErrorIs(t, err, errNoFirewallBackend)
+}
+
+func Test_buildFirewallRules(t *testing.T) {
+	chainRules, jumpRules, chains, err := buildFirewallRules(testFirewallConfig(), "192.168.254.10", "EG", "IN")
+	must.NoError(t, err)
+
+	must.Eq(t, [][]string{
+		{"filter", "NOMAD_CH_FW", "-s", "192.168.254.10", "-j", "EG"},
+		{"filter", "NOMAD_CH_FW", "-d", "192.168.254.10", "-j", "IN"},
+	}, jumpRules)
+	must.Eq(t, [][]string{{"filter", "EG"}, {"filter", "IN"}}, chains)
+
+	must.Eq(t, [][]string{
+		{"filter", "EG", "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "RETURN"},
+		{"filter", "EG", "-d", "10.0.0.0/8", "-p", "tcp", "-m", "tcp", "--dport", "443", "-j", "RETURN"},
+		{"filter", "EG", "-d", "10.0.0.0/8", "-p", "tcp", "-m", "tcp", "--dport", "8000:8100", "-j", "RETURN"},
+		{"filter", "EG", "-d", "10.0.0.0/8", "-p", "udp", "-m", "udp", "--dport", "8000:8100", "-j", "RETURN"},
+		{"filter", "EG", "-d", "192.168.1.10/32", "-p", "tcp", "-m", "tcp", "--dport", "443", "-j", "RETURN"},
+		{"filter", "EG", "-d", "192.168.1.10/32", "-p", "tcp", "-m", "tcp", "--dport", "8000:8100", "-j", "RETURN"},
+		{"filter", "EG", "-d", "192.168.1.10/32", "-p", "udp", "-m", "udp", "--dport", "8000:8100", "-j", "RETURN"},
+		{"filter", "EG", "-j", "DROP"},
+		{"filter", "IN", "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "RETURN"},
+		{"filter", "IN", "-s", "172.16.0.0/12", "-j", "RETURN"},
+		{"filter", "IN", "-j", "DROP"},
+	}, chainRules)
+}
+
+func Test_buildFirewallRules_Partial(t *testing.T) {
+	// Ports alone allow any destination.
+	chainRules, jumpRules, chains, err := buildFirewallRules(&net.NetworkInterfaceFirewallConfig{
+		EgressPorts: []string{"53/udp"},
+	}, "192.168.254.10", "EG", "IN")
+	must.NoError(t, err)
+	must.Len(t, 1, jumpRules)
+	must.Eq(t, [][]string{{"filter", "EG"}}, chains)
+	must.Eq(t, []string{"filter", "EG", "-p", "udp", "-m", "udp", "--dport", "53", "-j", "RETURN"}, chainRules[1])
+
+	// An empty block restricts nothing.
+	chainRules, jumpRules, chains, err = buildFirewallRules(&net.NetworkInterfaceFirewallConfig{},
+		"192.168.254.10", "EG", "IN")
+	must.NoError(t, err)
+	must.Nil(t, chainRules)
+	must.Nil(t, jumpRules)
+	must.Nil(t, chains)
+}
+
+func Test_firewallChainNames(t *testing.T) {
+	egress, ingress := firewallChainNames("nomad-task-0123456789abcdef")
+	must.StrHasPrefix(t, egressIPTablesChainPrefix, egress)
+	must.StrHasPrefix(t, ingressIPTablesChainPrefix, ingress)
+	must.LessEq(t, 28, len(egress))
+	must.LessEq(t, 28, len(ingress))
+}
@@ -0,0 +1,161 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
+	"github.com/hashicorp/nomad/client/lib/nsutil"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// ipForwardSysctl is the sysctl enabling IPv4 forwarding, which is set per
+	// network namespace.
+	ipForwardSysctl = "/proc/sys/net/ipv4/ip_forward"
+
+	// routeLocalnetSysctl is the sysctl allowing connections to loopback
+	// addresses to be routed out of the namespace once forwarded to the
+	// guest, which is also set per network namespace.
+	routeLocalnetSysctl = "/proc/sys/net/ipv4/conf/all/route_localnet"
+)
+
+// groupNetworkBuild configures the allocation network namespace of a VM
+// using group network mode. The namespace routes for the VM over its TAP:
+// traffic from the guest is masqueraded behind the namespace address, and
+// the task's ports arriving at the namespace are forwarded to the guest. The
+// host bridge, DHCP, DNS and isolation features do not apply, as the VM is
+// not attached to the host bridge.
+func (c *Controller) groupNetworkBuild(req *net.VMStartedBuildRequest) (*net.VMStartedBuildResponse, error) {
+	if len(req.GuestIPs) == 0 || req.GuestIPs[0] == "" || len(req.TAPs) == 0 || req.TAPs[0] == "" {
+		return nil, fmt.Errorf("virtualizer did not provide the address and TAP of VM %s", req.DomainName)
+	}
+	ip, tap := req.GuestIPs[0], req.TAPs[0]
+
+	var cfg *net.NetworkInterfaceBridgeConfig
+	if req.NetConfig != nil && len(*req.NetConfig) > 0 {
+		cfg = (*req.NetConfig)[0].Bridge
+	}
+
+	rules, err := groupNetworkRules(cfg, req.Resources, ip, tap)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &net.TeardownSpec{NetNS: req.NetNS}
+
+	err = nsutil.WithNetNSPath(req.NetNS, func(nsutil.NetNS) error {
+		fw, err := newFirewallBackend(c.logger, c.networkConfig.FirewallBackend)
+		if err != nil {
+			return fmt.Errorf("group network mode requires a firewall backend: %w", err)
+		}
+		spec.FirewallBackend = fw.Name()
+
+		if err := os.WriteFile(ipForwardSysctl, []byte("1"), 0644); err != nil {
+			return fmt.Errorf("failed to enable IP forwarding: %w", err)
+		}
+		if err := os.WriteFile(routeLocalnetSysctl, []byte("1"), 0644); err != nil {
+			return fmt.Errorf("failed to enable routing of loopback addresses: %w", err)
+		}
+		if err := c.ensureFirewallChains(fw); err != nil {
+			return err
+		}
+
+		for _, rule := range rules {
+			if err := fw.Append(rule[0], rule[1], rule[2:]...); err != nil {
+				c.deleteFirewall(fw, spec.IPTablesRules, nil)
+				return err
+			}
+			spec.IPTablesRules = append(spec.IPTablesRules, rule)
+		}
+
+		firewallRules, firewallChains, err := c.configureFirewall(fw, req.DomainName, cfg, ip)
+		if err != nil {
+			c.deleteFirewall(fw, spec.IPTablesRules, nil)
+			return fmt.Errorf("failed to configure firewall: %w", err)
+		}
+		spec.IPTablesRules = append(firewallRules, spec.IPTablesRules...)
+		spec.IPTablesChains = firewallChains
+
+		return nil
+	})
+	if err != nil {
+		var notExist nsutil.NSPathNotExistErr
+		if errors.As(err, &notExist) {
+			return nil, fmt.Errorf("network namespace %q does not exist", req.NetNS)
+		}
+		return nil, fmt.Errorf("failed to configure group network: %w", err)
+	}
+
+	c.logger.Info("successfully configured group network",
+		"vm", req.DomainName, "netns", req.NetNS, "ip", ip, "tap", tap)
+
+	return &net.VMStartedBuildResponse{
+		DriverNetwork: &drivers.DriverNetwork{
+			IP: ip,
+		},
+		TeardownSpec: spec,
+	}, nil
+}
+
+// groupNetworkRules returns the rules needed within the allocation network
+// namespace to route for the VM. The task's ports are forwarded to the guest
+// both as they arrive at the namespace, and as the other tasks of the group,
+// such as Consul Connect sidecars, connect to them on the loopback interface.
+func groupNetworkRules(cfg *net.NetworkInterfaceBridgeConfig, res *drivers.Resources, ip, tap string) ([][]string, error) {
+	rules := [][]string{
+		{iptablesNATTableName, "POSTROUTING", "-s", ip, "!", "-o", tap, "-j", "MASQUERADE"},
+	}
+
+	if cfg == nil || res == nil || len(cfg.Ports) == 0 {
+		return rules, nil
+	}
+
+	// Connections from the loopback interface forwarded to the guest are
+	// masqueraded, as the guest cannot reply to a loopback address.
+	rules = append(rules, []string{
+		iptablesNATTableName, "POSTROUTING", "-s", "127.0.0.0/8", "-o", tap, "-j", "MASQUERADE",
+	})
+
+	for _, port := range cfg.Ports {
+		reservedPort, ok := res.Ports.Get(port)
+		if !ok {
+			return nil, fmt.Errorf("failed to find reserved port %q", port)
+		}
+		to := strconv.Itoa(reservedPort.To)
+
+		// Nomad forwards the port from the host to the namespace for both
+		// protocols, which then forwards it on to the guest.
+		for _, proto := range []string{"tcp", "udp"} {
+			rules = append(rules,
+				[]string{
+					iptablesNATTableName, preroutingIPTablesChainName,
+					"!", "-i", tap,
+					"-p", proto, "-m", proto, "--dport", to,
+					"-j", "DNAT", "--to-destination", ip + ":" + to,
+				},
+				[]string{
+					iptablesNATTableName, "OUTPUT",
+					"-o", "lo",
+					"-p", proto, "-m", proto, "--dport", to,
+					"-j", "DNAT", "--to-destination", ip + ":" + to,
+				},
+				[]string{
+					iptablesFilterTableName, forwardIPTablesChainName,
+					"-d", ip,
+					"-p", proto, "-m", "state", "--state", "NEW", "-m", proto, "--dport", to,
+					"-j", "ACCEPT",
+				},
+			)
+		}
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,55 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	"testing"
+
+	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/shoenig/test/must"
+)
+
+func Test_groupNetworkRules(t *testing.T) {
+	res := &drivers.Resources{
+		Ports: &structs.AllocatedPorts{{Label: "http", Value: 25000, To: 8080}},
+	}
+
+	rules, err := groupNetworkRules(nil, res, "169.254.64.2", "tap-task")
+	must.NoError(t, err)
+	must.Eq(t, [][]string{
+		{"nat", "POSTROUTING", "-s", "169.254.64.2", "!", "-o", "tap-task", "-j", "MASQUERADE"},
+	}, rules)
+
+	rules, err = groupNetworkRules(&net.NetworkInterfaceBridgeConfig{Ports: []string{"http"}}, res, "169.254.64.2", "tap-task")
+	must.NoError(t, err)
+	must.Eq(t, [][]string{
+		{"nat", "POSTROUTING", "-s", "169.254.64.2", "!", "-o", "tap-task", "-j", "MASQUERADE"},
+		{"nat", "POSTROUTING", "-s", "127.0.0.0/8", "-o", "tap-task", "-j", "MASQUERADE"},
+		{"nat", "NOMAD_CH_PRT", "!", "-i", "tap-task", "-p", "tcp", "-m", "tcp", "--dport", "8080",
+			"-j", "DNAT", "--to-destination", "169.254.64.2:8080"},
+		{"nat", "OUTPUT", "-o", "lo", "-p", "tcp", "-m", "tcp", "--dport", "8080",
+			"-j", "DNAT", "--to-destination", "169.254.64.2:8080"},
+		{"filter", "NOMAD_CH_FW", "-d", "169.254.64.2", "-p", "tcp", "-m", "state", "--state", "NEW",
+			"-m", "tcp", "--dport", "8080", "-j", "ACCEPT"},
+		{"nat", "NOMAD_CH_PRT", "!", "-i", "tap-task", "-p", "udp", "-m", "udp", "--dport", "8080",
+			"-j", "DNAT", "--to-destination", "169.254.64.2:8080"},
+		{"nat", "OUTPUT", "-o", "lo", "-p", "udp", "-m", "udp", "--dport", "8080",
+			"-j", "DNAT", "--to-destination", "169.254.64.2:8080"},
+		{"filter", "NOMAD_CH_FW", "-d", "169.254.64.2", "-p", "udp", "-m", "state", "--state", "NEW",
+			"-m", "udp", "--dport", "8080", "-j", "ACCEPT"},
+	}, rules)
+
+	// The rules must be supported by the nftables backend too.
+	for _, rule := range rules {
+		_, err := nftablesExprs(rule[2:])
+		must.NoError(t, err)
+	}
+
+	_, err = groupNetworkRules(&net.NetworkInterfaceBridgeConfig{Ports: []string{"db"}}, res, "169.254.64.2", "tap-task")
+	must.ErrorContains(t, err, "failed to find reserved port")
+}
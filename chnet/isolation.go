@@ -0,0 +1,298 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	// antiSpoofEbtablesChainName is the ebtables chain holding the rules
+	// which stop guests sending frames using a MAC or IP address other than
+	// their own. It is jumped to from the INPUT and FORWARD chains, so it
+	// covers traffic to both the host and other bridge ports.
+	antiSpoofEbtablesChainName = "NOMAD_CH_SPF"
+
+	// isolationEbtablesChainName is the ebtables chain holding the rules
+	// which restrict traffic between VMs. It is jumped to from the FORWARD
+	// chain.
+	isolationEbtablesChainName = "NOMAD_CH_ISO"
+
+	// jobOutEbtablesChainPrefix and jobInEbtablesChainPrefix prefix the pair
+	// of chains created for each job using the same-job-only isolation policy.
+	// They list the job's TAP devices as permitted destinations and sources
+	// respectively, with a DROP policy for everything else.
+	jobOutEbtablesChainPrefix = "NOMAD_CH_JO_"
+	jobInEbtablesChainPrefix  = "NOMAD_CH_JI_"
+
+	// ebtablesFilterTableName is the name of the filter table within
+	// ebtables.
+	ebtablesFilterTableName = "filter"
+)
+
+// commandRunner is the function signature used to run host networking
+// commands such as ebtables and bridge, returning their combined output. It
+// is a field within the controller to aid testing.
+type commandRunner func(name string, args ...string) ([]byte, error)
+
+func runCommand(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// ebtables runs an ebtables command against the passed table.
+func (c *Controller) ebtables(table string, args ...string) ([]byte, error) {
+	out, err := c.commandRunner("ebtables", append([]string{"-t", table}, args...)...)
+	if err != nil {
+		return out, fmt.Errorf("ebtables %s: %w (output: %s)",
+			strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// ensureEbtables is responsible for ensuring the local host machine ebtables
+// are configured with the chains needed for VM isolation. ebtables is only
+// required by tasks which configure an isolation policy, so its absence is
+// not an error.
+func (c *Controller) ensureEbtables() error {
+	if _, err := exec.LookPath("ebtables"); err != nil {
+		c.logger.Warn("ebtables not available, network isolation will not be supported", "error", err)
+		return nil
+	}
+
+	hooks := map[string][]string{
+		antiSpoofEbtablesChainName: {"INPUT", "FORWARD"},
+		isolationEbtablesChainName: {"FORWARD"},
+	}
+
+	// The anti-spoofing chain must be jumped to first, so its RETURN rules
+	// cannot skip the isolation rules.
+	for _, chain := range []string{antiSpoofEbtablesChainName, isolationEbtablesChainName} {
+		if _, err := c.ensureEbtablesChain(chain, "RETURN"); err != nil {
+			return err
+		}
+		for _, hook := range hooks[chain] {
+			out, err := c.ebtables(ebtablesFilterTableName, "-L", hook)
+			if err != nil {
+				return err
+			}
+			if strings.Contains(string(out), "-j "+chain) {
+				continue
+			}
+			if _, err := c.ebtables(ebtablesFilterTableName, "-A", hook, "-j", chain); err != nil {
+				return err
+			}
+			c.logger.Info("successfully created ebtables chain", "name", chain, "hook", hook)
+		}
+	}
+
+	c.isolationSupported = true
+	return nil
+}
+
+// ensureEbtablesChain creates an ebtables chain with the passed policy if it
+// doesn't exist.
+func (c *Controller) ensureEbtablesChain(chain, policy string) (bool, error) {
+	if _, err := c.ebtables(ebtablesFilterTableName, "-L", chain); err == nil {
+		return false, nil
+	}
+	if _, err := c.ebtables(ebtablesFilterTableName, "-N", chain, "-P", policy); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// configureIsolation adds the ebtables rules which enforce the isolation
+// policy of the VM, along with its anti-spoofing rules. The returned rules
+// and chains should be stored within the teardown spec.
+func (c *Controller) configureIsolation(req *net.VMStartedBuildRequest,
+	cfg *net.NetworkInterfaceBridgeConfig, ip string) ([][]string, []string, error) {
+
+	if cfg == nil || cfg.Isolation == "" {
+		return nil, nil, nil
+	}
+	if !c.isolationSupported {
+		return nil, nil, errors.New("network isolation requires ebtables which is not available")
+	}
+	if len(req.TAPs) == 0 || req.TAPs[0] == "" || len(req.Hwaddrs) == 0 || req.Hwaddrs[0] == "" {
+		return nil, nil, errors.New("network isolation requires the VM TAP device and MAC address")
+	}
+
+	tap, mac := req.TAPs[0], req.Hwaddrs[0]
+
+	c.isolationLock.Lock()
+	defer c.isolationLock.Unlock()
+
+	var chains []string
+	rules := antiSpoofRules(tap, mac, ip)
+
+	switch cfg.Isolation {
+	case net.IsolationNone:
+		// Port isolation stops traffic with other isolated ports within the
+		// kernel bridge itself; the rules cover ports which are not.
+		if out, err := c.commandRunner("bridge", "link", "set", "dev", tap, "isolated", "on"); err != nil {
+			return nil, nil, fmt.Errorf("failed to isolate bridge port %s: %w (output: %s)",
+				tap, err, strings.TrimSpace(string(out)))
+		}
+		rules = append(rules, noneIsolationRules(tap, c.networkConfig.TAPPrefix)...)
+
+	case net.IsolationSameJob:
+		outChain, inChain := jobEbtablesChains(req.Namespace, req.JobID)
+		for _, chain := range []string{outChain, inChain} {
+			if _, err := c.ensureEbtablesChain(chain, "DROP"); err != nil {
+				return nil, nil, err
+			}
+		}
+		chains = []string{outChain, inChain}
+		rules = append(rules, sameJobIsolationRules(tap, c.networkConfig.TAPPrefix, outChain, inChain)...)
+	}
+
+	for i, rule := range rules {
+		if _, err := c.ebtables(rule[0], append([]string{"-A", rule[1]}, rule[2:]...)...); err != nil {
+			if delErr := c.deleteEbtablesRules(rules[:i], chains); delErr != nil {
+				c.logger.Error("failed to remove partial isolation rules, manual cleanup needed",
+					"tap", tap, "error", delErr)
+			}
+			return nil, nil, fmt.Errorf("failed to add isolation rule: %w", err)
+		}
+	}
+
+	c.logger.Debug("configured network isolation", "tap", tap, "policy", cfg.Isolation, "rules", len(rules))
+	return rules, chains, nil
+}
+
+// teardownIsolation deletes the rules and chains returned by
+// configureIsolation. Missing rules are not an error, so teardown can be
+// safely retried.
+func (c *Controller) teardownIsolation(rules [][]string, chains []string) error {
+	if len(rules) == 0 && len(chains) == 0 {
+		return nil
+	}
+
+	c.isolationLock.Lock()
+	defer c.isolationLock.Unlock()
+
+	return c.deleteEbtablesRules(rules, chains)
+}
+
+func (c *Controller) deleteEbtablesRules(rules [][]string, chains []string) error {
+	var mErr multierror.Error
+
+	for _, rule := range rules {
+		out, err := c.ebtables(rule[0], append([]string{"-D", rule[1]}, rule[2:]...)...)
+		if err != nil && !ebtablesNotFound(out) {
+			mErr.Errors = append(mErr.Errors,
+				fmt.Errorf("failed to delete ebtables %q entry in %q chain: %w", rule[0], rule[1], err))
+		}
+	}
+
+	// Job chains are shared by the job's VMs, so are only removed once the
+	// last member has gone.
+	for _, chain := range chains {
+		out, err := c.ebtables(ebtablesFilterTableName, "-L", chain)
+		if err != nil {
+			if !ebtablesNotFound(out) {
+				mErr.Errors = append(mErr.Errors, err)
+			}
+			continue
+		}
+		if ebtablesRuleCount(out) != 0 {
+			continue
+		}
+		if _, err := c.ebtables(ebtablesFilterTableName, "-X", chain); err != nil {
+			mErr.Errors = append(mErr.Errors, err)
+		}
+	}
+
+	return mErr.ErrorOrNil()
+}
+
+// antiSpoofRules returns the rules which drop frames from the TAP that do
+// not use the VM's MAC and IP address. DHCP requests and ARP probes, which
+// are sent before the guest has an address, are let through. Any other
+// protocol is dropped, including IPv6, as the VM is not assigned an IPv6
+// address its frames could be checked against, and VLAN tagged frames, whose
+// addresses ebtables cannot check.
+func antiSpoofRules(tap, mac, ip string) [][]string {
+	rule := func(args ...string) []string {
+		return append([]string{ebtablesFilterTableName, antiSpoofEbtablesChainName, "-i", tap}, args...)
+	}
+	return [][]string{
+		rule("!", "-s", mac, "-j", "DROP"),
+		rule("-p", "IPv4", "--ip-src", "0.0.0.0", "--ip-proto", "udp", "--ip-dport", "67", "-j", "RETURN"),
+		rule("-p", "IPv4", "!", "--ip-src", ip, "-j", "DROP"),
+		rule("-p", "IPv4", "-j", "RETURN"),
+		rule("-p", "ARP", "!", "--arp-mac-src", mac, "-j", "DROP"),
+		rule("-p", "ARP", "--arp-ip-src", "0.0.0.0", "-j", "RETURN"),
+		rule("-p", "ARP", "!", "--arp-ip-src", ip, "-j", "DROP"),
+		rule("-p", "ARP", "-j", "RETURN"),
+		rule("-j", "DROP"),
+	}
+}
+
+// noneIsolationRules returns the rules which drop all traffic between the
+// TAP and any other VM TAP.
+func noneIsolationRules(tap, tapPrefix string) [][]string {
+	return [][]string{
+		{ebtablesFilterTableName, isolationEbtablesChainName, "-i", tap, "-o", tapPrefix + "+", "-j", "DROP"},
+		{ebtablesFilterTableName, isolationEbtablesChainName, "-o", tap, "-i", tapPrefix + "+", "-j", "DROP"},
+	}
+}
+
+// sameJobIsolationRules returns the rules which send traffic between the TAP
+// and any other VM TAP through the job chains, and add the TAP to them.
+func sameJobIsolationRules(tap, tapPrefix, outChain, inChain string) [][]string {
+	return [][]string{
+		{ebtablesFilterTableName, outChain, "-o", tap, "-j", "RETURN"},
+		{ebtablesFilterTableName, inChain, "-i", tap, "-j", "RETURN"},
+		{ebtablesFilterTableName, isolationEbtablesChainName, "-i", tap, "-o", tapPrefix + "+", "-j", outChain},
+		{ebtablesFilterTableName, isolationEbtablesChainName, "-o", tap, "-i", tapPrefix + "+", "-j", inChain},
+	}
+}
+
+// jobEbtablesChains returns the names of the chain pair used for the job.
+// The names are derived from a hash, as ebtables limits chain names to 31
+// characters.
+func jobEbtablesChains(namespace, jobID string) (string, string) {
+	sum := sha256.Sum256([]byte(namespace + "/" + jobID))
+	id := hex.EncodeToString(sum[:])[:12]
+	return jobOutEbtablesChainPrefix + id, jobInEbtablesChainPrefix + id
+}
+
+// ebtablesRuleCount returns the number of rules within the output of an
+// ebtables list command for a single chain, which includes a header line of
+// the form "Bridge chain: NAME, entries: N, policy: DROP".
+func ebtablesRuleCount(out []byte) int {
+	for _, line := range strings.Split(string(out), "\n") {
+		_, rest, ok := strings.Cut(line, "entries: ")
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(rest, ",", 2)[0]))
+		if err == nil {
+			return n
+		}
+	}
+	return -1
+}
+
+// ebtablesNotFound identifies the ebtables errors for a rule or chain which
+// does not exist.
+func ebtablesNotFound(out []byte) bool {
+	s := strings.ToLower(string(out))
+	return strings.Contains(s, "does not exist") ||
+		strings.Contains(s, "doesn't exist") ||
+		strings.Contains(s, "bad rule") ||
+		strings.Contains(s, "no such file")
+}
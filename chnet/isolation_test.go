@@ -0,0 +1,172 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
+	"github.com/hashicorp/go-hclog"
+	"github.com/shoenig/test/must"
+)
+
+// fakeEbtables records the commands run by the controller and emulates just
+// enough of ebtables to track chains and their rules.
+type fakeEbtables struct {
+	cmds   []string
+	chains map[string][]string
+}
+
+func newFakeEbtables() *fakeEbtables {
+	return &fakeEbtables{chains: map[string][]string{}}
+}
+
+func (f *fakeEbtables) run(name string, args ...string) ([]byte, error) {
+	f.cmds = append(f.cmds, name+" "+strings.Join(args, " "))
+	if name != "ebtables" {
+		return nil, nil
+	}
+
+	// Strip the "-t table" prefix.
+	op, chain, rule := args[2], args[3], strings.Join(args[4:], " ")
+
+	rules, exists := f.chains[chain]
+	switch op {
+	case "-L":
+		if !exists {
+			return []byte("Chain '" + chain + "' doesn't exist."), errors.New("exit status 255")
+		}
+		return []byte("Bridge chain: " + chain + ", entries: " + strconv.Itoa(len(rules)) + ", policy: DROP\n"), nil
+	case "-N":
+		f.chains[chain] = nil
+	case "-A":
+		f.chains[chain] = append(rules, rule)
+	case "-D":
+		for i, r := range rules {
+			if r == rule {
+				f.chains[chain] = append(rules[:i], rules[i+1:]...)
+				return nil, nil
+			}
+		}
+		return []byte("Sorry, rule does not exist."), errors.New("exit status 255")
+	case "-X":
+		delete(f.chains, chain)
+	}
+	return nil, nil
+}
+
+func testIsolationController(f *fakeEbtables) *Controller {
+	return &Controller{
+		logger:             hclog.NewNullLogger(),
+		networkConfig:      &domain.Network{Bridge: "br0", TAPPrefix: "tap"},
+		commandRunner:      f.run,
+		isolationSupported: true,
+	}
+}
+
+func TestController_configureIsolation_SameJob(t *testing.T) {
+	f := newFakeEbtables()
+	c := testIsolationController(f)
+	cfg := &net.NetworkInterfaceBridgeConfig{Name: "br0", Isolation: net.IsolationSameJob}
+
+	req := func(tap, mac string) *net.VMStartedBuildRequest {
+		return &net.VMStartedBuildRequest{
+			TAPs:      []string{tap},
+			Hwaddrs:   []string{mac},
+			Namespace: "default",
+			JobID:     "web",
+		}
+	}
+
+	rules1, chains1, err := c.configureIsolation(req("tap1", "02:00:00:00:00:01"), cfg, "192.168.254.10")
+	must.NoError(t, err)
+	must.Len(t, 13, rules1)
+
+	outChain, inChain := jobEbtablesChains("default", "web")
+	must.Eq(t, []string{outChain, inChain}, chains1)
+	must.SliceContains(t, f.chains[antiSpoofEbtablesChainName], "-i tap1 ! -s 02:00:00:00:00:01 -j DROP")
+	must.SliceContains(t, f.chains[antiSpoofEbtablesChainName], "-i tap1 -p IPv4 ! --ip-src 192.168.254.10 -j DROP")
+	must.SliceContains(t, f.chains[isolationEbtablesChainName], "-i tap1 -o tap+ -j "+outChain)
+	must.Eq(t, []string{"-o tap1 -j RETURN"}, f.chains[outChain])
+
+	rules2, chains2, err := c.configureIsolation(req("tap2", "02:00:00:00:00:02"), cfg, "192.168.254.11")
+	must.NoError(t, err)
+	must.Eq(t, []string{"-o tap1 -j RETURN", "-o tap2 -j RETURN"}, f.chains[outChain])
+
+	// The job chains remain while any member is running.
+	must.NoError(t, c.teardownIsolation(rules1, chains1))
+	must.Eq(t, []string{"-o tap2 -j RETURN"}, f.chains[outChain])
+
+	must.NoError(t, c.teardownIsolation(rules2, chains2))
+	must.MapNotContainsKey(t, f.chains, outChain)
+	must.MapNotContainsKey(t, f.chains, inChain)
+	must.Len(t, 0, f.chains[antiSpoofEbtablesChainName])
+	must.Len(t, 0, f.chains[isolationEbtablesChainName])
+
+	// Teardown can be retried.
+	must.NoError(t, c.teardownIsolation(rules2, chains2))
+}
+
+func TestController_configureIsolation_None(t *testing.T) {
+	f := newFakeEbtables()
+	c := testIsolationController(f)
+
+	rules, chains, err := c.configureIsolation(&net.VMStartedBuildRequest{
+		TAPs:    []string{"tap1"},
+		Hwaddrs: []string{"02:00:00:00:00:01"},
+	}, &net.NetworkInterfaceBridgeConfig{Name: "br0", Isolation: net.IsolationNone}, "192.168.254.10")
+	must.NoError(t, err)
+	must.Nil(t, chains)
+	must.Len(t, 11, rules)
+	must.SliceContains(t, f.cmds, "bridge link set dev tap1 isolated on")
+	must.Eq(t, []string{"-i tap1 -o tap+ -j DROP", "-o tap1 -i tap+ -j DROP"}, f.chains[isolationEbtablesChainName])
+}
+
+func TestController_configureIsolation_Disabled(t *testing.T) {
+	f := newFakeEbtables()
+	c := testIsolationController(f)
+	req := &net.VMStartedBuildRequest{TAPs: []string{"tap1"}, Hwaddrs: []string{"02:00:00:00:00:01"}}
+
+	rules, chains, err := c.configureIsolation(req, &net.NetworkInterfaceBridgeConfig{Name: "br0"}, "192.168.254.10")
+	must.NoError(t, err)
+	must.Nil(t, rules)
+	must.Nil(t, chains)
+	must.Len(t, 0, f.cmds)
+
+	c.isolationSupported = false
+	_, _, err = c.configureIsolation(req,
+		&net.NetworkInterfaceBridgeConfig{Name: "br0", Isolation: net.IsolationAllowAll}, "192.168.254.10")
+	must.ErrorContains(t, err, "requires ebtables")
+}
+
+func TestAntiSpoofRules(t *testing.T) {
+	f := newFakeEbtables()
+	c := testIsolationController(f)
+
+	_, _, err := c.configureIsolation(&net.VMStartedBuildRequest{
+		TAPs:    []string{"tap1"},
+		Hwaddrs: []string{"02:00:00:00:00:01"},
+	}, &net.NetworkInterfaceBridgeConfig{Name: "br0", Isolation: net.IsolationAllowAll}, "192.168.254.10")
+	must.NoError(t, err)
+
+	// Only IPv4 and ARP from the VM's addresses are let through; anything
+	// else, such as IPv6 or VLAN tagged frames, reaches the final rule.
+	must.Eq(t, []string{
+		"-i tap1 ! -s 02:00:00:00:00:01 -j DROP",
+		"-i tap1 -p IPv4 --ip-src 0.0.0.0 --ip-proto udp --ip-dport 67 -j RETURN",
+		"-i tap1 -p IPv4 ! --ip-src 192.168.254.10 -j DROP",
+		"-i tap1 -p IPv4 -j RETURN",
+		"-i tap1 -p ARP ! --arp-mac-src 02:00:00:00:00:01 -j DROP",
+		"-i tap1 -p ARP --arp-ip-src 0.0.0.0 -j RETURN",
+		"-i tap1 -p ARP ! --arp-ip-src 192.168.254.10 -j DROP",
+		"-i tap1 -p ARP -j RETURN",
+		"-i tap1 -j DROP",
+	}, f.chains[antiSpoofEbtablesChainName])
+}
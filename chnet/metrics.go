@@ -0,0 +1,54 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsNamespace prefixes the names of all the metrics of the driver.
+const metricsNamespace = "nomad_driver_ch"
+
+var (
+	// portProxyLabels are the labels of the port forwarding proxy metrics.
+	portProxyLabels = []string{"protocol", "listen"}
+
+	portProxyConnectionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "port_proxy", "connections_total"),
+		"Connections, or UDP sessions, forwarded by a port forwarding proxy.",
+		portProxyLabels, nil,
+	)
+	portProxyRejectedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "port_proxy", "rejected_total"),
+		"Connections and datagrams rejected by a port forwarding proxy as their source is not allowed.",
+		portProxyLabels, nil,
+	)
+	portProxyBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "port_proxy", "bytes_total"),
+		"Bytes forwarded by a port forwarding proxy, to the VM (in) and from it (out).",
+		append(portProxyLabels[:len(portProxyLabels):len(portProxyLabels)], "direction"), nil,
+	)
+)
+
+// Describe implements prometheus.Collector.
+func (c *Controller) Describe(ch chan<- *prometheus.Desc) {
+	ch <- portProxyConnectionsDesc
+	ch <- portProxyRejectedDesc
+	ch <- portProxyBytesDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *Controller) Collect(ch chan<- prometheus.Metric) {
+	for key, stats := range c.portProxyStats() {
+		protocol, listen, _ := strings.Cut(key, "/")
+		ch <- prometheus.MustNewConstMetric(portProxyConnectionsDesc, prometheus.CounterValue, float64(stats.Connections), protocol, listen)
+		ch <- prometheus.MustNewConstMetric(portProxyRejectedDesc, prometheus.CounterValue, float64(stats.Rejected), protocol, listen)
+		ch <- prometheus.MustNewConstMetric(portProxyBytesDesc, prometheus.CounterValue, float64(stats.BytesIn), protocol, listen, "in")
+		ch <- prometheus.MustNewConstMetric(portProxyBytesDesc, prometheus.CounterValue, float64(stats.BytesOut), protocol, listen, "out")
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	"fmt"
+	"net/netip"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
+	"github.com/hashicorp/nomad/plugins/shared/structs"
+)
+
+// fingerprintNamedNetworks populates the attributes of each named network,
+// keyed by the network name.
+func (c *Controller) fingerprintNamedNetworks(attr map[string]*structs.Attribute) {
+	for _, network := range c.networks {
+		prefix := net.FingerprintAttributeKeyPrefix + network.Name
+		attr[prefix+".state"] = structs.NewStringAttribute(c.getBridgeState(network.Bridge))
+		attr[prefix+".bridge_name"] = structs.NewStringAttribute(network.Bridge)
+		attr[prefix+".nat"] = structs.NewBoolAttribute(network.NAT)
+	}
+}
+
+// ensureNAT masquerades the traffic of the named networks with NAT enabled
+// as it leaves the host, so their VMs can reach other networks. Existing
+// rules are replaced, so it is safe to call multiple times.
+func (c *Controller) ensureNAT() error {
+	for _, network := range c.networks {
+		if !network.NAT {
+			continue
+		}
+		if c.firewall == nil {
+			return fmt.Errorf("network %q requires a firewall backend for NAT: %w", network.Name, errNoFirewallBackend)
+		}
+
+		rule, err := natRule(network)
+		if err != nil {
+			return fmt.Errorf("failed to configure NAT for network %q: %w", network.Name, err)
+		}
+		if err := c.firewall.DeleteIfExists(rule[0], rule[1], rule[2:]...); err != nil {
+			return fmt.Errorf("failed to configure NAT for network %q: %w", network.Name, err)
+		}
+		if err := c.firewall.Append(rule[0], rule[1], rule[2:]...); err != nil {
+			return fmt.Errorf("failed to configure NAT for network %q: %w", network.Name, err)
+		}
+
+		c.logger.Info("configured NAT for network",
+			"network", network.Name, "bridge", network.Bridge, "subnet", rule[4])
+	}
+	return nil
+}
+
+// ensureGroupNAT masquerades the traffic of the group network of an
+// allocation as it leaves the host. The rule is shared by the VMs of the
+// allocation, so an existing rule is replaced.
+func (c *Controller) ensureGroupNAT(network *net.GroupNetwork) error {
+	if c.firewall == nil {
+		return fmt.Errorf("group network of allocation %s requires a firewall backend for NAT: %w",
+			network.AllocID, errNoFirewallBackend)
+	}
+
+	rule, err := natRule(groupNATNetwork(network))
+	if err != nil {
+		return fmt.Errorf("failed to configure NAT for group network of allocation %s: %w", network.AllocID, err)
+	}
+	if err := c.firewall.DeleteIfExists(rule[0], rule[1], rule[2:]...); err != nil {
+		return fmt.Errorf("failed to configure NAT for group network of allocation %s: %w", network.AllocID, err)
+	}
+	if err := c.firewall.Append(rule[0], rule[1], rule[2:]...); err != nil {
+		return fmt.Errorf("failed to configure NAT for group network of allocation %s: %w", network.AllocID, err)
+	}
+	return nil
+}
+
+// teardownGroupNAT deletes the NAT rule of a group network once the
+// virtualizer has removed its bridge, which happens when the last VM of the
+// allocation is destroyed. The rule must be deleted by the backend which
+// created it.
+func (c *Controller) teardownGroupNAT(network *net.GroupNetwork, backend string) error {
+	if network == nil || c.bridgeExists(network.Bridge) {
+		return nil
+	}
+
+	rule, err := natRule(groupNATNetwork(network))
+	if err != nil {
+		return fmt.Errorf("failed to delete NAT for group network of allocation %s: %w", network.AllocID, err)
+	}
+	fw, err := c.firewallBackendFor(backend)
+	if err != nil {
+		return fmt.Errorf("failed to initialize firewall backend: %w", err)
+	}
+	if err := fw.DeleteIfExists(rule[0], rule[1], rule[2:]...); err != nil {
+		return fmt.Errorf("failed to delete NAT for group network of allocation %s: %w", network.AllocID, err)
+	}
+
+	c.logger.Info("removed NAT for group network", "alloc_id", network.AllocID, "bridge", network.Bridge)
+	return nil
+}
+
+// groupNATNetwork returns the group network as a named network with NAT
+// enabled.
+func groupNATNetwork(network *net.GroupNetwork) domain.NamedNetwork {
+	return domain.NamedNetwork{
+		Name:       network.AllocID,
+		Bridge:     network.Bridge,
+		SubnetCIDR: network.SubnetCIDR,
+		NAT:        true,
+	}
+}
+
+// natRule returns the rule masquerading traffic from the subnet of a network
+// which leaves through any interface other than its bridge.
+func natRule(network domain.NamedNetwork) ([]string, error) {
+	subnet, err := netip.ParsePrefix(network.SubnetCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet_cidr %q: %w", network.SubnetCIDR, err)
+	}
+	return []string{
+		iptablesNATTableName, "POSTROUTING",
+		"-s", subnet.Masked().String(),
+		"!", "-o", network.Bridge,
+		"-j", "MASQUERADE",
+	}, nil
+}
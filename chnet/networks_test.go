@@ -0,0 +1,68 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	"testing"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/shared/structs"
+	"github.com/shoenig/test/must"
+)
+
+func TestController_NamedNetworks(t *testing.T) {
+	fw := newFakeFirewall()
+	c := &Controller{
+		logger:        hclog.NewNullLogger(),
+		networkConfig: &domain.Network{Bridge: "br0"},
+		networks: domain.NamedNetworks{
+			{Name: "dmz", Bridge: "br-dmz", SubnetCIDR: "10.20.0.1/24", NAT: true},
+			{Name: "lab", Bridge: "br-lab", SubnetCIDR: "10.30.0.0/24"},
+		},
+		firewall: fw,
+	}
+
+	// The rule is replaced, not duplicated, when initialized again.
+	must.NoError(t, c.ensureNAT())
+	must.NoError(t, c.ensureNAT())
+	must.Eq(t, []string{"-s 10.20.0.0/24 ! -o br-dmz -j MASQUERADE"}, fw.chains["nat/POSTROUTING"])
+
+	attr := map[string]*structs.Attribute{}
+	c.fingerprintNamedNetworks(attr)
+	must.Eq(t, structs.NewStringAttribute(NetworkStateInactive), attr[net.FingerprintAttributeKeyPrefix+"dmz.state"])
+	must.Eq(t, structs.NewStringAttribute("br-lab"), attr[net.FingerprintAttributeKeyPrefix+"lab.bridge_name"])
+	must.Eq(t, structs.NewBoolAttribute(true), attr[net.FingerprintAttributeKeyPrefix+"dmz.nat"])
+
+	// Without a backend, NAT cannot be silently skipped.
+	c.firewall = nil
+	must.ErrorIs(t, c.ensureNAT(), errNoFirewallBackend)
+}
+
+func TestController_GroupNetworkNAT(t *testing.T) {
+	fw := newFakeFirewall()
+	c := &Controller{
+		logger:        hclog.NewNullLogger(),
+		networkConfig: &domain.Network{Bridge: "br0"},
+		firewall:      fw,
+	}
+
+	network := &net.GroupNetwork{AllocID: "a1", Bridge: "chg-missing", SubnetCIDR: "10.200.1.0/24"}
+
+	// Each VM of the allocation ensures the shared rule exists.
+	must.NoError(t, c.ensureGroupNAT(network))
+	must.NoError(t, c.ensureGroupNAT(network))
+	must.Eq(t, []string{"-s 10.200.1.0/24 ! -o chg-missing -j MASQUERADE"}, fw.chains["nat/POSTROUTING"])
+
+	// The rule is deleted once the bridge has been removed.
+	must.NoError(t, c.teardownGroupNAT(network, fw.Name()))
+	must.SliceEmpty(t, fw.chains["nat/POSTROUTING"])
+	must.NoError(t, c.teardownGroupNAT(nil, fw.Name()))
+
+	c.firewall = nil
+	must.ErrorIs(t, c.ensureGroupNAT(network), errNoFirewallBackend)
+}
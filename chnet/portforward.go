@@ -0,0 +1,227 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	"fmt"
+	stdnet "net"
+	"net/netip"
+	"strconv"
+	"sync"
+
+	"github.com/ccheshirecat/nomad-driver-ch/chnet/proxy"
+	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+const (
+	// PortForwardingAuto uses kernel NAT when a firewall backend is available
+	// and the userspace proxy otherwise.
+	PortForwardingAuto = "auto"
+
+	// PortForwardingNAT forwards ports using firewall NAT rules.
+	PortForwardingNAT = "nat"
+
+	// PortForwardingProxy forwards ports using the userspace proxy.
+	PortForwardingProxy = "proxy"
+)
+
+// ensurePortForwarding validates the configured port forwarding mode against
+// the firewall backend selected during Init.
+func (c *Controller) ensurePortForwarding() error {
+	switch c.networkConfig.PortForwarding {
+	case "", PortForwardingAuto, PortForwardingProxy:
+	case PortForwardingNAT:
+		if c.firewall == nil {
+			return fmt.Errorf("port forwarding mode %q requires a firewall backend: %w",
+				PortForwardingNAT, errNoFirewallBackend)
+		}
+	default:
+		return fmt.Errorf("invalid port forwarding mode %q: must be %q, %q or %q",
+			c.networkConfig.PortForwarding, PortForwardingAuto, PortForwardingNAT, PortForwardingProxy)
+	}
+
+	c.logger.Info("using port forwarding mode", "mode", c.portForwardingMode())
+	return nil
+}
+
+// portForwardingMode returns the mode used to forward ports for new VMs.
+func (c *Controller) portForwardingMode() string {
+	switch c.networkConfig.PortForwarding {
+	case PortForwardingNAT, PortForwardingProxy:
+		return c.networkConfig.PortForwarding
+	}
+	if c.firewall != nil {
+		return PortForwardingNAT
+	}
+	return PortForwardingProxy
+}
+
+// configurePortProxies starts a userspace TCP and UDP proxy for each port
+// configured within the network interface. The proxies listen on the
+// addresses reserved by Nomad, and honour the ingress restrictions of the
+// firewall configuration, as proxied traffic does not traverse the forward
+// chain.
+//
+// The returned proxies should be stored within the teardown spec.
+func (c *Controller) configurePortProxies(res *drivers.Resources, cfg *net.NetworkInterfaceBridgeConfig, ip string) ([]net.PortProxy, error) {
+	if cfg == nil || len(cfg.Ports) == 0 {
+		return nil, nil
+	}
+
+	var allowed []string
+	if cfg.Firewall != nil {
+		for _, cidr := range cfg.Firewall.IngressCIDRs {
+			prefix, err := net.ParseFirewallCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			allowed = append(allowed, prefix.String())
+		}
+	}
+
+	var proxies []net.PortProxy
+
+	for _, port := range cfg.Ports {
+		reservedPort, ok := res.Ports.Get(port)
+		if !ok {
+			c.logger.Error("failed to find reserved port", "port", port)
+			continue
+		}
+
+		for _, protocol := range []string{proxy.ProtocolTCP, proxy.ProtocolUDP} {
+			spec := net.PortProxy{
+				Protocol:       protocol,
+				ListenAddr:     stdnet.JoinHostPort(reservedPort.HostIP, strconv.Itoa(reservedPort.Value)),
+				TargetAddr:     stdnet.JoinHostPort(ip, strconv.Itoa(reservedPort.To)),
+				AllowedSources: allowed,
+			}
+			if err := c.startPortProxy(spec); err != nil {
+				_ = c.stopPortProxies(proxies)
+				return nil, err
+			}
+			proxies = append(proxies, spec)
+		}
+
+		c.logger.Info("successfully configured port forwarding proxy",
+			"src_ip", reservedPort.HostIP, "src_port", reservedPort.Value,
+			"dst_ip", ip, "dst_port", reservedPort.To, "port_label", port)
+	}
+
+	return proxies, nil
+}
+
+// portProxyKey returns the key identifying a proxy, which is unique as only
+// one socket can listen on each address.
+func portProxyKey(spec net.PortProxy) string {
+	return spec.Protocol + "/" + spec.ListenAddr
+}
+
+// startPortProxy starts the proxy described by the spec, unless it is
+// already running. An error is returned if a proxy is already running on the
+// listen address for another target.
+func (c *Controller) startPortProxy(spec net.PortProxy) error {
+	var allowed []netip.Prefix
+	for _, cidr := range spec.AllowedSources {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid allowed source %q: %w", cidr, err)
+		}
+		allowed = append(allowed, prefix)
+	}
+
+	c.proxyLock.Lock()
+	defer c.proxyLock.Unlock()
+
+	key := portProxyKey(spec)
+	if p, ok := c.proxies[key]; ok {
+		if target := p.TargetAddr(); target != spec.TargetAddr {
+			return fmt.Errorf("port proxy on %s %s already forwards to %s",
+				spec.Protocol, spec.ListenAddr, target)
+		}
+		return nil
+	}
+
+	p, err := proxy.New(c.logger.Named("proxy"), proxy.Config{
+		Protocol:       spec.Protocol,
+		ListenAddr:     spec.ListenAddr,
+		TargetAddr:     spec.TargetAddr,
+		AllowedSources: allowed,
+	})
+	if err != nil {
+		return err
+	}
+	if err := p.Start(); err != nil {
+		return err
+	}
+
+	if c.proxies == nil {
+		c.proxies = make(map[string]*proxy.Proxy)
+	}
+	c.proxies[key] = p
+	return nil
+}
+
+// stopPortProxies closes the proxies described by the specs, draining their
+// connections concurrently. Proxies which are not running are ignored.
+func (c *Controller) stopPortProxies(specs []net.PortProxy) error {
+	if len(specs) == 0 {
+		return nil
+	}
+
+	c.proxyLock.Lock()
+	stopping := make(map[string]*proxy.Proxy)
+	for _, spec := range specs {
+		key := portProxyKey(spec)
+		if p, ok := c.proxies[key]; ok {
+			stopping[key] = p
+			delete(c.proxies, key)
+		}
+	}
+	c.proxyLock.Unlock()
+
+	var (
+		wg   sync.WaitGroup
+		lock sync.Mutex
+		mErr multierror.Error
+	)
+
+	for key, p := range stopping {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := p.Close()
+			stats := p.Stats()
+			c.logger.Debug("stopped port forwarding proxy", "proxy", key,
+				"connections", stats.Connections, "rejected", stats.Rejected,
+				"bytes_in", stats.BytesIn, "bytes_out", stats.BytesOut)
+
+			if err != nil {
+				lock.Lock()
+				mErr.Errors = append(mErr.Errors, fmt.Errorf("failed to close proxy %q: %w", key, err))
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return mErr.ErrorOrNil()
+}
+
+// portProxyStats returns the counters of each running port forwarding
+// proxy, keyed by protocol and listen address.
+func (c *Controller) portProxyStats() map[string]proxy.Stats {
+	c.proxyLock.Lock()
+	defer c.proxyLock.Unlock()
+
+	stats := make(map[string]proxy.Stats, len(c.proxies))
+	for key, p := range c.proxies {
+		stats[key] = p.Stats()
+	}
+	return stats
+}
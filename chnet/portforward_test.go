@@ -0,0 +1,156 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	"bufio"
+	"io"
+	stdnet "net"
+	"strconv"
+	"testing"
+	"time"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/shoenig/test/must"
+	"github.com/shoenig/test/wait"
+)
+
+// freePort returns a localhost TCP port which is not in use.
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	must.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*stdnet.TCPAddr).Port
+}
+
+func TestController_configurePortProxies(t *testing.T) {
+	// The echo server stands in for the guest.
+	guest, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	must.NoError(t, err)
+	defer guest.Close()
+	go func() {
+		for {
+			conn, err := guest.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	c := &Controller{
+		logger:        hclog.NewNullLogger(),
+		networkConfig: &domain.Network{PortForwarding: PortForwardingAuto},
+	}
+	must.Eq(t, PortForwardingProxy, c.portForwardingMode())
+
+	hostPort := freePort(t)
+	res := &drivers.Resources{
+		Ports: &structs.AllocatedPorts{{
+			Label:  "http",
+			Value:  hostPort,
+			To:     guest.Addr().(*stdnet.TCPAddr).Port,
+			HostIP: "127.0.0.1",
+		}},
+	}
+
+	proxies, err := c.configurePortProxies(res, &net.NetworkInterfaceBridgeConfig{Ports: []string{"http"}}, "127.0.0.1")
+	must.NoError(t, err)
+	must.Len(t, 2, proxies)
+	must.Eq(t, "127.0.0.1:"+strconv.Itoa(hostPort), proxies[0].ListenAddr)
+
+	conn, err := stdnet.Dial("tcp", proxies[0].ListenAddr)
+	must.NoError(t, err)
+	_, err = conn.Write([]byte("hello\n"))
+	must.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	must.NoError(t, err)
+	must.Eq(t, "hello\n", line)
+	must.NoError(t, conn.Close())
+
+	must.Wait(t, wait.InitialSuccess(wait.BoolFunc(func() bool {
+		return c.portProxyStats()["tcp/"+proxies[0].ListenAddr].BytesIn == 6
+	}), wait.Timeout(time.Second)))
+
+	// The counters of each proxy are exported as metrics.
+	registry := prometheus.NewRegistry()
+	must.NoError(t, registry.Register(c))
+	families, err := registry.Gather()
+	must.NoError(t, err)
+	metrics := make(map[string]int)
+	for _, family := range families {
+		metrics[family.GetName()] = len(family.GetMetric())
+	}
+	must.Eq(t, map[string]int{
+		"nomad_driver_ch_port_proxy_connections_total": 2,
+		"nomad_driver_ch_port_proxy_rejected_total":    2,
+		"nomad_driver_ch_port_proxy_bytes_total":       4,
+	}, metrics)
+
+	// Teardown stops the proxies and may be retried.
+	spec := &net.TeardownSpec{PortProxies: proxies}
+	_, err = c.VMTerminatedTeardown(&net.VMTerminatedTeardownRequest{TeardownSpec: spec})
+	must.NoError(t, err)
+	must.MapEmpty(t, c.portProxyStats())
+	_, err = c.VMTerminatedTeardown(&net.VMTerminatedTeardownRequest{TeardownSpec: spec})
+	must.NoError(t, err)
+
+	// Recovery restarts the proxies from the spec.
+	_, err = c.VMRecovered(&net.VMRecoveredRequest{TeardownSpec: spec})
+	must.NoError(t, err)
+	must.MapLen(t, 2, c.portProxyStats())
+	must.NoError(t, c.stopPortProxies(proxies))
+}
+
+func TestController_startPortProxy(t *testing.T) {
+	c := &Controller{logger: hclog.NewNullLogger()}
+
+	spec := net.PortProxy{
+		Protocol:   "tcp",
+		ListenAddr: "127.0.0.1:" + strconv.Itoa(freePort(t)),
+		TargetAddr: "192.168.1.10:8080",
+	}
+	must.NoError(t, c.startPortProxy(spec))
+	defer c.stopPortProxies([]net.PortProxy{spec})
+
+	// Starting the same proxy again is a no-op, as on recovery.
+	must.NoError(t, c.startPortProxy(spec))
+	must.MapLen(t, 1, c.portProxyStats())
+
+	// Another target may not take over the listen address.
+	other := spec
+	other.TargetAddr = "192.168.1.11:8080"
+	must.ErrorContains(t, c.startPortProxy(other), "already forwards to 192.168.1.10:8080")
+	must.MapLen(t, 1, c.portProxyStats())
+}
+
+func TestController_ensurePortForwarding(t *testing.T) {
+	c := &Controller{logger: hclog.NewNullLogger(), networkConfig: &domain.Network{}}
+
+	c.networkConfig.PortForwarding = PortForwardingNAT
+	must.ErrorIs(t, c.ensurePortForwarding(), errNoFirewallBackend)
+
+	c.networkConfig.PortForwarding = "socks"
+	must.ErrorContains(t, c.ensurePortForwarding(), "invalid port forwarding mode")
+
+	c.firewall = newFakeFirewall()
+	c.networkConfig.PortForwarding = PortForwardingNAT
+	must.NoError(t, c.ensurePortForwarding())
+
+	c.networkConfig.PortForwarding = PortForwardingAuto
+	must.Eq(t, PortForwardingNAT, c.portForwardingMode())
+	c.networkConfig.PortForwarding = PortForwardingProxy
+	must.Eq(t, PortForwardingProxy, c.portForwardingMode())
+}
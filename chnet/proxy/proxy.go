@@ -0,0 +1,445 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+// Package proxy implements a userspace TCP and UDP port forwarder. It is used
+// to expose VM ports on hosts where the kernel NAT rules normally used cannot
+// be configured, such as rootless or otherwise restricted environments.
+// Forwarders are started and stopped by the network controller as VMs start
+// and stop; nothing is persisted.
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	stdnet "net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// ProtocolTCP and ProtocolUDP are the supported protocols.
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+
+	// DefaultDrainTimeout is the time open TCP connections are given to
+	// finish once the proxy is closed, before they are forcibly closed.
+	DefaultDrainTimeout = 5 * time.Second
+
+	// dialTimeout is the time allowed to connect to the target.
+	dialTimeout = 5 * time.Second
+
+	// udpSessionTimeout is the time a UDP session is kept without traffic
+	// being received from the target.
+	udpSessionTimeout = 60 * time.Second
+
+	// udpBufferSize is large enough to hold any UDP datagram.
+	udpBufferSize = 65535
+)
+
+// Config is the configuration of a proxy.
+type Config struct {
+
+	// Protocol is either ProtocolTCP or ProtocolUDP.
+	Protocol string
+
+	// ListenAddr is the host:port address the proxy listens on.
+	ListenAddr string
+
+	// TargetAddr is the host:port address traffic is forwarded to.
+	TargetAddr string
+
+	// AllowedSources restricts the client addresses which may use the proxy.
+	// When empty, all clients are allowed.
+	AllowedSources []netip.Prefix
+
+	// DrainTimeout overrides DefaultDrainTimeout when non-zero.
+	DrainTimeout time.Duration
+}
+
+// Stats are the counters of a proxy.
+type Stats struct {
+
+	// Connections is the number of TCP connections accepted or UDP sessions
+	// created.
+	Connections uint64
+
+	// Rejected is the number of TCP connections or UDP datagrams refused as
+	// the client was not allowed.
+	Rejected uint64
+
+	// BytesIn is the number of bytes forwarded from clients to the target,
+	// and BytesOut the number forwarded from the target back to clients.
+	// Bytes of TCP connections are counted once each direction is closed.
+	BytesIn  uint64
+	BytesOut uint64
+}
+
+// Proxy forwards traffic for a single listen address. It is safe for
+// concurrent use.
+type Proxy struct {
+	logger hclog.Logger
+	cfg    Config
+
+	listener   stdnet.Listener
+	packetConn stdnet.PacketConn
+
+	connections atomic.Uint64
+	rejected    atomic.Uint64
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+
+	lock     sync.Mutex
+	closed   bool
+	conns    map[stdnet.Conn]struct{}
+	sessions map[string]*udpSession
+
+	// wg tracks the TCP connection handlers, which are waited on when
+	// draining.
+	wg sync.WaitGroup
+}
+
+// New validates the configuration and returns a proxy ready to be started
+// via Start.
+func New(logger hclog.Logger, cfg Config) (*Proxy, error) {
+	if cfg.Protocol != ProtocolTCP && cfg.Protocol != ProtocolUDP {
+		return nil, fmt.Errorf("proxy: unsupported protocol %q", cfg.Protocol)
+	}
+	if _, err := netip.ParseAddrPort(cfg.ListenAddr); err != nil {
+		return nil, fmt.Errorf("proxy: invalid listen address %q: %w", cfg.ListenAddr, err)
+	}
+	if _, err := netip.ParseAddrPort(cfg.TargetAddr); err != nil {
+		return nil, fmt.Errorf("proxy: invalid target address %q: %w", cfg.TargetAddr, err)
+	}
+	if cfg.DrainTimeout == 0 {
+		cfg.DrainTimeout = DefaultDrainTimeout
+	}
+
+	return &Proxy{
+		logger:   logger.With("protocol", cfg.Protocol, "listen", cfg.ListenAddr, "target", cfg.TargetAddr),
+		cfg:      cfg,
+		conns:    make(map[stdnet.Conn]struct{}),
+		sessions: make(map[string]*udpSession),
+	}, nil
+}
+
+// Start opens the listening socket and forwards traffic in the background
+// until Close is called.
+func (p *Proxy) Start() error {
+	switch p.cfg.Protocol {
+	case ProtocolTCP:
+		l, err := stdnet.Listen("tcp", p.cfg.ListenAddr)
+		if err != nil {
+			return fmt.Errorf("proxy: failed to listen: %w", err)
+		}
+		p.listener = l
+		go p.serveTCP()
+	case ProtocolUDP:
+		pc, err := stdnet.ListenPacket("udp", p.cfg.ListenAddr)
+		if err != nil {
+			return fmt.Errorf("proxy: failed to listen: %w", err)
+		}
+		p.packetConn = pc
+		go p.serveUDP()
+	}
+	return nil
+}
+
+// Addr returns the address the proxy is listening on, which is useful when
+// the configured port was zero.
+func (p *Proxy) Addr() stdnet.Addr {
+	if p.listener != nil {
+		return p.listener.Addr()
+	}
+	if p.packetConn != nil {
+		return p.packetConn.LocalAddr()
+	}
+	return nil
+}
+
+// TargetAddr returns the address the proxy forwards traffic to.
+func (p *Proxy) TargetAddr() string {
+	return p.cfg.TargetAddr
+}
+
+// Stats returns a snapshot of the proxy counters.
+func (p *Proxy) Stats() Stats {
+	return Stats{
+		Connections: p.connections.Load(),
+		Rejected:    p.rejected.Load(),
+		BytesIn:     p.bytesIn.Load(),
+		BytesOut:    p.bytesOut.Load(),
+	}
+}
+
+// Close stops accepting new traffic and waits up to the drain timeout for
+// open TCP connections to finish, before closing them. UDP sessions are
+// closed immediately, as there is no connection to drain. Close may be called
+// more than once.
+func (p *Proxy) Close() error {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil
+	}
+	p.closed = true
+	sessions := p.sessions
+	p.sessions = make(map[string]*udpSession)
+	p.lock.Unlock()
+
+	var err error
+	if p.listener != nil {
+		err = p.listener.Close()
+	}
+	if p.packetConn != nil {
+		err = p.packetConn.Close()
+	}
+	for _, s := range sessions {
+		_ = s.conn.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(p.cfg.DrainTimeout):
+		p.lock.Lock()
+		p.logger.Debug("drain timeout reached, closing connections", "connections", len(p.conns))
+		for conn := range p.conns {
+			_ = conn.Close()
+		}
+		p.lock.Unlock()
+		<-done
+	}
+
+	return err
+}
+
+// allowed reports whether the client address may use the proxy.
+func (p *Proxy) allowed(addr stdnet.Addr) bool {
+	if len(p.cfg.AllowedSources) == 0 {
+		return true
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+	for _, prefix := range p.cfg.AllowedSources {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// track adds the connection to those closed once draining times out. It
+// returns false if the proxy has been closed.
+func (p *Proxy) track(conn stdnet.Conn) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+func (p *Proxy) untrack(conn stdnet.Conn) {
+	p.lock.Lock()
+	delete(p.conns, conn)
+	p.lock.Unlock()
+}
+
+func (p *Proxy) serveTCP() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, stdnet.ErrClosed) {
+				p.logger.Error("failed to accept connection", "error", err)
+			}
+			return
+		}
+
+		if !p.allowed(conn.RemoteAddr()) {
+			p.rejected.Add(1)
+			p.logger.Debug("rejected connection from disallowed source", "client", conn.RemoteAddr())
+			_ = conn.Close()
+			continue
+		}
+
+		if !p.startHandler() {
+			_ = conn.Close()
+			return
+		}
+		go p.handleTCP(conn)
+	}
+}
+
+// startHandler adds a connection handler to those Close waits for. It
+// returns false if the proxy has been closed, as the wait group may then
+// already be waited on.
+func (p *Proxy) startHandler() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return false
+	}
+	p.wg.Add(1)
+	return true
+}
+
+func (p *Proxy) handleTCP(client stdnet.Conn) {
+	defer p.wg.Done()
+	defer client.Close()
+
+	if !p.track(client) {
+		return
+	}
+	defer p.untrack(client)
+
+	p.connections.Add(1)
+
+	target, err := stdnet.DialTimeout("tcp", p.cfg.TargetAddr, dialTimeout)
+	if err != nil {
+		p.logger.Debug("failed to connect to target", "client", client.RemoteAddr(), "error", err)
+		return
+	}
+	defer target.Close()
+
+	if !p.track(target) {
+		return
+	}
+	defer p.untrack(target)
+
+	// Copy each direction independently, propagating half-closes so
+	// protocols which rely on them keep working. The connections are copied
+	// between directly so the kernel can splice them, and the bytes are
+	// counted once each direction is done.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(target, client)
+		p.bytesIn.Add(uint64(n))
+		closeWrite(target)
+	}()
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(client, target)
+		p.bytesOut.Add(uint64(n))
+		closeWrite(client)
+	}()
+	wg.Wait()
+}
+
+// udpSession is the connection to the target used for a single UDP client.
+type udpSession struct {
+	client stdnet.Addr
+	conn   stdnet.Conn
+}
+
+func (p *Proxy) serveUDP() {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, addr, err := p.packetConn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, stdnet.ErrClosed) {
+				p.logger.Error("failed to read datagram", "error", err)
+			}
+			return
+		}
+
+		if !p.allowed(addr) {
+			p.rejected.Add(1)
+			continue
+		}
+
+		s, err := p.udpSession(addr)
+		if err != nil {
+			p.logger.Debug("failed to create UDP session", "client", addr, "error", err)
+			continue
+		}
+		if s == nil {
+			return
+		}
+
+		if _, err := s.conn.Write(buf[:n]); err != nil {
+			p.logger.Debug("failed to forward datagram", "client", addr, "error", err)
+			continue
+		}
+		p.bytesIn.Add(uint64(n))
+	}
+}
+
+// udpSession returns the session for the client, creating it if needed. It
+// returns nil if the proxy has been closed.
+func (p *Proxy) udpSession(client stdnet.Addr) (*udpSession, error) {
+	key := client.String()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.closed {
+		return nil, nil
+	}
+	if s, ok := p.sessions[key]; ok {
+		return s, nil
+	}
+
+	conn, err := stdnet.DialTimeout("udp", p.cfg.TargetAddr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &udpSession{client: client, conn: conn}
+	p.sessions[key] = s
+	p.connections.Add(1)
+
+	go p.replyUDP(key, s)
+	return s, nil
+}
+
+// replyUDP forwards the target's responses back to the client until the
+// session is idle for too long or closed.
+func (p *Proxy) replyUDP(key string, s *udpSession) {
+	defer func() {
+		p.lock.Lock()
+		if p.sessions[key] == s {
+			delete(p.sessions, key)
+		}
+		p.lock.Unlock()
+		_ = s.conn.Close()
+	}()
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		_ = s.conn.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := p.packetConn.WriteTo(buf[:n], s.client); err != nil {
+			return
+		}
+		p.bytesOut.Add(uint64(n))
+	}
+}
+
+// closeWrite half-closes the connection if supported, signalling EOF to the
+// peer.
+func closeWrite(conn stdnet.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
@@ -0,0 +1,212 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package proxy
+
+import (
+	"bufio"
+	"io"
+	stdnet "net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/shoenig/test/must"
+	"github.com/shoenig/test/wait"
+)
+
+// testProxy starts a proxy on a random localhost port.
+func testProxy(t *testing.T, cfg Config) *Proxy {
+	t.Helper()
+
+	cfg.ListenAddr = "127.0.0.1:0"
+	p, err := New(hclog.NewNullLogger(), cfg)
+	must.NoError(t, err)
+	must.NoError(t, p.Start())
+	t.Cleanup(func() { _ = p.Close() })
+	return p
+}
+
+// tcpEcho starts a TCP server which echoes each line it receives.
+func tcpEcho(t *testing.T) stdnet.Listener {
+	t.Helper()
+
+	l, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	must.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestProxy_TCP(t *testing.T) {
+	target := tcpEcho(t)
+	p := testProxy(t, Config{Protocol: ProtocolTCP, TargetAddr: target.Addr().String()})
+
+	conn, err := stdnet.Dial("tcp", p.Addr().String())
+	must.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello\n"))
+	must.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	must.NoError(t, err)
+	must.Eq(t, "hello\n", line)
+	must.Eq(t, 1, p.Stats().Connections)
+
+	// The bytes are counted once the connection is closed.
+	must.NoError(t, conn.Close())
+	must.Wait(t, wait.InitialSuccess(wait.BoolFunc(func() bool {
+		stats := p.Stats()
+		return stats.BytesIn == 6 && stats.BytesOut == 6
+	}), wait.Timeout(time.Second)))
+}
+
+func TestProxy_TCP_Drain(t *testing.T) {
+	target := tcpEcho(t)
+	p := testProxy(t, Config{
+		Protocol:     ProtocolTCP,
+		TargetAddr:   target.Addr().String(),
+		DrainTimeout: 100 * time.Millisecond,
+	})
+
+	conn, err := stdnet.Dial("tcp", p.Addr().String())
+	must.NoError(t, err)
+	defer conn.Close()
+
+	// Ensure the connection is established before closing.
+	_, err = conn.Write([]byte("x"))
+	must.NoError(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	must.NoError(t, err)
+
+	// The idle connection is closed once the drain timeout passes.
+	start := time.Now()
+	must.NoError(t, p.Close())
+	must.GreaterEq(t, 100*time.Millisecond, time.Since(start))
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	must.ErrorIs(t, err, io.EOF)
+
+	// New connections are refused.
+	_, err = stdnet.Dial("tcp", p.Addr().String())
+	must.Error(t, err)
+
+	must.NoError(t, p.Close())
+}
+
+func TestProxy_TCP_CloseWhileAccepting(t *testing.T) {
+	target := tcpEcho(t)
+	p := testProxy(t, Config{
+		Protocol:     ProtocolTCP,
+		TargetAddr:   target.Addr().String(),
+		DrainTimeout: 100 * time.Millisecond,
+	})
+	addr := p.Addr().String()
+
+	// Connections accepted as the proxy closes are either handled, and
+	// drained by Close, or closed without being handled.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			conn, err := stdnet.Dial("tcp", addr)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	must.NoError(t, p.Close())
+	<-done
+
+	p.lock.Lock()
+	must.MapEmpty(t, p.conns)
+	p.lock.Unlock()
+}
+
+func TestProxy_TCP_AllowedSources(t *testing.T) {
+	target := tcpEcho(t)
+	p := testProxy(t, Config{
+		Protocol:       ProtocolTCP,
+		TargetAddr:     target.Addr().String(),
+		AllowedSources: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+
+	conn, err := stdnet.Dial("tcp", p.Addr().String())
+	must.NoError(t, err)
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	must.ErrorIs(t, err, io.EOF)
+
+	must.Wait(t, wait.InitialSuccess(wait.BoolFunc(func() bool {
+		return p.Stats().Rejected == 1
+	}), wait.Timeout(time.Second)))
+	must.Eq(t, 0, p.Stats().Connections)
+}
+
+func TestProxy_UDP(t *testing.T) {
+	target, err := stdnet.ListenPacket("udp", "127.0.0.1:0")
+	must.NoError(t, err)
+	defer target.Close()
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := target.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = target.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	p := testProxy(t, Config{Protocol: ProtocolUDP, TargetAddr: target.LocalAddr().String()})
+
+	conn, err := stdnet.Dial("udp", p.Addr().String())
+	must.NoError(t, err)
+	defer conn.Close()
+
+	for range 2 {
+		_, err = conn.Write([]byte("ping"))
+		must.NoError(t, err)
+
+		buf := make([]byte, 16)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		must.NoError(t, err)
+		must.Eq(t, "ping", string(buf[:n]))
+	}
+
+	stats := p.Stats()
+	must.Eq(t, 1, stats.Connections)
+	must.Eq(t, 8, stats.BytesIn)
+	must.Eq(t, 8, stats.BytesOut)
+}
+
+func TestNew_Validation(t *testing.T) {
+	_, err := New(hclog.NewNullLogger(), Config{Protocol: "sctp", ListenAddr: "127.0.0.1:80", TargetAddr: "10.0.0.1:80"})
+	must.ErrorContains(t, err, "unsupported protocol")
+
+	_, err = New(hclog.NewNullLogger(), Config{Protocol: ProtocolTCP, ListenAddr: "127.0.0.1", TargetAddr: "10.0.0.1:80"})
+	must.ErrorContains(t, err, "invalid listen address")
+
+	_, err = New(hclog.NewNullLogger(), Config{Protocol: ProtocolTCP, ListenAddr: "127.0.0.1:80", TargetAddr: "host:80"})
+	must.ErrorContains(t, err, "invalid target address")
+}
@@ -0,0 +1,416 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+// Package resolver implements a small DNS server which answers for the VMs
+// running on the host and forwards all other queries to upstream resolvers.
+// Records are registered and removed by the network controller as VMs start
+// and stop; nothing is persisted.
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	stdnet "net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+)
+
+const (
+	// DefaultDomain is the domain VM records are served under when the
+	// configuration does not specify one.
+	DefaultDomain = "vm.nomad"
+
+	// DefaultResolvConf is the file read to discover upstream resolvers when
+	// none are configured.
+	DefaultResolvConf = "/etc/resolv.conf"
+
+	// recordTTL is the TTL, in seconds, of every record the server answers.
+	// It is kept short, as records come and go with the VMs.
+	recordTTL = 30
+
+	// forwardTimeout is the time allowed for each upstream to answer a
+	// forwarded query.
+	forwardTimeout = 2 * time.Second
+)
+
+// Config is the configuration of the server.
+type Config struct {
+
+	// Domain is the zone VM records are served within. Queries for a bare
+	// hostname are also answered.
+	Domain string
+
+	// Upstreams are the resolvers non-VM queries are forwarded to, in order
+	// of preference. Entries are an IP address with an optional port, which
+	// defaults to 53.
+	Upstreams []string
+}
+
+// Server is the DNS server. It is safe for concurrent use.
+type Server struct {
+	logger    hclog.Logger
+	domain    string
+	upstreams []string
+
+	lock    sync.RWMutex
+	records map[string][]netip.Addr
+	servers []*dns.Server
+
+	// exchange performs a forwarded query against an upstream; it is a
+	// field to aid testing.
+	exchange func(network string, m *dns.Msg, upstream string) (*dns.Msg, error)
+}
+
+// NewServer validates the configuration and returns a server ready to be
+// started via Serve.
+func NewServer(logger hclog.Logger, cfg Config) (*Server, error) {
+	domain := cfg.Domain
+	if domain == "" {
+		domain = DefaultDomain
+	}
+	if _, ok := dns.IsDomainName(domain); !ok {
+		return nil, fmt.Errorf("resolver: invalid domain %q", domain)
+	}
+
+	upstreams := make([]string, 0, len(cfg.Upstreams))
+	for _, u := range cfg.Upstreams {
+		addr, err := ParseUpstream(u)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, addr)
+	}
+
+	return &Server{
+		logger:    logger.Named("resolver"),
+		domain:    dns.CanonicalName(domain),
+		upstreams: upstreams,
+		records:   make(map[string][]netip.Addr),
+		exchange:  exchange,
+	}, nil
+}
+
+// ParseUpstream converts an upstream resolver entry into the host:port form
+// used when forwarding. The port defaults to 53.
+func ParseUpstream(s string) (string, error) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.String(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return "", fmt.Errorf("resolver: invalid upstream %q: must be an IP address with an optional port", s)
+	}
+	return netip.AddrPortFrom(addr, 53).String(), nil
+}
+
+// UpstreamsFromResolvConf reads the nameservers listed within a resolv.conf
+// style file, in the form accepted by Config.Upstreams.
+func UpstreamsFromResolvConf(path string) ([]string, error) {
+	cc, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("resolver: failed to read %s: %w", path, err)
+	}
+	upstreams := make([]string, 0, len(cc.Servers))
+	for _, s := range cc.Servers {
+		upstreams = append(upstreams, stdnet.JoinHostPort(s, cc.Port))
+	}
+	return upstreams, nil
+}
+
+// Domain returns the zone VM records are served within, without the
+// trailing dot.
+func (s *Server) Domain() string { return strings.TrimSuffix(s.domain, ".") }
+
+// Register adds an address for the hostname. A hostname may have several
+// addresses, for example when multiple VMs share a configured hostname.
+func (s *Server) Register(hostname string, addr netip.Addr) error {
+	name, err := s.recordName(hostname)
+	if err != nil {
+		return err
+	}
+	if !addr.IsValid() {
+		return fmt.Errorf("resolver: invalid address for %q", hostname)
+	}
+	addr = addr.Unmap()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !slices.Contains(s.records[name], addr) {
+		s.records[name] = append(s.records[name], addr)
+	}
+	s.logger.Debug("registered record", "name", name, "address", addr)
+	return nil
+}
+
+// Deregister removes an address from the hostname. Removing an unknown record
+// is not an error, so teardown can be safely retried.
+func (s *Server) Deregister(hostname string, addr netip.Addr) {
+	name, err := s.recordName(hostname)
+	if err != nil {
+		return
+	}
+	addr = addr.Unmap()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	addrs := slices.DeleteFunc(s.records[name], func(a netip.Addr) bool { return a == addr })
+	if len(addrs) == 0 {
+		delete(s.records, name)
+	} else {
+		s.records[name] = addrs
+	}
+}
+
+// Serve answers queries received on the passed connections until Shutdown
+// is called. Either connection may be nil. It returns once the servers are
+// running.
+func (s *Server) Serve(pc stdnet.PacketConn, l stdnet.Listener) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.servers) > 0 {
+		return errors.New("resolver: server already running")
+	}
+
+	var servers []*dns.Server
+	if pc != nil {
+		servers = append(servers, &dns.Server{PacketConn: pc, Handler: s})
+	}
+	if l != nil {
+		servers = append(servers, &dns.Server{Listener: l, Handler: s})
+	}
+
+	for _, srv := range servers {
+		started := make(chan struct{})
+		srv.NotifyStartedFunc = func() { close(started) }
+		go func() {
+			if err := srv.ActivateAndServe(); err != nil {
+				s.logger.Error("DNS server stopped", "error", err)
+			}
+		}()
+		<-started
+	}
+
+	s.servers = servers
+	return nil
+}
+
+// Listen opens the UDP and TCP sockets for the passed host:port address,
+// ready to be passed to Serve.
+func Listen(addr string) (stdnet.PacketConn, stdnet.Listener, error) {
+	pc, err := stdnet.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("resolver: failed to listen on udp %s: %w", addr, err)
+	}
+	l, err := stdnet.Listen("tcp", addr)
+	if err != nil {
+		_ = pc.Close()
+		return nil, nil, fmt.Errorf("resolver: failed to listen on tcp %s: %w", addr, err)
+	}
+	return pc, l, nil
+}
+
+// Shutdown stops the running servers and closes their connections.
+func (s *Server) Shutdown() error {
+	s.lock.Lock()
+	servers := s.servers
+	s.servers = nil
+	s.lock.Unlock()
+
+	var errs []error
+	for _, srv := range servers {
+		errs = append(errs, srv.Shutdown())
+	}
+	return errors.Join(errs...)
+}
+
+// ServeDNS implements dns.Handler.
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 || req.Opcode != dns.OpcodeQuery {
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeNotImplemented)
+		_ = w.WriteMsg(resp)
+		return
+	}
+
+	resp := s.answer(req)
+	if resp == nil {
+		resp = s.forward(w.LocalAddr().Network(), req)
+	}
+	if err := w.WriteMsg(resp); err != nil {
+		s.logger.Debug("failed to write response", "error", err)
+	}
+}
+
+// answer builds the response for queries the server is authoritative for,
+// returning nil if the query should be forwarded.
+func (s *Server) answer(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	name := dns.CanonicalName(q.Name)
+
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+
+	if q.Qtype == dns.TypePTR {
+		return s.answerPTR(req, name)
+	}
+
+	host, inZone := s.hostLabel(name)
+
+	s.lock.RLock()
+	addrs, found := s.records[host]
+	addrs = slices.Clone(addrs)
+	s.lock.RUnlock()
+
+	switch {
+	case found:
+	case inZone:
+		resp := new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeNameError)
+		resp.Authoritative = true
+		return resp
+	default:
+		return nil
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: recordTTL}
+	for _, addr := range addrs {
+		switch {
+		case addr.Is4() && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY):
+			hdr.Rrtype = dns.TypeA
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: addr.AsSlice()})
+		case addr.Is6() && (q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY):
+			hdr.Rrtype = dns.TypeAAAA
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()})
+		}
+	}
+	return resp
+}
+
+// answerPTR answers reverse lookups for registered addresses. Unknown
+// addresses are forwarded, as the upstream may know them.
+func (s *Server) answerPTR(req *dns.Msg, name string) *dns.Msg {
+	addr, ok := reverseAddr(name)
+	if !ok {
+		return nil
+	}
+
+	s.lock.RLock()
+	var hosts []string
+	for host, addrs := range s.records {
+		if slices.Contains(addrs, addr) {
+			hosts = append(hosts, host)
+		}
+	}
+	s.lock.RUnlock()
+
+	if len(hosts) == 0 {
+		return nil
+	}
+	slices.Sort(hosts)
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	for _, host := range hosts {
+		resp.Answer = append(resp.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: recordTTL},
+			Ptr: host + "." + s.domain,
+		})
+	}
+	return resp
+}
+
+// forward sends the query to each upstream in turn, returning the first
+// answer received or SERVFAIL if none answer.
+func (s *Server) forward(network string, req *dns.Msg) *dns.Msg {
+	for _, upstream := range s.upstreams {
+		resp, err := s.exchange(network, req, upstream)
+		if err != nil {
+			s.logger.Debug("upstream query failed", "upstream", upstream, "error", err)
+			continue
+		}
+		return resp
+	}
+
+	resp := new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeServerFailure)
+	return resp
+}
+
+// hostLabel returns the record key for a query name and whether the name
+// falls within the served zone.
+func (s *Server) hostLabel(name string) (string, bool) {
+	if strings.HasSuffix(name, "."+s.domain) {
+		return strings.TrimSuffix(name, "."+s.domain), true
+	}
+	if dns.CountLabel(name) == 1 {
+		return strings.TrimSuffix(name, "."), false
+	}
+	return "", false
+}
+
+// recordName validates a hostname and converts it into a record key.
+func (s *Server) recordName(hostname string) (string, error) {
+	name := strings.ToLower(strings.TrimSuffix(hostname, "."))
+	name = strings.TrimSuffix(name, "."+strings.TrimSuffix(s.domain, "."))
+	if name == "" || strings.Contains(name, ".") {
+		return "", fmt.Errorf("resolver: invalid hostname %q", hostname)
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return "", fmt.Errorf("resolver: invalid hostname %q", hostname)
+	}
+	return name, nil
+}
+
+// reverseAddr parses a PTR query name into the address it refers to.
+func reverseAddr(name string) (netip.Addr, bool) {
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, ".in-addr.arpa."))
+		if len(labels) != 4 {
+			return netip.Addr{}, false
+		}
+		slices.Reverse(labels)
+		addr, err := netip.ParseAddr(strings.Join(labels, "."))
+		return addr, err == nil
+
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		nibbles := dns.SplitDomainName(strings.TrimSuffix(name, ".ip6.arpa."))
+		if len(nibbles) != 32 {
+			return netip.Addr{}, false
+		}
+		slices.Reverse(nibbles)
+		var b strings.Builder
+		for i, n := range nibbles {
+			if i > 0 && i%4 == 0 {
+				b.WriteByte(':')
+			}
+			b.WriteString(n)
+		}
+		addr, err := netip.ParseAddr(b.String())
+		return addr, err == nil
+
+	default:
+		return netip.Addr{}, false
+	}
+}
+
+func exchange(network string, m *dns.Msg, upstream string) (*dns.Msg, error) {
+	c := &dns.Client{Net: network, Timeout: forwardTimeout}
+	resp, _, err := c.Exchange(m, upstream)
+	return resp, err
+}
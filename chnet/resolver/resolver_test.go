@@ -0,0 +1,172 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package resolver
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/miekg/dns"
+	"github.com/shoenig/test/must"
+)
+
+// testServer starts a server on a random localhost port, returning it along
+// with the address it is listening on.
+func testServer(t *testing.T, cfg Config) (*Server, string) {
+	t.Helper()
+
+	srv, err := NewServer(hclog.NewNullLogger(), cfg)
+	must.NoError(t, err)
+	return srv, serve(t, srv)
+}
+
+// serve starts the server on a random localhost port, returning the address
+// it is listening on.
+func serve(t *testing.T, srv *Server) string {
+	t.Helper()
+
+	pc, l, err := Listen("127.0.0.1:0")
+	must.NoError(t, err)
+	l.Close()
+
+	must.NoError(t, srv.Serve(pc, nil))
+	t.Cleanup(func() { must.NoError(t, srv.Shutdown()) })
+
+	return pc.LocalAddr().String()
+}
+
+func query(t *testing.T, addr, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+
+	resp, err := dns.Exchange(m, addr)
+	must.NoError(t, err)
+	return resp
+}
+
+func TestServer_Records(t *testing.T) {
+	srv, addr := testServer(t, Config{Domain: "vm.test"})
+
+	must.NoError(t, srv.Register("web", netip.MustParseAddr("192.168.254.10")))
+	must.NoError(t, srv.Register("Web", netip.MustParseAddr("192.168.254.11")))
+	must.NoError(t, srv.Register("db.vm.test", netip.MustParseAddr("fd00::10")))
+
+	resp := query(t, addr, "web.vm.test", dns.TypeA)
+	must.Eq(t, dns.RcodeSuccess, resp.Rcode)
+	must.True(t, resp.Authoritative)
+	must.Len(t, 2, resp.Answer)
+	must.Eq(t, "192.168.254.10", resp.Answer[0].(*dns.A).A.String())
+	must.Eq(t, "192.168.254.11", resp.Answer[1].(*dns.A).A.String())
+
+	// Bare hostnames are answered too.
+	resp = query(t, addr, "WEB", dns.TypeA)
+	must.Len(t, 2, resp.Answer)
+
+	resp = query(t, addr, "db.vm.test", dns.TypeAAAA)
+	must.Len(t, 1, resp.Answer)
+	must.Eq(t, "fd00::10", resp.Answer[0].(*dns.AAAA).AAAA.String())
+
+	// A known name without records of the type is NODATA, not NXDOMAIN.
+	resp = query(t, addr, "db.vm.test", dns.TypeA)
+	must.Eq(t, dns.RcodeSuccess, resp.Rcode)
+	must.Len(t, 0, resp.Answer)
+
+	resp = query(t, addr, "missing.vm.test", dns.TypeA)
+	must.Eq(t, dns.RcodeNameError, resp.Rcode)
+
+	resp = query(t, addr, "10.254.168.192.in-addr.arpa", dns.TypePTR)
+	must.Len(t, 1, resp.Answer)
+	must.Eq(t, "web.vm.test.", resp.Answer[0].(*dns.PTR).Ptr)
+
+	ptr, err := dns.ReverseAddr("fd00::10")
+	must.NoError(t, err)
+	resp = query(t, addr, ptr, dns.TypePTR)
+	must.Len(t, 1, resp.Answer)
+	must.Eq(t, "db.vm.test.", resp.Answer[0].(*dns.PTR).Ptr)
+
+	srv.Deregister("web", netip.MustParseAddr("192.168.254.10"))
+	srv.Deregister("web", netip.MustParseAddr("192.168.254.11"))
+	resp = query(t, addr, "web.vm.test", dns.TypeA)
+	must.Eq(t, dns.RcodeNameError, resp.Rcode)
+}
+
+func TestServer_Forward(t *testing.T) {
+	var (
+		lock  sync.Mutex
+		tried []string
+		fail  bool
+	)
+
+	// The exchange function must be set before the server starts, so the
+	// behaviour is switched via the variables it reads.
+	srv, err := NewServer(hclog.NewNullLogger(), Config{Upstreams: []string{"192.0.2.1", "192.0.2.2:8600"}})
+	must.NoError(t, err)
+	srv.exchange = func(network string, m *dns.Msg, upstream string) (*dns.Msg, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		tried = append(tried, upstream)
+		if fail || upstream == "192.0.2.1:53" {
+			return nil, errors.New("timeout")
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		rr, err := dns.NewRR(m.Question[0].Name + " 60 IN A 203.0.113.5")
+		if err != nil {
+			return nil, err
+		}
+		resp.Answer = append(resp.Answer, rr)
+		return resp, nil
+	}
+	addr := serve(t, srv)
+
+	resp := query(t, addr, "example.com", dns.TypeA)
+	must.Eq(t, dns.RcodeSuccess, resp.Rcode)
+	must.Len(t, 1, resp.Answer)
+	must.Eq(t, "203.0.113.5", resp.Answer[0].(*dns.A).A.String())
+	lock.Lock()
+	must.Eq(t, []string{"192.0.2.1:53", "192.0.2.2:8600"}, tried)
+
+	// Unknown reverse lookups are forwarded.
+	tried = nil
+	lock.Unlock()
+	_ = query(t, addr, "1.2.0.192.in-addr.arpa", dns.TypePTR)
+	lock.Lock()
+	must.Len(t, 2, tried)
+
+	fail = true
+	lock.Unlock()
+	resp = query(t, addr, "example.com", dns.TypeA)
+	must.Eq(t, dns.RcodeServerFailure, resp.Rcode)
+}
+
+func TestNewServer_Validation(t *testing.T) {
+	_, err := NewServer(hclog.NewNullLogger(), Config{Upstreams: []string{"consul.service"}})
+	must.ErrorContains(t, err, "invalid upstream")
+
+	srv, err := NewServer(hclog.NewNullLogger(), Config{})
+	must.NoError(t, err)
+	must.Eq(t, DefaultDomain, srv.Domain())
+
+	must.ErrorContains(t, srv.Register("a.b", netip.MustParseAddr("192.168.254.10")), "invalid hostname")
+	must.ErrorContains(t, srv.Register("web", netip.Addr{}), "invalid address")
+}
+
+func TestUpstreamsFromResolvConf(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	must.NoError(t, os.WriteFile(path, []byte("nameserver 10.0.0.2\nnameserver fd00::53\nsearch example.com\n"), 0o644))
+
+	upstreams, err := UpstreamsFromResolvConf(path)
+	must.NoError(t, err)
+	must.Eq(t, []string{"10.0.0.2:53", "[fd00::53]:53"}, upstreams)
+
+	_, err = UpstreamsFromResolvConf(filepath.Join(t.TempDir(), "missing"))
+	must.Error(t, err)
+}
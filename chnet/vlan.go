@@ -0,0 +1,72 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package chnet
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sysClassNet is the sysfs directory describing the host network interfaces.
+// It is a variable so tests can use a fake hierarchy.
+var sysClassNet = "/sys/class/net"
+
+// BridgeVLAN is the VLAN configuration of a bridge.
+type BridgeVLAN struct {
+
+	// Filtering reports whether VLAN filtering is enabled, which is required
+	// for the VLAN membership of ports to apply.
+	Filtering bool
+
+	// DefaultPVID is the VLAN ports join untagged when added to the bridge,
+	// or zero if none.
+	DefaultPVID int
+}
+
+// GetBridgeVLAN returns the VLAN configuration of the named bridge.
+func GetBridgeVLAN(name string) (*BridgeVLAN, error) {
+	dir := filepath.Join(sysClassNet, name, "bridge")
+
+	filtering, err := readSysfsInt(filepath.Join(dir, "vlan_filtering"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("interface %q is not a bridge", name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	pvid, err := readSysfsInt(filepath.Join(dir, "default_pvid"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &BridgeVLAN{Filtering: filtering == 1, DefaultPVID: pvid}, nil
+}
+
+// vlanAwareBridges returns the names of the host bridges with VLAN filtering
+// enabled.
+func vlanAwareBridges() []string {
+	paths, _ := filepath.Glob(filepath.Join(sysClassNet, "*", "bridge", "vlan_filtering"))
+
+	var bridges []string
+	for _, path := range paths {
+		if filtering, err := readSysfsInt(path); err == nil && filtering == 1 {
+			bridges = append(bridges, filepath.Base(filepath.Dir(filepath.Dir(path))))
+		}
+	}
+	return bridges
+}
+
+// readSysfsInt reads a sysfs attribute holding an integer.
+func readSysfsInt(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
@@ -0,0 +1,44 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package chnet
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shoenig/test/must"
+)
+
+func TestGetBridgeVLAN(t *testing.T) {
+	dir := t.TempDir()
+	writeBridge := func(name, filtering, pvid string) {
+		t.Helper()
+		bridgeDir := filepath.Join(dir, name, "bridge")
+		must.NoError(t, os.MkdirAll(bridgeDir, 0755))
+		must.NoError(t, os.WriteFile(filepath.Join(bridgeDir, "vlan_filtering"), []byte(filtering+"\n"), 0644))
+		must.NoError(t, os.WriteFile(filepath.Join(bridgeDir, "default_pvid"), []byte(pvid+"\n"), 0644))
+	}
+	writeBridge("br0", "1", "1")
+	writeBridge("br1", "0", "1")
+	writeBridge("br2", "1", "0")
+	must.NoError(t, os.MkdirAll(filepath.Join(dir, "eth0"), 0755))
+
+	original := sysClassNet
+	sysClassNet = dir
+	t.Cleanup(func() { sysClassNet = original })
+
+	vlan, err := GetBridgeVLAN("br0")
+	must.NoError(t, err)
+	must.Eq(t, &BridgeVLAN{Filtering: true, DefaultPVID: 1}, vlan)
+
+	vlan, err = GetBridgeVLAN("br1")
+	must.NoError(t, err)
+	must.False(t, vlan.Filtering)
+
+	_, err = GetBridgeVLAN("eth0")
+	must.ErrorContains(t, err, `interface "eth0" is not a bridge`)
+
+	must.Eq(t, []string{"br0", "br2"}, vlanAwareBridges())
+}
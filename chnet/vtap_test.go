@@ -0,0 +1,59 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package chnet
+
+import (
+	"testing"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/shoenig/test/must"
+)
+
+func TestController_Vtap(t *testing.T) {
+	// The controller has no firewall, bridge or DHCP server, so any attempt
+	// to configure the host would fail.
+	c := &Controller{
+		logger:        hclog.NewNullLogger(),
+		networkConfig: &domain.Network{},
+	}
+
+	build := func(iface *net.NetworkInterfaceConfig, guestIPs ...string) *net.VMStartedBuildResponse {
+		t.Helper()
+		resp, err := c.VMStartedBuild(&net.VMStartedBuildRequest{
+			DomainName: "nomad-task-1",
+			GuestIPs:   guestIPs,
+			NetConfig:  &net.NetworkInterfacesConfig{iface},
+			Resources:  &drivers.Resources{},
+		})
+		must.NoError(t, err)
+		return resp
+	}
+
+	// Without a static IP the guest is addressed by DHCP on the parent
+	// network, so its address is unknown.
+	resp := build(&net.NetworkInterfaceConfig{
+		Macvtap: &net.NetworkInterfaceVtapConfig{Parent: "eth0"},
+	})
+	must.Nil(t, resp.DriverNetwork)
+	must.Eq(t, &net.TeardownSpec{}, resp.TeardownSpec)
+
+	resp = build(&net.NetworkInterfaceConfig{
+		IPVtap: &net.NetworkInterfaceVtapConfig{Parent: "eth0", StaticIP: "192.168.1.50"},
+	})
+	must.Eq(t, "192.168.1.50", resp.DriverNetwork.IP)
+
+	resp = build(&net.NetworkInterfaceConfig{
+		Macvtap: &net.NetworkInterfaceVtapConfig{Parent: "eth0", StaticIP: "192.168.1.50"},
+	}, "192.168.1.60")
+	must.Eq(t, "192.168.1.60", resp.DriverNetwork.IP)
+
+	// Nothing was configured on the host, so there is nothing to tear down.
+	_, err := c.VMTerminatedTeardown(&net.VMTerminatedTeardownRequest{TeardownSpec: resp.TeardownSpec})
+	must.NoError(t, err)
+}
@@ -0,0 +1,156 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ccheshirecat/nomad-driver-ch/chnet/cni"
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	virtNet "github.com/ccheshirecat/nomad-driver-ch/virt/net"
+)
+
+const (
+	// cniIfName is the interface name CNI plugins are asked to create within
+	// the network namespace of a VM.
+	cniIfName = "eth0"
+
+	// cniTimeout bounds each invocation of a CNI plugin chain.
+	cniTimeout = time.Minute
+)
+
+// cniInterface returns the CNI configuration of the VM's first interface, if
+// it uses a CNI network.
+func cniInterface(config *domain.Config) *virtNet.NetworkInterfaceCNIConfig {
+	if config == nil || len(config.NetworkInterfaces) == 0 {
+		return nil
+	}
+	return config.NetworkInterfaces[0].CNI
+}
+
+// attachCNI creates a network namespace for the VM and attaches it to its CNI
+// network within it. The plugins create the TAP and assign the address, which
+// are stored on proc, and the VMM is later launched within the namespace.
+func (d *Driver) attachCNI(config *domain.Config, proc *VMProcess, cfg *virtNet.NetworkInterfaceCNIConfig) error {
+	if config.NetNS != "" {
+		return errors.New("cni network interfaces cannot be used with group network mode, use a cni network mode within the group network block instead")
+	}
+
+	client := cni.New(d.networkConfig.CNIPath, d.networkConfig.CNIConfigDir)
+	list, err := client.LoadNetwork(cfg.Network)
+	if err != nil {
+		return err
+	}
+
+	netns, err := createNetNS(config.Name)
+	if err != nil {
+		return fmt.Errorf("failed to create network namespace: %w", err)
+	}
+
+	attachment := &virtNet.CNIAttachment{
+		Network:     cfg.Network,
+		ContainerID: config.Name,
+		IfName:      cniIfName,
+		Args:        cfg.Args,
+		NetNS:       netns,
+		OwnsNetNS:   true,
+		Config:      list.Bytes,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cniTimeout)
+	defer cancel()
+
+	res, err := client.Add(ctx, list, cniRuntimeConf(attachment))
+	if err == nil {
+		attachment.Result = res.Raw
+		var vm *cni.VMInterface
+		if vm, err = res.VMInterface(cniIfName, netns); err == nil {
+			proc.TapName = vm.TAP
+			proc.MAC = vm.MAC
+			proc.IP = vm.Address.Addr().String()
+		}
+	}
+
+	// The attachment is recorded even on failure, so the caller detaches it.
+	proc.NetNS = netns
+	proc.CNI = attachment
+
+	if err != nil {
+		return fmt.Errorf("failed to attach to CNI network %q: %w", cfg.Network, err)
+	}
+
+	d.logger.Info("attached VM to CNI network",
+		"vm", config.Name, "network", cfg.Network, "ip", proc.IP, "tap", proc.TapName, "netns", netns)
+
+	return nil
+}
+
+// detachCNI deletes the CNI attachment of a VM which failed to start, along
+// with its network namespace. Once the VM has started, this is the
+// responsibility of the network teardown. VMs not attached by CNI plugins are
+// ignored.
+func (d *Driver) detachCNI(proc *VMProcess) {
+	if proc.CNI == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cniTimeout)
+	defer cancel()
+
+	client := cni.New(d.networkConfig.CNIPath, d.networkConfig.CNIConfigDir)
+	list, err := cni.ParseNetworkList(proc.CNI.Config)
+	if err == nil {
+		err = client.Del(ctx, list, cniRuntimeConf(proc.CNI), proc.CNI.Result)
+	}
+	if err != nil {
+		d.logger.Warn("failed to detach VM from CNI network", "vm", proc.Name, "network", proc.CNI.Network, "error", err)
+	}
+
+	if proc.CNI.OwnsNetNS {
+		if err := removeNetNS(proc.CNI.NetNS); err != nil {
+			d.logger.Warn("failed to remove network namespace", "vm", proc.Name, "netns", proc.CNI.NetNS, "error", err)
+		}
+	}
+}
+
+// cniRuntimeConf returns the runtime configuration the attachment was made
+// with.
+func cniRuntimeConf(attachment *virtNet.CNIAttachment) *cni.RuntimeConf {
+	return &cni.RuntimeConf{
+		ContainerID: attachment.ContainerID,
+		NetNS:       attachment.NetNS,
+		IfName:      attachment.IfName,
+		Args:        attachment.Args,
+	}
+}
+
+// cniNetworkSettings returns the guest network settings from the result of
+// the CNI plugins.
+func cniNetworkSettings(settings networkSettings, config *domain.Config, attachment *virtNet.CNIAttachment) (networkSettings, bool) {
+	res, err := cni.ParseResult(attachment.Result)
+	if err != nil {
+		return settings, false
+	}
+	vm, err := res.VMInterface(attachment.IfName, attachment.NetNS)
+	if err != nil {
+		return settings, false
+	}
+
+	settings.address = vm.Address.Addr().String()
+	settings.cidrBits = vm.Address.Bits()
+	if vm.Gateway.IsValid() {
+		settings.gateway = vm.Gateway.String()
+	}
+
+	if cfg := cniInterface(config); cfg != nil && len(cfg.DNS) > 0 {
+		settings.nameservers = append([]string{}, cfg.DNS...)
+	} else if len(res.DNS.Nameservers) > 0 {
+		settings.nameservers = append([]string{}, res.DNS.Nameservers...)
+	}
+
+	return settings, true
+}
@@ -0,0 +1,86 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+)
+
+// DescribeDomain returns the host resources backing the VM.
+func (d *Driver) DescribeDomain(name string) (*domain.Description, error) {
+	// The version is read before taking the lock, as reading it runs the
+	// CH binary.
+	version, err := d.vmmVersion()
+	if err != nil {
+		d.logger.Debug("unable to read cloud-hypervisor version", "error", err)
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	proc, exists := d.processes[name]
+	if !exists {
+		return nil, fmt.Errorf("VM %s not found", name)
+	}
+
+	desc := &domain.Description{
+		PID:        proc.Pid,
+		APISocket:  proc.APISocket,
+		TAP:        proc.TapName,
+		Bridge:     proc.Bridge,
+		MAC:        proc.MAC,
+		VMMVersion: version,
+	}
+	if proc.IP != "" {
+		desc.IPs = []string{proc.IP}
+	}
+
+	if cfg := proc.Config; cfg != nil {
+		desc.CPUs = cfg.CPUs.BootVCPUs
+		desc.Memory = uint64(cfg.Memory.Size)
+		if cfg.Serial.Mode == "File" {
+			desc.SerialLog = cfg.Serial.File
+		}
+
+		desc.BootMode = "firmware"
+		if cfg.Payload != nil && cfg.Payload.Kernel != "" {
+			desc.BootMode = "kernel"
+			desc.Kernel = cfg.Payload.Kernel
+		}
+
+		for _, device := range cfg.Devices {
+			desc.VFIODevices = append(desc.VFIODevices, device.Path)
+		}
+	}
+
+	return desc, nil
+}
+
+// vmmVersion returns the version reported by the CH binary, such as v48.0.0.
+// It is read once, regardless of whether the binary was validated.
+func (d *Driver) vmmVersion() (string, error) {
+	d.versionLock.Lock()
+	defer d.versionLock.Unlock()
+
+	if d.version != "" {
+		return d.version, nil
+	}
+
+	output, err := exec.Command(d.config.Bin, "--version").Output()
+	if err != nil {
+		return "", err
+	}
+
+	// The version follows the name of the binary.
+	fields := strings.Fields(string(output))
+	if len(fields) < 2 {
+		return "", fmt.Errorf("unexpected cloud-hypervisor version %q", strings.TrimSpace(string(output)))
+	}
+	d.version = fields[len(fields)-1]
+	return d.version, nil
+}
@@ -0,0 +1,93 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestDescribeDomain(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "cloud-hypervisor")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\necho cloud-hypervisor v48.0.0\n"), 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The version is read even though the binary is not validated.
+	d := &Driver{
+		logger:               hclog.NewNullLogger(),
+		config:               &domain.CloudHypervisor{Bin: bin},
+		skipBinaryValidation: true,
+		processes: map[string]*VMProcess{
+			"vm1": {
+				Name:      "vm1",
+				Pid:       1234,
+				APISocket: "/var/lib/ch/vm1/api.sock",
+				TapName:   "tap-vm1",
+				Bridge:    "br0",
+				MAC:       "52:54:00:12:34:56",
+				IP:        "192.168.1.10",
+				Config: &VMConfig{
+					CPUs:    CPUConfig{BootVCPUs: 2, MaxVCPUs: 2},
+					Memory:  MemoryConfig{Size: 512 * 1024 * 1024},
+					Payload: &PayloadConfig{Kernel: "/boot/vmlinuz", Initramfs: "/boot/initramfs.img"},
+					Serial:  SerialConfig{Mode: "File", File: "/var/lib/ch/vm1/serial.log"},
+					Devices: []DeviceConfig{{Path: "/sys/bus/pci/devices/0000:01:00.0"}},
+				},
+			},
+			"vm2": {Name: "vm2", Pid: 5678},
+		},
+	}
+
+	desc, err := d.DescribeDomain("vm1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := &domain.Description{
+		PID:         1234,
+		APISocket:   "/var/lib/ch/vm1/api.sock",
+		SerialLog:   "/var/lib/ch/vm1/serial.log",
+		TAP:         "tap-vm1",
+		Bridge:      "br0",
+		MAC:         "52:54:00:12:34:56",
+		IPs:         []string{"192.168.1.10"},
+		CPUs:        2,
+		Memory:      512 * 1024 * 1024,
+		BootMode:    "kernel",
+		Kernel:      "/boot/vmlinuz",
+		VMMVersion:  "v48.0.0",
+		VFIODevices: []string{"/sys/bus/pci/devices/0000:01:00.0"},
+	}
+	if !reflect.DeepEqual(desc, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, desc)
+	}
+
+	// VMs without a configuration report their process only.
+	desc, err = d.DescribeDomain("vm2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = &domain.Description{PID: 5678, VMMVersion: "v48.0.0"}
+	if !reflect.DeepEqual(desc, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, desc)
+	}
+
+	if _, err := d.DescribeDomain("missing"); err == nil {
+		t.Fatalf("expected error for unknown VM")
+	}
+
+	// The host info reports the major version of the same binary.
+	version, err := d.getCHVersion()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if version != "48" {
+		t.Fatalf("expected version 48, got %q", version)
+	}
+}
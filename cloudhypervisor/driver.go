@@ -18,11 +18,13 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/ccheshirecat/nomad-driver-ch/cloudinit"
 	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	virtNet "github.com/ccheshirecat/nomad-driver-ch/virt/net"
 	"github.com/hashicorp/go-hclog"
 )
 
@@ -36,12 +38,21 @@ const (
 
 	// Default timeouts and intervals
 	defaultShutdownTimeout = 30 * time.Second
-	defaultStartupTimeout  = 60 * time.Second
+	defaultBootTimeout     = 60 * time.Second
 
 	envFilePath  = "/etc/profile.d/virt.sh"
 	envFilePerms = "777"
+
+	// groupLinkBits is the prefix length of the link between a VM and its
+	// allocation network namespace in group network mode.
+	groupLinkBits = 30
 )
 
+// groupLinkNetwork is the network the links between VMs and their allocation
+// network namespace are allocated from in group network mode. Each VM gets a
+// /30, with the namespace side of its TAP acting as the guest's gateway.
+var groupLinkNetwork = netip.MustParsePrefix("169.254.64.0/24")
+
 // VMProcess represents a running VM process with its metadata
 type VMProcess struct {
 	Name          string
@@ -50,11 +61,30 @@ type VMProcess struct {
 	LogFile       string
 	WorkDir       string
 	TapName       string
+	Bridge        string
+	NetNS         string
+	Network       string
+	CNI           *virtNet.CNIAttachment
+	GroupNetwork  *virtNet.GroupNetwork
+	TapFile       *os.File `json:"-"`
+	VtapParent    string
 	MAC           string
 	IP            string
 	VirtiofsdPIDs []int
 	Config        *VMConfig
 	StartedAt     time.Time
+
+	// vmm and virtiofsd supervise the processes started for the VM, which
+	// are reaped once they exit.
+	vmm       *supervisedProcess
+	virtiofsd []*supervisedProcess
+
+	// bootTimeout is how long the VM may take to boot, and readiness the
+	// probes its guest must pass once booted. phoneHome serves the endpoint
+	// cloud-init phones home to, if it is one of the probes.
+	bootTimeout time.Duration
+	readiness   *domain.Readiness
+	phoneHome   *phoneHomeServer
 }
 
 // Driver implements the Virtualizer interface for Cloud Hypervisor
@@ -65,12 +95,35 @@ type Driver struct {
 	vfioConfig    *domain.VFIO
 	dataDir       string
 
+	// namedNetworkConfig is the configuration of the named networks, which
+	// are parsed into namedNetworks when the driver is started.
+	namedNetworkConfig domain.NamedNetworks
+	namedNetworks      []*namedNetwork
+
+	// groupNetworks are the private networks of allocations using a group
+	// network, keyed by allocation ID.
+	groupNetworks map[string]*groupNetwork
+
 	// Registry of running VMs
 	mu        sync.RWMutex
 	processes map[string]*VMProcess
 
-	// HTTP client for Unix socket communication
-	httpClient *http.Client
+	// apiClients are the clients of the API sockets of the VMs, keyed by
+	// socket path, so connections are reused between requests. apiLock
+	// guards access to them.
+	apiClients map[string]*http.Client
+	apiLock    sync.Mutex
+
+	// eventSubs are the subscribers to the events of each VM whose event
+	// monitor is being read, keyed by VM name. eventsLock guards access to
+	// them.
+	eventSubs  map[string]map[chan domain.Event]struct{}
+	eventsLock sync.Mutex
+
+	// version is the full version of the CH binary, read once it can be run
+	// as it is reported for each VM. versionLock guards access to it.
+	version     string
+	versionLock sync.Mutex
 
 	// Cloud-init controller
 	ci CloudInit
@@ -78,12 +131,21 @@ type Driver struct {
 	// IP allocation state
 	allocatedIPs map[string]bool // IP -> allocated
 
+	// MAC address allocation state
+	macs *macAllocator
+
 	// Parsed network configuration for quick reuse
 	ipPoolStart netip.Addr
 	ipPoolEnd   netip.Addr
 	subnet      netip.Prefix
 	gatewayIP   netip.Addr
 
+	// metrics are the Cloud Hypervisor API metrics recorded by the driver,
+	// and metricsState the snapshot of the state reported by the other
+	// metrics.
+	metrics      *driverMetrics
+	metricsState atomic.Pointer[metricsSnapshot]
+
 	// For testing - skip binary validation
 	skipBinaryValidation bool
 }
@@ -134,21 +196,60 @@ func (d *Driver) deriveNetworkSettings(config *domain.Config, proc *VMProcess) (
 	settings := networkSettings{
 		interfaceName: "eth0",
 		cidrBits:      -1,
-		nameservers:   []string{"8.8.8.8", "8.8.4.4"},
+		nameservers:   append([]string{}, virtNet.DefaultNameservers...),
 	}
 
 	if proc != nil && proc.IP != "" {
 		settings.address = proc.IP
 	}
 
-	if d.subnet.IsValid() {
-		settings.cidrBits = d.subnet.Bits()
+	// VMs attached by CNI plugins take their addressing from the result.
+	if proc != nil && proc.CNI != nil {
+		return cniNetworkSettings(settings, config, proc.CNI)
+	}
+
+	// VMs attached directly to a host interface are addressed by its network.
+	if _, vtap := vtapInterface(config); vtap != nil {
+		return vtapNetworkSettings(settings, vtap)
 	}
 
-	if d.gatewayIP.IsValid() {
-		settings.gateway = d.gatewayIP.String()
-	} else if d.networkConfig != nil && d.networkConfig.Gateway != "" {
-		settings.gateway = d.networkConfig.Gateway
+	// In group network mode the VM sits behind its allocation network
+	// namespace, which routes for it over a point-to-point link. Only the
+	// nameservers can be overridden.
+	if config != nil && config.NetNS != "" {
+		if link, ok := groupLinkFor(settings.address); ok {
+			settings.gateway = link.gateway.String()
+		}
+		settings.cidrBits = groupLinkBits
+		if len(config.NetworkInterfaces) > 0 && config.NetworkInterfaces[0].Bridge != nil &&
+			len(config.NetworkInterfaces[0].Bridge.DNS) > 0 {
+			settings.nameservers = append([]string{}, config.NetworkInterfaces[0].Bridge.DNS...)
+		}
+		return settings, settings.address != ""
+	}
+
+	if network := d.procNetwork(proc); network != nil {
+		settings.cidrBits = network.subnet.Bits()
+		settings.gateway = network.gatewayIP.String()
+		if len(network.config.DNS) > 0 {
+			settings.nameservers = append([]string{}, network.config.DNS...)
+		}
+	} else {
+		if d.subnet.IsValid() {
+			settings.cidrBits = d.subnet.Bits()
+		}
+
+		if d.gatewayIP.IsValid() {
+			settings.gateway = d.gatewayIP.String()
+		} else if d.networkConfig != nil && d.networkConfig.Gateway != "" {
+			settings.gateway = d.networkConfig.Gateway
+		}
+
+		// The embedded resolver listens on the driver gateway, so hand it to
+		// guests attached to the driver bridge in place of the public defaults.
+		if d.networkConfig.ResolverEnabled() && settings.gateway != "" && d.usesDriverBridge(config) {
+			settings.nameservers = []string{settings.gateway}
+		}
 	}
 
 	if config != nil && len(config.NetworkInterfaces) > 0 {
@@ -183,6 +284,34 @@ func (d *Driver) deriveNetworkSettings(config *domain.Config, proc *VMProcess) (
 	return settings, true
 }
 
+// usesDriverBridge reports whether the VM's first interface is attached to
+// the bridge configured within the driver.
+func (d *Driver) usesDriverBridge(config *domain.Config) bool {
+	if config != nil && (config.NetNS != "" || cniInterface(config) != nil) {
+		return false
+	}
+	if _, vtap := vtapInterface(config); vtap != nil {
+		return false
+	}
+	if config == nil || len(config.NetworkInterfaces) == 0 || config.NetworkInterfaces[0].Bridge == nil {
+		return true
+	}
+	if config.NetworkInterfaces[0].Bridge.Network != "" || config.NetworkInterfaces[0].Bridge.GroupNetwork {
+		return false
+	}
+	name := config.NetworkInterfaces[0].Bridge.Name
+	return name == "" || name == d.networkConfig.Bridge
+}
+
+// procNetwork returns the named network the VM is attached to, or nil if it
+// uses the driver network.
+func (d *Driver) procNetwork(proc *VMProcess) *namedNetwork {
+	if proc == nil {
+		return nil
+	}
+	return d.namedNetwork(proc.Network)
+}
+
 func envFileFromMap(env map[string]string) (domain.File, bool) {
 	if len(env) == 0 {
 		return domain.File{}, false
@@ -232,6 +361,8 @@ type VMConfig struct {
 	Devices  []DeviceConfig  `json:"devices,omitempty"`
 	Console  ConsoleConfig   `json:"console"`
 	Serial   SerialConfig    `json:"serial"`
+	PVPanic  bool            `json:"pvpanic,omitempty"`
+	Watchdog bool            `json:"watchdog,omitempty"`
 }
 
 type CPUConfig struct {
@@ -261,10 +392,30 @@ type DiskConfig struct {
 }
 
 type NetConfig struct {
-	Tap  string `json:"tap"`
+	Tap  string `json:"tap,omitempty"`
 	MAC  string `json:"mac"`
 	IP   string `json:"ip,omitempty"`
 	Mask string `json:"mask,omitempty"`
+	FDs  []int  `json:"fds,omitempty"`
+
+	NumQueues   int   `json:"num_queues,omitempty"`
+	QueueSize   int   `json:"queue_size,omitempty"`
+	MTU         int   `json:"mtu,omitempty"`
+	OffloadTSO  *bool `json:"offload_tso,omitempty"`
+	OffloadCsum *bool `json:"offload_csum,omitempty"`
+
+	RateLimiterConfig *RateLimiterConfig `json:"rate_limiter_config,omitempty"`
+}
+
+type RateLimiterConfig struct {
+	Bandwidth *TokenBucketConfig `json:"bandwidth,omitempty"`
+	Ops       *TokenBucketConfig `json:"ops,omitempty"`
+}
+
+type TokenBucketConfig struct {
+	Size         int64 `json:"size"`
+	OneTimeBurst int64 `json:"one_time_burst,omitempty"`
+	RefillTime   int64 `json:"refill_time"` // milliseconds
 }
 
 type RNGConfig struct {
@@ -315,7 +466,12 @@ type SerialConfig struct {
 
 // VMInfo represents the response from CH vm.info API
 type VMInfo struct {
-	State  string `json:"state"`
+	State string `json:"state"`
+
+	// MemoryActualSize is the memory available to the guest, which is less
+	// than configured while a balloon is inflated.
+	MemoryActualSize uint64 `json:"memory_actual_size"`
+
 	Memory struct {
 		ActualSize uint64 `json:"actual_size"`
 		LastUpdate uint64 `json:"last_update_ts"`
@@ -326,30 +482,26 @@ type VMInfo struct {
 }
 
 // New creates a new Cloud Hypervisor driver
-func New(ctx context.Context, logger hclog.Logger, config *domain.CloudHypervisor, netConfig *domain.Network, vfioConfig *domain.VFIO, dataDir string) *Driver {
-	return NewWithSkipValidation(ctx, logger, config, netConfig, vfioConfig, dataDir, false)
+func New(ctx context.Context, logger hclog.Logger, config *domain.CloudHypervisor, netConfig *domain.Network, namedNetworks domain.NamedNetworks, vfioConfig *domain.VFIO, dataDir string) *Driver {
+	return NewWithSkipValidation(ctx, logger, config, netConfig, namedNetworks, vfioConfig, dataDir, false)
 }
 
 // NewWithSkipValidation creates a new Cloud Hypervisor driver with optional binary validation skip
-func NewWithSkipValidation(ctx context.Context, logger hclog.Logger, config *domain.CloudHypervisor, netConfig *domain.Network, vfioConfig *domain.VFIO, dataDir string, skipValidation bool) *Driver {
+func NewWithSkipValidation(ctx context.Context, logger hclog.Logger, config *domain.CloudHypervisor, netConfig *domain.Network, namedNetworks domain.NamedNetworks, vfioConfig *domain.VFIO, dataDir string, skipValidation bool) *Driver {
 	d := &Driver{
 		logger:               logger.Named("cloud-hypervisor"),
 		config:               config,
 		networkConfig:        netConfig,
+		namedNetworkConfig:   namedNetworks,
 		vfioConfig:           vfioConfig,
 		dataDir:              dataDir,
 		processes:            make(map[string]*VMProcess),
 		allocatedIPs:         make(map[string]bool),
+		macs:                 newMACAllocator(),
+		metrics:              newDriverMetrics(),
 		skipBinaryValidation: skipValidation,
-		httpClient: &http.Client{
-			Transport: &http.Transport{
-				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-					// This will be overridden per request with the actual socket path
-					return nil, fmt.Errorf("socket path not set")
-				},
-			},
-			Timeout: 30 * time.Second,
-		},
+		apiClients:           make(map[string]*http.Client),
+		eventSubs:            make(map[string]map[chan domain.Event]struct{}),
 	}
 
 	d.initializeNetworkConfig()
@@ -421,7 +573,9 @@ func (d *Driver) initializeNetworkConfig() {
 
 }
 
-func (d *Driver) ensureBridgeConfigured() error {
+// ensureBridgeConfigured creates the bridge of a network, if it does not
+// exist, and assigns it the gateway address.
+func (d *Driver) ensureBridgeConfigured(bridge string, gatewayIP netip.Addr, subnet netip.Prefix) error {
 	ipPath, err := findIPCommand()
 	if err != nil {
 		// When running in test environments we may not have ip; skip silently.
@@ -431,7 +585,6 @@ func (d *Driver) ensureBridgeConfigured() error {
 		return err
 	}
 
-	bridge := d.networkConfig.Bridge
 	if bridge == "" {
 		return fmt.Errorf("bridge name not provided")
 	}
@@ -450,8 +603,8 @@ func (d *Driver) ensureBridgeConfigured() error {
 		return fmt.Errorf("unable to read bridge addresses: %w (output: %s)", addrErr, strings.TrimSpace(string(addrOutput)))
 	}
 
-	if !strings.Contains(string(addrOutput), d.gatewayIP.String()) {
-		cidr := fmt.Sprintf("%s/%d", d.gatewayIP.String(), d.subnet.Bits())
+	if !strings.Contains(string(addrOutput), gatewayIP.String()) {
+		cidr := fmt.Sprintf("%s/%d", gatewayIP.String(), subnet.Bits())
 		if output, addErr := exec.Command(ipPath, "addr", "add", cidr, "dev", bridge).CombinedOutput(); addErr != nil {
 			if !strings.Contains(strings.ToLower(string(output)), "file exists") {
 				return fmt.Errorf("unable to assign %s to %s: %w (output: %s)", cidr, bridge, addErr, strings.TrimSpace(string(output)))
@@ -539,15 +692,45 @@ func (d *Driver) Start(dataDir string) error {
 		return fmt.Errorf("invalid network configuration: %w", err)
 	}
 
-	if err := d.ensureBridgeConfigured(); err != nil {
+	if err := d.initializeNamedNetworks(); err != nil {
+		return fmt.Errorf("invalid network configuration: %w", err)
+	}
+
+	if err := d.validateGroupNetworkConfig(); err != nil {
+		return fmt.Errorf("invalid network configuration: %w", err)
+	}
+
+	if err := d.ensureBridgeConfigured(d.networkConfig.Bridge, d.gatewayIP, d.subnet); err != nil {
 		return fmt.Errorf("failed to configure bridge %s: %w", d.networkConfig.Bridge, err)
 	}
 
+	for _, n := range d.namedNetworks {
+		if err := d.ensureBridgeConfigured(n.config.Bridge, n.gatewayIP, n.subnet); err != nil {
+			return fmt.Errorf("failed to configure bridge %s of network %q: %w", n.config.Bridge, n.config.Name, err)
+		}
+	}
+
 	// Ensure data directory exists
 	if err := os.MkdirAll(d.dataDir, 0755); err != nil {
 		return fmt.Errorf("failed to create data directory: %w", err)
 	}
 
+	if err := d.macs.load(filepath.Join(d.dataDir, macAssignmentsFile)); err != nil {
+		return err
+	}
+
+	if err := d.loadGroupNetworks(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	err = d.recoverDomains()
+	d.snapshotMetrics()
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
 	d.logger.Info("cloud hypervisor driver started successfully",
 		"data_dir", d.dataDir,
 		"ch_binary", d.config.Bin)
@@ -594,6 +777,7 @@ func (d *Driver) validateBinaries() error {
 func (d *Driver) CreateDomain(config *domain.Config, env map[string]string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	defer d.snapshotMetrics()
 
 	// Check if VM already exists
 	if _, exists := d.processes[config.Name]; exists {
@@ -615,11 +799,88 @@ func (d *Driver) CreateDomain(config *domain.Config, env map[string]string) erro
 		APISocket: filepath.Join(workDir, "api.sock"),
 		LogFile:   filepath.Join(workDir, "vmm.log"),
 		StartedAt: time.Now(),
+
+		bootTimeout: config.BootTimeout,
+		readiness:   config.Readiness,
+	}
+	if proc.bootTimeout <= 0 {
+		proc.bootTimeout = defaultBootTimeout
 	}
 
-	// Allocate IP address - use task-specific static IP if provided, otherwise allocate from pool
+	// A VM attached by CNI plugins must be detached if it fails to start, as
+	// the network teardown only runs for started VMs.
+	created := false
+	defer func() {
+		if !created {
+			d.stopPhoneHome(proc)
+			d.detachCNI(proc)
+			d.leaveGroupNetwork(config.Name)
+			d.releaseMAC(config.Name)
+		}
+	}()
+
+	// Allocate IP address - use the address assigned by CNI plugins, the
+	// static IP of a VM attached to a host interface, an address of the
+	// group network of its allocation or the named network the VM is
+	// attached to, a link address within the
+	// allocation network namespace in group mode, the task-specific static
+	// IP if provided, otherwise allocate from pool
 	var ip string
-	if len(config.NetworkInterfaces) > 0 && config.NetworkInterfaces[0].Bridge != nil && config.NetworkInterfaces[0].Bridge.StaticIP != "" {
+	if cniCfg := cniInterface(config); cniCfg != nil {
+		if err := d.attachCNI(config, proc, cniCfg); err != nil {
+			return err
+		}
+		ip = proc.IP
+	} else if kind, vtap := vtapInterface(config); vtap != nil {
+		if config.NetNS != "" {
+			return fmt.Errorf("%s network interfaces cannot be used with group network mode", kind)
+		}
+		ip = vtap.StaticIP
+		proc.VtapParent = vtap.Parent
+
+		// The guest of an ipvtap device must use the address of the parent.
+		if kind == "ipvtap" {
+			mac, err := interfaceMAC(vtap.Parent)
+			if err != nil {
+				return err
+			}
+			proc.MAC = mac
+		}
+	} else if bridge := groupBridgeInterface(config); bridge != nil {
+		if config.NetNS != "" {
+			return fmt.Errorf("group networks cannot be used with group network mode")
+		}
+		network, groupIP, err := d.joinGroupNetwork(config.AllocID, config.Name, bridge.StaticIP)
+		if err != nil {
+			return fmt.Errorf("failed to join group network: %w", err)
+		}
+		ip = groupIP
+		proc.Network = network.config.Name
+		proc.GroupNetwork = network.info()
+		d.logger.Debug("allocated IP from group network", "ip", ip, "bridge", network.config.Bridge, "vm", config.Name)
+	} else if name := bridgeNetwork(config); name != "" {
+		if config.NetNS != "" {
+			return fmt.Errorf("named networks cannot be used with group network mode")
+		}
+		network := d.namedNetwork(name)
+		if network == nil {
+			return fmt.Errorf("network %q is not configured within the driver", name)
+		}
+		var err error
+		if ip, err = network.reserveIP(config.NetworkInterfaces[0].Bridge.StaticIP); err != nil {
+			return fmt.Errorf("failed to allocate IP on network %q: %w", name, err)
+		}
+		proc.Network = name
+		d.logger.Debug("allocated IP from named network", "ip", ip, "network", name, "vm", config.Name)
+	} else if config.NetNS != "" {
+		link, err := d.allocateGroupLink(config.NetNS)
+		if err != nil {
+			return fmt.Errorf("failed to allocate IP: %w", err)
+		}
+		ip = link.guest.String()
+		proc.NetNS = config.NetNS
+		d.logger.Debug("allocated group network link", "ip", ip, "netns", config.NetNS, "vm", config.Name)
+	} else if len(config.NetworkInterfaces) > 0 && config.NetworkInterfaces[0].Bridge != nil && config.NetworkInterfaces[0].Bridge.StaticIP != "" {
 		// Use task-specified static IP
 		ip = config.NetworkInterfaces[0].Bridge.StaticIP
 		if d.subnet.IsValid() {
@@ -668,30 +929,59 @@ func (d *Driver) CreateDomain(config *domain.Config, env map[string]string) erro
 		config.Files = upsertFile(config.Files, file)
 	}
 
-	// Generate MAC address deterministically
-	proc.MAC = d.generateMAC(config.Name)
+	// Allocate the MAC address, unless the CNI plugins or an ipvtap device
+	// require the guest to use a specific one
+	if proc.MAC == "" {
+		var requested string
+		if iface := firstInterface(config); iface != nil {
+			requested = iface.MAC
+		}
+		mac, err := d.macs.allocate(config.Name, requested, d.runningMACs())
+		if err != nil {
+			d.deallocateIP(proc.Network, ip)
+			return fmt.Errorf("failed to allocate MAC address: %w", err)
+		}
+		proc.MAC = mac
+	}
 
 	// Generate short TAP name to fit Linux's 15-char limit (IFNAMSIZ)
-	// Use prefix + hash of name + current nanosecond time for uniqueness
-	uniqueStr := fmt.Sprintf("%s-%d", config.Name, time.Now().UnixNano())
-	nameHash := fmt.Sprintf("%x", sha256.Sum256([]byte(uniqueStr)))[:8]
-	proc.TapName = d.networkConfig.TAPPrefix + nameHash
+	// Use prefix + hash of name + current nanosecond time for uniqueness.
+	// TAPs created by CNI plugins are named by the plugins.
+	if proc.TapName == "" {
+		uniqueStr := fmt.Sprintf("%s-%d", config.Name, time.Now().UnixNano())
+		nameHash := fmt.Sprintf("%x", sha256.Sum256([]byte(uniqueStr)))[:8]
+		proc.TapName = d.networkConfig.TAPPrefix + nameHash
+	}
+
+	// A guest phoning home once ready reaches the driver on its gateway.
+	if proc.readiness != nil && proc.readiness.PhoneHome {
+		if err := d.startPhoneHome(config, proc); err != nil {
+			d.deallocateIP(proc.Network, ip)
+			return fmt.Errorf("failed to start phone home endpoint: %w", err)
+		}
+	}
 
 	// Create cloud-init ISO
-	if err := d.createCloudInit(config, proc, workDir); err != nil {
-		d.deallocateIP(ip)
+	if err := config.ReportPhase.Run(domain.PhaseCloudInitBuilt, func() error {
+		return d.createCloudInit(config, proc, workDir)
+	}); err != nil {
+		d.deallocateIP(proc.Network, ip)
 		return fmt.Errorf("failed to create cloud-init: %w", err)
 	}
 
 	// Setup networking (create TAP interface)
-	if err := d.setupNetworking(config, proc); err != nil {
-		d.deallocateIP(ip)
+	if err := config.ReportPhase.Run(domain.PhaseTAPCreated, func() error {
+		return d.setupNetworking(config, proc)
+	}); err != nil {
+		d.deallocateIP(proc.Network, ip)
 		return fmt.Errorf("failed to setup networking: %w", err)
 	}
 
 	// Start virtiofsd processes for mounts
-	if err := d.startVirtiofsd(config, proc); err != nil {
-		d.deallocateIP(ip)
+	if err := config.ReportPhase.Run(domain.PhaseVirtiofsdStarted, func() error {
+		return d.startVirtiofsd(config, proc)
+	}); err != nil {
+		d.deallocateIP(proc.Network, ip)
 		d.cleanupNetworking(config, proc)
 		d.cleanupProcess(config, proc)
 		return fmt.Errorf("failed to start virtiofsd: %w", err)
@@ -700,7 +990,7 @@ func (d *Driver) CreateDomain(config *domain.Config, env map[string]string) erro
 	// Build CH VM configuration
 	vmConfig, err := d.buildVMConfig(config, proc)
 	if err != nil {
-		d.deallocateIP(ip)
+		d.deallocateIP(proc.Network, ip)
 		d.cleanupNetworking(config, proc)
 		d.stopVirtiofsd(proc)
 		d.cleanupProcess(config, proc)
@@ -709,7 +999,7 @@ func (d *Driver) CreateDomain(config *domain.Config, env map[string]string) erro
 
 	// Add VFIO devices if configured
 	if err := d.addVFIODevices(config, vmConfig); err != nil {
-		d.deallocateIP(ip)
+		d.deallocateIP(proc.Network, ip)
 		d.cleanupNetworking(config, proc)
 		d.stopVirtiofsd(proc)
 		return fmt.Errorf("failed to add VFIO devices: %w", err)
@@ -718,8 +1008,10 @@ func (d *Driver) CreateDomain(config *domain.Config, env map[string]string) erro
 	proc.Config = vmConfig
 
 	// Start Cloud Hypervisor process
-	if err := d.startCHProcess(proc); err != nil {
-		d.deallocateIP(ip)
+	if err := config.ReportPhase.Run(domain.PhaseVMMStarted, func() error {
+		return d.startCHProcess(proc)
+	}); err != nil {
+		d.deallocateIP(proc.Network, ip)
 		d.cleanupNetworking(config, proc)
 		d.stopVirtiofsd(proc)
 		d.cleanupProcess(config, proc)
@@ -727,14 +1019,21 @@ func (d *Driver) CreateDomain(config *domain.Config, env map[string]string) erro
 	}
 
 	// Create and boot VM via REST API
-	if err := d.createAndBootVM(proc); err != nil {
+	if err := config.ReportPhase.Run(domain.PhaseVMBooted, func() error {
+		return d.createAndBootVM(proc)
+	}); err != nil {
 		d.cleanupProcess(config, proc)
-		d.deallocateIP(ip)
+		d.deallocateIP(proc.Network, ip)
 		return fmt.Errorf("failed to create/boot VM: %w", err)
 	}
 
 	// Register the process
 	d.processes[config.Name] = proc
+	created = true
+
+	if err := d.saveVMState(proc); err != nil {
+		d.logger.Warn("failed to persist VM state, it cannot be recovered", "name", config.Name, "error", err)
+	}
 
 	d.logger.Info("VM created successfully",
 		"name", config.Name,
@@ -761,11 +1060,7 @@ func (d *Driver) StopDomain(name string) error {
 	if err := d.shutdownVM(proc); err != nil {
 		d.logger.Warn("graceful shutdown failed, forcing stop", "vm", name, "error", err)
 		// Force kill the process
-		if proc.Pid > 0 {
-			if process, err := os.FindProcess(proc.Pid); err == nil {
-				process.Kill()
-			}
-		}
+		d.killVMM(proc)
 	}
 
 	return nil
@@ -775,9 +1070,15 @@ func (d *Driver) StopDomain(name string) error {
 func (d *Driver) DestroyDomain(name string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	defer d.snapshotMetrics()
 
 	proc, exists := d.processes[name]
 	if !exists {
+		// VMs which could not be recovered after a driver restart are not
+		// tracked, but are still detached from their group network, so it
+		// is removed once empty, and release their persisted MAC address.
+		d.leaveGroupNetwork(name)
+		d.releaseMAC(name)
 		return fmt.Errorf("VM %s not found", name)
 	}
 
@@ -789,8 +1090,10 @@ func (d *Driver) DestroyDomain(name string) error {
 	// Cleanup everything
 	d.cleanupProcess(nil, proc)
 
-	// Deallocate IP
-	d.deallocateIP(proc.IP)
+	// Deallocate IP and MAC addresses
+	d.deallocateIP(proc.Network, proc.IP)
+	d.leaveGroupNetwork(name)
+	d.releaseMAC(name)
 
 	// Remove from registry
 	delete(d.processes, name)
@@ -815,6 +1118,7 @@ func (d *Driver) GetInfo() (domain.VirtualizerInfo, error) {
 	// Count running VMs
 	d.mu.RLock()
 	info.RunningDomains = uint(len(d.processes))
+	info.FreeAddresses = d.freeAddresses()
 	d.mu.RUnlock()
 
 	// TODO: Get actual host memory/CPU info if needed
@@ -823,27 +1127,19 @@ func (d *Driver) GetInfo() (domain.VirtualizerInfo, error) {
 	return info, nil
 }
 
-// getCHVersion extracts version from cloud-hypervisor --version
+// getCHVersion extracts the major version from cloud-hypervisor --version
 func (d *Driver) getCHVersion() (string, error) {
-	cmd := exec.Command(d.config.Bin, "--version")
-	output, err := cmd.Output()
+	version, err := d.vmmVersion()
 	if err != nil {
 		return "", err
 	}
 
-	// Parse "cloud-hypervisor v48.0.0" -> "48"
-	versionStr := strings.TrimSpace(string(output))
-	parts := strings.Fields(versionStr)
-	if len(parts) >= 2 {
-		version := strings.TrimPrefix(parts[1], "v")
-		// Extract major version number
-		if dotIndex := strings.Index(version, "."); dotIndex > 0 {
-			return version[:dotIndex], nil
-		}
-		return version, nil
+	// Parse "v48.0.0" -> "48"
+	version = strings.TrimPrefix(version, "v")
+	if dotIndex := strings.Index(version, "."); dotIndex > 0 {
+		return version[:dotIndex], nil
 	}
-
-	return "0", nil
+	return version, nil
 }
 
 // GetNetworkInterfaces returns network interface information for a VM
@@ -859,13 +1155,24 @@ func (d *Driver) GetNetworkInterfaces(name string) ([]domain.NetworkInterface, e
 	// Return interface info from our stored configuration
 	interfaces := []domain.NetworkInterface{
 		{
-			NetworkName: d.networkConfig.Bridge,
-			DeviceName:  proc.TapName,
-			MAC:         proc.MAC,
-			Model:       "virtio",
-			Driver:      "virtio-net",
+			NetworkName:  d.networkConfig.Bridge,
+			DeviceName:   proc.TapName,
+			MAC:          proc.MAC,
+			Model:        "virtio",
+			Driver:       "virtio-net",
+			CNI:          proc.CNI,
+			GroupNetwork: proc.GroupNetwork,
 		},
 	}
+	if proc.Network != "" {
+		interfaces[0].NetworkName = proc.Network
+	}
+	if proc.CNI != nil {
+		interfaces[0].NetworkName = proc.CNI.Network
+	}
+	if proc.VtapParent != "" {
+		interfaces[0].NetworkName = proc.VtapParent
+	}
 
 	// Parse IP address if available
 	if proc.IP != "" {
@@ -887,16 +1194,46 @@ func (d *Driver) GetDomain(name string) (*domain.Info, error) {
 		return nil, nil // VM not found
 	}
 
+	// A VMM which has exited no longer runs the VM.
+	if proc.vmm != nil {
+		if exit, exited := proc.vmm.Exited(); exited {
+			if !exit.Stopped && exit.ExitCode != 0 {
+				return &domain.Info{
+					State: CHStateCrashed,
+					Exit:  exit,
+				}, nil
+			}
+			return &domain.Info{
+				State:         CHStateShutoff,
+				Exit:          exit,
+				GuestExitCode: d.guestExitCode(proc),
+			}, nil
+		}
+	}
+
 	// Query VM info via REST API
 	info, err := d.getVMInfo(proc)
 	if err != nil {
+		// A supervised VMM which has not exited is still running.
+		if proc.vmm != nil {
+			processes, cpuTime := d.processStats(proc)
+			return &domain.Info{
+				State:     CHStateRunning,
+				CPUTime:   cpuTime,
+				Processes: processes,
+			}, nil
+		}
+
 		// If REST API fails, check if process is still running
 		if proc.Pid > 0 {
 			if process, err := os.FindProcess(proc.Pid); err == nil {
 				if err := process.Signal(syscall.Signal(0)); err == nil {
 					// Process exists, assume running
+					processes, cpuTime := d.processStats(proc)
 					return &domain.Info{
-						State: CHStateRunning,
+						State:     CHStateRunning,
+						CPUTime:   cpuTime,
+						Processes: processes,
 					}, nil
 				}
 			}
@@ -909,12 +1246,40 @@ func (d *Driver) GetDomain(name string) (*domain.Info, error) {
 
 	// Map CH state to domain state
 	domainState := mapCHState(info.State)
+	var guestExitCode *int
+	if domainState == CHStateShutdown || domainState == CHStateShutoff {
+		guestExitCode = d.guestExitCode(proc)
+	}
+
+	// The guest memory is reduced from the configured size by any balloon.
+	// How much of it the guest uses is unknown, as the balloon of CH does not
+	// report guest memory statistics.
+	memory := info.MemoryActualSize
+	if memory == 0 {
+		memory = info.Memory.ActualSize
+	}
+	maxMemory := memory
+	if proc.Config != nil && proc.Config.Memory.Size > 0 {
+		maxMemory = uint64(proc.Config.Memory.Size)
+	}
+
+	processes, cpuTime := d.processStats(proc)
+
+	// Counters are only available once the VM has booted.
+	counters, err := d.getVMCounters(proc)
+	if err != nil {
+		d.logger.Trace("unable to read VM counters", "vm", name, "error", err)
+	}
 
 	return &domain.Info{
 		State:     domainState,
-		Memory:    info.Memory.ActualSize,
-		MaxMemory: info.Memory.ActualSize, // CH doesn't distinguish
-		CPUTime:   0,                      // TODO: extract if available
+		Memory:    memory,
+		MaxMemory: maxMemory,
+		CPUTime:   cpuTime,
+		Processes: processes,
+		Counters:  counters,
+
+		GuestExitCode: guestExitCode,
 	}, nil
 }
 
@@ -924,59 +1289,78 @@ func (d *Driver) allocateIP() (string, error) {
 	if !d.ipPoolStart.IsValid() || !d.ipPoolEnd.IsValid() {
 		return "", fmt.Errorf("IP pool is not configured; set network.ip_pool_start and network.ip_pool_end")
 	}
+	return allocatePoolIP(d.allocatedIPs, d.subnet, d.gatewayIP, d.ipPoolStart, d.ipPoolEnd)
+}
 
-	for ip := d.ipPoolStart; ; {
-		if d.subnet.IsValid() && !d.subnet.Contains(ip) {
-			return "", fmt.Errorf("allocated IP %s is outside configured subnet %s", ip.String(), d.subnet.String())
-		}
+// deallocateIP releases an address allocated from the named network, or the
+// driver network if empty.
+func (d *Driver) deallocateIP(network, ip string) {
+	if n := d.namedNetwork(network); n != nil {
+		delete(n.allocatedIPs, ip)
+		return
+	}
+	delete(d.allocatedIPs, ip)
+}
 
-		if d.gatewayIP.IsValid() && ip == d.gatewayIP {
-			if ip == d.ipPoolEnd {
-				break
-			}
-			next := ip.Next()
-			if !next.IsValid() {
-				break
-			}
-			ip = next
-			continue
-		}
+// groupLink is the addressing of the link between a VM and its allocation
+// network namespace.
+type groupLink struct {
+	gateway netip.Addr
+	guest   netip.Addr
+}
 
-		ipStr := ip.String()
-		if !d.allocatedIPs[ipStr] {
-			d.allocatedIPs[ipStr] = true
-			return ipStr, nil
-		}
+// groupLinkFor returns the link the guest address belongs to.
+func groupLinkFor(guest string) (groupLink, bool) {
+	addr, err := netip.ParseAddr(guest)
+	if err != nil || !groupLinkNetwork.Contains(addr) {
+		return groupLink{}, false
+	}
+	base := netip.PrefixFrom(addr, groupLinkBits).Masked().Addr()
+	return groupLink{gateway: base.Next(), guest: base.Next().Next()}, true
+}
 
-		if ip == d.ipPoolEnd {
-			break
+// allocateGroupLink returns the first link not used by another VM within the
+// network namespace. The caller must hold d.mu.
+func (d *Driver) allocateGroupLink(netns string) (groupLink, error) {
+	used := make(map[string]bool)
+	for _, proc := range d.processes {
+		if proc.NetNS == netns {
+			used[proc.IP] = true
 		}
+	}
 
-		next := ip.Next()
-		if !next.IsValid() {
-			break
+	base := groupLinkNetwork.Addr()
+	for groupLinkNetwork.Contains(base) {
+		link, _ := groupLinkFor(base.Next().Next().String())
+		if !used[link.guest.String()] {
+			return link, nil
+		}
+		for range 1 << (32 - groupLinkBits) {
+			base = base.Next()
 		}
-		ip = next
 	}
 
-	return "", fmt.Errorf("no available IPs in pool %s-%s", d.ipPoolStart.String(), d.ipPoolEnd.String())
+	return groupLink{}, fmt.Errorf("no available links in %s for network namespace %s", groupLinkNetwork, netns)
 }
 
-func (d *Driver) deallocateIP(ip string) {
-	delete(d.allocatedIPs, ip)
+// runningMACs returns the MAC addresses of the running VMs. The caller must
+// hold d.mu.
+func (d *Driver) runningMACs() map[string]bool {
+	macs := make(map[string]bool, len(d.processes))
+	for _, proc := range d.processes {
+		if proc.MAC != "" {
+			macs[proc.MAC] = true
+		}
+	}
+	return macs
 }
 
-func (d *Driver) generateMAC(vmName string) string {
-	// Generate deterministic MAC address based on VM name
-	// Use a simple hash-based approach
-	hash := 0
-	for _, c := range vmName {
-		hash = hash*31 + int(c)
+// releaseMAC releases the MAC address assigned to a VM. The caller must hold
+// d.mu.
+func (d *Driver) releaseMAC(name string) {
+	if err := d.macs.release(name); err != nil {
+		d.logger.Warn("failed to release MAC address", "vm", name, "error", err)
 	}
-
-	// Generate MAC with 52:54:00 prefix (QEMU/KVM range)
-	return fmt.Sprintf("52:54:00:%02x:%02x:%02x",
-		byte(hash>>16), byte(hash>>8), byte(hash))
 }
 
 func mapCHState(chState string) string {
@@ -2,6 +2,11 @@ package cloudhypervisor
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -152,3 +157,560 @@ func TestBuildVMConfigAddsKernelIPParam(t *testing.T) {
 		t.Fatalf("unexpected net mask %q", vmConfig.Net[0].Mask)
 	}
 }
+
+func TestDeriveNetworkSettingsResolver(t *testing.T) {
+	d := &Driver{
+		logger: hclog.NewNullLogger(),
+		networkConfig: &domain.Network{
+			Bridge:  "br0",
+			Gateway: "192.168.254.1",
+			DNS:     &domain.DNS{Enabled: true},
+		},
+	}
+	d.subnet = netip.MustParsePrefix("192.168.254.0/24")
+	d.gatewayIP = netip.MustParseAddr("192.168.254.1")
+
+	settings, _ := d.deriveNetworkSettings(&domain.Config{}, &VMProcess{IP: "192.168.254.10"})
+	if len(settings.nameservers) != 1 || settings.nameservers[0] != "192.168.254.1" {
+		t.Fatalf("expected resolver nameserver, got %#v", settings.nameservers)
+	}
+
+	// Task provided nameservers still take precedence.
+	cfg := &domain.Config{
+		NetworkInterfaces: virtNet.NetworkInterfacesConfig{
+			&virtNet.NetworkInterfaceConfig{
+				Bridge: &virtNet.NetworkInterfaceBridgeConfig{Name: "br0", DNS: []string{"1.1.1.1"}},
+			},
+		},
+	}
+	settings, _ = d.deriveNetworkSettings(cfg, &VMProcess{IP: "192.168.254.10"})
+	if len(settings.nameservers) != 1 || settings.nameservers[0] != "1.1.1.1" {
+		t.Fatalf("unexpected nameservers %#v", settings.nameservers)
+	}
+
+	// The resolver is not reachable from other bridges.
+	cfg.NetworkInterfaces[0].Bridge = &virtNet.NetworkInterfaceBridgeConfig{Name: "br1"}
+	settings, _ = d.deriveNetworkSettings(cfg, &VMProcess{IP: "192.168.254.10"})
+	if len(settings.nameservers) != 2 || settings.nameservers[0] != "8.8.8.8" {
+		t.Fatalf("unexpected nameservers %#v", settings.nameservers)
+	}
+}
+
+func TestDeriveNetworkSettingsGroup(t *testing.T) {
+	d := &Driver{
+		logger:        hclog.NewNullLogger(),
+		networkConfig: &domain.Network{Bridge: "br0", Gateway: "192.168.254.1"},
+	}
+	d.subnet = netip.MustParsePrefix("192.168.254.0/24")
+	d.gatewayIP = netip.MustParseAddr("192.168.254.1")
+
+	cfg := &domain.Config{
+		NetNS: "/var/run/netns/alloc",
+		NetworkInterfaces: virtNet.NetworkInterfacesConfig{
+			&virtNet.NetworkInterfaceConfig{
+				Bridge: &virtNet.NetworkInterfaceBridgeConfig{Name: "br0", Gateway: "10.0.0.1"},
+			},
+		},
+	}
+	if d.usesDriverBridge(cfg) {
+		t.Fatalf("expected group mode VM not to use the driver bridge")
+	}
+
+	settings, ok := d.deriveNetworkSettings(cfg, &VMProcess{IP: "169.254.64.6"})
+	if !ok {
+		t.Fatalf("expected settings for proc IP")
+	}
+	if settings.cidrBits != 30 {
+		t.Fatalf("expected CIDR 30, got %d", settings.cidrBits)
+	}
+	if settings.gateway != "169.254.64.5" {
+		t.Fatalf("expected gateway 169.254.64.5, got %q", settings.gateway)
+	}
+}
+
+func TestAllocateGroupLink(t *testing.T) {
+	d := &Driver{
+		logger: hclog.NewNullLogger(),
+		processes: map[string]*VMProcess{
+			"a": {NetNS: "/var/run/netns/alloc", IP: "169.254.64.2"},
+			"b": {NetNS: "/var/run/netns/other", IP: "169.254.64.6"},
+		},
+	}
+
+	link, err := d.allocateGroupLink("/var/run/netns/alloc")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if link.gateway.String() != "169.254.64.5" || link.guest.String() != "169.254.64.6" {
+		t.Fatalf("unexpected link %+v", link)
+	}
+
+	link, err = d.allocateGroupLink("/var/run/netns/other")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if link.guest.String() != "169.254.64.2" {
+		t.Fatalf("unexpected link %+v", link)
+	}
+}
+
+func TestDeriveNetworkSettingsCNI(t *testing.T) {
+	d := &Driver{
+		logger:        hclog.NewNullLogger(),
+		networkConfig: &domain.Network{Bridge: "br0", Gateway: "192.168.254.1"},
+	}
+	d.subnet = netip.MustParsePrefix("192.168.254.0/24")
+	d.gatewayIP = netip.MustParseAddr("192.168.254.1")
+
+	cfg := &domain.Config{
+		NetworkInterfaces: virtNet.NetworkInterfacesConfig{
+			&virtNet.NetworkInterfaceConfig{
+				CNI: &virtNet.NetworkInterfaceCNIConfig{Network: "vms"},
+			},
+		},
+	}
+	if d.usesDriverBridge(cfg) {
+		t.Fatalf("expected CNI VM not to use the driver bridge")
+	}
+
+	proc := &VMProcess{
+		IP: "10.22.0.5",
+		CNI: &virtNet.CNIAttachment{
+			IfName: "eth0",
+			NetNS:  "/var/run/netns/vm",
+			Result: []byte(`{"cniVersion": "1.0.0", "ips": [{"address": "10.22.0.5/16", "gateway": "10.22.0.1"}],
+				"dns": {"nameservers": ["10.22.0.53"]}}`),
+		},
+	}
+
+	settings, ok := d.deriveNetworkSettings(cfg, proc)
+	if !ok {
+		t.Fatalf("expected settings for CNI result")
+	}
+	if settings.address != "10.22.0.5" || settings.cidrBits != 16 || settings.gateway != "10.22.0.1" {
+		t.Fatalf("unexpected settings %+v", settings)
+	}
+	if len(settings.nameservers) != 1 || settings.nameservers[0] != "10.22.0.53" {
+		t.Fatalf("unexpected nameservers %#v", settings.nameservers)
+	}
+
+	cfg.NetworkInterfaces[0].CNI.DNS = []string{"1.1.1.1"}
+	settings, _ = d.deriveNetworkSettings(cfg, proc)
+	if len(settings.nameservers) != 1 || settings.nameservers[0] != "1.1.1.1" {
+		t.Fatalf("unexpected nameservers %#v", settings.nameservers)
+	}
+}
+
+func TestDeriveNetworkSettingsVtap(t *testing.T) {
+	d := &Driver{
+		logger:        hclog.NewNullLogger(),
+		config:        &domain.CloudHypervisor{},
+		networkConfig: &domain.Network{Bridge: "br0", Gateway: "192.168.254.1"},
+	}
+	d.subnet = netip.MustParsePrefix("192.168.254.0/24")
+	d.gatewayIP = netip.MustParseAddr("192.168.254.1")
+
+	cfg := &domain.Config{
+		Name:      "alloc/test",
+		BaseImage: "/tmp/disk.img",
+		Kernel:    "/tmp/vmlinuz",
+		Initramfs: "/tmp/initramfs",
+		NetworkInterfaces: virtNet.NetworkInterfacesConfig{
+			&virtNet.NetworkInterfaceConfig{
+				Macvtap: &virtNet.NetworkInterfaceVtapConfig{Parent: "eth0"},
+			},
+		},
+	}
+	if d.usesDriverBridge(cfg) {
+		t.Fatalf("expected macvtap VM not to use the driver bridge")
+	}
+
+	// Without a static IP the guest uses DHCP on the parent network.
+	proc := &VMProcess{Name: "alloc-test", TapName: "tap1234", WorkDir: t.TempDir(), TapFile: os.Stdin}
+	if settings, ok := d.deriveNetworkSettings(cfg, proc); ok {
+		t.Fatalf("expected no settings without static IP, got %+v", settings)
+	}
+
+	vmConfig, err := d.buildVMConfig(cfg, proc)
+	if err != nil {
+		t.Fatalf("buildVMConfig failed: %v", err)
+	}
+	if strings.Contains(vmConfig.Payload.Cmdline, "ip=") {
+		t.Fatalf("cmdline unexpectedly has ip parameter: %q", vmConfig.Payload.Cmdline)
+	}
+	if len(vmConfig.Net) != 1 || vmConfig.Net[0].Tap != "" || vmConfig.Net[0].IP != "" {
+		t.Fatalf("expected the device to be passed by descriptor, got %+v", vmConfig.Net)
+	}
+
+	cfg.NetworkInterfaces[0].Macvtap.StaticIP = "10.0.0.50"
+	cfg.NetworkInterfaces[0].Macvtap.Gateway = "10.0.0.1"
+	cfg.NetworkInterfaces[0].Macvtap.Netmask = "16"
+	cfg.NetworkInterfaces[0].Macvtap.DNS = []string{"10.0.0.53"}
+	proc.IP = "10.0.0.50"
+
+	settings, ok := d.deriveNetworkSettings(cfg, proc)
+	if !ok {
+		t.Fatalf("expected settings for static IP")
+	}
+	if settings.address != "10.0.0.50" || settings.cidrBits != 16 || settings.gateway != "10.0.0.1" {
+		t.Fatalf("unexpected settings %+v", settings)
+	}
+	if len(settings.nameservers) != 1 || settings.nameservers[0] != "10.0.0.53" {
+		t.Fatalf("unexpected nameservers %#v", settings.nameservers)
+	}
+}
+
+func TestTapVLANCommands(t *testing.T) {
+	cmds := tapVLANCommands("tap1234", 1, &virtNet.NetworkInterfaceBridgeConfig{VLAN: 100, Trunk: []int{200}})
+	expected := [][]string{
+		{"vlan", "del", "dev", "tap1234", "vid", "1"},
+		{"vlan", "add", "dev", "tap1234", "vid", "100", "pvid", "untagged"},
+		{"vlan", "add", "dev", "tap1234", "vid", "200"},
+	}
+	if !reflect.DeepEqual(cmds, expected) {
+		t.Fatalf("unexpected commands %#v", cmds)
+	}
+
+	// The default VLAN is kept when configured, and there is nothing to
+	// remove when the bridge has none.
+	cmds = tapVLANCommands("tap1234", 1, &virtNet.NetworkInterfaceBridgeConfig{VLAN: 1})
+	if len(cmds) != 1 || cmds[0][5] != "1" {
+		t.Fatalf("unexpected commands %#v", cmds)
+	}
+	cmds = tapVLANCommands("tap1234", 0, &virtNet.NetworkInterfaceBridgeConfig{Trunk: []int{200}})
+	if !reflect.DeepEqual(cmds, [][]string{{"vlan", "add", "dev", "tap1234", "vid", "200"}}) {
+		t.Fatalf("unexpected commands %#v", cmds)
+	}
+}
+
+func TestBuildVMConfigRateLimit(t *testing.T) {
+	d := &Driver{
+		logger:        hclog.NewNullLogger(),
+		config:        &domain.CloudHypervisor{},
+		networkConfig: &domain.Network{Bridge: "br0"},
+	}
+
+	cfg := &domain.Config{
+		Name:      "alloc/test",
+		BaseImage: "/tmp/disk.img",
+		Kernel:    "/tmp/vmlinuz",
+		Initramfs: "/tmp/initramfs",
+		NetworkInterfaces: virtNet.NetworkInterfacesConfig{
+			&virtNet.NetworkInterfaceConfig{
+				Bridge: &virtNet.NetworkInterfaceBridgeConfig{Name: "br0"},
+				RateLimit: &virtNet.NetworkInterfaceRateLimitConfig{
+					Bandwidth: &virtNet.TokenBucketConfig{Size: 1250000, OneTimeBurst: 5000000, RefillTime: "100ms"},
+					Ops:       &virtNet.TokenBucketConfig{Size: 1000},
+				},
+			},
+		},
+	}
+	proc := &VMProcess{Name: "alloc-test", TapName: "tap1234", WorkDir: t.TempDir()}
+
+	vmConfig, err := d.buildVMConfig(cfg, proc)
+	if err != nil {
+		t.Fatalf("buildVMConfig failed: %v", err)
+	}
+
+	expected := &RateLimiterConfig{
+		Bandwidth: &TokenBucketConfig{Size: 1250000, OneTimeBurst: 5000000, RefillTime: 100},
+		Ops:       &TokenBucketConfig{Size: 1000, RefillTime: 1000},
+	}
+	if !reflect.DeepEqual(vmConfig.Net[0].RateLimiterConfig, expected) {
+		t.Fatalf("unexpected rate limiter %+v", vmConfig.Net[0].RateLimiterConfig)
+	}
+
+	cfg.NetworkInterfaces[0].RateLimit = nil
+	vmConfig, err = d.buildVMConfig(cfg, proc)
+	if err != nil {
+		t.Fatalf("buildVMConfig failed: %v", err)
+	}
+	if vmConfig.Net[0].RateLimiterConfig != nil {
+		t.Fatalf("unexpected rate limiter %+v", vmConfig.Net[0].RateLimiterConfig)
+	}
+}
+
+func TestApplyNetTuning(t *testing.T) {
+	disabled := false
+	iface := &virtNet.NetworkInterfaceConfig{
+		Bridge:      &virtNet.NetworkInterfaceBridgeConfig{Name: "br0"},
+		NumQueues:   4,
+		QueueSize:   1024,
+		MTU:         9000,
+		OffloadCsum: &disabled,
+	}
+
+	var netConfig NetConfig
+	applyNetTuning(&netConfig, iface)
+	if netConfig.NumQueues != 8 || netConfig.QueueSize != 1024 || netConfig.MTU != 9000 {
+		t.Fatalf("unexpected net config %+v", netConfig)
+	}
+	if netConfig.OffloadCsum == nil || *netConfig.OffloadCsum || netConfig.OffloadTSO == nil || *netConfig.OffloadTSO {
+		t.Fatalf("expected checksum and segmentation offload to be disabled, got %+v", netConfig)
+	}
+
+	args := tapAddArgs("tap1234", iface)
+	if args[len(args)-1] != "multi_queue" {
+		t.Fatalf("expected multi-queue tap, got %v", args)
+	}
+
+	// Defaults are left to Cloud Hypervisor.
+	netConfig = NetConfig{}
+	applyNetTuning(&netConfig, &virtNet.NetworkInterfaceConfig{})
+	if !reflect.DeepEqual(netConfig, NetConfig{}) {
+		t.Fatalf("unexpected net config %+v", netConfig)
+	}
+	if args := tapAddArgs("tap1234", nil); args[len(args)-1] == "multi_queue" {
+		t.Fatalf("unexpected multi-queue tap")
+	}
+}
+
+func TestNamedNetworks(t *testing.T) {
+	d := &Driver{
+		logger:        hclog.NewNullLogger(),
+		networkConfig: &domain.Network{Bridge: "br0"},
+		subnet:        netip.MustParsePrefix("192.168.254.0/24"),
+		namedNetworkConfig: domain.NamedNetworks{
+			{Name: "dmz", Bridge: "br-dmz", SubnetCIDR: "10.20.0.0/29", DNS: []string{"1.1.1.1"}},
+		},
+	}
+	if err := d.initializeNamedNetworks(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The gateway and pool default to the usable addresses of the subnet.
+	dmz := d.namedNetwork("dmz")
+	if dmz == nil {
+		t.Fatalf("expected network dmz")
+	}
+	if dmz.gatewayIP.String() != "10.20.0.1" || dmz.ipPoolStart.String() != "10.20.0.1" || dmz.ipPoolEnd.String() != "10.20.0.6" {
+		t.Fatalf("unexpected defaults %s %s-%s", dmz.gatewayIP, dmz.ipPoolStart, dmz.ipPoolEnd)
+	}
+
+	ip, err := dmz.reserveIP("")
+	if err != nil || ip != "10.20.0.2" {
+		t.Fatalf("expected 10.20.0.2, got %q (%v)", ip, err)
+	}
+	if _, err := dmz.reserveIP("10.20.0.2"); err == nil {
+		t.Fatalf("expected allocated static IP to be rejected")
+	}
+	if _, err := dmz.reserveIP("192.168.254.10"); err == nil {
+		t.Fatalf("expected static IP outside subnet to be rejected")
+	}
+	if free := d.freeAddresses()["dmz"]; free != 4 {
+		t.Fatalf("expected 4 free addresses, got %d", free)
+	}
+	d.deallocateIP("dmz", ip)
+	if free := d.freeAddresses()["dmz"]; free != 5 {
+		t.Fatalf("expected 5 free addresses, got %d", free)
+	}
+
+	// Guests take the subnet, gateway and DNS of their network.
+	settings, ok := d.deriveNetworkSettings(&domain.Config{}, &VMProcess{IP: ip, Network: "dmz"})
+	if !ok {
+		t.Fatalf("expected settings for proc IP")
+	}
+	if settings.cidrBits != 29 || settings.gateway != "10.20.0.1" {
+		t.Fatalf("unexpected settings %+v", settings)
+	}
+	if !reflect.DeepEqual(settings.nameservers, []string{"1.1.1.1"}) {
+		t.Fatalf("unexpected nameservers %#v", settings.nameservers)
+	}
+
+	invalid := map[string]domain.NamedNetworks{
+		"missing name":     {{Bridge: "br-dmz", SubnetCIDR: "10.20.0.0/24"}},
+		"duplicate name":   {{Name: "dmz", Bridge: "br-a", SubnetCIDR: "10.20.0.0/24"}, {Name: "dmz", Bridge: "br-b", SubnetCIDR: "10.30.0.0/24"}},
+		"driver bridge":    {{Name: "dmz", Bridge: "br0", SubnetCIDR: "10.20.0.0/24"}},
+		"overlapping":      {{Name: "dmz", Bridge: "br-dmz", SubnetCIDR: "192.168.254.128/25"}},
+		"gateway outside":  {{Name: "dmz", Bridge: "br-dmz", SubnetCIDR: "10.20.0.0/24", Gateway: "10.30.0.1"}},
+		"pool reversed":    {{Name: "dmz", Bridge: "br-dmz", SubnetCIDR: "10.20.0.0/24", IPPoolStart: "10.20.0.100", IPPoolEnd: "10.20.0.10"}},
+		"no usable subnet": {{Name: "dmz", Bridge: "br-dmz", SubnetCIDR: "10.20.0.0/31"}},
+	}
+	for name, networks := range invalid {
+		d.namedNetworkConfig = networks
+		if err := d.initializeNamedNetworks(); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
+
+func TestMACAllocator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), macAssignmentsFile)
+
+	hostMAC := candidateMAC("vm-a", 0)
+	a := newMACAllocator()
+	a.hostMACs = func() (map[string]bool, error) {
+		return map[string]bool{hostMAC: true}, nil
+	}
+	if err := a.load(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Candidates colliding with host interfaces are skipped.
+	macA, err := a.allocate("vm-a", "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if macA != candidateMAC("vm-a", 1) {
+		t.Fatalf("expected second candidate, got %s", macA)
+	}
+	if hw, _ := net.ParseMAC(macA); hw[0] != macPrefix[0] || hw[1] != macPrefix[1] {
+		t.Fatalf("unexpected prefix %s", macA)
+	}
+
+	// Requested addresses must not be in use by running or assigned VMs.
+	if _, err := a.allocate("vm-b", strings.ToUpper(macA), nil); err == nil {
+		t.Fatalf("expected assigned MAC to be rejected")
+	}
+	if _, err := a.allocate("vm-b", "02:00:00:00:00:01", map[string]bool{"02:00:00:00:00:01": true}); err == nil {
+		t.Fatalf("expected running MAC to be rejected")
+	}
+	macB, err := a.allocate("vm-b", "02:00:00:00:00:02", nil)
+	if err != nil || macB != "02:00:00:00:00:02" {
+		t.Fatalf("expected requested MAC, got %q (%v)", macB, err)
+	}
+
+	// Assignments survive a restart, until released.
+	a = newMACAllocator()
+	a.hostMACs = func() (map[string]bool, error) { return map[string]bool{}, nil }
+	if err := a.load(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mac, err := a.allocate("vm-a", "", nil); err != nil || mac != macA {
+		t.Fatalf("expected persisted MAC %s, got %q (%v)", macA, mac, err)
+	}
+	if err := a.release("vm-b"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := a.load(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(a.assigned, map[string]string{"vm-a": macA}) {
+		t.Fatalf("unexpected assignments %#v", a.assigned)
+	}
+}
+
+func TestDestroyDomain_ReleasesRecoveredMAC(t *testing.T) {
+	macs := newMACAllocator()
+	macs.hostMACs = func() (map[string]bool, error) { return map[string]bool{}, nil }
+	if err := macs.load(filepath.Join(t.TempDir(), macAssignmentsFile)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := macs.allocate("vm-a", "", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// VMs recovered after a driver restart are not tracked, but their MAC
+	// address assignment is persisted.
+	d := &Driver{
+		logger:        hclog.NewNullLogger(),
+		processes:     make(map[string]*VMProcess),
+		groupNetworks: make(map[string]*groupNetwork),
+		macs:          macs,
+	}
+	if err := d.DestroyDomain("vm-a"); err == nil {
+		t.Fatalf("expected error for untracked VM")
+	}
+
+	if err := macs.load(macs.path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(macs.assigned) != 0 {
+		t.Fatalf("expected MAC to be released, got %#v", macs.assigned)
+	}
+}
+
+func TestGroupNetworks(t *testing.T) {
+	d := &Driver{
+		logger: hclog.NewNullLogger(),
+		networkConfig: &domain.Network{
+			Bridge:       "br0",
+			GroupNetwork: &domain.GroupNetwork{SubnetPool: "10.200.0.0/22", DNS: []string{"1.1.1.1"}},
+		},
+		subnet:               netip.MustParsePrefix("10.200.0.0/24"),
+		namedNetworkConfig:   domain.NamedNetworks{{Name: "dmz", Bridge: "br-dmz", SubnetCIDR: "10.200.1.0/24"}},
+		groupNetworks:        make(map[string]*groupNetwork),
+		dataDir:              t.TempDir(),
+		skipBinaryValidation: true,
+	}
+	if err := d.validateGroupNetworkConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := d.initializeNamedNetworks(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Subnets of the pool used by the driver and named networks are skipped.
+	subnet, err := d.allocateGroupSubnet()
+	if err != nil || subnet.String() != "10.200.2.0/24" {
+		t.Fatalf("expected 10.200.2.0/24, got %s (%v)", subnet, err)
+	}
+	bridge, err := d.groupBridgeName("alloc-a")
+	if err != nil || !strings.HasPrefix(bridge, defaultGroupBridgePrefix) || len(bridge) > 15 {
+		t.Fatalf("unexpected bridge name %q (%v)", bridge, err)
+	}
+
+	g, err := d.newGroupNetwork("alloc-a", bridge, subnet.String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d.groupNetworks["alloc-a"] = g
+
+	// Other allocations are given the next free subnet and another bridge.
+	if next, err := d.allocateGroupSubnet(); err != nil || next.String() != "10.200.3.0/24" {
+		t.Fatalf("expected 10.200.3.0/24, got %s (%v)", next, err)
+	}
+	if other, err := d.groupBridgeName("alloc-a"); err != nil || other == bridge {
+		t.Fatalf("expected another bridge name, got %q (%v)", other, err)
+	}
+
+	// The VMs of the allocation share the network, addressed from its subnet
+	// with the configured DNS.
+	for _, vm := range []string{"vm-a", "vm-b"} {
+		joined, ip, err := d.joinGroupNetwork("alloc-a", vm, "")
+		if err != nil || joined != g {
+			t.Fatalf("unexpected join result %v (%v)", joined, err)
+		}
+		if !g.subnet.Contains(netip.MustParseAddr(ip)) {
+			t.Fatalf("expected IP within %s, got %s", g.subnet, ip)
+		}
+	}
+	settings, ok := d.deriveNetworkSettings(&domain.Config{}, &VMProcess{IP: g.vms["vm-a"], Network: g.config.Name})
+	if !ok || settings.cidrBits != 24 || settings.gateway != "10.200.2.1" {
+		t.Fatalf("unexpected settings %+v", settings)
+	}
+	if !reflect.DeepEqual(settings.nameservers, []string{"1.1.1.1"}) {
+		t.Fatalf("unexpected nameservers %#v", settings.nameservers)
+	}
+
+	// The VMs attached are persisted, and the network is removed once the
+	// last has left.
+	readState := func() map[string]groupNetworkState {
+		b, err := os.ReadFile(filepath.Join(d.dataDir, groupNetworksFile))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var states map[string]groupNetworkState
+		if err := json.Unmarshal(b, &states); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return states
+	}
+	if state := readState()["alloc-a"]; state.Bridge != bridge || len(state.VMs) != 2 {
+		t.Fatalf("unexpected persisted state %+v", state)
+	}
+
+	d.leaveGroupNetwork("vm-a")
+	if d.groupNetworks["alloc-a"] == nil || len(readState()["alloc-a"].VMs) != 1 {
+		t.Fatalf("expected network to remain while VMs are attached")
+	}
+	d.leaveGroupNetwork("vm-b")
+	if len(d.groupNetworks) != 0 || len(readState()) != 0 {
+		t.Fatalf("expected network to be removed")
+	}
+
+	d.networkConfig.GroupNetwork = &domain.GroupNetwork{SubnetPool: "10.200.0.0/22", PrefixLength: 20}
+	if err := d.validateGroupNetworkConfig(); err == nil {
+		t.Fatalf("expected prefix length shorter than the pool to be rejected")
+	}
+}
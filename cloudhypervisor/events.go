@@ -0,0 +1,124 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+)
+
+const (
+	// eventMonitorFD is the file descriptor the VMM writes its events to,
+	// which is the first of the extra files passed to the process.
+	eventMonitorFD = 3
+
+	// eventBufferSize is the number of events buffered for each subscriber.
+	// Events are dropped when a subscriber falls behind, as subscribers
+	// reconcile the VM state periodically.
+	eventBufferSize = 16
+)
+
+// chEvent is an event written by the VMM to its event monitor.
+type chEvent struct {
+	Source     string            `json:"source"`
+	Event      string            `json:"event"`
+	Properties map[string]string `json:"properties"`
+}
+
+// readEvents publishes the events written by the VMM of a VM until the
+// stream ends, which happens when the VMM exits. Subscribers are then
+// notified by closing their channels.
+func (d *Driver) readEvents(name string, r io.ReadCloser) {
+	defer r.Close()
+	defer d.endEventStream(name)
+
+	// Events are written as a stream of JSON objects.
+	dec := json.NewDecoder(r)
+	for {
+		var event chEvent
+		if err := dec.Decode(&event); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrClosed) {
+				d.logger.Warn("failed to read VM events", "vm", name, "error", err)
+			}
+			return
+		}
+
+		d.logger.Debug("received VM event", "vm", name, "source", event.Source, "event", event.Event)
+		d.publishEvent(domain.Event{
+			Domain:     name,
+			Source:     event.Source,
+			Event:      event.Event,
+			Properties: event.Properties,
+			Timestamp:  time.Now(),
+		})
+	}
+}
+
+// startEventStream marks the events of the VM as being read, so it can be
+// subscribed to.
+func (d *Driver) startEventStream(name string) {
+	d.eventsLock.Lock()
+	defer d.eventsLock.Unlock()
+	d.eventSubs[name] = make(map[chan domain.Event]struct{})
+}
+
+// endEventStream closes the channels of the subscribers to the events of
+// the VM.
+func (d *Driver) endEventStream(name string) {
+	d.eventsLock.Lock()
+	defer d.eventsLock.Unlock()
+
+	for ch := range d.eventSubs[name] {
+		close(ch)
+	}
+	delete(d.eventSubs, name)
+}
+
+// publishEvent sends the event to the subscribers of its VM, dropping it
+// for those which have fallen behind.
+func (d *Driver) publishEvent(event domain.Event) {
+	d.eventsLock.Lock()
+	defer d.eventsLock.Unlock()
+
+	for ch := range d.eventSubs[event.Domain] {
+		select {
+		case ch <- event:
+		default:
+			d.logger.Trace("dropped VM event", "vm", event.Domain, "event", event.Event)
+		}
+	}
+}
+
+// SubscribeDomain returns a channel receiving the events of the VM, which is
+// closed once the VMM exits, and a function ending the subscription. The
+// channel is nil if the events of the VM are not available, such as for VMs
+// started by a previous run of the driver.
+func (d *Driver) SubscribeDomain(name string) (<-chan domain.Event, func()) {
+	d.eventsLock.Lock()
+	defer d.eventsLock.Unlock()
+
+	subs, ok := d.eventSubs[name]
+	if !ok {
+		return nil, func() {}
+	}
+
+	ch := make(chan domain.Event, eventBufferSize)
+	subs[ch] = struct{}{}
+
+	return ch, func() {
+		d.eventsLock.Lock()
+		defer d.eventsLock.Unlock()
+
+		// The channel has already been closed if the stream has ended.
+		if _, ok := d.eventSubs[name][ch]; ok {
+			delete(d.eventSubs[name], ch)
+			close(ch)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestEvents(t *testing.T) {
+	d := &Driver{
+		logger:    hclog.NewNullLogger(),
+		eventSubs: make(map[string]map[chan domain.Event]struct{}),
+	}
+
+	// Events of VMs which are not being read cannot be subscribed to.
+	if ch, unsubscribe := d.SubscribeDomain("vm1"); ch != nil {
+		t.Fatalf("expected no events for unknown VM")
+	} else {
+		unsubscribe()
+	}
+
+	r, w := io.Pipe()
+	d.startEventStream("vm1")
+	events, _ := d.SubscribeDomain("vm1")
+	other, unsubscribe := d.SubscribeDomain("vm1")
+	unsubscribe()
+	unsubscribe()
+	if _, ok := <-other; ok {
+		t.Fatalf("expected unsubscribed channel to be closed")
+	}
+
+	go d.readEvents("vm1", r)
+
+	// The VMM writes pretty-printed JSON objects.
+	go func() {
+		io.WriteString(w, `{
+  "timestamp": {
+    "secs": 0,
+    "nanos": 27000
+  },
+  "source": "vm",
+  "event": "booted",
+  "properties": null
+}
+
+{
+  "timestamp": {
+    "secs": 5,
+    "nanos": 1000
+  },
+  "source": "virtio-device",
+  "event": "activated",
+  "properties": {
+    "id": "_disk0"
+  }
+}
+`)
+		w.Close()
+	}()
+
+	var received []domain.Event
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				done = true
+				break
+			}
+			if event.Domain != "vm1" || event.Timestamp.IsZero() {
+				t.Fatalf("unexpected event %+v", event)
+			}
+			event.Timestamp = time.Time{}
+			received = append(received, event)
+		case <-timeout:
+			t.Fatalf("timed out waiting for events")
+		}
+	}
+
+	expected := []domain.Event{
+		{Domain: "vm1", Source: "vm", Event: "booted"},
+		{Domain: "vm1", Source: "virtio-device", Event: "activated", Properties: map[string]string{"id": "_disk0"}},
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Fatalf("unexpected events %+v", received)
+	}
+
+	// The stream has ended, so the VM can no longer be subscribed to.
+	if ch, _ := d.SubscribeDomain("vm1"); ch != nil {
+		t.Fatalf("expected no events once the stream ended")
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	virtNet "github.com/ccheshirecat/nomad-driver-ch/virt/net"
+)
+
+const (
+	// groupNetworksFile is the file within the data directory the group
+	// networks and their VMs are persisted to.
+	groupNetworksFile = "group_networks.json"
+
+	// groupNetworkPrefix prefixes the allocation ID to form the name of its
+	// group network.
+	groupNetworkPrefix = "group-"
+
+	// defaultGroupPrefixLength and defaultGroupBridgePrefix are used when
+	// the group network configuration does not set them.
+	defaultGroupPrefixLength = 24
+	defaultGroupBridgePrefix = "chg"
+
+	// groupBridgeAttempts is the number of candidate bridge names tried for
+	// an allocation before creating its network fails.
+	groupBridgeAttempts = 16
+)
+
+// groupNetwork is the private network of an allocation whose VMs use a group
+// network. It is created when the first VM joins, and removed once the last
+// VM has left.
+type groupNetwork struct {
+	*namedNetwork
+	allocID string
+
+	// vms maps the names of the VMs attached to the network to their IP,
+	// and acts as the reference count of the network.
+	vms map[string]string
+}
+
+// groupNetworkState is the persisted form of a group network.
+type groupNetworkState struct {
+	Bridge     string            `json:"bridge"`
+	SubnetCIDR string            `json:"subnet_cidr"`
+	VMs        map[string]string `json:"vms"`
+}
+
+// info returns the description of the network handed to the network
+// sub-system.
+func (g *groupNetwork) info() *virtNet.GroupNetwork {
+	return &virtNet.GroupNetwork{
+		AllocID:    g.allocID,
+		Bridge:     g.config.Bridge,
+		SubnetCIDR: g.subnet.String(),
+	}
+}
+
+// groupBridgeInterface returns the bridge configuration of the VM's first
+// interface if it uses a group network.
+func groupBridgeInterface(config *domain.Config) *virtNet.NetworkInterfaceBridgeConfig {
+	if config == nil || len(config.NetworkInterfaces) == 0 {
+		return nil
+	}
+	if bridge := config.NetworkInterfaces[0].Bridge; bridge != nil && bridge.GroupNetwork {
+		return bridge
+	}
+	return nil
+}
+
+// groupNetworkConfig returns the group network configuration with defaults
+// applied, or nil if group networks are not enabled.
+func (d *Driver) groupNetworkConfig() *domain.GroupNetwork {
+	if d.networkConfig == nil || d.networkConfig.GroupNetwork == nil {
+		return nil
+	}
+	cfg := *d.networkConfig.GroupNetwork
+	if cfg.PrefixLength == 0 {
+		cfg.PrefixLength = defaultGroupPrefixLength
+	}
+	if cfg.BridgePrefix == "" {
+		cfg.BridgePrefix = defaultGroupBridgePrefix
+	}
+	return &cfg
+}
+
+// validateGroupNetworkConfig ensures each allocation can be given a subnet of
+// the pool and a bridge name within the interface name limit.
+func (d *Driver) validateGroupNetworkConfig() error {
+	cfg := d.groupNetworkConfig()
+	if cfg == nil {
+		return nil
+	}
+
+	pool, err := netip.ParsePrefix(cfg.SubnetPool)
+	if err != nil || !pool.Addr().Is4() {
+		return fmt.Errorf("group_network subnet_pool %q must be a valid IPv4 CIDR", cfg.SubnetPool)
+	}
+	if cfg.PrefixLength < pool.Bits() || cfg.PrefixLength > 30 {
+		return fmt.Errorf("group_network prefix_length %d must be between %d and 30", cfg.PrefixLength, pool.Bits())
+	}
+	if len(cfg.BridgePrefix) > 7 {
+		return fmt.Errorf("group_network bridge_prefix %q must be at most 7 characters", cfg.BridgePrefix)
+	}
+	return nil
+}
+
+// loadGroupNetworks restores the group networks persisted by a previous run
+// of the driver, whose VMs may still be running, and ensures their bridges
+// are configured. Networks are restored even if group networks have since
+// been disabled, so they are still removed once their VMs are destroyed.
+func (d *Driver) loadGroupNetworks() error {
+	d.groupNetworks = make(map[string]*groupNetwork)
+
+	b, err := os.ReadFile(d.groupNetworksPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read group networks: %w", err)
+	}
+
+	var states map[string]groupNetworkState
+	if err := json.Unmarshal(b, &states); err != nil {
+		return fmt.Errorf("failed to decode group networks %s: %w", d.groupNetworksPath(), err)
+	}
+
+	for allocID, state := range states {
+		g, err := d.newGroupNetwork(allocID, state.Bridge, state.SubnetCIDR)
+		if err != nil {
+			return fmt.Errorf("group network of allocation %s is invalid: %w", allocID, err)
+		}
+		for vm, ip := range state.VMs {
+			g.vms[vm] = ip
+			g.allocatedIPs[ip] = true
+		}
+		if err := d.ensureBridgeConfigured(g.config.Bridge, g.gatewayIP, g.subnet); err != nil {
+			return fmt.Errorf("failed to configure bridge %s of allocation %s: %w", g.config.Bridge, allocID, err)
+		}
+		d.groupNetworks[allocID] = g
+	}
+
+	return nil
+}
+
+// saveGroupNetworks persists the group networks, replacing the file
+// atomically. The caller must hold d.mu.
+func (d *Driver) saveGroupNetworks() error {
+	states := make(map[string]groupNetworkState, len(d.groupNetworks))
+	for allocID, g := range d.groupNetworks {
+		states[allocID] = groupNetworkState{
+			Bridge:     g.config.Bridge,
+			SubnetCIDR: g.subnet.String(),
+			VMs:        g.vms,
+		}
+	}
+
+	b, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	tmp := d.groupNetworksPath() + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("failed to write group networks: %w", err)
+	}
+	return os.Rename(tmp, d.groupNetworksPath())
+}
+
+func (d *Driver) groupNetworksPath() string {
+	return filepath.Join(d.dataDir, groupNetworksFile)
+}
+
+// newGroupNetwork returns the group network of an allocation, using the
+// passed bridge and subnet.
+func (d *Driver) newGroupNetwork(allocID, bridge, subnet string) (*groupNetwork, error) {
+	cfg := domain.NamedNetwork{
+		Name:       groupNetworkPrefix + allocID,
+		Bridge:     bridge,
+		SubnetCIDR: subnet,
+	}
+	if groupCfg := d.groupNetworkConfig(); groupCfg != nil {
+		cfg.DNS = groupCfg.DNS
+	}
+
+	n, err := newNamedNetwork(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &groupNetwork{namedNetwork: n, allocID: allocID, vms: make(map[string]string)}, nil
+}
+
+// joinGroupNetwork attaches the VM to the group network of its allocation,
+// creating the network if the VM is the first to join, and allocates its IP.
+// The caller must hold d.mu.
+func (d *Driver) joinGroupNetwork(allocID, vm, staticIP string) (*groupNetwork, string, error) {
+	if allocID == "" {
+		return nil, "", errors.New("group networks require an allocation ID")
+	}
+
+	g, exists := d.groupNetworks[allocID]
+	if !exists {
+		if d.groupNetworkConfig() == nil {
+			return nil, "", errors.New("group networks are not enabled within the driver")
+		}
+
+		subnet, err := d.allocateGroupSubnet()
+		if err != nil {
+			return nil, "", err
+		}
+		bridge, err := d.groupBridgeName(allocID)
+		if err != nil {
+			return nil, "", err
+		}
+		if g, err = d.newGroupNetwork(allocID, bridge, subnet.String()); err != nil {
+			return nil, "", err
+		}
+		if err := d.ensureBridgeConfigured(bridge, g.gatewayIP, g.subnet); err != nil {
+			d.deleteGroupBridge(bridge)
+			return nil, "", fmt.Errorf("failed to configure bridge %s: %w", bridge, err)
+		}
+
+		d.logger.Info("created group network", "alloc_id", allocID, "bridge", bridge, "subnet", g.subnet)
+	}
+
+	ip, err := g.reserveIP(staticIP)
+	if err != nil {
+		if !exists {
+			d.deleteGroupBridge(g.config.Bridge)
+		}
+		return nil, "", err
+	}
+	g.vms[vm] = ip
+	d.groupNetworks[allocID] = g
+
+	if err := d.saveGroupNetworks(); err != nil {
+		d.leaveGroupNetwork(vm)
+		return nil, "", err
+	}
+	return g, ip, nil
+}
+
+// leaveGroupNetwork detaches the VM from its group network, if any, removing
+// the network once no VMs remain attached. The caller must hold d.mu.
+func (d *Driver) leaveGroupNetwork(vm string) {
+	for allocID, g := range d.groupNetworks {
+		ip, ok := g.vms[vm]
+		if !ok {
+			continue
+		}
+
+		delete(g.vms, vm)
+		delete(g.allocatedIPs, ip)
+		if len(g.vms) == 0 {
+			d.deleteGroupBridge(g.config.Bridge)
+			delete(d.groupNetworks, allocID)
+			d.logger.Info("removed group network", "alloc_id", allocID, "bridge", g.config.Bridge)
+		}
+
+		if err := d.saveGroupNetworks(); err != nil {
+			d.logger.Warn("failed to persist group networks", "error", err)
+		}
+		return
+	}
+}
+
+// allocateGroupSubnet returns the first subnet of the pool which does not
+// overlap the driver network, a named network or another group network. The
+// caller must hold d.mu.
+func (d *Driver) allocateGroupSubnet() (netip.Prefix, error) {
+	cfg := d.groupNetworkConfig()
+	pool := netip.MustParsePrefix(cfg.SubnetPool).Masked()
+
+	used := make([]netip.Prefix, 0, 1+len(d.namedNetworks)+len(d.groupNetworks))
+	if d.subnet.IsValid() {
+		used = append(used, d.subnet)
+	}
+	for _, n := range d.namedNetworks {
+		used = append(used, n.subnet)
+	}
+	for _, g := range d.groupNetworks {
+		used = append(used, g.subnet)
+	}
+
+	size := uint64(1) << (32 - cfg.PrefixLength)
+	end := uint64(addrUint32(pool.Addr())) + uint64(1)<<(32-pool.Bits())
+	for base := uint64(addrUint32(pool.Addr())); base < end; base += size {
+		subnet := netip.PrefixFrom(uint32Addr(uint32(base)), cfg.PrefixLength)
+		free := true
+		for _, other := range used {
+			if other.Overlaps(subnet) {
+				free = false
+				break
+			}
+		}
+		if free {
+			return subnet, nil
+		}
+	}
+
+	return netip.Prefix{}, fmt.Errorf("no free /%d subnets in group network pool %s", cfg.PrefixLength, pool)
+}
+
+// groupBridgeName returns the first candidate bridge name of the allocation,
+// derived from its ID, which is not used by another network. The caller must
+// hold d.mu.
+func (d *Driver) groupBridgeName(allocID string) (string, error) {
+	used := map[string]bool{d.networkConfig.Bridge: true}
+	for _, n := range d.namedNetworks {
+		used[n.config.Bridge] = true
+	}
+	for _, g := range d.groupNetworks {
+		used[g.config.Bridge] = true
+	}
+
+	prefix := d.groupNetworkConfig().BridgePrefix
+	for i := 0; i < groupBridgeAttempts; i++ {
+		sum := sha256.Sum256([]byte(allocID + "/" + strconv.Itoa(i)))
+		if name := fmt.Sprintf("%s%x", prefix, sum[:4]); !used[name] {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no free bridge name found for allocation %s", allocID)
+}
+
+// deleteGroupBridge removes the bridge of a group network. Failures are
+// logged, as the VMs have already been detached.
+func (d *Driver) deleteGroupBridge(bridge string) {
+	ipPath, err := findIPCommand()
+	if err != nil {
+		if !d.skipBinaryValidation {
+			d.logger.Warn("failed to delete group network bridge", "bridge", bridge, "error", err)
+		}
+		return
+	}
+
+	output, err := exec.Command(ipPath, "link", "delete", "dev", bridge).CombinedOutput()
+	if err != nil && !strings.Contains(string(output), "Cannot find device") {
+		d.logger.Warn("failed to delete group network bridge",
+			"bridge", bridge, "error", err, "output", strings.TrimSpace(string(output)))
+	}
+}
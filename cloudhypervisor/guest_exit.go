@@ -0,0 +1,88 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// guestExitCodePrefix prefixes the line written by the guest to its
+	// serial console to report the exit code of its workload, such as
+	// NOMAD_EXIT_CODE=3, before powering off.
+	guestExitCodePrefix = "NOMAD_EXIT_CODE="
+
+	// guestExitCodeScanSize is how much of the end of the serial log is
+	// scanned for the exit code, as it is written just before powering off.
+	guestExitCodeScanSize = 64 * 1024
+)
+
+// guestExitCode returns the exit code last reported by the guest of the VM
+// on its serial console, or nil if it reported none.
+func (d *Driver) guestExitCode(proc *VMProcess) *int {
+	if proc.Config == nil || proc.Config.Serial.Mode != "File" || proc.Config.Serial.File == "" {
+		return nil
+	}
+
+	code, err := readGuestExitCode(proc.Config.Serial.File)
+	if err != nil {
+		d.logger.Warn("unable to read guest exit code", "vm", proc.Name, "error", err)
+		return nil
+	}
+	if code != nil {
+		d.logger.Debug("guest reported exit code", "vm", proc.Name, "exit_code", *code)
+	}
+	return code
+}
+
+// readGuestExitCode returns the last exit code reported within the end of
+// the serial log, or nil if there is none.
+func readGuestExitCode(path string) (*int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if offset := info.Size() - guestExitCodeScanSize; offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var code *int
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		// Serial consoles may terminate lines with carriage returns, and
+		// kernel messages may precede the line.
+		line := strings.TrimSpace(scanner.Text())
+		i := strings.LastIndex(line, guestExitCodePrefix)
+		if i < 0 {
+			continue
+		}
+		n, err := strconv.Atoi(line[i+len(guestExitCodePrefix):])
+		if err != nil || n < 0 || n > 255 {
+			continue
+		}
+		code = &n
+	}
+	return code, scanner.Err()
+}
@@ -0,0 +1,80 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadGuestExitCode(t *testing.T) {
+	cases := []struct {
+		name     string
+		log      string
+		expected int
+		none     bool
+	}{
+		{
+			name:     "exit code",
+			log:      "Booting Linux\r\nNOMAD_EXIT_CODE=3\r\nreboot: Power down\r\n",
+			expected: 3,
+		},
+		{
+			name:     "last exit code",
+			log:      "NOMAD_EXIT_CODE=1\nNOMAD_EXIT_CODE=0\n",
+			expected: 0,
+		},
+		{
+			name:     "interleaved kernel message",
+			log:      "[   12.345678] random: crng init done NOMAD_EXIT_CODE=42\n",
+			expected: 42,
+		},
+		{
+			name: "invalid exit code",
+			log:  "NOMAD_EXIT_CODE=abc\nNOMAD_EXIT_CODE=256\n",
+			none: true,
+		},
+		{
+			name: "no exit code",
+			log:  "Booting Linux\nreboot: Power down\n",
+			none: true,
+		},
+		{
+			// Only the end of the log is scanned.
+			name: "before scanned end",
+			log:  "NOMAD_EXIT_CODE=5\n" + strings.Repeat("x", guestExitCodeScanSize) + "\n",
+			none: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "serial.log")
+			if err := os.WriteFile(path, []byte(tc.log), 0644); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			code, err := readGuestExitCode(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.none {
+				if code != nil {
+					t.Fatalf("expected no exit code, got %d", *code)
+				}
+				return
+			}
+			if code == nil || *code != tc.expected {
+				t.Fatalf("expected exit code %d, got %v", tc.expected, code)
+			}
+		})
+	}
+
+	code, err := readGuestExitCode(filepath.Join(t.TempDir(), "missing.log"))
+	if err != nil || code != nil {
+		t.Fatalf("expected no exit code for missing log, got %v, %v", code, err)
+	}
+}
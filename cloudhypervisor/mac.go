@@ -0,0 +1,172 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+const (
+	// macAssignmentsFile is the file within the data directory MAC
+	// assignments are persisted to.
+	macAssignmentsFile = "mac_assignments.json"
+
+	// macAllocationAttempts is the number of candidate addresses tried for a
+	// VM before allocation fails.
+	macAllocationAttempts = 64
+)
+
+// macPrefix is the prefix of allocated MAC addresses. The first octet has the
+// locally administered bit set and the multicast bit clear, so addresses
+// cannot clash with those assigned to hardware vendors.
+var macPrefix = [2]byte{0x02, 0x43}
+
+// macAllocator assigns guest MAC addresses which do not collide with those
+// of other VMs or host interfaces. Assignments are persisted, so VMs still
+// running after a driver restart keep their address reserved. It is not safe
+// for concurrent use; the driver serializes access using its lock.
+type macAllocator struct {
+	// path is the file assignments are persisted to. When empty, they are
+	// only held in memory.
+	path string
+
+	// assigned maps VM names to their MAC address.
+	assigned map[string]string
+
+	// hostMACs returns the MAC addresses of the host interfaces. It is a
+	// field to aid testing.
+	hostMACs func() (map[string]bool, error)
+}
+
+func newMACAllocator() *macAllocator {
+	return &macAllocator{
+		assigned: make(map[string]string),
+		hostMACs: hostInterfaceMACs,
+	}
+}
+
+// load reads the assignments persisted to path, which is then used to
+// persist any changes. A missing file holds no assignments.
+func (a *macAllocator) load(path string) error {
+	a.path = path
+	a.assigned = make(map[string]string)
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read MAC assignments: %w", err)
+	}
+	if err := json.Unmarshal(b, &a.assigned); err != nil {
+		return fmt.Errorf("failed to decode MAC assignments %s: %w", path, err)
+	}
+	return nil
+}
+
+// save persists the assignments, replacing the file atomically.
+func (a *macAllocator) save() error {
+	if a.path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(a.assigned)
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("failed to write MAC assignments: %w", err)
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// allocate assigns a MAC address to the VM. The requested address is used if
+// set, otherwise the address previously assigned to the VM, or the first
+// free candidate derived from the VM name. inUse holds the addresses of the
+// running VMs.
+func (a *macAllocator) allocate(name, requested string, inUse map[string]bool) (string, error) {
+	used, err := a.hostMACs()
+	if err != nil {
+		return "", fmt.Errorf("failed to list host interfaces: %w", err)
+	}
+	for mac := range inUse {
+		used[mac] = true
+	}
+	for vm, mac := range a.assigned {
+		if vm != name {
+			used[mac] = true
+		}
+	}
+
+	var mac string
+	switch {
+	case requested != "":
+		hw, err := net.ParseMAC(requested)
+		if err != nil {
+			return "", fmt.Errorf("invalid MAC address %q: %w", requested, err)
+		}
+		if used[hw.String()] {
+			return "", fmt.Errorf("MAC address %s is already in use", hw)
+		}
+		mac = hw.String()
+	case a.assigned[name] != "" && !used[a.assigned[name]]:
+		mac = a.assigned[name]
+	default:
+		for i := 0; i < macAllocationAttempts; i++ {
+			if candidate := candidateMAC(name, i); !used[candidate] {
+				mac = candidate
+				break
+			}
+		}
+		if mac == "" {
+			return "", fmt.Errorf("no free MAC address found for %s", name)
+		}
+	}
+
+	a.assigned[name] = mac
+	if err := a.save(); err != nil {
+		delete(a.assigned, name)
+		return "", err
+	}
+	return mac, nil
+}
+
+// release removes the assignment of the VM.
+func (a *macAllocator) release(name string) error {
+	if _, ok := a.assigned[name]; !ok {
+		return nil
+	}
+	delete(a.assigned, name)
+	return a.save()
+}
+
+// candidateMAC returns the nth candidate address of a VM, derived from a hash
+// of its name, so a VM is usually assigned the same address.
+func candidateMAC(name string, n int) string {
+	sum := sha256.Sum256([]byte(name + "/" + strconv.Itoa(n)))
+	hw := net.HardwareAddr{macPrefix[0], macPrefix[1], sum[0], sum[1], sum[2], sum[3]}
+	return hw.String()
+}
+
+// hostInterfaceMACs returns the MAC addresses of the host interfaces.
+func hostInterfaceMACs() (map[string]bool, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	macs := make(map[string]bool, len(ifaces))
+	for _, iface := range ifaces {
+		if len(iface.HardwareAddr) > 0 {
+			macs[iface.HardwareAddr.String()] = true
+		}
+	}
+	return macs, nil
+}
@@ -0,0 +1,125 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsNamespace prefixes the names of all the metrics of the driver.
+const metricsNamespace = "nomad_driver_ch"
+
+var (
+	ipPoolAddressesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "ip_pool", "addresses"),
+		"Number of addresses within the IP pool of a network.",
+		[]string{"network"}, nil,
+	)
+	ipPoolFreeAddressesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "ip_pool", "free_addresses"),
+		"Number of addresses left to allocate within the IP pool of a network.",
+		[]string{"network"}, nil,
+	)
+	vfioDevicesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "vfio", "devices"),
+		"Number of VFIO devices passed through to running VMs.",
+		nil, nil,
+	)
+	virtiofsdProcessesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "virtiofsd", "processes"),
+		"Number of virtiofsd processes serving running VMs.",
+		nil, nil,
+	)
+)
+
+// driverMetrics are the metrics recorded by the driver as it operates, in
+// addition to those computed from its state when collected.
+type driverMetrics struct {
+	apiDuration *prometheus.HistogramVec
+	apiErrors   *prometheus.CounterVec
+}
+
+func newDriverMetrics() *driverMetrics {
+	return &driverMetrics{
+		apiDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "api",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of Cloud Hypervisor API requests.",
+			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		}, []string{"method", "path"}),
+		apiErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "api",
+			Name:      "request_errors_total",
+			Help:      "Cloud Hypervisor API requests which failed or returned an error status.",
+		}, []string{"method", "path"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (d *Driver) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ipPoolAddressesDesc
+	ch <- ipPoolFreeAddressesDesc
+	ch <- vfioDevicesDesc
+	ch <- virtiofsdProcessesDesc
+	if d.metrics != nil {
+		d.metrics.apiDuration.Describe(ch)
+		d.metrics.apiErrors.Describe(ch)
+	}
+}
+
+// metricsSnapshot is the state of the driver reported by its metrics. It is
+// taken as the state changes, rather than when collected, as VMs are created
+// while holding the lock guarding it.
+type metricsSnapshot struct {
+	poolAddresses map[string]int
+	freeAddresses map[string]int
+	vfioDevices   int
+	virtiofsd     int
+}
+
+// snapshotMetrics takes the snapshot of the state reported by the metrics.
+// The caller must hold mu.
+func (d *Driver) snapshotMetrics() {
+	s := &metricsSnapshot{
+		poolAddresses: make(map[string]int),
+		freeAddresses: d.freeAddresses(),
+	}
+
+	if d.networkConfig != nil && d.ipPoolStart.IsValid() && d.ipPoolEnd.IsValid() {
+		s.poolAddresses[d.networkConfig.Bridge] = poolFreeAddresses(nil, d.gatewayIP, d.ipPoolStart, d.ipPoolEnd)
+	}
+	for _, n := range d.namedNetworks {
+		s.poolAddresses[n.config.Name] = poolFreeAddresses(nil, n.gatewayIP, n.ipPoolStart, n.ipPoolEnd)
+	}
+
+	for _, proc := range d.processes {
+		if proc.Config != nil {
+			s.vfioDevices += len(proc.Config.Devices)
+		}
+		s.virtiofsd += len(proc.VirtiofsdPIDs)
+	}
+
+	d.metricsState.Store(s)
+}
+
+// Collect implements prometheus.Collector.
+func (d *Driver) Collect(ch chan<- prometheus.Metric) {
+	if s := d.metricsState.Load(); s != nil {
+		for network, free := range s.freeAddresses {
+			ch <- prometheus.MustNewConstMetric(ipPoolFreeAddressesDesc, prometheus.GaugeValue, float64(free), network)
+		}
+		for network, size := range s.poolAddresses {
+			ch <- prometheus.MustNewConstMetric(ipPoolAddressesDesc, prometheus.GaugeValue, float64(size), network)
+		}
+		ch <- prometheus.MustNewConstMetric(vfioDevicesDesc, prometheus.GaugeValue, float64(s.vfioDevices))
+		ch <- prometheus.MustNewConstMetric(virtiofsdProcessesDesc, prometheus.GaugeValue, float64(s.virtiofsd))
+	}
+
+	if d.metrics != nil {
+		d.metrics.apiDuration.Collect(ch)
+		d.metrics.apiErrors.Collect(ch)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"net/netip"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestDriverMetrics(t *testing.T) {
+	d := &Driver{
+		logger:        hclog.NewNullLogger(),
+		networkConfig: &domain.Network{Bridge: "br0"},
+		ipPoolStart:   netip.MustParseAddr("192.168.1.10"),
+		ipPoolEnd:     netip.MustParseAddr("192.168.1.19"),
+		gatewayIP:     netip.MustParseAddr("192.168.1.1"),
+		allocatedIPs:  map[string]bool{"192.168.1.10": true, "192.168.1.11": true},
+		processes: map[string]*VMProcess{
+			"vm1": {
+				Name:          "vm1",
+				VirtiofsdPIDs: []int{100, 101},
+				Config:        &VMConfig{Devices: []DeviceConfig{{Path: "/sys/bus/pci/devices/0000:01:00.0"}}},
+			},
+			"vm2": {Name: "vm2"},
+		},
+		metrics: newDriverMetrics(),
+	}
+
+	d.snapshotMetrics()
+
+	// Requests to an unreachable API socket are recorded as errors.
+	if _, err := d.httpRequest(filepath.Join(t.TempDir(), "missing.sock"), "GET", "/api/v1/vm.info", nil); err == nil {
+		t.Fatalf("expected request to fail")
+	}
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(d); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			key := family.GetName()
+			for _, label := range metric.GetLabel() {
+				key += "/" + label.GetValue()
+			}
+			switch {
+			case metric.GetGauge() != nil:
+				values[key] = metric.GetGauge().GetValue()
+			case metric.GetCounter() != nil:
+				values[key] = metric.GetCounter().GetValue()
+			case metric.GetHistogram() != nil:
+				values[key] = float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+
+	expected := map[string]float64{
+		"nomad_driver_ch_ip_pool_addresses/br0":                            10,
+		"nomad_driver_ch_ip_pool_free_addresses/br0":                       8,
+		"nomad_driver_ch_vfio_devices":                                     1,
+		"nomad_driver_ch_virtiofsd_processes":                              2,
+		"nomad_driver_ch_api_request_duration_seconds/GET//api/v1/vm.info": 1,
+		"nomad_driver_ch_api_request_errors_total/GET//api/v1/vm.info":     1,
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("unexpected metrics %v", values)
+	}
+
+	// Collecting does not wait on VMs being created, which hold the lock.
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		registry.Gather()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("collecting metrics blocked on the driver lock")
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !linux
+
+package cloudhypervisor
+
+import (
+	"errors"
+)
+
+// withNetNS runs fn, as network namespaces are only supported on Linux.
+func withNetNS(path string, fn func() error) error {
+	if path == "" {
+		return fn()
+	}
+	return errors.New("network namespaces are only supported on Linux")
+}
+
+// netNSExists always returns false, as network namespaces are only supported
+// on Linux.
+func netNSExists(string) bool {
+	return false
+}
+
+// createNetNS is not supported, as network namespaces are only supported on
+// Linux.
+func createNetNS(string) (string, error) {
+	return "", errors.New("network namespaces are only supported on Linux")
+}
+
+// removeNetNS is a no-op, as network namespaces are only supported on Linux.
+func removeNetNS(string) error {
+	return nil
+}
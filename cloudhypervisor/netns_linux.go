@@ -0,0 +1,38 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package cloudhypervisor
+
+import (
+	"github.com/hashicorp/nomad/client/lib/nsutil"
+)
+
+// withNetNS runs fn within the network namespace at path, or the current one
+// if path is empty. Processes started by fn inherit the namespace.
+func withNetNS(path string, fn func() error) error {
+	if path == "" {
+		return fn()
+	}
+	return nsutil.WithNetNSPath(path, func(nsutil.NetNS) error { return fn() })
+}
+
+// netNSExists reports whether path refers to a network namespace.
+func netNSExists(path string) bool {
+	return nsutil.IsNSorErr(path) == nil
+}
+
+// createNetNS creates a network namespace for a VM and returns its path.
+func createNetNS(name string) (string, error) {
+	ns, err := nsutil.NewNS(name)
+	if err != nil {
+		return "", err
+	}
+	return ns.Path(), nil
+}
+
+// removeNetNS removes a network namespace created by createNetNS.
+func removeNetNS(path string) error {
+	return nsutil.UnmountNS(path)
+}
@@ -0,0 +1,276 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+)
+
+// namedNetwork is the parsed configuration and address allocation state of a
+// network configured within the driver's named_network blocks.
+type namedNetwork struct {
+	config       domain.NamedNetwork
+	subnet       netip.Prefix
+	gatewayIP    netip.Addr
+	ipPoolStart  netip.Addr
+	ipPoolEnd    netip.Addr
+	allocatedIPs map[string]bool
+}
+
+// newNamedNetwork parses and validates the configuration of a named network.
+// The gateway defaults to the first usable address of the subnet, and the
+// pool to the usable addresses of the subnet.
+func newNamedNetwork(cfg domain.NamedNetwork) (*namedNetwork, error) {
+	if cfg.Bridge == "" {
+		return nil, errors.New("bridge must be configured")
+	}
+
+	prefix, err := netip.ParsePrefix(cfg.SubnetCIDR)
+	if err != nil || !prefix.Addr().Is4() {
+		return nil, fmt.Errorf("subnet_cidr %q must be a valid IPv4 CIDR", cfg.SubnetCIDR)
+	}
+
+	n := &namedNetwork{
+		config:       cfg,
+		subnet:       prefix.Masked(),
+		allocatedIPs: make(map[string]bool),
+	}
+
+	first, last, ok := subnetHosts(n.subnet)
+	if !ok {
+		return nil, fmt.Errorf("subnet %s has no usable addresses", n.subnet)
+	}
+	n.gatewayIP, n.ipPoolStart, n.ipPoolEnd = first, first, last
+
+	if cfg.Gateway != "" {
+		if n.gatewayIP, err = netip.ParseAddr(cfg.Gateway); err != nil {
+			return nil, fmt.Errorf("invalid gateway %q: %w", cfg.Gateway, err)
+		}
+	}
+	if cfg.IPPoolStart != "" {
+		if n.ipPoolStart, err = netip.ParseAddr(cfg.IPPoolStart); err != nil {
+			return nil, fmt.Errorf("invalid ip_pool_start %q: %w", cfg.IPPoolStart, err)
+		}
+	}
+	if cfg.IPPoolEnd != "" {
+		if n.ipPoolEnd, err = netip.ParseAddr(cfg.IPPoolEnd); err != nil {
+			return nil, fmt.Errorf("invalid ip_pool_end %q: %w", cfg.IPPoolEnd, err)
+		}
+	}
+
+	if !n.subnet.Contains(n.gatewayIP) {
+		return nil, fmt.Errorf("gateway %s must be within %s", n.gatewayIP, n.subnet)
+	}
+	if !n.subnet.Contains(n.ipPoolStart) || !n.subnet.Contains(n.ipPoolEnd) {
+		return nil, fmt.Errorf("IP pool %s-%s must fall within subnet %s", n.ipPoolStart, n.ipPoolEnd, n.subnet)
+	}
+	if n.ipPoolEnd.Compare(n.ipPoolStart) < 0 {
+		return nil, fmt.Errorf("ip_pool_end %s precedes ip_pool_start %s", n.ipPoolEnd, n.ipPoolStart)
+	}
+
+	return n, nil
+}
+
+// reserveIP marks the static IP as allocated, or allocates an address from
+// the pool if empty.
+func (n *namedNetwork) reserveIP(staticIP string) (string, error) {
+	if staticIP == "" {
+		return allocatePoolIP(n.allocatedIPs, n.subnet, n.gatewayIP, n.ipPoolStart, n.ipPoolEnd)
+	}
+
+	addr, err := netip.ParseAddr(staticIP)
+	if err != nil {
+		return "", fmt.Errorf("invalid static IP %q: %w", staticIP, err)
+	}
+	if !n.subnet.Contains(addr) {
+		return "", fmt.Errorf("static IP %s is outside subnet %s", staticIP, n.subnet)
+	}
+	if addr == n.gatewayIP {
+		return "", fmt.Errorf("static IP %s conflicts with the gateway", staticIP)
+	}
+	if n.allocatedIPs[staticIP] {
+		return "", fmt.Errorf("static IP %s is already allocated", staticIP)
+	}
+
+	n.allocatedIPs[staticIP] = true
+	return staticIP, nil
+}
+
+// initializeNamedNetworks parses the named networks, ensuring each has a
+// unique name, bridge and subnet, which do not clash with the driver
+// network. Any addresses allocated are discarded.
+func (d *Driver) initializeNamedNetworks() error {
+	d.namedNetworks = nil
+
+	names := make(map[string]bool)
+	bridges := map[string]bool{d.networkConfig.Bridge: true}
+
+	for _, cfg := range d.namedNetworkConfig {
+		if cfg.Name == "" {
+			return errors.New("named network requires name parameter")
+		}
+		if names[cfg.Name] || cfg.Name == d.networkConfig.Bridge {
+			return fmt.Errorf("named network %q is not unique", cfg.Name)
+		}
+		if strings.HasPrefix(cfg.Name, groupNetworkPrefix) {
+			return fmt.Errorf("named network %q must not use the %q prefix of group networks", cfg.Name, groupNetworkPrefix)
+		}
+		names[cfg.Name] = true
+
+		n, err := newNamedNetwork(cfg)
+		if err != nil {
+			return fmt.Errorf("named network %q is invalid: %w", cfg.Name, err)
+		}
+
+		if bridges[cfg.Bridge] {
+			return fmt.Errorf("named network %q bridge %s is already in use", cfg.Name, cfg.Bridge)
+		}
+		bridges[cfg.Bridge] = true
+
+		if d.subnet.IsValid() && d.subnet.Overlaps(n.subnet) {
+			return fmt.Errorf("named network %q subnet %s overlaps %s", cfg.Name, n.subnet, d.subnet)
+		}
+		for _, other := range d.namedNetworks {
+			if other.subnet.Overlaps(n.subnet) {
+				return fmt.Errorf("named network %q subnet %s overlaps %s", cfg.Name, n.subnet, other.subnet)
+			}
+		}
+
+		d.namedNetworks = append(d.namedNetworks, n)
+	}
+
+	return nil
+}
+
+// namedNetwork returns the named or group network with the passed name, or
+// nil if it is not configured.
+func (d *Driver) namedNetwork(name string) *namedNetwork {
+	if name == "" {
+		return nil
+	}
+	for _, n := range d.namedNetworks {
+		if n.config.Name == name {
+			return n
+		}
+	}
+	for _, g := range d.groupNetworks {
+		if g.config.Name == name {
+			return g.namedNetwork
+		}
+	}
+	return nil
+}
+
+// bridgeNetwork returns the name of the named network the VM's first
+// interface is attached to, if any.
+func bridgeNetwork(config *domain.Config) string {
+	if config == nil || len(config.NetworkInterfaces) == 0 || config.NetworkInterfaces[0].Bridge == nil {
+		return ""
+	}
+	return config.NetworkInterfaces[0].Bridge.Network
+}
+
+// freeAddresses returns the number of addresses left to allocate within each
+// network. The caller must hold d.mu.
+func (d *Driver) freeAddresses() map[string]int {
+	free := make(map[string]int)
+	if d.networkConfig != nil && d.ipPoolStart.IsValid() && d.ipPoolEnd.IsValid() {
+		free[d.networkConfig.Bridge] = poolFreeAddresses(d.allocatedIPs, d.gatewayIP, d.ipPoolStart, d.ipPoolEnd)
+	}
+	for _, n := range d.namedNetworks {
+		free[n.config.Name] = poolFreeAddresses(n.allocatedIPs, n.gatewayIP, n.ipPoolStart, n.ipPoolEnd)
+	}
+	return free
+}
+
+// allocatePoolIP allocates the first free address of the pool, skipping the
+// gateway.
+func allocatePoolIP(allocated map[string]bool, subnet netip.Prefix, gateway, start, end netip.Addr) (string, error) {
+	for ip := start; ; {
+		if subnet.IsValid() && !subnet.Contains(ip) {
+			return "", fmt.Errorf("allocated IP %s is outside configured subnet %s", ip.String(), subnet.String())
+		}
+
+		if gateway.IsValid() && ip == gateway {
+			if ip == end {
+				break
+			}
+			next := ip.Next()
+			if !next.IsValid() {
+				break
+			}
+			ip = next
+			continue
+		}
+
+		ipStr := ip.String()
+		if !allocated[ipStr] {
+			allocated[ipStr] = true
+			return ipStr, nil
+		}
+
+		if ip == end {
+			break
+		}
+
+		next := ip.Next()
+		if !next.IsValid() {
+			break
+		}
+		ip = next
+	}
+
+	return "", fmt.Errorf("no available IPs in pool %s-%s", start.String(), end.String())
+}
+
+// poolFreeAddresses returns the number of addresses of the pool which are
+// neither the gateway nor allocated.
+func poolFreeAddresses(allocated map[string]bool, gateway, start, end netip.Addr) int {
+	if !start.Is4() || !end.Is4() || end.Compare(start) < 0 {
+		return 0
+	}
+
+	inPool := func(addr netip.Addr) bool {
+		return addr.Compare(start) >= 0 && addr.Compare(end) <= 0
+	}
+
+	free := int(addrUint32(end) - addrUint32(start) + 1)
+	if gateway.IsValid() && inPool(gateway) {
+		free--
+	}
+	for ip := range allocated {
+		if addr, err := netip.ParseAddr(ip); err == nil && addr != gateway && inPool(addr) {
+			free--
+		}
+	}
+	return free
+}
+
+// subnetHosts returns the first and last usable host addresses of an IPv4
+// subnet, excluding the network and broadcast addresses.
+func subnetHosts(subnet netip.Prefix) (netip.Addr, netip.Addr, bool) {
+	if !subnet.Addr().Is4() || subnet.Bits() > 30 {
+		return netip.Addr{}, netip.Addr{}, false
+	}
+	network := addrUint32(subnet.Addr())
+	broadcast := network | (^uint32(0) >> subnet.Bits())
+	return uint32Addr(network + 1), uint32Addr(broadcast - 1), true
+}
+
+func addrUint32(addr netip.Addr) uint32 {
+	b := addr.As4()
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func uint32Addr(v uint32) netip.Addr {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return netip.AddrFrom4(b)
+}
@@ -0,0 +1,48 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"fmt"
+
+	virtNet "github.com/ccheshirecat/nomad-driver-ch/virt/net"
+)
+
+// rateLimiterConfig converts the rate limit of a network interface to the
+// Cloud Hypervisor rate limiter configuration, or nil if not limited.
+func rateLimiterConfig(cfg *virtNet.NetworkInterfaceRateLimitConfig) (*RateLimiterConfig, error) {
+	if cfg == nil || (cfg.Bandwidth == nil && cfg.Ops == nil) {
+		return nil, nil
+	}
+
+	bandwidth, err := tokenBucketConfig(cfg.Bandwidth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bandwidth rate limit: %w", err)
+	}
+	ops, err := tokenBucketConfig(cfg.Ops)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ops rate limit: %w", err)
+	}
+
+	return &RateLimiterConfig{Bandwidth: bandwidth, Ops: ops}, nil
+}
+
+// tokenBucketConfig converts a rate limit token bucket, or returns nil if not
+// configured.
+func tokenBucketConfig(cfg *virtNet.TokenBucketConfig) (*TokenBucketConfig, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	refill, err := cfg.RefillDuration()
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenBucketConfig{
+		Size:         cfg.Size,
+		OneTimeBurst: cfg.OneTimeBurst,
+		RefillTime:   refill.Milliseconds(),
+	}, nil
+}
@@ -0,0 +1,304 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+)
+
+const (
+	// readinessPollInterval is how often the readiness probes of a booting
+	// guest are retried, and readinessProbeTimeout how long each attempt
+	// may take.
+	readinessPollInterval = 500 * time.Millisecond
+	readinessProbeTimeout = 2 * time.Second
+
+	// serialProbeLineSize caps the length of the serial console lines the
+	// serial probe matches, so a guest never writing a newline does not grow
+	// the pending line indefinitely.
+	serialProbeLineSize = 64 * 1024
+
+	// guestVsockCID is the context ID of the vsock device added to VMs using
+	// the vsock readiness probe, and vsockSocketName the name of its socket
+	// within the VM working directory.
+	guestVsockCID   = 3
+	vsockSocketName = "vsock.sock"
+
+	// phoneHomePath prefixes the path of the endpoint cloud-init phones home
+	// to, which is followed by a token unique to the VM.
+	phoneHomePath = "/phone-home/"
+)
+
+// WaitDomainReady waits for the guest of the VM to pass its readiness probes,
+// in turn, until the context is done. VMs without readiness probes are ready
+// once booted.
+func (d *Driver) WaitDomainReady(ctx context.Context, name string) error {
+	d.mu.RLock()
+	proc, exists := d.processes[name]
+	var phoneHome *phoneHomeServer
+	if exists {
+		phoneHome = proc.phoneHome
+	}
+	d.mu.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("VM %s not found", name)
+	}
+
+	r := proc.readiness
+	if r == nil {
+		return nil
+	}
+
+	if r.Serial != "" {
+		re, err := regexp.Compile(r.Serial)
+		if err != nil {
+			return fmt.Errorf("invalid serial readiness pattern: %w", err)
+		}
+		probe := &serialProbe{path: proc.Config.Serial.File, re: re}
+		if err := d.waitReady(ctx, proc, "serial", probe.probe); err != nil {
+			return err
+		}
+	}
+
+	if r.TCPPort > 0 {
+		if proc.IP == "" {
+			return errors.New("tcp readiness probe requires the guest IP to be known")
+		}
+		address := net.JoinHostPort(proc.IP, strconv.Itoa(r.TCPPort))
+		if err := d.waitReady(ctx, proc, "tcp", tcpProbe(proc.NetNS, address)); err != nil {
+			return err
+		}
+	}
+
+	if r.VsockPort > 0 {
+		socket := filepath.Join(proc.WorkDir, vsockSocketName)
+		if err := d.waitReady(ctx, proc, "vsock", vsockProbe(socket, r.VsockPort)); err != nil {
+			return err
+		}
+	}
+
+	if r.PhoneHome && phoneHome != nil {
+		if err := d.waitReady(ctx, proc, "phone_home", phoneHome.probe); err != nil {
+			return err
+		}
+
+		// The endpoint is no longer needed once the guest has phoned home.
+		d.mu.Lock()
+		d.stopPhoneHome(proc)
+		d.mu.Unlock()
+	}
+
+	return nil
+}
+
+// waitReady retries the probe until it passes, the context is done or the
+// VMM exits, as the guest then never becomes ready.
+func (d *Driver) waitReady(ctx context.Context, proc *VMProcess, name string, probe func() error) error {
+	ticker := time.NewTicker(readinessPollInterval)
+	defer ticker.Stop()
+
+	for {
+		err := probe()
+		if err == nil {
+			d.logger.Debug("readiness probe passed", "vm", proc.Name, "probe", name)
+			return nil
+		}
+
+		if proc.vmm != nil {
+			if exit, exited := proc.vmm.Exited(); exited {
+				return fmt.Errorf("VMM exited with code %d waiting for %s readiness probe", exit.ExitCode, name)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s readiness probe did not pass before the boot timeout: %w", name, err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// serialProbe passes once a line written by the guest to its serial console
+// matches the pattern. Each attempt reads the lines written since the
+// previous one.
+type serialProbe struct {
+	path string
+	re   *regexp.Regexp
+
+	offset  int64
+	pending []byte
+}
+
+func (p *serialProbe) probe() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(p.offset, io.SeekStart); err != nil {
+		return err
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	p.offset += int64(len(b))
+
+	lines := bytes.Split(append(p.pending, b...), []byte("\n"))
+	p.pending = lines[len(lines)-1]
+	if len(p.pending) > serialProbeLineSize {
+		p.pending = p.pending[len(p.pending)-serialProbeLineSize:]
+	}
+	p.pending = bytes.Clone(p.pending)
+
+	// The pending line is matched too, as prompts are not followed by a
+	// newline.
+	for _, line := range lines {
+		if p.re.Match(bytes.TrimRight(line, "\r")) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no serial console line matches %q", p.re)
+}
+
+// tcpProbe returns a probe passing once the guest accepts TCP connections on
+// the address, dialed within the network namespace of the VM.
+func tcpProbe(netns, address string) func() error {
+	return func() error {
+		return withNetNS(netns, func() error {
+			conn, err := net.DialTimeout("tcp", address, readinessProbeTimeout)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		})
+	}
+}
+
+// vsockProbe returns a probe passing once a guest agent accepts connections
+// on the vsock port. Connections are made through the socket of the vsock
+// device, to which the VMM replies OK once the guest has accepted them.
+func vsockProbe(socket string, port uint32) func() error {
+	return func() error {
+		conn, err := net.DialTimeout("unix", socket, readinessProbeTimeout)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		if err := conn.SetDeadline(time.Now().Add(readinessProbeTimeout)); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(conn, "CONNECT %d\n", port); err != nil {
+			return err
+		}
+		reply, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("vsock port %d: %w", port, err)
+		}
+		if !strings.HasPrefix(reply, "OK ") {
+			return fmt.Errorf("vsock port %d: unexpected reply %q", port, strings.TrimSpace(reply))
+		}
+		return nil
+	}
+}
+
+// phoneHomeServer serves the endpoint the cloud-init of a VM phones home to
+// once it has finished.
+type phoneHomeServer struct {
+	url    string
+	server *http.Server
+
+	// done is closed once the guest has phoned home.
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// newPhoneHomeServer serves the phone home endpoint of a VM on an ephemeral
+// port of the address, listening within the network namespace of the VM.
+func newPhoneHomeServer(netns, address string) (*phoneHomeServer, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(b)
+
+	var listener net.Listener
+	if err := withNetNS(netns, func() error {
+		var err error
+		listener, err = net.Listen("tcp", net.JoinHostPort(address, "0"))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	p := &phoneHomeServer{
+		url:  "http://" + listener.Addr().String() + phoneHomePath + token,
+		done: make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+phoneHomePath+token, func(w http.ResponseWriter, r *http.Request) {
+		p.doneOnce.Do(func() { close(p.done) })
+		w.WriteHeader(http.StatusOK)
+	})
+	p.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go p.server.Serve(listener)
+	return p, nil
+}
+
+func (p *phoneHomeServer) probe() error {
+	select {
+	case <-p.done:
+		return nil
+	default:
+		return errors.New("guest has not phoned home")
+	}
+}
+
+// startPhoneHome serves the phone home endpoint of the VM on its gateway.
+func (d *Driver) startPhoneHome(config *domain.Config, proc *VMProcess) error {
+	settings, ok := d.deriveNetworkSettings(config, proc)
+	if !ok || settings.gateway == "" {
+		return errors.New("phone home readiness probe requires the VM to have a gateway")
+	}
+
+	server, err := newPhoneHomeServer(proc.NetNS, settings.gateway)
+	if err != nil {
+		return err
+	}
+	proc.phoneHome = server
+
+	d.logger.Debug("serving phone home endpoint", "vm", proc.Name, "url", server.url)
+	return nil
+}
+
+// stopPhoneHome stops serving the phone home endpoint of the VM, if any.
+func (d *Driver) stopPhoneHome(proc *VMProcess) {
+	if proc.phoneHome != nil {
+		proc.phoneHome.server.Close()
+		proc.phoneHome = nil
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestSerialProbe(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "serial.log")
+	probe := &serialProbe{path: path, re: regexp.MustCompile(`^Cloud-init v\. .* finished`)}
+
+	// The serial log does not exist until the VM boots.
+	if err := probe.probe(); err == nil {
+		t.Fatalf("expected error for missing serial log")
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+
+	f.WriteString("[    0.000000] Linux version 6.1\r\nCloud-init v. 24.1 run")
+	if err := probe.probe(); err == nil {
+		t.Fatalf("expected no match before the line is complete")
+	}
+
+	// The line is completed by a later write.
+	f.WriteString("ning modules\r\nCloud-init v. 24.1 fin")
+	if err := probe.probe(); err == nil {
+		t.Fatalf("expected no match for a partial line")
+	}
+	f.WriteString("ished at Thu, 02 May 2024\r\n")
+	if err := probe.probe(); err != nil {
+		t.Fatalf("expected match, got: %v", err)
+	}
+}
+
+func TestTCPProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	address := listener.Addr().String()
+
+	if err := tcpProbe("", address)(); err != nil {
+		t.Fatalf("expected probe to pass, got: %v", err)
+	}
+
+	listener.Close()
+	if err := tcpProbe("", address)(); err == nil {
+		t.Fatalf("expected probe to fail once the listener is closed")
+	}
+}
+
+func TestVsockProbe(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), vsockSocketName)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+
+	// The VMM replies OK to connections to the port the guest listens on,
+	// and closes the others.
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			if strings.TrimSpace(line) == "CONNECT 1024" {
+				conn.Write([]byte("OK 1073741824\n"))
+			}
+			conn.Close()
+		}
+	}()
+
+	if err := vsockProbe(socket, 1024)(); err != nil {
+		t.Fatalf("expected probe to pass, got: %v", err)
+	}
+	if err := vsockProbe(socket, 2048)(); err == nil {
+		t.Fatalf("expected probe to fail for a port the guest does not listen on")
+	}
+}
+
+func TestPhoneHomeServer(t *testing.T) {
+	server, err := newPhoneHomeServer("", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer server.server.Close()
+
+	if err := server.probe(); err == nil {
+		t.Fatalf("expected probe to fail before phoning home")
+	}
+
+	// Only the URL of the VM is served.
+	resp, err := http.Post(strings.TrimSuffix(server.url, "0")+"1", "text/plain", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+	if err := server.probe(); err == nil {
+		t.Fatalf("expected probe to fail for another URL")
+	}
+
+	resp, err = http.Post(server.url, "application/x-www-form-urlencoded", strings.NewReader("instance_id=vm"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if err := server.probe(); err != nil {
+		t.Fatalf("expected probe to pass, got: %v", err)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	d := &Driver{logger: hclog.NewNullLogger()}
+	proc := &VMProcess{Name: "test-vm"}
+
+	attempts := 0
+	probe := func() error {
+		attempts++
+		if attempts < 3 {
+			return os.ErrNotExist
+		}
+		return nil
+	}
+	if err := d.waitReady(context.Background(), proc, "test", probe); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+
+	// The probe error is reported once the boot timeout expires.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*readinessPollInterval)
+	defer cancel()
+	err := d.waitReady(ctx, proc, "test", func() error { return os.ErrNotExist })
+	if err == nil || !strings.Contains(err.Error(), "did not pass before the boot timeout") {
+		t.Fatalf("expected boot timeout error, got: %v", err)
+	}
+}
+
+func TestWaitReady_VMMExited(t *testing.T) {
+	d := &Driver{logger: hclog.NewNullLogger()}
+	proc := &VMProcess{Name: "test-vm", vmm: startSupervised(t, "exit 1")}
+	waitExited(t, proc.vmm)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := d.waitReady(ctx, proc, "test", func() error { return os.ErrNotExist })
+	if err == nil || !strings.Contains(err.Error(), "VMM exited with code 1") {
+		t.Fatalf("expected VMM exit error, got: %v", err)
+	}
+}
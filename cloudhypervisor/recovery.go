@@ -0,0 +1,101 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// vmStateFile is the file within the work directory of a VM its process is
+// persisted to, so the VM can be recovered once the driver restarts.
+const vmStateFile = "vm.json"
+
+// saveVMState persists the process of the VM within its work directory,
+// replacing the file atomically.
+func (d *Driver) saveVMState(proc *VMProcess) error {
+	b, err := json.Marshal(proc)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(proc.WorkDir, vmStateFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("failed to write VM state: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadVMState reads the process of the VM persisted within the work
+// directory.
+func loadVMState(workDir string) (*VMProcess, error) {
+	path := filepath.Join(workDir, vmStateFile)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var proc VMProcess
+	if err := json.Unmarshal(b, &proc); err != nil {
+		return nil, fmt.Errorf("failed to decode VM state %s: %w", path, err)
+	}
+	proc.WorkDir = workDir
+	return &proc, nil
+}
+
+// recoverDomains registers the VMs started by a previous run of the driver
+// whose VMM still serves its API, so they can be recovered by their tasks.
+// Their addresses are reserved again, while the MAC addresses and group
+// networks are restored from their own files. The caller must hold d.mu.
+func (d *Driver) recoverDomains() error {
+	entries, err := os.ReadDir(d.dataDir)
+	if err != nil {
+		return fmt.Errorf("failed to read data directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		proc, err := loadVMState(filepath.Join(d.dataDir, entry.Name()))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			d.logger.Warn("unable to recover VM", "work_dir", entry.Name(), "error", err)
+			continue
+		}
+		if _, exists := d.processes[proc.Name]; exists {
+			continue
+		}
+
+		// The VMM is only recovered while it serves its API, as its PID may
+		// have since been reused by another process.
+		if _, err := d.getVMInfo(proc); err != nil {
+			d.logger.Warn("VM is no longer running, not recovering it", "name", proc.Name, "error", err)
+			d.closeAPIClient(proc.APISocket)
+			continue
+		}
+
+		switch {
+		case proc.GroupNetwork != nil:
+			// Addresses of group networks are restored with the networks.
+		case proc.Network != "":
+			if n := d.namedNetwork(proc.Network); n != nil {
+				n.allocatedIPs[proc.IP] = true
+			}
+		case proc.CNI == nil && proc.VtapParent == "" && proc.NetNS == "" && proc.IP != "":
+			d.allocatedIPs[proc.IP] = true
+		}
+
+		d.processes[proc.Name] = proc
+		d.logger.Info("recovered VM", "name", proc.Name, "pid", proc.Pid, "ip", proc.IP)
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	"github.com/hashicorp/go-hclog"
+)
+
+// fakeVMM serves the API of a VMM on a socket, whose VM is shut off once
+// shut down.
+func fakeVMM(t *testing.T, socket string) {
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var lock sync.Mutex
+	state := "Running"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/vm.info", func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		w.Write([]byte(`{"state":"` + state + `"}`))
+	})
+	mux.HandleFunc("/api/v1/vm.shutdown", func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		state = "Shutoff"
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+}
+
+func TestRecoverDomains(t *testing.T) {
+	dataDir := t.TempDir()
+
+	// The VMM process of the VM, which is killed once it is destroyed.
+	vmm := exec.Command("sleep", "60")
+	if err := vmm.Start(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		vmm.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() { vmm.Process.Kill() })
+
+	// The VMs started by the previous run of the driver, of which only the
+	// first still runs.
+	running := &VMProcess{
+		Name:      "vm1",
+		Pid:       vmm.Process.Pid,
+		WorkDir:   filepath.Join(dataDir, "vm1"),
+		APISocket: filepath.Join(dataDir, "vm1", "api.sock"),
+		MAC:       "02:43:00:00:00:01",
+		IP:        "192.168.1.10",
+		Config: &VMConfig{
+			CPUs:   CPUConfig{BootVCPUs: 2, MaxVCPUs: 2},
+			Memory: MemoryConfig{Size: 512 * 1024 * 1024},
+		},
+	}
+	stopped := &VMProcess{
+		Name:      "vm2",
+		WorkDir:   filepath.Join(dataDir, "vm2"),
+		APISocket: filepath.Join(dataDir, "vm2", "api.sock"),
+		IP:        "192.168.1.11",
+	}
+
+	previous := &Driver{logger: hclog.NewNullLogger()}
+	for _, proc := range []*VMProcess{running, stopped} {
+		if err := os.MkdirAll(proc.WorkDir, 0755); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := previous.saveVMState(proc); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	fakeVMM(t, running.APISocket)
+
+	d := NewWithSkipValidation(context.Background(), hclog.NewNullLogger(),
+		&domain.CloudHypervisor{}, &domain.Network{Bridge: "br0"}, nil, &domain.VFIO{}, dataDir, true)
+
+	d.mu.Lock()
+	err := d.recoverDomains()
+	d.mu.Unlock()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := d.processes["vm2"]; ok {
+		t.Fatalf("expected stopped VM not to be recovered")
+	}
+	proc, ok := d.processes["vm1"]
+	if !ok {
+		t.Fatalf("expected running VM to be recovered")
+	}
+	if proc.Pid != running.Pid || proc.MAC != running.MAC || proc.IP != running.IP {
+		t.Fatalf("expected %+v, got %+v", running, proc)
+	}
+	if !d.allocatedIPs["192.168.1.10"] {
+		t.Fatalf("expected address of recovered VM to be allocated")
+	}
+
+	info, err := d.GetDomain("vm1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info == nil || info.State != CHStateRunning {
+		t.Fatalf("expected running VM, got %+v", info)
+	}
+
+	desc, err := d.DescribeDomain("vm1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if desc.PID != running.Pid || desc.CPUs != 2 {
+		t.Fatalf("unexpected description %+v", desc)
+	}
+
+	// The recovered VM is shut down and its VMM killed once destroyed.
+	if err := d.DestroyDomain("vm1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	<-exited
+	if d.allocatedIPs["192.168.1.10"] {
+		t.Fatalf("expected address of destroyed VM to be released")
+	}
+	if _, err := os.Stat(running.WorkDir); !os.IsNotExist(err) {
+		t.Fatalf("expected work directory to be removed, got %v", err)
+	}
+}
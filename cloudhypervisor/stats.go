@@ -0,0 +1,136 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+)
+
+const (
+	// clockTicks is the USER_HZ unit of the CPU times within /proc, which
+	// is 100 on all Linux platforms.
+	clockTicks = 100
+
+	// procRoot is the mount point of procfs.
+	procRoot = "/proc"
+)
+
+// processStats returns the resource usage of the VMM and virtiofsd
+// processes of a VM, keyed by PID, along with their total CPU time in
+// nanoseconds. Processes which cannot be read, such as those which have
+// exited, are omitted.
+func (d *Driver) processStats(proc *VMProcess) (map[string]domain.ProcessStats, uint64) {
+	pids := append([]int{proc.Pid}, proc.VirtiofsdPIDs...)
+
+	stats := make(map[string]domain.ProcessStats, len(pids))
+	var cpuTime uint64
+	for _, pid := range pids {
+		if pid <= 0 {
+			continue
+		}
+		s, err := readProcessStats(procRoot, pid)
+		if err != nil {
+			d.logger.Trace("unable to read process stats", "vm", proc.Name, "pid", pid, "error", err)
+			continue
+		}
+		stats[strconv.Itoa(pid)] = s
+		cpuTime += s.UserTime + s.SystemTime
+	}
+	return stats, cpuTime
+}
+
+// readProcessStats reads the CPU time, memory and page faults of a process
+// from the stat and status files of procfs mounted at root.
+func readProcessStats(root string, pid int) (domain.ProcessStats, error) {
+	dir := fmt.Sprintf("%s/%d", root, pid)
+
+	stat, err := os.ReadFile(dir + "/stat")
+	if err != nil {
+		return domain.ProcessStats{}, err
+	}
+	s, err := parseProcStat(stat)
+	if err != nil {
+		return domain.ProcessStats{}, fmt.Errorf("invalid %s/stat: %w", dir, err)
+	}
+
+	status, err := os.ReadFile(dir + "/status")
+	if err != nil {
+		return domain.ProcessStats{}, err
+	}
+	s.RSS, s.MaxRSS, s.Swap = parseProcStatus(status)
+
+	return s, nil
+}
+
+// parseProcStat parses the CPU times and page faults from the contents of
+// /proc/<pid>/stat.
+func parseProcStat(b []byte) (domain.ProcessStats, error) {
+	// The command name is enclosed in parentheses and may contain spaces, so
+	// fields are counted from the last closing parenthesis, which is
+	// followed by the third field, the process state.
+	i := bytes.LastIndexByte(b, ')')
+	if i < 0 {
+		return domain.ProcessStats{}, errors.New("missing command name")
+	}
+	fields := strings.Fields(string(b[i+1:]))
+	if len(fields) < 13 {
+		return domain.ProcessStats{}, fmt.Errorf("expected at least 15 fields, found %d", len(fields)+2)
+	}
+
+	// minflt, majflt, utime and stime are the 10th, 12th, 14th and 15th
+	// fields respectively.
+	var values [4]uint64
+	for n, idx := range []int{7, 9, 11, 12} {
+		v, err := strconv.ParseUint(fields[idx], 10, 64)
+		if err != nil {
+			return domain.ProcessStats{}, fmt.Errorf("invalid field %d: %w", idx+3, err)
+		}
+		values[n] = v
+	}
+
+	const tickNanos = 1e9 / clockTicks
+	return domain.ProcessStats{
+		MinorFaults: values[0],
+		MajorFaults: values[1],
+		UserTime:    values[2] * tickNanos,
+		SystemTime:  values[3] * tickNanos,
+	}, nil
+}
+
+// parseProcStatus parses the resident set size, its peak and the swap usage,
+// in bytes, from the contents of /proc/<pid>/status. Missing entries, such
+// as for kernel threads, are zero.
+func parseProcStatus(b []byte) (rss, maxRSS, swap uint64) {
+	for _, line := range strings.Split(string(b), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+
+		var dst *uint64
+		switch key {
+		case "VmRSS":
+			dst = &rss
+		case "VmHWM":
+			dst = &maxRSS
+		case "VmSwap":
+			dst = &swap
+		default:
+			continue
+		}
+
+		// Values are reported in kB.
+		if kb, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64); err == nil {
+			*dst = kb * 1024
+		}
+	}
+	return rss, maxRSS, swap
+}
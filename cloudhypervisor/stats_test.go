@@ -0,0 +1,71 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestReadProcessStats(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "42")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The command name contains spaces and parentheses.
+	stat := "42 (cloud (hyper) visor) S 1 42 42 0 -1 4194560 1500 0 3 0 250 75 0 0 20 0 4 0 100 1073741824 2048"
+	status := "Name:\tcloud-hypervisor\nVmHWM:\t  204800 kB\nVmRSS:\t  102400 kB\nVmSwap:\t      16 kB\n"
+	if err := os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "status"), []byte(status), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stats, err := readProcessStats(root, 42)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := domain.ProcessStats{
+		UserTime:    2500 * 1000 * 1000,
+		SystemTime:  750 * 1000 * 1000,
+		RSS:         100 * 1024 * 1024,
+		MaxRSS:      200 * 1024 * 1024,
+		Swap:        16 * 1024,
+		MinorFaults: 1500,
+		MajorFaults: 3,
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	if _, err := parseProcStat([]byte("42 (truncated) S 1 42")); err == nil {
+		t.Fatalf("expected truncated stat to be rejected")
+	}
+	if _, err := readProcessStats(root, 43); err == nil {
+		t.Fatalf("expected missing process to be rejected")
+	}
+}
+
+func TestProcessStats(t *testing.T) {
+	d := &Driver{logger: hclog.NewNullLogger()}
+
+	// Processes which cannot be read are omitted.
+	stats, cpuTime := d.processStats(&VMProcess{Name: "vm", Pid: os.Getpid(), VirtiofsdPIDs: []int{-1}})
+	self, ok := stats[strconv.Itoa(os.Getpid())]
+	if len(stats) != 1 || !ok {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if self.RSS == 0 || cpuTime != self.UserTime+self.SystemTime {
+		t.Fatalf("unexpected stats %+v (cpu time %d)", self, cpuTime)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// cgroupRoot is the mount point of the cgroup filesystem.
+	cgroupRoot = "/sys/fs/cgroup"
+
+	// processKillTimeout is how long to wait for a killed process to be
+	// reaped.
+	processKillTimeout = 5 * time.Second
+)
+
+// supervisedProcess is a started child process which is waited on, so it is
+// reaped once it exits and its exit status is recorded.
+type supervisedProcess struct {
+	name string
+	cmd  *exec.Cmd
+
+	// done is closed once the process has exited, after exit is set.
+	done chan struct{}
+	exit *domain.ProcessExit
+
+	// stopping indicates the driver killed the process, so its exit is not
+	// a crash.
+	stopping atomic.Bool
+
+	// oomEvents is the cgroup file counting the OOM kills within the cgroup
+	// of the process, and oomKills the count when the process started.
+	oomEvents string
+	oomKills  uint64
+}
+
+// supervise waits on the started process in the background, logging its exit
+// unless it was stopped by the driver.
+func supervise(logger hclog.Logger, name string, cmd *exec.Cmd) *supervisedProcess {
+	p := &supervisedProcess{
+		name: name,
+		cmd:  cmd,
+		done: make(chan struct{}),
+	}
+	p.oomEvents, p.oomKills = oomKillCounter(procRoot, cgroupRoot, cmd.Process.Pid)
+
+	go func() {
+		err := cmd.Wait()
+		p.exit = p.exitStatus(err)
+		close(p.done)
+
+		if !p.stopping.Load() {
+			logger.Warn("process exited unexpectedly", "process", name, "pid", cmd.Process.Pid,
+				"exit_code", p.exit.ExitCode, "signal", p.exit.Signal, "oom_killed", p.exit.OOMKilled)
+		}
+	}()
+
+	return p
+}
+
+// exitStatus returns the exit status of the process given the result of
+// waiting on it.
+func (p *supervisedProcess) exitStatus(err error) *domain.ProcessExit {
+	exit := &domain.ProcessExit{Stopped: p.stopping.Load()}
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		exit.ExitCode = -1
+		return exit
+	}
+
+	status, ok := p.cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok {
+		exit.ExitCode = p.cmd.ProcessState.ExitCode()
+		return exit
+	}
+
+	switch {
+	case status.Exited():
+		exit.ExitCode = status.ExitStatus()
+	case status.Signaled():
+		exit.Signal = int(status.Signal())
+		exit.ExitCode = 128 + exit.Signal
+
+		// A process killed by the kernel OOM killer receives SIGKILL, and
+		// increments the OOM kill count of its cgroup.
+		if status.Signal() == syscall.SIGKILL && p.oomEvents != "" {
+			if kills, err := readOOMKills(p.oomEvents); err == nil && kills > p.oomKills {
+				exit.OOMKilled = true
+			}
+		}
+	}
+	return exit
+}
+
+// Exited returns the exit status of the process if it has exited.
+func (p *supervisedProcess) Exited() (*domain.ProcessExit, bool) {
+	select {
+	case <-p.done:
+		return p.exit, true
+	default:
+		return nil, false
+	}
+}
+
+// Kill kills the process, recording it was stopped by the driver, and waits
+// for it to be reaped.
+func (p *supervisedProcess) Kill(timeout time.Duration) {
+	if _, exited := p.Exited(); exited {
+		return
+	}
+
+	p.stopping.Store(true)
+	p.cmd.Process.Kill()
+
+	select {
+	case <-p.done:
+	case <-time.After(timeout):
+	}
+}
+
+// oomKillCounter returns the cgroup file counting the OOM kills within the
+// cgroup of the process, and its current count. The file is empty if the
+// cgroup cannot be determined.
+func oomKillCounter(procRoot, cgroupRoot string, pid int) (string, uint64) {
+	b, err := os.ReadFile(fmt.Sprintf("%s/%d/cgroup", procRoot, pid))
+	if err != nil {
+		return "", 0
+	}
+
+	path := oomEventsPath(cgroupRoot, b)
+	if path == "" {
+		return "", 0
+	}
+	kills, err := readOOMKills(path)
+	if err != nil {
+		return "", 0
+	}
+	return path, kills
+}
+
+// oomEventsPath returns the file counting OOM kills for the cgroup given the
+// contents of /proc/<pid>/cgroup, which is memory.events with cgroup v2, and
+// memory.oom_control of the memory controller with cgroup v1.
+func oomEventsPath(cgroupRoot string, b []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		// Each line is hierarchy-ID:controllers:path.
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		switch {
+		case fields[0] == "0" && fields[1] == "":
+			return filepath.Join(cgroupRoot, fields[2], "memory.events")
+		case strings.Contains(","+fields[1]+",", ",memory,"):
+			return filepath.Join(cgroupRoot, "memory", fields[2], "memory.oom_control")
+		}
+	}
+	return ""
+}
+
+// readOOMKills returns the oom_kill count within a memory.events or
+// memory.oom_control file.
+func readOOMKills(path string) (uint64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		if value, ok := strings.CutPrefix(line, "oom_kill "); ok {
+			return strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("oom_kill not found within %s", path)
+}
@@ -0,0 +1,119 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	"github.com/hashicorp/go-hclog"
+)
+
+func startSupervised(t *testing.T, script string) *supervisedProcess {
+	t.Helper()
+
+	cmd := exec.Command("sh", "-c", script)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return supervise(hclog.NewNullLogger(), "sh", cmd)
+}
+
+func waitExited(t *testing.T, p *supervisedProcess) *domain.ProcessExit {
+	t.Helper()
+
+	select {
+	case <-p.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("process did not exit")
+	}
+	exit, exited := p.Exited()
+	if !exited {
+		t.Fatalf("expected process to have exited")
+	}
+	return exit
+}
+
+func TestSupervise(t *testing.T) {
+	exit := waitExited(t, startSupervised(t, "exit 3"))
+	if expected := (&domain.ProcessExit{ExitCode: 3}); !reflect.DeepEqual(exit, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, exit)
+	}
+
+	exit = waitExited(t, startSupervised(t, "kill -SEGV $$"))
+	if expected := (&domain.ProcessExit{ExitCode: 139, Signal: 11}); !reflect.DeepEqual(exit, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, exit)
+	}
+
+	p := startSupervised(t, "sleep 60")
+	if _, exited := p.Exited(); exited {
+		t.Fatalf("expected process to be running")
+	}
+	p.Kill(processKillTimeout)
+	exit = waitExited(t, p)
+	if expected := (&domain.ProcessExit{ExitCode: 137, Signal: 9, Stopped: true}); !reflect.DeepEqual(exit, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, exit)
+	}
+}
+
+func TestOOMEventsPath(t *testing.T) {
+	cases := []struct {
+		name     string
+		cgroup   string
+		expected string
+	}{
+		{
+			name:     "v2",
+			cgroup:   "0::/nomad.slice/vm.scope\n",
+			expected: "/sys/fs/cgroup/nomad.slice/vm.scope/memory.events",
+		},
+		{
+			name:     "v1",
+			cgroup:   "12:cpu,cpuacct:/nomad/vm\n11:memory:/nomad/vm\n1:name=systemd:/nomad/vm\n",
+			expected: "/sys/fs/cgroup/memory/nomad/vm/memory.oom_control",
+		},
+		{
+			name:     "no memory controller",
+			cgroup:   "12:cpu,cpuacct:/nomad/vm\n",
+			expected: "",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if path := oomEventsPath(cgroupRoot, []byte(tc.cgroup)); path != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, path)
+			}
+		})
+	}
+}
+
+func TestReadOOMKills(t *testing.T) {
+	dir := t.TempDir()
+
+	events := filepath.Join(dir, "memory.events")
+	if err := os.WriteFile(events, []byte("low 0\nhigh 0\nmax 4\noom 2\noom_kill 2\noom_group_kill 0\n"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	kills, err := readOOMKills(events)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if kills != 2 {
+		t.Fatalf("expected 2 OOM kills, got %d", kills)
+	}
+
+	control := filepath.Join(dir, "memory.oom_control")
+	if err := os.WriteFile(control, []byte("oom_kill_disable 0\nunder_oom 0\n"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := readOOMKills(control); err == nil {
+		t.Fatalf("expected error for missing oom_kill count")
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	virtNet "github.com/ccheshirecat/nomad-driver-ch/virt/net"
+)
+
+// firstInterface returns the configuration of the VM's first interface, or
+// nil if it has none.
+func firstInterface(config *domain.Config) *virtNet.NetworkInterfaceConfig {
+	if config == nil || len(config.NetworkInterfaces) == 0 {
+		return nil
+	}
+	return config.NetworkInterfaces[0]
+}
+
+// tapAddArgs returns the ip command arguments creating the TAP of a VM. A
+// device with several queue pairs requires a multi-queue TAP, with a queue
+// for each.
+func tapAddArgs(tap string, iface *virtNet.NetworkInterfaceConfig) []string {
+	args := []string{"tuntap", "add", "dev", tap, "mode", "tap"}
+	if iface != nil && iface.NumQueues > 1 {
+		args = append(args, "multi_queue")
+	}
+	return args
+}
+
+// applyNetTuning sets the queue, MTU and offload settings of the interface
+// on the device configuration.
+func applyNetTuning(netConfig *NetConfig, iface *virtNet.NetworkInterfaceConfig) {
+	if iface == nil {
+		return
+	}
+
+	// Cloud Hypervisor counts receive and transmit queues separately.
+	if iface.NumQueues > 0 {
+		netConfig.NumQueues = iface.NumQueues * 2
+	}
+	netConfig.QueueSize = iface.QueueSize
+	netConfig.MTU = iface.MTU
+	netConfig.OffloadCsum = iface.OffloadCsum
+	netConfig.OffloadTSO = iface.OffloadTSO
+
+	// Segmentation offload requires checksum offload, so is disabled along
+	// with it unless configured.
+	if iface.OffloadCsum != nil && !*iface.OffloadCsum && iface.OffloadTSO == nil {
+		disabled := false
+		netConfig.OffloadTSO = &disabled
+	}
+}
+
+// setLinkMTU sets the MTU of a host interface, within the network namespace
+// at netns if not empty.
+func setLinkMTU(ipPath, netns, name string, mtu int) error {
+	err := withNetNS(netns, func() error {
+		output, err := exec.Command(ipPath, "link", "set", "dev", name, "mtu", strconv.Itoa(mtu)).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%w (output: %s)", err, string(output))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set MTU of %s to %d: %w", name, mtu, err)
+	}
+	return nil
+}
+
+// ensureBridgeMTU raises the MTU of a bridge to at least mtu, so frames of a
+// VM using a larger MTU than the bridge are not dropped. The bridge MTU is
+// never lowered, as other VMs may rely on it.
+func ensureBridgeMTU(ipPath, bridgeName string, mtu int) error {
+	b, err := os.ReadFile(filepath.Join("/sys/class/net", bridgeName, "mtu"))
+	if err != nil {
+		return fmt.Errorf("failed to read MTU of bridge %s: %w", bridgeName, err)
+	}
+	current, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return fmt.Errorf("failed to read MTU of bridge %s: %w", bridgeName, err)
+	}
+	if current >= mtu {
+		return nil
+	}
+	return setLinkMTU(ipPath, "", bridgeName, mtu)
+}
@@ -0,0 +1,63 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+
+	"github.com/ccheshirecat/nomad-driver-ch/chnet"
+	virtNet "github.com/ccheshirecat/nomad-driver-ch/virt/net"
+)
+
+// setupTapVLANs configures the VLAN membership of a VM's TAP port on a bridge
+// with VLAN filtering enabled.
+func (d *Driver) setupTapVLANs(bridgeName, tap string, cfg *virtNet.NetworkInterfaceBridgeConfig) error {
+	vlan, err := chnet.GetBridgeVLAN(bridgeName)
+	if err != nil {
+		return fmt.Errorf("failed to read VLAN configuration of bridge %s: %w", bridgeName, err)
+	}
+	if !vlan.Filtering {
+		return fmt.Errorf("bridge %s does not have vlan_filtering enabled, which is required to tag VM traffic", bridgeName)
+	}
+
+	bridgePath, err := findCommand("bridge")
+	if err != nil {
+		return err
+	}
+
+	for _, args := range tapVLANCommands(tap, vlan.DefaultPVID, cfg) {
+		if output, err := exec.Command(bridgePath, args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to configure VLANs of tap %s: %w (output: %s)", tap, err, string(output))
+		}
+	}
+
+	d.logger.Debug("configured tap VLANs",
+		"tap", tap,
+		"bridge", bridgeName,
+		"vlan", cfg.VLAN,
+		"trunk", cfg.Trunk)
+
+	return nil
+}
+
+// tapVLANCommands returns the bridge commands which make the TAP port a
+// member of the configured VLANs only. Ports join the bridge default VLAN
+// untagged when added, so it is removed unless configured.
+func tapVLANCommands(tap string, defaultPVID int, cfg *virtNet.NetworkInterfaceBridgeConfig) [][]string {
+	var cmds [][]string
+
+	if defaultPVID != 0 && defaultPVID != cfg.VLAN {
+		cmds = append(cmds, []string{"vlan", "del", "dev", tap, "vid", strconv.Itoa(defaultPVID)})
+	}
+	if cfg.VLAN != 0 {
+		cmds = append(cmds, []string{"vlan", "add", "dev", tap, "vid", strconv.Itoa(cfg.VLAN), "pvid", "untagged"})
+	}
+	for _, vid := range cfg.Trunk {
+		cmds = append(cmds, []string{"vlan", "add", "dev", tap, "vid", strconv.Itoa(vid)})
+	}
+
+	return cmds
+}
@@ -12,38 +12,41 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ccheshirecat/nomad-driver-ch/cloudinit"
 	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	virtNet "github.com/ccheshirecat/nomad-driver-ch/virt/net"
 )
 
 // findIPCommand returns the path to the ip command, trying common locations
 func findIPCommand() (string, error) {
-	// Try common paths where ip command is typically located
-	commonPaths := []string{
-		"/usr/sbin/ip",
-		"/sbin/ip",
-		"/usr/bin/ip",
-		"/bin/ip",
-	}
+	return findCommand("ip")
+}
 
-	for _, path := range commonPaths {
+// findCommand returns the path to the named iproute2 command, trying common
+// locations
+func findCommand(name string) (string, error) {
+	// Try common paths where iproute2 commands are typically located
+	for _, dir := range []string{"/usr/sbin", "/sbin", "/usr/bin", "/bin"} {
+		path := filepath.Join(dir, name)
 		if _, err := os.Stat(path); err == nil {
 			return path, nil
 		}
 	}
 
 	// Fallback to PATH lookup
-	if path, err := exec.LookPath("ip"); err == nil {
+	if path, err := exec.LookPath(name); err == nil {
 		return path, nil
 	}
 
-	return "", fmt.Errorf("ip command not found in common locations or PATH")
+	return "", fmt.Errorf("%s command not found in common locations or PATH", name)
 }
 
 // createCloudInit generates cloud-init ISO for VM
@@ -72,6 +75,9 @@ func (d *Driver) createCloudInit(config *domain.Config, proc *VMProcess, workDir
 			Interface:   settings.interfaceName,
 			Nameservers: settings.nameservers,
 		}
+		if iface := firstInterface(config); iface != nil {
+			networkConfig.MTU = iface.MTU
+		}
 
 		d.logger.Debug("configured cloud-init network",
 			"ip", settings.address,
@@ -83,6 +89,11 @@ func (d *Driver) createCloudInit(config *domain.Config, proc *VMProcess, workDir
 			"source", "task_config+driver_config")
 	}
 
+	var phoneHome string
+	if proc.phoneHome != nil {
+		phoneHome = proc.phoneHome.url
+	}
+
 	// Build cloud-init config
 	ciConfig := &cloudinit.Config{
 		MetaData: cloudinit.MetaData{
@@ -90,12 +101,13 @@ func (d *Driver) createCloudInit(config *domain.Config, proc *VMProcess, workDir
 			LocalHostname: config.HostName,
 		},
 		VendorData: cloudinit.VendorData{
-			Password: config.Password,
-			SSHKey:   config.SSHKey,
-			BootCMD:  bootCMDs,
-			RunCMD:   config.CMDs,
-			Files:    convertFiles(config.Files),
-			Network:  networkConfig,
+			Password:  config.Password,
+			SSHKey:    config.SSHKey,
+			BootCMD:   bootCMDs,
+			RunCMD:    config.CMDs,
+			Files:     convertFiles(config.Files),
+			Network:   networkConfig,
+			PhoneHome: phoneHome,
 		},
 		UserData: config.CIUserData,
 	}
@@ -128,6 +140,11 @@ func convertFiles(domainFiles []domain.File) []cloudinit.File {
 
 // setupNetworking creates TAP interface and attaches to bridge
 func (d *Driver) setupNetworking(config *domain.Config, proc *VMProcess) error {
+	// The TAP of VMs attached by CNI plugins is created by the plugins.
+	if proc.CNI != nil {
+		return nil
+	}
+
 	// Find the ip command
 	ipPath, err := findIPCommand()
 	if err != nil {
@@ -137,23 +154,44 @@ func (d *Driver) setupNetworking(config *domain.Config, proc *VMProcess) error {
 		return nil
 	}
 
+	iface := firstInterface(config)
+
+	if proc.NetNS != "" {
+		return d.setupGroupNetworking(ipPath, iface, proc)
+	}
+	if kind, vtap := vtapInterface(config); vtap != nil {
+		return d.setupVtapNetworking(ipPath, kind, vtap, iface.MTU, proc)
+	}
+
 	// Create TAP interface
-	cmd := exec.Command(ipPath, "tuntap", "add", "dev", proc.TapName, "mode", "tap")
+	cmd := exec.Command(ipPath, tapAddArgs(proc.TapName, iface)...)
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to create tap interface %s: %w (output: %s)", proc.TapName, err, string(output))
 	}
 
+	// Set the TAP MTU, if configured
+	if iface != nil && iface.MTU != 0 {
+		if err := setLinkMTU(ipPath, "", proc.TapName, iface.MTU); err != nil {
+			_ = exec.Command(ipPath, "link", "delete", "dev", proc.TapName).Run()
+			return err
+		}
+	}
+
 	// Set TAP interface up
 	cmd = exec.Command(ipPath, "link", "set", "dev", proc.TapName, "up")
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to bring up tap interface %s: %w (output: %s)", proc.TapName, err, string(output))
 	}
 
-	// Determine which bridge to use - from task config if specified, otherwise from driver config
+	// Determine which bridge to use - from task config if specified, then
+	// from the named network, otherwise from driver config
 	var bridgeName string
 	if len(config.NetworkInterfaces) > 0 && config.NetworkInterfaces[0].Bridge != nil && config.NetworkInterfaces[0].Bridge.Name != "" {
 		bridgeName = config.NetworkInterfaces[0].Bridge.Name
 		d.logger.Debug("using bridge from task configuration", "bridge", bridgeName)
+	} else if network := d.procNetwork(proc); network != nil {
+		bridgeName = network.config.Bridge
+		d.logger.Debug("using bridge from named network", "bridge", bridgeName, "network", network.config.Name)
 	} else {
 		bridgeName = d.networkConfig.Bridge
 		d.logger.Debug("using bridge from driver configuration", "bridge", bridgeName)
@@ -164,6 +202,24 @@ func (d *Driver) setupNetworking(config *domain.Config, proc *VMProcess) error {
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to add tap %s to bridge %s: %w (output: %s)", proc.TapName, bridgeName, err, string(output))
 	}
+	proc.Bridge = bridgeName
+
+	// Raise the bridge MTU to the TAP MTU, if lower, as the bridge otherwise
+	// drops larger frames
+	if iface != nil && iface.MTU != 0 {
+		if err := ensureBridgeMTU(ipPath, bridgeName, iface.MTU); err != nil {
+			_ = exec.Command(ipPath, "link", "delete", "dev", proc.TapName).Run()
+			return err
+		}
+	}
+
+	// Tag the port onto its VLANs, if configured
+	if len(config.NetworkInterfaces) > 0 && config.NetworkInterfaces[0].Bridge.HasVLANs() {
+		if err := d.setupTapVLANs(bridgeName, proc.TapName, config.NetworkInterfaces[0].Bridge); err != nil {
+			_ = exec.Command(ipPath, "link", "delete", "dev", proc.TapName).Run()
+			return err
+		}
+	}
 
 	d.logger.Debug("networking setup complete",
 		"tap", proc.TapName,
@@ -173,25 +229,59 @@ func (d *Driver) setupNetworking(config *domain.Config, proc *VMProcess) error {
 	return nil
 }
 
-// cleanupNetworkingWithBridge removes TAP interface using a specific bridge
-func (d *Driver) cleanupNetworkingWithBridge(bridgeName string, proc *VMProcess) {
-	if proc.TapName != "" {
-		// Find the ip command
-		ipPath, err := findIPCommand()
-		if err != nil {
-			d.logger.Warn("ip command not available, skipping tap cleanup", "tap", proc.TapName, "error", err)
-			return
-		}
+// setupGroupNetworking creates the TAP interface within the allocation network
+// namespace and assigns it the gateway address of the VM's link, so the
+// namespace routes for the guest.
+func (d *Driver) setupGroupNetworking(ipPath string, iface *virtNet.NetworkInterfaceConfig, proc *VMProcess) error {
+	link, ok := groupLinkFor(proc.IP)
+	if !ok {
+		return fmt.Errorf("invalid group network address %s", proc.IP)
+	}
+	gateway := netip.PrefixFrom(link.gateway, groupLinkBits).String()
 
-		cmd := exec.Command(ipPath, "link", "delete", "dev", proc.TapName)
-		if err := cmd.Run(); err != nil {
-			d.logger.Warn("failed to cleanup tap interface", "tap", proc.TapName, "error", err)
+	err := withNetNS(proc.NetNS, func() error {
+		cmds := [][]string{
+			tapAddArgs(proc.TapName, iface),
+			{"addr", "add", gateway, "dev", proc.TapName},
+		}
+		if iface != nil && iface.MTU != 0 {
+			cmds = append(cmds, []string{"link", "set", "dev", proc.TapName, "mtu", strconv.Itoa(iface.MTU)})
+		}
+		cmds = append(cmds, []string{"link", "set", "dev", proc.TapName, "up"})
+		for _, args := range cmds {
+			if output, err := exec.Command(ipPath, args...).CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to configure tap interface %s: %w (output: %s)", proc.TapName, err, string(output))
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+
+	d.logger.Debug("group networking setup complete",
+		"tap", proc.TapName,
+		"netns", proc.NetNS,
+		"gateway", gateway,
+		"ip", proc.IP)
+
+	return nil
+}
+
+// cleanupNetworkingWithBridge removes TAP interface using a specific bridge
+func (d *Driver) cleanupNetworkingWithBridge(bridgeName string, proc *VMProcess) {
+	d.cleanupNetworking(nil, proc)
 }
 
 // cleanupNetworking removes TAP interface
 func (d *Driver) cleanupNetworking(config *domain.Config, proc *VMProcess) {
+	// The TAP of VMs attached by CNI plugins is deleted by the plugins.
+	if proc.CNI != nil {
+		return
+	}
+
+	closeTapFile(proc)
+
 	if proc.TapName != "" {
 		// Find the ip command
 		ipPath, err := findIPCommand()
@@ -200,8 +290,16 @@ func (d *Driver) cleanupNetworking(config *domain.Config, proc *VMProcess) {
 			return
 		}
 
-		cmd := exec.Command(ipPath, "link", "delete", "dev", proc.TapName)
-		if err := cmd.Run(); err != nil {
+		// The TAP is removed along with the allocation network namespace, so
+		// only needs deleting while the namespace exists.
+		if proc.NetNS != "" && !netNSExists(proc.NetNS) {
+			return
+		}
+
+		err = withNetNS(proc.NetNS, func() error {
+			return exec.Command(ipPath, "link", "delete", "dev", proc.TapName).Run()
+		})
+		if err != nil {
 			d.logger.Warn("failed to cleanup tap interface", "tap", proc.TapName, "error", err)
 		}
 	}
@@ -249,6 +347,7 @@ func (d *Driver) startVirtiofsd(config *domain.Config, proc *VMProcess) error {
 		}
 
 		proc.VirtiofsdPIDs = append(proc.VirtiofsdPIDs, cmd.Process.Pid)
+		proc.virtiofsd = append(proc.virtiofsd, supervise(d.logger, "virtiofsd", cmd))
 
 		d.logger.Debug("virtiofsd started",
 			"tag", mount.Tag,
@@ -262,13 +361,36 @@ func (d *Driver) startVirtiofsd(config *domain.Config, proc *VMProcess) error {
 
 // stopVirtiofsd stops all virtiofsd processes
 func (d *Driver) stopVirtiofsd(proc *VMProcess) {
-	for _, pid := range proc.VirtiofsdPIDs {
-		if process, err := os.FindProcess(pid); err == nil {
-			process.Kill()
-			d.logger.Debug("stopped virtiofsd", "pid", pid)
+	for _, p := range proc.virtiofsd {
+		p.Kill(processKillTimeout)
+		d.logger.Debug("stopped virtiofsd", "pid", p.cmd.Process.Pid)
+	}
+
+	// The processes of recovered VMs are no longer supervised.
+	if proc.virtiofsd == nil {
+		for _, pid := range proc.VirtiofsdPIDs {
+			if process, err := os.FindProcess(pid); err == nil {
+				process.Kill()
+				d.logger.Debug("stopped virtiofsd", "pid", pid)
+			}
 		}
 	}
 	proc.VirtiofsdPIDs = nil
+	proc.virtiofsd = nil
+}
+
+// killVMM kills the CH process of the VM, waiting for it to be reaped.
+func (d *Driver) killVMM(proc *VMProcess) {
+	if proc.vmm != nil {
+		proc.vmm.Kill(processKillTimeout)
+		return
+	}
+
+	if proc.Pid > 0 {
+		if process, err := os.FindProcess(proc.Pid); err == nil {
+			process.Kill()
+		}
+	}
 }
 
 // buildVMConfig constructs the VM configuration for CH API
@@ -282,8 +404,18 @@ func (d *Driver) buildVMConfig(config *domain.Config, proc *VMProcess) (*VMConfi
 			Size:   int64(config.Memory) * 1024 * 1024, // Convert MB to bytes
 			Shared: true,                               // Required for virtio-fs
 		},
-		Console: ConsoleConfig{Mode: "Null"}, // Disable console
-		Serial:  SerialConfig{Mode: "File", File: filepath.Join(proc.WorkDir, "serial.log")},
+		Console:  ConsoleConfig{Mode: "Null"}, // Disable console
+		Serial:   SerialConfig{Mode: "File", File: filepath.Join(proc.WorkDir, "serial.log")},
+		PVPanic:  config.PVPanic,
+		Watchdog: config.Watchdog,
+	}
+
+	// The vsock readiness probe connects to a guest agent over vsock.
+	if proc.readiness != nil && proc.readiness.VsockPort > 0 {
+		vmConfig.Vsock = &VsockConfig{
+			CID:    guestVsockCID,
+			Socket: filepath.Join(proc.WorkDir, vsockSocketName),
+		}
 	}
 
 	// Set kernel/initramfs/cmdline - ALWAYS REQUIRED for Cloud Hypervisor
@@ -357,20 +489,34 @@ func (d *Driver) buildVMConfig(config *domain.Config, proc *VMProcess) (*VMConfi
 
 	// Add network interface with optional static IP
 	netConfig := NetConfig{
-		Tap: proc.TapName,
 		MAC: proc.MAC,
 	}
+	applyNetTuning(&netConfig, firstInterface(config))
 
-	// Add static IP configuration if available (cloud-init will handle final network setup)
-	if haveSettings {
-		netConfig.IP = settings.address
-		if mask := settings.netmaskDotted(); mask != "" {
-			netConfig.Mask = mask
+	if len(config.NetworkInterfaces) > 0 {
+		rateLimiter, err := rateLimiterConfig(config.NetworkInterfaces[0].RateLimit)
+		if err != nil {
+			return nil, err
 		}
-	} else if proc.IP != "" {
-		netConfig.IP = proc.IP
-		if mask := maskStringFromPrefix(d.subnet); mask != "" {
-			netConfig.Mask = mask
+		netConfig.RateLimiterConfig = rateLimiter
+	}
+
+	// The device of a VM attached to a host interface is passed by
+	// descriptor instead, and addressed by the guest only
+	if proc.TapFile == nil {
+		netConfig.Tap = proc.TapName
+
+		// Add static IP configuration if available (cloud-init will handle final network setup)
+		if haveSettings {
+			netConfig.IP = settings.address
+			if mask := settings.netmaskDotted(); mask != "" {
+				netConfig.Mask = mask
+			}
+		} else if proc.IP != "" {
+			netConfig.IP = proc.IP
+			if mask := maskStringFromPrefix(d.subnet); mask != "" {
+				netConfig.Mask = mask
+			}
 		}
 	}
 
@@ -421,19 +567,35 @@ func (d *Driver) startCHProcess(proc *VMProcess) error {
 		args = append(args, "--seccomp", d.config.Seccomp)
 	}
 
+	// The VMM reports its events on a pipe, which ends when it exits.
+	eventsR, eventsW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create event monitor pipe: %w", err)
+	}
+	args = append(args, "--event-monitor", fmt.Sprintf("fd=%d", eventMonitorFD))
+
 	cmd := exec.Command(d.config.Bin, args...)
 	cmd.Stdout = logFile
 	cmd.Stderr = logFile
+	cmd.ExtraFiles = []*os.File{eventsW}
 
-	if err := cmd.Start(); err != nil {
+	// In group network mode, the VMM must run within the allocation network
+	// namespace to open the TAP created there.
+	err = withNetNS(proc.NetNS, cmd.Start)
+	eventsW.Close()
+	if err != nil {
+		eventsR.Close()
 		return fmt.Errorf("failed to start cloud-hypervisor: %w", err)
 	}
 
 	proc.Pid = cmd.Process.Pid
+	proc.vmm = supervise(d.logger, "cloud-hypervisor", cmd)
+	d.startEventStream(proc.Name)
+	go d.readEvents(proc.Name, eventsR)
 
 	// Wait for API socket to become available
-	if err := d.waitForAPISocket(proc.APISocket, defaultStartupTimeout); err != nil {
-		cmd.Process.Kill()
+	if err := d.waitForAPISocket(proc.APISocket, proc.bootTimeout); err != nil {
+		proc.vmm.Kill(processKillTimeout)
 		return fmt.Errorf("CH API socket not ready: %w", err)
 	}
 
@@ -470,13 +632,23 @@ func (d *Driver) createAndBootVM(proc *VMProcess) error {
 		return fmt.Errorf("failed to create VM: %w", err)
 	}
 
+	// Attach the macvtap or ipvtap device, whose descriptor Cloud Hypervisor
+	// duplicates, so it is closed here.
+	if proc.TapFile != nil {
+		err := d.vmAddNet(proc)
+		closeTapFile(proc)
+		if err != nil {
+			return fmt.Errorf("failed to add network device: %w", err)
+		}
+	}
+
 	// Boot VM
 	if err := d.vmBoot(proc); err != nil {
 		return fmt.Errorf("failed to boot VM: %w", err)
 	}
 
 	// Wait for VM to be running
-	if err := d.waitForVMState(proc, CHStateRunning, defaultStartupTimeout); err != nil {
+	if err := d.waitForVMState(proc, CHStateRunning, proc.bootTimeout); err != nil {
 		return fmt.Errorf("VM failed to reach running state: %w", err)
 	}
 
@@ -485,7 +657,14 @@ func (d *Driver) createAndBootVM(proc *VMProcess) error {
 
 // vmCreate calls CH vm.create API
 func (d *Driver) vmCreate(proc *VMProcess) error {
-	body, err := json.Marshal(proc.Config)
+	// The device of a VM attached to a host interface is added once the VM
+	// is created, as its descriptor must be passed over the API socket.
+	vmConfig := *proc.Config
+	if proc.TapFile != nil {
+		vmConfig.Net = nil
+	}
+
+	body, err := json.Marshal(&vmConfig)
 	if err != nil {
 		return fmt.Errorf("failed to marshal VM config: %w", err)
 	}
@@ -558,6 +737,27 @@ func (d *Driver) getVMInfo(proc *VMProcess) (*VMInfo, error) {
 	return &info, nil
 }
 
+// getVMCounters calls CH vm.counters API
+func (d *Driver) getVMCounters(proc *VMProcess) (map[string]map[string]uint64, error) {
+	resp, err := d.httpRequest(proc.APISocket, "GET", "/api/v1/vm.counters", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("VM counters failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var counters map[string]map[string]uint64
+	if err := json.NewDecoder(resp.Body).Decode(&counters); err != nil {
+		return nil, fmt.Errorf("failed to decode VM counters: %w", err)
+	}
+
+	return counters, nil
+}
+
 // waitForVMState waits for VM to reach the specified state
 func (d *Driver) waitForVMState(proc *VMProcess, targetState string, timeout time.Duration) error {
 	deadline := time.Now().Add(timeout)
@@ -579,19 +779,47 @@ func (d *Driver) waitForVMState(proc *VMProcess, targetState string, timeout tim
 	return fmt.Errorf("timeout waiting for VM state %s", targetState)
 }
 
-// httpRequest performs HTTP request to CH API via Unix socket
-func (d *Driver) httpRequest(socketPath, method, path string, body []byte) (*http.Response, error) {
-	// Create a custom transport for this specific socket
-	transport := &http.Transport{
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return net.Dial("unix", socketPath)
-		},
+// apiClient returns the client of the CH API socket, reusing its connections
+// between requests.
+func (d *Driver) apiClient(socketPath string) *http.Client {
+	d.apiLock.Lock()
+	defer d.apiLock.Unlock()
+
+	if client, ok := d.apiClients[socketPath]; ok {
+		return client
 	}
 
 	client := &http.Client{
-		Transport: transport,
-		Timeout:   30 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+		Timeout: 30 * time.Second,
+	}
+	if d.apiClients == nil {
+		d.apiClients = make(map[string]*http.Client)
+	}
+	d.apiClients[socketPath] = client
+	return client
+}
+
+// closeAPIClient closes the connections of the client of the CH API socket,
+// once the VM has been destroyed.
+func (d *Driver) closeAPIClient(socketPath string) {
+	d.apiLock.Lock()
+	defer d.apiLock.Unlock()
+
+	if client, ok := d.apiClients[socketPath]; ok {
+		client.CloseIdleConnections()
+		delete(d.apiClients, socketPath)
 	}
+}
+
+// httpRequest performs HTTP request to CH API via Unix socket
+func (d *Driver) httpRequest(socketPath, method, path string, body []byte) (*http.Response, error) {
+	client := d.apiClient(socketPath)
 
 	var bodyReader io.Reader
 	if body != nil {
@@ -608,7 +836,15 @@ func (d *Driver) httpRequest(socketPath, method, path string, body []byte) (*htt
 	}
 	req.Header.Set("Accept", "application/json")
 
-	return client.Do(req)
+	start := time.Now()
+	resp, err := client.Do(req)
+	if d.metrics != nil {
+		d.metrics.apiDuration.WithLabelValues(method, path).Observe(time.Since(start).Seconds())
+		if err != nil || resp.StatusCode >= http.StatusBadRequest {
+			d.metrics.apiErrors.WithLabelValues(method, path).Inc()
+		}
+	}
+	return resp, err
 }
 
 // cleanupProcess cleans up all resources associated with a VM process
@@ -618,12 +854,11 @@ func (d *Driver) cleanupProcess(config *domain.Config, proc *VMProcess) {
 		d.stopVirtiofsd(proc)
 	}
 
+	d.stopPhoneHome(proc)
+
 	// Kill CH process
-	if proc.Pid > 0 {
-		if process, err := os.FindProcess(proc.Pid); err == nil {
-			process.Kill()
-		}
-	}
+	d.killVMM(proc)
+	d.closeAPIClient(proc.APISocket)
 
 	// Cleanup networking - use driver config bridge if config is nil
 	if config == nil {
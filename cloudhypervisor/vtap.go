@@ -0,0 +1,148 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package cloudhypervisor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	virtNet "github.com/ccheshirecat/nomad-driver-ch/virt/net"
+)
+
+// vtapInterface returns the kind, "macvtap" or "ipvtap", and configuration of
+// the VM's first interface, if it is attached directly to a host interface.
+func vtapInterface(config *domain.Config) (string, *virtNet.NetworkInterfaceVtapConfig) {
+	if config == nil || len(config.NetworkInterfaces) == 0 {
+		return "", nil
+	}
+	return config.NetworkInterfaces[0].Vtap()
+}
+
+// vtapMode returns the mode a device of kind is created with.
+func vtapMode(kind, mode string) string {
+	switch {
+	case mode != "":
+		return mode
+	case kind == "ipvtap":
+		return virtNet.IPVtapModeL2
+	default:
+		return virtNet.MacvtapModeBridge
+	}
+}
+
+// interfaceMAC returns the MAC address of a host interface.
+func interfaceMAC(name string) (string, error) {
+	b, err := os.ReadFile(filepath.Join("/sys/class/net", name, "address"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read address of interface %s: %w", name, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// setupVtapNetworking creates the macvtap or ipvtap device of a VM on its
+// parent interface, with the MTU if not zero, and opens its character device,
+// which is handed to Cloud Hypervisor once the VM is created.
+func (d *Driver) setupVtapNetworking(ipPath, kind string, cfg *virtNet.NetworkInterfaceVtapConfig, mtu int, proc *VMProcess) error {
+	// The guest MAC is set on a macvtap device, as frames from other
+	// addresses are dropped. An ipvtap device shares the parent address.
+	args := []string{"link", "add", "link", cfg.Parent, "name", proc.TapName}
+	if kind == "macvtap" {
+		args = append(args, "address", proc.MAC)
+	}
+	if mtu != 0 {
+		args = append(args, "mtu", strconv.Itoa(mtu))
+	}
+	args = append(args, "type", kind, "mode", vtapMode(kind, cfg.Mode))
+
+	if output, err := exec.Command(ipPath, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create %s interface %s on %s: %w (output: %s)",
+			kind, proc.TapName, cfg.Parent, err, string(output))
+	}
+
+	if output, err := exec.Command(ipPath, "link", "set", "dev", proc.TapName, "up").CombinedOutput(); err != nil {
+		_ = exec.Command(ipPath, "link", "delete", "dev", proc.TapName).Run()
+		return fmt.Errorf("failed to bring up %s interface %s: %w (output: %s)", kind, proc.TapName, err, string(output))
+	}
+
+	file, err := openVtapDevice(kind, proc.TapName)
+	if err != nil {
+		_ = exec.Command(ipPath, "link", "delete", "dev", proc.TapName).Run()
+		return fmt.Errorf("failed to open %s device of %s: %w", kind, proc.TapName, err)
+	}
+	proc.TapFile = file
+
+	d.logger.Debug("networking setup complete",
+		"tap", proc.TapName,
+		"kind", kind,
+		"parent", cfg.Parent,
+		"mode", vtapMode(kind, cfg.Mode),
+		"ip", proc.IP)
+
+	return nil
+}
+
+// vtapNetworkSettings returns the guest network settings of a VM attached
+// through a macvtap or ipvtap device. Without a static IP the guest is
+// addressed by the network using DHCP, so there are no settings to apply.
+func vtapNetworkSettings(settings networkSettings, cfg *virtNet.NetworkInterfaceVtapConfig) (networkSettings, bool) {
+	if cfg.StaticIP == "" {
+		return settings, false
+	}
+
+	settings.address = cfg.StaticIP
+	settings.gateway = cfg.Gateway
+	settings.cidrBits = 24
+	if bits, err := strconv.Atoi(cfg.Netmask); err == nil && bits >= 0 && bits <= 32 {
+		settings.cidrBits = bits
+	}
+	if len(cfg.DNS) > 0 {
+		settings.nameservers = append([]string{}, cfg.DNS...)
+	}
+
+	return settings, true
+}
+
+// vmAddNet calls the CH vm.add-net API to attach the opened macvtap or ipvtap
+// device of a VM, using the network configuration built for it. Devices
+// backed by file descriptors cannot be configured by vm.create, as the
+// descriptors must be passed over the API socket.
+func (d *Driver) vmAddNet(proc *VMProcess) error {
+	netConfig := proc.Config.Net[0]
+	netConfig.FDs = []int{int(proc.TapFile.Fd())}
+
+	body, err := json.Marshal(netConfig)
+	if err != nil {
+		return fmt.Errorf("failed to marshal net config: %w", err)
+	}
+
+	resp, err := d.httpRequestWithFiles(proc.APISocket, "PUT", "/api/v1/vm.add-net", body, []*os.File{proc.TapFile})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("VM add-net failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	return nil
+}
+
+// closeTapFile closes the device opened for a VM, once handed to Cloud
+// Hypervisor or when the VM failed to start.
+func closeTapFile(proc *VMProcess) {
+	if proc.TapFile != nil {
+		_ = proc.TapFile.Close()
+		proc.TapFile = nil
+	}
+}
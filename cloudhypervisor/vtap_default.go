@@ -0,0 +1,24 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !linux
+
+package cloudhypervisor
+
+import (
+	"errors"
+	"net/http"
+	"os"
+)
+
+// openVtapDevice is not supported, as macvtap and ipvtap devices are only
+// supported on Linux.
+func openVtapDevice(string, string) (*os.File, error) {
+	return nil, errors.New("macvtap and ipvtap devices are only supported on Linux")
+}
+
+// httpRequestWithFiles is not supported, as it is only needed to pass the
+// descriptors of macvtap and ipvtap devices.
+func (d *Driver) httpRequestWithFiles(string, string, string, []byte, []*os.File) (*http.Response, error) {
+	return nil, errors.New("passing files to Cloud Hypervisor is only supported on Linux")
+}
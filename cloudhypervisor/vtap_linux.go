@@ -0,0 +1,107 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package cloudhypervisor
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// openVtapDevice opens the character device of the macvtap or ipvtap
+// interface name, which is named after its interface index. The device node
+// is normally created by udev, but is created from the device number exposed
+// in sysfs when missing, so hosts without udev are supported.
+func openVtapDevice(kind, name string) (*os.File, error) {
+	b, err := os.ReadFile(filepath.Join("/sys/class/net", name, "ifindex"))
+	if err != nil {
+		return nil, err
+	}
+	tap := "tap" + strings.TrimSpace(string(b))
+	path := filepath.Join("/dev", tap)
+
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		b, err := os.ReadFile(filepath.Join("/sys/class", kind, tap, "dev"))
+		if err != nil {
+			return nil, err
+		}
+		var major, minor uint32
+		if _, err := fmt.Sscanf(strings.TrimSpace(string(b)), "%d:%d", &major, &minor); err != nil {
+			return nil, fmt.Errorf("invalid device number %q: %w", strings.TrimSpace(string(b)), err)
+		}
+		err = unix.Mknod(path, unix.S_IFCHR|0600, int(unix.Mkdev(major, minor)))
+		if err != nil && !errors.Is(err, unix.EEXIST) {
+			return nil, fmt.Errorf("failed to create device %s: %w", path, err)
+		}
+	}
+
+	return os.OpenFile(path, os.O_RDWR, 0)
+}
+
+// httpRequestWithFiles performs a request over the API socket, passing the
+// descriptors of files alongside it. The HTTP client used by httpRequest
+// cannot send ancillary data, so the request is written to the connection
+// directly, with the descriptors attached to the first write.
+func (d *Driver) httpRequestWithFiles(socketPath, method, path string, body []byte, files []*os.File) (*http.Response, error) {
+	conn, err := net.DialTimeout("unix", socketPath, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	req, err := http.NewRequest(method, "http://localhost"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	var buf bytes.Buffer
+	if err := req.Write(&buf); err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	fds := make([]int, len(files))
+	for i, file := range files {
+		fds[i] = int(file.Fd())
+	}
+
+	data := buf.Bytes()
+	n, _, err := conn.(*net.UnixConn).WriteMsgUnix(data, unix.UnixRights(fds...), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	if _, err := conn.Write(data[n:]); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	// The connection is closed on return, so the body is read up front.
+	respBody, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	return resp, nil
+}
@@ -55,6 +55,8 @@ type VendorData struct {
 	Files   []File
 	// Network configuration for cloud-init
 	Network *NetworkConfig
+	// PhoneHome is the URL cloud-init posts to once it has finished.
+	PhoneHome string
 }
 
 type File struct {
@@ -81,6 +83,8 @@ type NetworkConfig struct {
 	Nameservers []string
 	// Interface name (optional, defaults to eth0)
 	Interface string
+	// MTU of the interface (optional, defaults to the device MTU)
+	MTU int
 }
 
 type Controller struct {
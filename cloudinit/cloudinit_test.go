@@ -295,6 +295,54 @@ runcmd:
 bootcmd:
   - bootcmd1 arg arg
   - bootcmd2 arg arg
+`,
+		},
+		{
+			name: "vendor_data_with_network",
+			config: &Config{
+				VendorData: VendorData{
+					Network: &NetworkConfig{
+						Address:     "192.168.254.20",
+						Gateway:     "192.168.254.1",
+						Netmask:     "24",
+						Nameservers: []string{"192.168.254.1"},
+						MTU:         9000,
+					},
+				},
+			},
+			templatePath: "vendor-data.tmpl",
+			expectError:  false,
+			expectedContent: `#cloud-config
+network:
+  version: 2
+  ethernets:
+    eth0:
+      addresses:
+        - 192.168.254.20/24
+      gateway4: 192.168.254.1
+      mtu: 9000
+      nameservers:
+        addresses:
+          - 192.168.254.1
+`,
+		},
+		{
+			name: "vendor_data_with_phone_home",
+			config: &Config{
+				VendorData: VendorData{
+					PhoneHome: "http://192.168.254.1:41234/phone-home/token",
+					RunCMD:    []string{"cmd1 arg arg"},
+				},
+			},
+			templatePath: "vendor-data.tmpl",
+			expectError:  false,
+			expectedContent: `#cloud-config
+runcmd:
+  - cmd1 arg arg
+phone_home:
+  url: http://192.168.254.1:41234/phone-home/token
+  post: [instance_id]
+  tries: 10
 `,
 		},
 		{
@@ -87,6 +87,47 @@ type Config struct {
 	VFIODevices []string
 
 	NetworkInterfaces net.NetworkInterfacesConfig
+
+	// NetNS is the path of the allocation network namespace the VM is placed
+	// within when the task uses group network mode.
+	NetNS string
+
+	// AllocID is the allocation the VM belongs to, whose VMs share a group
+	// network.
+	AllocID string
+
+	// ReportPhase is called as each phase of creating the VM completes.
+	ReportPhase PhaseReporter
+
+	// Readiness configures how the guest is determined to be ready once
+	// booted, if at all, and BootTimeout is how long the VM may take to boot
+	// and become ready.
+	Readiness   *Readiness
+	BootTimeout time.Duration
+
+	// PVPanic adds a pvpanic device, through which the guest reports kernel
+	// panics, and Watchdog a watchdog device, which resets the VM if the
+	// guest stops petting it.
+	PVPanic  bool
+	Watchdog bool
+}
+
+// Readiness configures the probes determining the guest of a VM is ready for
+// use once booted. All the configured probes must pass.
+type Readiness struct {
+	// Serial is a regular expression matching a line written by the guest to
+	// its serial console, such as "Cloud-init .* finished".
+	Serial string
+
+	// TCPPort is a port the guest accepts TCP connections on.
+	TCPPort int
+
+	// VsockPort is a vsock port a guest agent accepts connections on.
+	VsockPort uint32
+
+	// PhoneHome indicates the guest is ready once cloud-init phones home to
+	// the driver, which happens once it has finished.
+	PhoneHome bool
 }
 
 func (dc *Config) Validate(allowedPaths []string) error {
@@ -172,6 +213,45 @@ type NetworkInterface struct {
 	Addrs       []netip.Addr
 	Model       string
 	Driver      string
+
+	// CNI is the attachment made by CNI plugins, if the interface uses a CNI
+	// network.
+	CNI *net.CNIAttachment
+
+	// GroupNetwork is the private network of the allocation, if the
+	// interface uses a group network.
+	GroupNetwork *net.GroupNetwork
+}
+
+// Description describes the host resources backing a VM, so operators can
+// inspect them without reading the logs of the host.
+type Description struct {
+	// PID is the process ID of the VMM, APISocket the path of its API socket
+	// and SerialLog the file the guest serial console is written to.
+	PID       int
+	APISocket string
+	SerialLog string
+
+	// TAP is the name of the TAP device of the VM, attached to Bridge, if
+	// any, and MAC and IPs the addresses of the guest.
+	TAP    string
+	Bridge string
+	MAC    string
+	IPs    []string
+
+	// CPUs is the number of vCPUs of the VM, and Memory its memory in bytes.
+	CPUs   uint
+	Memory uint64
+
+	// BootMode is how the VM boots, which is "kernel" for direct kernel boot
+	// and "firmware" otherwise, and Kernel the kernel booted, if any.
+	BootMode string
+	Kernel   string
+
+	// VMMVersion is the version of the VMM, and VFIODevices the PCI devices
+	// passed through to the VM.
+	VMMVersion  string
+	VFIODevices []string
 }
 
 type VirtualizerInfo struct {
@@ -185,6 +265,11 @@ type VirtualizerInfo struct {
 	RunningDomains  uint
 	InactiveDomains uint
 	StoragePools    uint
+
+	// FreeAddresses is the number of addresses left to allocate within each
+	// network, keyed by the bridge of the driver network or the name of a
+	// named network.
+	FreeAddresses map[string]int
 }
 
 type Info struct {
@@ -193,6 +278,94 @@ type Info struct {
 	CPUTime   uint64
 	MaxMemory uint64
 	NrVirtCPU uint
+
+	// Processes is the resource usage of the host processes backing the VM,
+	// such as the VMM and virtiofsd, keyed by PID. CPUTime is the sum of
+	// their CPU time, in nanoseconds.
+	Processes map[string]ProcessStats
+
+	// Counters is the cumulative I/O counters of the VM devices, such as
+	// read_bytes or rx_frames, keyed by device ID and counter name.
+	Counters map[string]map[string]uint64
+
+	// Exit is the exit status of the VMM process, once it has exited.
+	Exit *ProcessExit
+
+	// GuestExitCode is the exit code reported by the guest before powering
+	// off, if any.
+	GuestExitCode *int
+}
+
+// ProcessExit is the exit status of a host process backing a VM. Signal is
+// set if the process was killed by a signal, in which case ExitCode is 128
+// plus the signal number, as reported by shells.
+type ProcessExit struct {
+	ExitCode  int
+	Signal    int
+	OOMKilled bool
+
+	// Stopped indicates the process was killed by the driver, rather than
+	// exiting on its own.
+	Stopped bool
+}
+
+// ProcessStats is the resource usage of a host process backing a VM. CPU
+// times are in nanoseconds, and memory in bytes.
+type ProcessStats struct {
+	UserTime    uint64
+	SystemTime  uint64
+	RSS         uint64
+	MaxRSS      uint64
+	Swap        uint64
+	MinorFaults uint64
+	MajorFaults uint64
+}
+
+// Event is a lifecycle event of a VM reported by the virtualizer, such as the
+// VM booting, shutting down or rebooting, a device being added, or a guest
+// panic.
+type Event struct {
+	Domain string
+
+	// Source is the component which emitted the event, such as "vm" or
+	// "guest", and Event its name.
+	Source string
+	Event  string
+
+	// Properties are the details of the event, such as the ID of a device.
+	Properties map[string]string
+	Timestamp  time.Time
+}
+
+// Phase is a step of starting a VM, which is reported once it completes so
+// operators can see where a slow start spends its time.
+type Phase string
+
+const (
+	PhaseImageResolved       Phase = "image_resolved"
+	PhaseThinCopyCreated     Phase = "thin_copy_created"
+	PhaseCloudInitBuilt      Phase = "cloud_init_built"
+	PhaseTAPCreated          Phase = "tap_created"
+	PhaseVirtiofsdStarted    Phase = "virtiofsd_started"
+	PhaseVMMStarted          Phase = "vmm_started"
+	PhaseVMBooted            Phase = "vm_booted"
+	PhaseNetworkRulesApplied Phase = "network_rules_applied"
+	PhaseGuestReady          Phase = "guest_ready"
+)
+
+// PhaseReporter is called as each phase of starting a VM completes, with the
+// time it took and the error it failed with, if any.
+type PhaseReporter func(phase Phase, duration time.Duration, err error)
+
+// Run runs the phase, reporting its duration and result. The reporter may be
+// nil, in which case the phase is only run.
+func (r PhaseReporter) Run(phase Phase, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	if r != nil {
+		r(phase, time.Since(start), err)
+	}
+	return err
 }
 
 // IsValidLabel returns true if the string given is a valid DNS label (RFC 1123).
@@ -236,12 +409,77 @@ func isAllowedImagePath(allowedPaths []string, imagePath string) bool {
 
 // Network configuration for Cloud Hypervisor networking
 type Network struct {
-	Bridge      string `codec:"bridge"`
-	SubnetCIDR  string `codec:"subnet_cidr"`
-	Gateway     string `codec:"gateway"`
-	IPPoolStart string `codec:"ip_pool_start"`
-	IPPoolEnd   string `codec:"ip_pool_end"`
-	TAPPrefix   string `codec:"tap_prefix"`
+	Bridge          string `codec:"bridge"`
+	SubnetCIDR      string `codec:"subnet_cidr"`
+	Gateway         string `codec:"gateway"`
+	IPPoolStart     string `codec:"ip_pool_start"`
+	IPPoolEnd       string `codec:"ip_pool_end"`
+	TAPPrefix       string `codec:"tap_prefix"`
+	FirewallBackend string `codec:"firewall_backend"`
+	PortForwarding  string `codec:"port_forwarding"`
+	CNIPath         string `codec:"cni_path"`
+	CNIConfigDir    string `codec:"cni_config_dir"`
+	DHCP            *DHCP  `codec:"dhcp"`
+	DNS             *DNS   `codec:"dns"`
+
+	// GroupNetwork enables private networks shared by the VMs of an
+	// allocation. It is nil when disabled.
+	GroupNetwork *GroupNetwork `codec:"group_network"`
+}
+
+// ResolverEnabled returns whether the driver's embedded DNS resolver should
+// run, and therefore be handed to guests as their nameserver.
+func (n *Network) ResolverEnabled() bool {
+	return n != nil && n.DNS != nil && n.DNS.Enabled
+}
+
+// NamedNetwork configures an additional bridge network, which VMs are
+// attached to by setting its name as the network of a bridge interface.
+type NamedNetwork struct {
+	Name        string   `codec:"name"`
+	Bridge      string   `codec:"bridge"`
+	SubnetCIDR  string   `codec:"subnet_cidr"`
+	Gateway     string   `codec:"gateway"`
+	IPPoolStart string   `codec:"ip_pool_start"`
+	IPPoolEnd   string   `codec:"ip_pool_end"`
+	DNS         []string `codec:"dns"`
+	NAT         bool     `codec:"nat"`
+}
+
+// NamedNetworks is the list of named networks configured within the driver.
+type NamedNetworks []NamedNetwork
+
+// Get returns the network with the passed name.
+func (n NamedNetworks) Get(name string) (*NamedNetwork, bool) {
+	for i := range n {
+		if n[i].Name == name {
+			return &n[i], true
+		}
+	}
+	return nil, false
+}
+
+// GroupNetwork configures the private networks created for the VMs of an
+// allocation which use a group network. Each allocation is given a bridge and
+// a subnet of SubnetPool, which is NATed to the outside.
+type GroupNetwork struct {
+	SubnetPool   string   `codec:"subnet_pool"`
+	PrefixLength int      `codec:"prefix_length"`
+	BridgePrefix string   `codec:"bridge_prefix"`
+	DNS          []string `codec:"dns"`
+}
+
+// DHCP configuration for the driver's embedded DHCP server
+type DHCP struct {
+	Enabled   bool   `codec:"enabled"`
+	LeaseTime string `codec:"lease_time"`
+}
+
+// DNS configuration for the driver's embedded DNS resolver
+type DNS struct {
+	Enabled   bool     `codec:"enabled"`
+	Domain    string   `codec:"domain"`
+	Upstreams []string `codec:"upstreams"`
 }
 
 // CloudHypervisor configuration for the Cloud Hypervisor VMM
@@ -262,3 +500,10 @@ type VFIO struct {
 	IOMMUAddressWidth uint     `codec:"iommu_address_width"`
 	PCISegments       uint     `codec:"pci_segments"`
 }
+
+// Metrics configuration for the Prometheus metrics endpoint. Address is
+// either a loopback host and port, or a Unix socket path prefixed with
+// "unix:". The endpoint is disabled when it is empty.
+type Metrics struct {
+	Address string `codec:"address"`
+}
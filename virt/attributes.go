@@ -0,0 +1,165 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package virt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// driverAttributes returns the attributes of the VM reported within the task
+// status, shown by the verbose allocation status. Attributes without a value
+// are omitted. The caller must hold stateLock.
+func (h *taskHandle) driverAttributes() map[string]string {
+	attrs := map[string]string{
+		"reboots": strconv.Itoa(h.reboots),
+	}
+	set := func(key, value string) {
+		if value != "" {
+			attrs[key] = value
+		}
+	}
+
+	set("image_path", h.imagePath)
+	set("image_digest", h.imageDigest)
+
+	// The host resources are released once the VM has stopped.
+	desc := h.description
+	if desc == nil || h.procState != drivers.TaskStateRunning {
+		return attrs
+	}
+
+	if desc.PID > 0 {
+		set("vmm_pid", strconv.Itoa(desc.PID))
+	}
+	set("vmm_version", desc.VMMVersion)
+	set("api_socket", desc.APISocket)
+	set("serial_log", desc.SerialLog)
+	set("tap", desc.TAP)
+	set("bridge", desc.Bridge)
+	set("mac", desc.MAC)
+	set("guest_ips", strings.Join(desc.IPs, ","))
+	if desc.CPUs > 0 {
+		set("vcpus", strconv.FormatUint(uint64(desc.CPUs), 10))
+	}
+	if desc.Memory > 0 {
+		set("memory_mb", strconv.FormatUint(desc.Memory/1024/1024, 10))
+	}
+	set("boot_mode", desc.BootMode)
+	set("kernel", desc.Kernel)
+	set("vfio_devices", strings.Join(desc.VFIODevices, ","))
+
+	return attrs
+}
+
+// digestImage computes the digest of the image the VM was started from, as it
+// may take a while for large images. Digests are shared through the cache, so
+// an image is only read again once it changes.
+func (h *taskHandle) digestImage(digests *imageDigests) {
+	if h.imagePath == "" {
+		return
+	}
+
+	digest, err := digests.Get(h.imagePath)
+	if err != nil {
+		h.logger.Warn("unable to compute image digest", "image_path", h.imagePath, "error", err)
+		return
+	}
+
+	h.stateLock.Lock()
+	h.imageDigest = digest
+	h.stateLock.Unlock()
+}
+
+// imageDigests caches the digests of images, keyed by path, which remain
+// valid while the size and modification time of the image are unchanged.
+// Images are hashed one at a time, so starting or recovering many tasks does
+// not read all of their images at once.
+type imageDigests struct {
+	lock    sync.Mutex
+	entries map[string]imageDigestEntry
+
+	// hashLock serializes the hashing of images.
+	hashLock sync.Mutex
+}
+
+type imageDigestEntry struct {
+	size    int64
+	modTime time.Time
+	digest  string
+}
+
+func newImageDigests() *imageDigests {
+	return &imageDigests{entries: map[string]imageDigestEntry{}}
+}
+
+// Get returns the digest of the image, computing it if it is not cached.
+func (id *imageDigests) Get(path string) (string, error) {
+	if digest, ok, err := id.cached(path); ok || err != nil {
+		return digest, err
+	}
+
+	id.hashLock.Lock()
+	defer id.hashLock.Unlock()
+
+	// The image may have been hashed while waiting for the lock.
+	if digest, ok, err := id.cached(path); ok || err != nil {
+		return digest, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	digest, err := imageDigest(path)
+	if err != nil {
+		return "", err
+	}
+
+	id.lock.Lock()
+	id.entries[path] = imageDigestEntry{size: info.Size(), modTime: info.ModTime(), digest: digest}
+	id.lock.Unlock()
+
+	return digest, nil
+}
+
+// cached returns the cached digest of the image, if the image is unchanged.
+func (id *imageDigests) cached(path string) (string, bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", false, err
+	}
+
+	id.lock.Lock()
+	defer id.lock.Unlock()
+
+	entry, ok := id.entries[path]
+	if !ok || entry.size != info.Size() || !entry.modTime.Equal(info.ModTime()) {
+		return "", false, nil
+	}
+	return entry.digest, true, nil
+}
+
+// imageDigest returns the SHA-256 digest of the image, such as sha256:e3b0...
+func imageDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package virt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/shoenig/test/must"
+)
+
+func Test_DriverAttributes(t *testing.T) {
+	th := &taskHandle{
+		logger:     hclog.NewNullLogger(),
+		taskConfig: &drivers.TaskConfig{ID: "task-id", Name: "web"},
+		procState:  drivers.TaskStateRunning,
+		name:       "test-domain",
+		description: &domain.Description{
+			PID:         1234,
+			APISocket:   "/var/lib/ch/vm1/api.sock",
+			SerialLog:   "/var/lib/ch/vm1/serial.log",
+			TAP:         "tap-vm1",
+			Bridge:      "br0",
+			MAC:         "52:54:00:12:34:56",
+			IPs:         []string{"192.168.1.10", "fd00::10"},
+			CPUs:        2,
+			Memory:      512 * 1024 * 1024,
+			BootMode:    "kernel",
+			Kernel:      "/boot/vmlinuz",
+			VMMVersion:  "v48.0.0",
+			VFIODevices: []string{"0000:01:00.0", "0000:02:00.0"},
+		},
+		imagePath:   "/var/lib/images/ubuntu.img",
+		imageDigest: "sha256:abc",
+		reboots:     1,
+	}
+
+	must.Eq(t, map[string]string{
+		"reboots":      "1",
+		"image_path":   "/var/lib/images/ubuntu.img",
+		"image_digest": "sha256:abc",
+		"vmm_pid":      "1234",
+		"vmm_version":  "v48.0.0",
+		"api_socket":   "/var/lib/ch/vm1/api.sock",
+		"serial_log":   "/var/lib/ch/vm1/serial.log",
+		"tap":          "tap-vm1",
+		"bridge":       "br0",
+		"mac":          "52:54:00:12:34:56",
+		"guest_ips":    "192.168.1.10,fd00::10",
+		"vcpus":        "2",
+		"memory_mb":    "512",
+		"boot_mode":    "kernel",
+		"kernel":       "/boot/vmlinuz",
+		"vfio_devices": "0000:01:00.0,0000:02:00.0",
+	}, th.TaskStatus().DriverAttributes)
+
+	// The host resources of VMs which have stopped are omitted.
+	th.procState = drivers.TaskStateExited
+	th.imageDigest = ""
+	must.Eq(t, map[string]string{
+		"reboots":    "1",
+		"image_path": "/var/lib/images/ubuntu.img",
+	}, th.TaskStatus().DriverAttributes)
+}
+
+func Test_DigestImage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image.img")
+	must.NoError(t, os.WriteFile(path, []byte("image"), 0644))
+	digests := newImageDigests()
+
+	th := &taskHandle{logger: hclog.NewNullLogger(), imagePath: path}
+	th.digestImage(digests)
+	must.Eq(t, "sha256:6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d", th.imageDigest)
+
+	// Images which cannot be read have no digest.
+	th = &taskHandle{logger: hclog.NewNullLogger(), imagePath: filepath.Join(t.TempDir(), "missing.img")}
+	th.digestImage(digests)
+	must.Eq(t, "", th.imageDigest)
+}
+
+func Test_ImageDigests(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image.img")
+	must.NoError(t, os.WriteFile(path, []byte("image"), 0644))
+	modTime := time.Now().Add(-time.Hour)
+	must.NoError(t, os.Chtimes(path, modTime, modTime))
+
+	digests := newImageDigests()
+	digest, err := digests.Get(path)
+	must.NoError(t, err)
+	must.Eq(t, "sha256:6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d", digest)
+
+	// The image is not read again while its size and modification time are
+	// unchanged.
+	must.NoError(t, os.WriteFile(path, []byte("other"), 0644))
+	must.NoError(t, os.Chtimes(path, modTime, modTime))
+	digest, err = digests.Get(path)
+	must.NoError(t, err)
+	must.Eq(t, "sha256:6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d", digest)
+
+	// Once modified, the image is hashed again.
+	must.NoError(t, os.Chtimes(path, time.Now(), time.Now()))
+	digest, err = digests.Get(path)
+	must.NoError(t, err)
+	must.NotEq(t, "sha256:6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d", digest)
+}
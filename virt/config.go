@@ -4,6 +4,8 @@
 package virt
 
 import (
+	"fmt"
+	"regexp"
 	"time"
 
 	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
@@ -62,12 +64,68 @@ var (
 				hclspec.NewAttr("tap_prefix", "string", false),
 				hclspec.NewLiteral(`"tap"`),
 			),
+			"firewall_backend": hclspec.NewDefault(
+				hclspec.NewAttr("firewall_backend", "string", false),
+				hclspec.NewLiteral(`"auto"`),
+			),
+			"port_forwarding": hclspec.NewDefault(
+				hclspec.NewAttr("port_forwarding", "string", false),
+				hclspec.NewLiteral(`"auto"`),
+			),
+			"cni_path": hclspec.NewDefault(
+				hclspec.NewAttr("cni_path", "string", false),
+				hclspec.NewLiteral(`"/opt/cni/bin"`),
+			),
+			"cni_config_dir": hclspec.NewDefault(
+				hclspec.NewAttr("cni_config_dir", "string", false),
+				hclspec.NewLiteral(`"/opt/cni/config"`),
+			),
+			"dhcp": hclspec.NewBlock("dhcp", false, hclspec.NewObject(map[string]*hclspec.Spec{
+				"enabled": hclspec.NewAttr("enabled", "bool", false),
+				"lease_time": hclspec.NewDefault(
+					hclspec.NewAttr("lease_time", "string", false),
+					hclspec.NewLiteral(`"1h"`),
+				),
+			})),
+			"dns": hclspec.NewBlock("dns", false, hclspec.NewObject(map[string]*hclspec.Spec{
+				"enabled": hclspec.NewAttr("enabled", "bool", false),
+				"domain": hclspec.NewDefault(
+					hclspec.NewAttr("domain", "string", false),
+					hclspec.NewLiteral(`"vm.nomad"`),
+				),
+				"upstreams": hclspec.NewAttr("upstreams", "list(string)", false),
+			})),
+			"group_network": hclspec.NewBlock("group_network", false, hclspec.NewObject(map[string]*hclspec.Spec{
+				"subnet_pool": hclspec.NewAttr("subnet_pool", "string", true),
+				"prefix_length": hclspec.NewDefault(
+					hclspec.NewAttr("prefix_length", "number", false),
+					hclspec.NewLiteral(`24`),
+				),
+				"bridge_prefix": hclspec.NewDefault(
+					hclspec.NewAttr("bridge_prefix", "string", false),
+					hclspec.NewLiteral(`"chg"`),
+				),
+				"dns": hclspec.NewAttr("dns", "list(string)", false),
+			})),
+		})),
+		"named_network": hclspec.NewBlockList("named_network", hclspec.NewObject(map[string]*hclspec.Spec{
+			"name":          hclspec.NewAttr("name", "string", true),
+			"bridge":        hclspec.NewAttr("bridge", "string", true),
+			"subnet_cidr":   hclspec.NewAttr("subnet_cidr", "string", true),
+			"gateway":       hclspec.NewAttr("gateway", "string", false),
+			"ip_pool_start": hclspec.NewAttr("ip_pool_start", "string", false),
+			"ip_pool_end":   hclspec.NewAttr("ip_pool_end", "string", false),
+			"dns":           hclspec.NewAttr("dns", "list(string)", false),
+			"nat":           hclspec.NewAttr("nat", "bool", false),
 		})),
 		"vfio": hclspec.NewBlock("vfio", false, hclspec.NewObject(map[string]*hclspec.Spec{
 			"allowlist":           hclspec.NewAttr("allowlist", "list(string)", false),
 			"iommu_address_width": hclspec.NewAttr("iommu_address_width", "number", false),
 			"pci_segments":        hclspec.NewAttr("pci_segments", "number", false),
 		})),
+		"metrics": hclspec.NewBlock("metrics", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"address": hclspec.NewAttr("address", "string", true),
+		})),
 		"data_dir":             hclspec.NewAttr("data_dir", "string", false),
 		"image_paths":          hclspec.NewAttr("image_paths", "list(string)", false),
 		"disable_alloc_mounts": hclspec.NewAttr("disable_alloc_mounts", "bool", false),
@@ -133,6 +191,19 @@ var (
 			"iommu_segments":      hclspec.NewAttr("iommu_segments", "list(number)", false),
 			"iommu_address_width": hclspec.NewAttr("iommu_address_width", "number", false),
 		})),
+		"readiness": hclspec.NewBlock("readiness", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"timeout": hclspec.NewDefault(
+				hclspec.NewAttr("timeout", "string", false),
+				hclspec.NewLiteral(`"60s"`),
+			),
+			"serial":     hclspec.NewAttr("serial", "string", false),
+			"tcp_port":   hclspec.NewAttr("tcp_port", "number", false),
+			"vsock_port": hclspec.NewAttr("vsock_port", "number", false),
+			"phone_home": hclspec.NewAttr("phone_home", "bool", false),
+		})),
+		"pvpanic":       hclspec.NewAttr("pvpanic", "bool", false),
+		"watchdog":      hclspec.NewAttr("watchdog", "bool", false),
+		"fail_on_panic": hclspec.NewAttr("fail_on_panic", "bool", false),
 		// VFIO device passthrough
 		"vfio_devices": hclspec.NewAttr("vfio_devices", "list(string)", false),
 		// USB device passthrough
@@ -157,10 +228,12 @@ var (
 			drivers.NetIsolationModeGroup,
 		},
 
-		// MustInitiateNetwork is set to false, indicating the driver does not
-		// implement and thus satisfy the Nomad drivers.DriverNetworkManager
-		// interface.
-		MustInitiateNetwork: false,
+		// MustInitiateNetwork is set to true, indicating the driver implements
+		// the Nomad drivers.DriverNetworkManager interface and creates the
+		// network namespace of allocations using group network mode. This
+		// cannot be combined with other initiating drivers, such as Docker,
+		// within the same group.
+		MustInitiateNetwork: true,
 
 		// MountConfigs is currently not supported, although the plumbing is
 		// ready to handle this.
@@ -202,6 +275,14 @@ type TaskConfig struct {
 	Rng             *RngConfig      `codec:"rng"`
 	Devices         []DeviceConfig  `codec:"devices"`
 	Platform        *PlatformConfig `codec:"platform"`
+	// Readiness gates the task being reported as started on the guest
+	// being ready.
+	Readiness *ReadinessConfig `codec:"readiness"`
+	// PVPanic and Watchdog add the pvpanic and watchdog devices to the VM,
+	// and FailOnPanic fails the task once the guest reports a kernel panic.
+	PVPanic     bool `codec:"pvpanic"`
+	Watchdog    bool `codec:"watchdog"`
+	FailOnPanic bool `codec:"fail_on_panic"`
 }
 
 type OS struct {
@@ -230,6 +311,57 @@ type VsockConfig struct {
 	Socket string `codec:"socket"`
 }
 
+// ReadinessConfig configures the probes determining the guest of a VM is
+// ready, and how long the VM may take to boot and pass them.
+type ReadinessConfig struct {
+	Timeout   string `codec:"timeout"`
+	Serial    string `codec:"serial"`
+	TCPPort   int    `codec:"tcp_port"`
+	VsockPort uint32 `codec:"vsock_port"`
+	PhoneHome bool   `codec:"phone_home"`
+}
+
+// domainReadiness returns the readiness probes of the VM and its boot
+// timeout, which is the default one if the task has no readiness block.
+func (r *ReadinessConfig) domainReadiness() (*domain.Readiness, time.Duration, error) {
+	if r == nil {
+		return nil, defaultBootTimeout, nil
+	}
+
+	timeout := defaultBootTimeout
+	if r.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(r.Timeout); err != nil {
+			return nil, 0, fmt.Errorf("invalid readiness timeout %q: %w", r.Timeout, err)
+		}
+		if timeout <= 0 {
+			return nil, 0, fmt.Errorf("readiness timeout must be positive")
+		}
+	}
+
+	if r.Serial != "" {
+		if _, err := regexp.Compile(r.Serial); err != nil {
+			return nil, 0, fmt.Errorf("invalid readiness serial pattern: %w", err)
+		}
+	}
+	if r.TCPPort < 0 || r.TCPPort > 65535 {
+		return nil, 0, fmt.Errorf("invalid readiness tcp_port %d", r.TCPPort)
+	}
+
+	// A block with only a timeout extends the boot timeout without probing
+	// the guest.
+	if r.Serial == "" && r.TCPPort == 0 && r.VsockPort == 0 && !r.PhoneHome {
+		return nil, timeout, nil
+	}
+
+	return &domain.Readiness{
+		Serial:    r.Serial,
+		TCPPort:   r.TCPPort,
+		VsockPort: r.VsockPort,
+		PhoneHome: r.PhoneHome,
+	}, timeout, nil
+}
+
 type RngConfig struct {
 	Src string `codec:"src"`
 }
@@ -250,7 +382,9 @@ type PlatformConfig struct {
 type Config struct {
 	CloudHypervisor domain.CloudHypervisor `codec:"cloud_hypervisor"`
 	Network         domain.Network         `codec:"network"`
+	NamedNetworks   domain.NamedNetworks   `codec:"named_network"`
 	VFIO            domain.VFIO            `codec:"vfio"`
+	Metrics         domain.Metrics         `codec:"metrics"`
 	DataDir         string                 `codec:"data_dir"`
 	// ImagePaths is an allow-list of paths cloud hypervisor is allowed to load an image from
 	ImagePaths []string `codec:"image_paths"`
@@ -279,6 +413,18 @@ func (c *Config) initDefaults() {
 	if c.Network.TAPPrefix == "" {
 		c.Network.TAPPrefix = "tap"
 	}
+	if c.Network.FirewallBackend == "" {
+		c.Network.FirewallBackend = "auto"
+	}
+	if c.Network.PortForwarding == "" {
+		c.Network.PortForwarding = "auto"
+	}
+	if c.Network.CNIPath == "" {
+		c.Network.CNIPath = "/opt/cni/bin"
+	}
+	if c.Network.CNIConfigDir == "" {
+		c.Network.CNIConfigDir = "/opt/cni/config"
+	}
 
 	// Initialize ImagePaths with common defaults if empty
 	if len(c.ImagePaths) == 0 {
@@ -301,3 +447,37 @@ func (c *Config) initDefaults() {
 
 	// DisableAllocMounts defaults to false; no action required here
 }
+
+// resolveNamedNetworks sets the bridge of each interface attached to a named
+// network to the bridge of the network, so the interface is handled like any
+// other bridge interface. Interfaces using a group network require it to be
+// enabled within the driver.
+func (c *Config) resolveNamedNetworks(ifaces net.NetworkInterfacesConfig) error {
+	for i, iface := range ifaces {
+		if iface == nil || iface.Bridge == nil {
+			continue
+		}
+		if iface.Bridge.GroupNetwork && c.Network.GroupNetwork == nil {
+			return fmt.Errorf("network interface bridge '%v' uses a group network, which is not enabled within the driver", i)
+		}
+		if iface.Bridge.Network == "" {
+			continue
+		}
+
+		network, ok := c.NamedNetworks.Get(iface.Bridge.Network)
+		if !ok {
+			return fmt.Errorf("network interface bridge '%v' network %q is not configured within the driver",
+				i, iface.Bridge.Network)
+		}
+
+		switch iface.Bridge.Name {
+		case "":
+			iface.Bridge.Name = network.Bridge
+		case network.Bridge:
+		default:
+			return fmt.Errorf("network interface bridge '%v' name %q does not match bridge %q of network %q",
+				i, iface.Bridge.Name, network.Bridge, network.Name)
+		}
+	}
+	return nil
+}
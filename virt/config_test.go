@@ -5,7 +5,9 @@ package virt
 
 import (
 	"testing"
+	"time"
 
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
 	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
 	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
 	"github.com/hashicorp/nomad/plugins/drivers"
@@ -22,7 +24,7 @@ func Test_capabilities(t *testing.T) {
 		DisableLogCollection: true,
 		FSIsolation:          fsisolation.Image,
 		NetIsolationModes:    []drivers.NetIsolationMode{drivers.NetIsolationModeHost, drivers.NetIsolationModeGroup},
-		MustInitiateNetwork:  false,
+		MustInitiateNetwork:  true,
 		MountConfigs:         drivers.MountConfigSupportNone,
 	}
 	must.Eq(t, &expectedCapabilities, capabilities)
@@ -94,6 +96,19 @@ func TestConfig_Plugin(t *testing.T) {
 	network {
 		bridge = "br0"
 		subnet_cidr = "194.31.143.0/24"
+		group_network {
+			subnet_pool = "10.200.0.0/16"
+		}
+	}
+	named_network {
+		name = "dmz"
+		bridge = "br-dmz"
+		subnet_cidr = "10.20.0.0/24"
+		dns = ["1.1.1.1"]
+		nat = true
+	}
+	metrics {
+		address = "127.0.0.1:9655"
 	}
   }
 `
@@ -106,6 +121,48 @@ func TestConfig_Plugin(t *testing.T) {
 	must.StrContains(t, expectedCHBin, cs.CloudHypervisor.Bin)
 	must.StrContains(t, expectedBridge, cs.Network.Bridge)
 	must.StrContains(t, expectedKernel, cs.CloudHypervisor.DefaultKernel)
+	must.Eq(t, domain.NamedNetworks{{
+		Name:       "dmz",
+		Bridge:     "br-dmz",
+		SubnetCIDR: "10.20.0.0/24",
+		DNS:        []string{"1.1.1.1"},
+		NAT:        true,
+	}}, cs.NamedNetworks)
+	must.Eq(t, &domain.GroupNetwork{
+		SubnetPool:   "10.200.0.0/16",
+		PrefixLength: 24,
+		BridgePrefix: "chg",
+	}, cs.Network.GroupNetwork)
+	must.Eq(t, "127.0.0.1:9655", cs.Metrics.Address)
+}
+
+func TestConfig_resolveNamedNetworks(t *testing.T) {
+	t.Parallel()
+
+	cfg := &Config{
+		NamedNetworks: domain.NamedNetworks{{Name: "dmz", Bridge: "br-dmz"}},
+	}
+
+	ifaces := net.NetworkInterfacesConfig{
+		{Bridge: &net.NetworkInterfaceBridgeConfig{Network: "dmz"}},
+	}
+	must.NoError(t, cfg.resolveNamedNetworks(ifaces))
+	must.Eq(t, "br-dmz", ifaces[0].Bridge.Name)
+
+	// Naming the bridge of the network is allowed, but not another.
+	must.NoError(t, cfg.resolveNamedNetworks(ifaces))
+	ifaces[0].Bridge.Name = "br0"
+	must.ErrorContains(t, cfg.resolveNamedNetworks(ifaces), `does not match bridge "br-dmz"`)
+
+	ifaces[0].Bridge = &net.NetworkInterfaceBridgeConfig{Network: "lan"}
+	must.ErrorContains(t, cfg.resolveNamedNetworks(ifaces), `network "lan" is not configured`)
+
+	// Group networks must be enabled within the driver.
+	ifaces[0].Bridge = &net.NetworkInterfaceBridgeConfig{GroupNetwork: true}
+	must.ErrorContains(t, cfg.resolveNamedNetworks(ifaces), "group network, which is not enabled")
+	cfg.Network.GroupNetwork = &domain.GroupNetwork{SubnetPool: "10.200.0.0/16"}
+	must.NoError(t, cfg.resolveNamedNetworks(ifaces))
+	must.Eq(t, "", ifaces[0].Bridge.Name)
 }
 
 func Test_taskConfigSpec(t *testing.T) {
@@ -151,6 +208,30 @@ config {
 				Devices:  []DeviceConfig{},
 			},
 		},
+		{
+			name: "readiness",
+			inputConfig: `
+config {
+  image = "/path/to/image/here"
+  readiness {
+    serial   = "Cloud-init .* finished"
+    tcp_port = 22
+  }
+}
+`,
+			expectedOutput: TaskConfig{
+				ImagePath: "/path/to/image/here",
+				Readiness: &ReadinessConfig{
+					Timeout: "60s",
+					Serial:  "Cloud-init .* finished",
+					TCPPort: 22,
+				},
+				NetworkInterfacesConfig: net.NetworkInterfacesConfig{},
+				Disks:                   []DiskConfig{},
+				FSMounts:                []FSMountConfig{},
+				Devices:                 []DeviceConfig{},
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -163,3 +244,37 @@ config {
 		})
 	}
 }
+
+func TestReadinessConfig_domainReadiness(t *testing.T) {
+	// Tasks without a readiness block use the default boot timeout.
+	var none *ReadinessConfig
+	readiness, timeout, err := none.domainReadiness()
+	must.NoError(t, err)
+	must.Nil(t, readiness)
+	must.Eq(t, defaultBootTimeout, timeout)
+
+	// A block with only a timeout does not probe the guest.
+	readiness, timeout, err = (&ReadinessConfig{Timeout: "5m"}).domainReadiness()
+	must.NoError(t, err)
+	must.Nil(t, readiness)
+	must.Eq(t, 5*time.Minute, timeout)
+
+	readiness, timeout, err = (&ReadinessConfig{
+		Timeout:   "90s",
+		Serial:    "login:",
+		VsockPort: 1024,
+		PhoneHome: true,
+	}).domainReadiness()
+	must.NoError(t, err)
+	must.Eq(t, &domain.Readiness{Serial: "login:", VsockPort: 1024, PhoneHome: true}, readiness)
+	must.Eq(t, 90*time.Second, timeout)
+
+	_, _, err = (&ReadinessConfig{Timeout: "soon"}).domainReadiness()
+	must.ErrorContains(t, err, "invalid readiness timeout")
+
+	_, _, err = (&ReadinessConfig{Serial: "("}).domainReadiness()
+	must.ErrorContains(t, err, "invalid readiness serial pattern")
+
+	_, _, err = (&ReadinessConfig{TCPPort: 70000}).domainReadiness()
+	must.ErrorContains(t, err, "invalid readiness tcp_port")
+}
@@ -7,6 +7,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -18,6 +19,7 @@ import (
 	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
 	"github.com/ccheshirecat/nomad-driver-ch/virt/image_tools"
 	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
+	"github.com/hashicorp/nomad/client/lib/cpustats"
 	"github.com/hashicorp/nomad/client/lib/idset"
 
 	"github.com/hashicorp/go-hclog"
@@ -28,6 +30,7 @@ import (
 	"github.com/hashicorp/nomad/plugins/drivers"
 	"github.com/hashicorp/nomad/plugins/shared/hclspec"
 	"github.com/hashicorp/nomad/plugins/shared/structs"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
@@ -52,6 +55,14 @@ const (
 
 	envVariblesFilePath        = "/etc/profile.d/virt.sh" //Only valid for linux OS
 	envVariblesFilePermissions = "777"
+
+	// networkSpecHostnameLabel is the network isolation spec label holding
+	// the hostname requested for the allocation network.
+	networkSpecHostnameLabel = "nomad-driver-ch.hostname"
+
+	// defaultBootTimeout is how long VMs may take to boot and pass their
+	// readiness probes, unless their task configures otherwise.
+	defaultBootTimeout = 60 * time.Second
 )
 
 var (
@@ -80,6 +91,12 @@ type TaskState struct {
 	// NetTeardown is the specification used to delete all the network
 	// configuration associated to a VM.
 	NetTeardown *net.TeardownSpec
+
+	// ImagePath is the image the VM was started from, before any thin copy.
+	ImagePath string
+
+	// FailOnPanic is whether the task fails once the guest kernel panics.
+	FailOnPanic bool
 }
 
 // Net is the interface that defines the virtualization network sub-system. It
@@ -115,6 +132,12 @@ type Net interface {
 	// implementations must be able to support this and not enter death spirals
 	// when an error occurs.
 	VMTerminatedTeardown(*net.VMTerminatedTeardownRequest) (*net.VMTerminatedTeardownResponse, error)
+
+	// VMRecovered restores any configuration held in memory by the network
+	// sub-system for a VM, such as userspace port forwarding, after the
+	// driver has recovered the VM's task. An error is logged by the driver,
+	// but does not fail the recovery.
+	VMRecovered(*net.VMRecoveredRequest) (*net.VMRecoveredResponse, error)
 }
 
 type Virtualizer interface {
@@ -126,10 +149,34 @@ type Virtualizer interface {
 	GetNetworkInterfaces(name string) ([]domain.NetworkInterface, error)
 }
 
+// DomainReadinessWaiter is implemented by virtualizers which can probe the
+// guest of a VM for readiness once booted.
+type DomainReadinessWaiter interface {
+	// WaitDomainReady waits for the guest of the VM to pass its readiness
+	// probes, until the context is done.
+	WaitDomainReady(ctx context.Context, name string) error
+}
+
+// DomainDescriber is implemented by virtualizers which can describe the host
+// resources backing a VM.
+type DomainDescriber interface {
+	DescribeDomain(name string) (*domain.Description, error)
+}
+
 type DomainGetter interface {
 	GetDomain(name string) (*domain.Info, error)
 }
 
+// DomainEventSource is implemented by virtualizers which report the lifecycle
+// events of VMs, so task handles can react to state changes without waiting
+// for their next poll.
+type DomainEventSource interface {
+	// SubscribeDomain returns a channel receiving the events of the VM, which
+	// is closed once the events end, and a function ending the subscription.
+	// The channel is nil if the events of the VM are not available.
+	SubscribeDomain(name string) (<-chan domain.Event, func())
+}
+
 type ImageHandler interface {
 	GetImageFormat(basePath string) (string, error)
 	GetImageInfo(basePath string) (*image_tools.ImageInfo, error)
@@ -140,8 +187,10 @@ type VirtDriverPlugin struct {
 	eventer        *eventer.Eventer
 	virtualizer    Virtualizer
 	taskGetter     DomainGetter
+	eventSource    DomainEventSource
 	config         *Config
 	nomadConfig    *base.ClientDriverConfig
+	compute        cpustats.Compute
 	tasks          *taskStore
 	baseCtx        context.Context
 	signalShutdown context.CancelFunc
@@ -155,6 +204,15 @@ type VirtDriverPlugin struct {
 	// avoid unnecessary calls and work.
 	networkInit  atomic.Bool
 	imageHandler ImageHandler
+	// metrics is the registry of the Prometheus metrics of the driver, which
+	// metricsServer serves when enabled. pluginMetrics are the metrics the
+	// plugin records as tasks are started and stopped.
+	metrics       *prometheus.Registry
+	metricsServer *http.Server
+	pluginMetrics *pluginMetrics
+	// imageDigests caches the digests of the images of tasks, reported by
+	// their task status.
+	imageDigests *imageDigests
 }
 
 // NewPlugin returns a new driver plugin
@@ -164,7 +222,7 @@ func NewPlugin(logger hclog.Logger) drivers.DriverPlugin {
 
 	// Cloud Hypervisor driver will be initialized later in SetConfig
 	// when we have the full configuration available
-	return &VirtDriverPlugin{
+	d := &VirtDriverPlugin{
 		eventer:        eventer.NewEventer(ctx, logger),
 		config:         &Config{},
 		tasks:          newTaskStore(),
@@ -173,8 +231,12 @@ func NewPlugin(logger hclog.Logger) drivers.DriverPlugin {
 		logger:         logger,
 		networkInit:    atomic.Bool{},
 		imageHandler:   image_tools.NewHandler(logger),
+		pluginMetrics:  newPluginMetrics(),
+		imageDigests:   newImageDigests(),
 		// virtualizer and networkController will be set in SetConfig
 	}
+	d.metrics = newMetricsRegistry(d)
+	return d
 }
 
 // PluginInfo returns information describing the plugin.
@@ -205,6 +267,7 @@ func (d *VirtDriverPlugin) SetConfig(cfg *base.Config) error {
 	// Save the Nomad agent configuration
 	if cfg.AgentConfig != nil {
 		d.nomadConfig = cfg.AgentConfig.Driver
+		d.compute = cfg.AgentConfig.Compute()
 	}
 
 	if d.config.DataDir != "" {
@@ -219,12 +282,13 @@ func (d *VirtDriverPlugin) SetConfig(cfg *base.Config) error {
 	}
 
 	// Initialize Cloud Hypervisor driver with config
-	v := cloudhypervisor.NewWithSkipValidation(d.baseCtx, d.logger, &d.config.CloudHypervisor, &d.config.Network, &d.config.VFIO, d.dataDir, true)
+	v := cloudhypervisor.NewWithSkipValidation(d.baseCtx, d.logger, &d.config.CloudHypervisor, &d.config.Network, d.config.NamedNetworks, &d.config.VFIO, d.dataDir, true)
 	d.virtualizer = v
 	d.taskGetter = v
+	d.eventSource = v
 
 	// Initialize network controller with config
-	d.networkController = chnet.NewController(d.logger, &d.config.Network)
+	d.networkController = chnet.NewController(d.logger, &d.config.Network, d.config.NamedNetworks)
 
 	err = d.virtualizer.Start(d.dataDir)
 	if err != nil {
@@ -239,6 +303,10 @@ func (d *VirtDriverPlugin) SetConfig(cfg *base.Config) error {
 		}
 	}
 
+	if err := d.startMetricsServer(); err != nil {
+		return fmt.Errorf("virt: failed to start metrics server: %w", err)
+	}
+
 	return nil
 }
 
@@ -311,6 +379,12 @@ func (d *VirtDriverPlugin) buildFingerprint() *drivers.Fingerprint {
 		d.networkController.Fingerprint(attrs)
 	}
 
+	// Advertise the addresses left within each network, so jobs can be
+	// constrained to nodes able to place them.
+	for name, free := range virtInfo.FreeAddresses {
+		attrs[net.FingerprintAttributeKeyPrefix+name+".free_addresses"] = structs.NewIntAttribute(int64(free), "")
+	}
+
 	fp := &drivers.Fingerprint{
 		Attributes:        attrs,
 		Health:            drivers.HealthStateHealthy,
@@ -357,10 +431,12 @@ func (d *VirtDriverPlugin) StopTask(taskID string, timeout time.Duration, signal
 		return nil
 	}
 
+	start := time.Now()
 	err := d.virtualizer.StopDomain(domainNameFromTaskID(taskID))
 	if err != nil {
 		return fmt.Errorf("virt: unable to stop task %s: %w", taskID, err)
 	}
+	d.pluginMetrics.stopDuration.Observe(time.Since(start).Seconds())
 
 	return nil
 }
@@ -394,7 +470,11 @@ func (d *VirtDriverPlugin) DestroyTask(taskID string, force bool) error {
 		return fmt.Errorf("virt: failed to destroy task network: %w", err)
 	}
 
-	d.tasks.Delete(taskName)
+	if err := os.Remove(handle.rebootsPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		d.logger.Warn("failed to remove VM reboots", "task_id", taskID, "error", err)
+	}
+
+	d.tasks.Delete(taskID)
 
 	return nil
 }
@@ -436,6 +516,7 @@ func (d *VirtDriverPlugin) publishStats(ctx context.Context, interval time.Durat
 			stats, err := handle.GetStats()
 			if err != nil {
 				d.logger.Error("error while reading stats from the task", "task", handle.name, "error", err)
+				continue
 			}
 
 			d.logger.Trace("publishing stats", "values", fmt.Sprintf("%+v", stats.ResourceUsage.MemoryStats))
@@ -532,6 +613,30 @@ func setUpTaskState(vmState string) drivers.TaskState {
 	}
 }
 
+// describeDomain returns the description of the host resources backing the
+// VM, if supported by the virtualizer. It is only taken as the task starts,
+// as describing a VM waits on other VMs being booted.
+func (d *VirtDriverPlugin) describeDomain(name string) *domain.Description {
+	describer, ok := d.virtualizer.(DomainDescriber)
+	if !ok {
+		return nil
+	}
+
+	desc, err := describer.DescribeDomain(name)
+	if err != nil {
+		// Recovered VMs may not be known to the virtualizer.
+		d.logger.Debug("unable to describe VM", "name", name, "error", err)
+		return nil
+	}
+	return desc
+}
+
+// rebootsPath returns the path the reboot count of the VM of the task is
+// saved at, within the plugin data directory.
+func (d *VirtDriverPlugin) rebootsPath(taskName string) string {
+	return filepath.Join(d.dataDir, taskName+".reboots")
+}
+
 func buildHostname(taskName string) string {
 	return fmt.Sprintf("nomad-%s", taskName)
 }
@@ -582,6 +687,29 @@ func (d *VirtDriverPlugin) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHand
 		}
 	}
 
+	// Default the interface bandwidth limit from the task network
+	// reservation, so VMs cannot use more of the host uplink than reserved.
+	var mbits int
+	for _, network := range cfg.Resources.NomadResources.Networks {
+		mbits += network.MBits
+	}
+	driverConfig.NetworkInterfacesConfig.DefaultBandwidth(mbits)
+
+	// Interfaces attached to a named network use the bridge of the network.
+	if err := d.config.resolveNamedNetworks(driverConfig.NetworkInterfacesConfig); err != nil {
+		return nil, nil, fmt.Errorf("virt: invalid network configuration: %w", err)
+	}
+
+	readiness, bootTimeout, err := driverConfig.Readiness.domainReadiness()
+	if err != nil {
+		return nil, nil, fmt.Errorf("virt: invalid readiness configuration: %w", err)
+	}
+
+	// Guest panics are only reported through the pvpanic device.
+	if driverConfig.FailOnPanic && !driverConfig.PVPanic {
+		return nil, nil, errors.New("virt: fail_on_panic requires the pvpanic device")
+	}
+
 	taskName := domainNameFromTaskID(cfg.ID)
 
 	d.logger.Info("starting task", "name", taskName)
@@ -603,9 +731,18 @@ func (d *VirtDriverPlugin) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHand
 		}
 	}
 
+	// In group network mode, the VMM is launched within the allocation
+	// network namespace, which may also carry the group hostname.
+	var netns string
+	if iso := cfg.NetworkIsolation; iso != nil && iso.Mode == drivers.NetIsolationModeGroup {
+		netns = iso.Path
+	}
+
 	hostname := buildHostname(taskName)
 	if driverConfig.Hostname != "" {
 		hostname = driverConfig.Hostname
+	} else if cfg.NetworkIsolation != nil && cfg.NetworkIsolation.Labels[networkSpecHostnameLabel] != "" {
+		hostname = cfg.NetworkIsolation.Labels[networkSpecHostnameLabel]
 	}
 
 	// The alloc directory and plugin data directory are assumed to be allowed
@@ -614,31 +751,45 @@ func (d *VirtDriverPlugin) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHand
 
 	d.logger.Debug("checking image path", "image_path", driverConfig.ImagePath, "allowed_paths", allowedPaths, "config_image_paths", d.config.ImagePaths, "data_dir", d.dataDir, "alloc_dir", cfg.AllocDir)
 
-	diskImagePath := driverConfig.ImagePath
+	// Each phase of starting the VM is reported as a task event.
+	reportPhase := d.phaseReporter(cfg)
 
-	if !fileExists(diskImagePath) {
+	diskImagePath := driverConfig.ImagePath
+	var diskFormat string
 
-		// Assuming the image was downloaded using artifacts and will be placed
-		// somewhere in the alloc's filesystem.
-		diskImagePath = filepath.Join(cfg.TaskDir().Dir, diskImagePath)
+	if err := reportPhase.Run(domain.PhaseImageResolved, func() error {
 		if !fileExists(diskImagePath) {
-			return nil, nil, fmt.Errorf("virt: %s, %w", cfg.AllocID, ErrImageNotFound)
+
+			// Assuming the image was downloaded using artifacts and will be placed
+			// somewhere in the alloc's filesystem.
+			diskImagePath = filepath.Join(cfg.TaskDir().Dir, diskImagePath)
+			if !fileExists(diskImagePath) {
+				return fmt.Errorf("virt: %s, %w", cfg.AllocID, ErrImageNotFound)
+			}
 		}
-	}
 
-	imageInfo, err := d.imageHandler.GetImageInfo(diskImagePath)
-	if err != nil {
-		return nil, nil, fmt.Errorf("virt: unable to get disk info %s: %w", cfg.AllocID, err)
+		imageInfo, err := d.imageHandler.GetImageInfo(diskImagePath)
+		if err != nil {
+			return fmt.Errorf("virt: unable to get disk info %s: %w", cfg.AllocID, err)
+		}
+
+		diskFormat = imageInfo.Format
+		return nil
+	}); err != nil {
+		return nil, nil, err
 	}
 
-	diskFormat := imageInfo.Format
+	// The image is reported by the task status, rather than its thin copy.
+	imagePath := diskImagePath
 
 	if driverConfig.UseThinCopy {
 		copyPath := filepath.Join(d.dataDir, taskName+".img")
 		d.logger.Info("creating thin copy at", "path", copyPath) // TODO: Put back at info
 
-		if err := d.imageHandler.CreateThinCopy(diskImagePath, copyPath,
-			cfg.Resources.NomadResources.Memory.MemoryMB); err != nil {
+		if err := reportPhase.Run(domain.PhaseThinCopyCreated, func() error {
+			return d.imageHandler.CreateThinCopy(diskImagePath, copyPath,
+				cfg.Resources.NomadResources.Memory.MemoryMB)
+		}); err != nil {
 			return nil, nil, fmt.Errorf("virt: unable to create thin copy for %s: %w",
 				taskName, err)
 		}
@@ -689,6 +840,13 @@ func (d *VirtDriverPlugin) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHand
 		Initramfs:   driverConfig.Initramfs,
 		Cmdline:     driverConfig.Cmdline,
 		VFIODevices: driverConfig.VFIODevices,
+		NetNS:       netns,
+		AllocID:     cfg.AllocID,
+		ReportPhase: reportPhase,
+		Readiness:   readiness,
+		BootTimeout: bootTimeout,
+		PVPanic:     driverConfig.PVPanic,
+		Watchdog:    driverConfig.Watchdog,
 	}
 
 	// Debug logging for path validation
@@ -698,18 +856,32 @@ func (d *VirtDriverPlugin) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHand
 		return nil, nil, fmt.Errorf("virt: invalid configuration %s: %w", cfg.AllocID, err)
 	}
 
+	start := time.Now()
 	if err := d.virtualizer.CreateDomain(dc, cfg.Env); err != nil {
 		return nil, nil, fmt.Errorf("virt: failed to start task %s: %w", cfg.AllocID, err)
 	}
+	d.pluginMetrics.bootDuration.Observe(time.Since(start).Seconds())
 
 	ifaces, err := d.virtualizer.GetNetworkInterfaces(dc.Name)
 	if err != nil {
 		return nil, nil, fmt.Errorf("virt: failed to retrieve guest interfaces %s: %w", cfg.AllocID, err)
 	}
 	hwaddrs := make([]string, len(ifaces))
+	taps := make([]string, len(ifaces))
 	guestIPs := make([]string, 0)
+	var (
+		cniAttachment *net.CNIAttachment
+		groupNetwork  *net.GroupNetwork
+	)
 	for i, iface := range ifaces {
+		if iface.CNI != nil {
+			cniAttachment = iface.CNI
+		}
+		if iface.GroupNetwork != nil {
+			groupNetwork = iface.GroupNetwork
+		}
 		hwaddrs[i] = iface.MAC
+		taps[i] = iface.DeviceName
 		for _, addr := range iface.Addrs {
 			if addr.IsValid() {
 				guestIPs = append(guestIPs, addr.String())
@@ -718,13 +890,20 @@ func (d *VirtDriverPlugin) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHand
 	}
 
 	h := &taskHandle{
-		taskConfig: cfg,
-		procState:  drivers.TaskStateRunning,
-		startedAt:  time.Now().Round(time.Millisecond),
-		logger:     d.logger.Named("handle").With("alloc-id", cfg.AllocID),
-		taskGetter: d.taskGetter,
-		name:       taskName,
+		taskConfig:  cfg,
+		procState:   drivers.TaskStateRunning,
+		startedAt:   time.Now().Round(time.Millisecond),
+		logger:      d.logger.Named("handle").With("alloc-id", cfg.AllocID),
+		taskGetter:  d.taskGetter,
+		eventSource: d.eventSource,
+		eventer:     d.eventer,
+		failOnPanic: driverConfig.FailOnPanic,
+		rebootsPath: d.rebootsPath(taskName),
+		imagePath:   imagePath,
+		name:        taskName,
+		compute:     d.compute,
 	}
+	h.description = d.describeDomain(taskName)
 
 	// Build our network request to send now that the VM has been started. The
 	// response will contain our teardown spec, which gets stored in the task
@@ -736,12 +915,18 @@ func (d *VirtDriverPlugin) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHand
 		}
 	}
 	netBuildReq := net.VMStartedBuildRequest{
-		DomainName: taskName,
-		Hostname:   hostname,
-		NetConfig:  &driverConfig.NetworkInterfacesConfig,
-		Resources:  cfg.Resources,
-		Hwaddrs:    hwaddrs,
-		GuestIPs:   guestIPs,
+		DomainName:   taskName,
+		Hostname:     hostname,
+		NetConfig:    &driverConfig.NetworkInterfacesConfig,
+		Resources:    cfg.Resources,
+		Hwaddrs:      hwaddrs,
+		GuestIPs:     guestIPs,
+		TAPs:         taps,
+		Namespace:    cfg.Namespace,
+		JobID:        cfg.JobID,
+		NetNS:        netns,
+		CNI:          cniAttachment,
+		GroupNetwork: groupNetwork,
 	}
 
 	// Build out the network now that the VM has been started.
@@ -752,7 +937,12 @@ func (d *VirtDriverPlugin) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHand
 	//
 	// In the future, we may want to add some retry logic when destroying a VM,
 	// however, at least attempting it is a good start.
-	netBuildResp, err := d.networkController.VMStartedBuild(&netBuildReq)
+	var netBuildResp *net.VMStartedBuildResponse
+	err = reportPhase.Run(domain.PhaseNetworkRulesApplied, func() error {
+		var err error
+		netBuildResp, err = d.networkController.VMStartedBuild(&netBuildReq)
+		return err
+	})
 	if err != nil {
 		if destroyDomainErr := d.virtualizer.DestroyDomain(taskName); destroyDomainErr != nil {
 			d.logger.Error("virt: failed to destroy domain, manual cleanup needed",
@@ -767,6 +957,31 @@ func (d *VirtDriverPlugin) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHand
 		h.netTeardown = netBuildResp.TeardownSpec
 	}
 
+	// The task is only started once its guest is ready, within what remains
+	// of the boot timeout. The guest is waited on once its network is built,
+	// as guests addressed over DHCP need their reservation to come up.
+	if waiter, ok := d.virtualizer.(DomainReadinessWaiter); ok && readiness != nil {
+		ctx, cancel := context.WithDeadline(d.baseCtx, start.Add(bootTimeout))
+		err := reportPhase.Run(domain.PhaseGuestReady, func() error {
+			return waiter.WaitDomainReady(ctx, taskName)
+		})
+		cancel()
+		if err != nil {
+			if destroyDomainErr := d.virtualizer.DestroyDomain(taskName); destroyDomainErr != nil {
+				d.logger.Error("virt: failed to destroy domain, manual cleanup needed",
+					"task_name", taskName, "error", destroyDomainErr)
+			}
+			netTeardownReq := net.VMTerminatedTeardownRequest{
+				TeardownSpec: netBuildResp.TeardownSpec,
+			}
+			if _, teardownErr := d.networkController.VMTerminatedTeardown(&netTeardownReq); teardownErr != nil {
+				d.logger.Error("virt: failed to destroy task network, manual cleanup needed",
+					"task_name", taskName, "error", teardownErr)
+			}
+			return nil, nil, fmt.Errorf("virt: guest of task %s not ready: %w", cfg.AllocID, err)
+		}
+	}
+
 	d.logger.Info("task started successfully", "task_name", taskName)
 
 	// Generate our driver state and send this to Nomad. It stores critical
@@ -776,6 +991,8 @@ func (d *VirtDriverPlugin) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHand
 		NetTeardown: netBuildResp.TeardownSpec,
 		StartedAt:   h.startedAt,
 		TaskConfig:  cfg,
+		ImagePath:   imagePath,
+		FailOnPanic: driverConfig.FailOnPanic,
 	}
 
 	handle := drivers.NewTaskHandle(taskHandleVersion)
@@ -787,6 +1004,7 @@ func (d *VirtDriverPlugin) StartTask(cfg *drivers.TaskConfig) (*drivers.TaskHand
 	}
 
 	d.tasks.Set(cfg.ID, h)
+	go h.digestImage(d.imageDigests)
 
 	return handle, netBuildResp.DriverNetwork, nil
 }
@@ -807,14 +1025,28 @@ func (d *VirtDriverPlugin) RecoverTask(handle *drivers.TaskHandle) error {
 			handle.Config.ID, err)
 	}
 
+	taskName := domainNameFromTaskID(handle.Config.ID)
+	reboots, err := loadReboots(d.rebootsPath(taskName))
+	if err != nil {
+		d.logger.Warn("failed to restore VM reboots", "task", handle.Config.ID, "error", err)
+	}
+
 	h := &taskHandle{
-		name:        domainNameFromTaskID(handle.Config.ID),
+		name:        taskName,
 		logger:      d.logger.Named("handle").With("alloc-id", handle.Config.AllocID),
 		taskConfig:  taskState.TaskConfig,
 		startedAt:   taskState.StartedAt,
 		taskGetter:  d.taskGetter,
+		eventSource: d.eventSource,
+		eventer:     d.eventer,
+		failOnPanic: taskState.FailOnPanic,
+		reboots:     reboots,
+		rebootsPath: d.rebootsPath(taskName),
 		netTeardown: taskState.NetTeardown,
+		imagePath:   taskState.ImagePath,
+		compute:     d.compute,
 	}
+	h.description = d.describeDomain(taskName)
 
 	vm, err := h.taskGetter.GetDomain(h.name)
 	if err != nil {
@@ -828,7 +1060,16 @@ func (d *VirtDriverPlugin) RecoverTask(handle *drivers.TaskHandle) error {
 
 	h.procState = setUpTaskState(vm.State)
 
+	if h.netTeardown != nil {
+		if _, err := d.networkController.VMRecovered(&net.VMRecoveredRequest{
+			TeardownSpec: h.netTeardown,
+		}); err != nil {
+			d.logger.Error("failed to restore task network", "task", handle.Config.ID, "error", err)
+		}
+	}
+
 	d.tasks.Set(handle.Config.ID, h)
+	go h.digestImage(d.imageDigests)
 
 	return nil
 }
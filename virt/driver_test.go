@@ -5,7 +5,9 @@ package virt
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"sync"
 	"testing"
@@ -53,6 +55,10 @@ func (mn *mockNet) VMTerminatedTeardown(*net.VMTerminatedTeardownRequest) (*net.
 	return &net.VMTerminatedTeardownResponse{}, nil
 }
 
+func (mn *mockNet) VMRecovered(*net.VMRecoveredRequest) (*net.VMRecoveredResponse, error) {
+	return &net.VMRecoveredResponse{}, nil
+}
+
 type mockImageHandler struct {
 	lock sync.RWMutex
 
@@ -519,6 +525,221 @@ func TestVirtDriver_Start_Wait_Crashed(t *testing.T) {
 	must.Eq(t, "exited", dts.State)
 }
 
+// callRecorder records the calls made to the mocks of a test, in order.
+type callRecorder struct {
+	lock  sync.Mutex
+	calls []string
+}
+
+func (cr *callRecorder) record(call string) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	cr.calls = append(cr.calls, call)
+}
+
+func (cr *callRecorder) getCalls() []string {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	return append([]string(nil), cr.calls...)
+}
+
+// dhcpNetMock reserves the guest address over DHCP when the task network is
+// built.
+type dhcpNetMock struct {
+	mockNet
+
+	recorder *callRecorder
+	lock     sync.Mutex
+	reserved bool
+}
+
+func (mn *dhcpNetMock) VMStartedBuild(*net.VMStartedBuildRequest) (*net.VMStartedBuildResponse, error) {
+	mn.lock.Lock()
+	defer mn.lock.Unlock()
+
+	mn.recorder.record("build")
+	mn.reserved = true
+	return &net.VMStartedBuildResponse{TeardownSpec: &net.TeardownSpec{}}, nil
+}
+
+func (mn *dhcpNetMock) VMTerminatedTeardown(*net.VMTerminatedTeardownRequest) (*net.VMTerminatedTeardownResponse, error) {
+	mn.lock.Lock()
+	defer mn.lock.Unlock()
+
+	mn.recorder.record("teardown")
+	mn.reserved = false
+	return &net.VMTerminatedTeardownResponse{}, nil
+}
+
+func (mn *dhcpNetMock) isReserved() bool {
+	mn.lock.Lock()
+	defer mn.lock.Unlock()
+
+	return mn.reserved
+}
+
+// dhcpGuestMock is a virtualizer whose guest is addressed over DHCP, so it
+// only becomes ready once its address is reserved.
+type dhcpGuestMock struct {
+	mockVirtualizar
+
+	recorder *callRecorder
+	net      *dhcpNetMock
+	err      error
+}
+
+func (mv *dhcpGuestMock) CreateDomain(config *domain.Config, env map[string]string) error {
+	mv.recorder.record("create")
+	return mv.mockVirtualizar.CreateDomain(config, env)
+}
+
+func (mv *dhcpGuestMock) DestroyDomain(name string) error {
+	mv.recorder.record("destroy")
+	return mv.mockVirtualizar.DestroyDomain(name)
+}
+
+func (mv *dhcpGuestMock) GetNetworkInterfaces(name string) ([]domain.NetworkInterface, error) {
+	return []domain.NetworkInterface{{DeviceName: "tap0", MAC: "52:54:00:12:34:56"}}, nil
+}
+
+func (mv *dhcpGuestMock) WaitDomainReady(ctx context.Context, name string) error {
+	mv.recorder.record("wait")
+	if !mv.net.isReserved() {
+		return errors.New("guest has no DHCP lease")
+	}
+	return mv.err
+}
+
+// newStartTaskDriver returns a driver using the passed virtualizer and
+// network controller, without the Cloud Hypervisor binary SetConfig needs.
+func newStartTaskDriver(t *testing.T, v *dhcpGuestMock, dataDir string) *VirtDriverPlugin {
+	d := NewPlugin(testlog.HCLogger(t)).(*VirtDriverPlugin)
+	t.Cleanup(d.signalShutdown)
+
+	d.config = &Config{ImagePaths: []string{dataDir}}
+	d.dataDir = dataDir
+	d.imageHandler = &mockImageHandler{imageFormat: "raw"}
+	d.virtualizer = v
+	d.taskGetter = v
+	d.networkController = v.net
+	return d
+}
+
+func TestVirtDriver_StartTask_ReadinessAfterNetwork(t *testing.T) {
+	ci.Parallel(t)
+
+	testCases := []struct {
+		name          string
+		readyErr      error
+		expectedErr   string
+		expectedCalls []string
+	}{
+		{
+			name:          "ready",
+			expectedCalls: []string{"create", "build", "wait"},
+		},
+		{
+			name:          "not ready",
+			readyErr:      errors.New("timed out"),
+			expectedErr:   "not ready: timed out",
+			expectedCalls: []string{"create", "build", "wait", "destroy", "teardown"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+
+			taskCfg := newTaskConfig(t, createUniqueRootfsImage(t, tempDir))
+			taskCfg.Readiness = &ReadinessConfig{Serial: "login:"}
+
+			allocID := uuid.Generate()
+			task := &drivers.TaskConfig{
+				ID:        fmt.Sprintf("%s/%s/%s", allocID[:7], "task-name", "0000000"),
+				AllocID:   allocID,
+				Resources: createBasicResources(),
+			}
+			must.NoError(t, task.EncodeConcreteDriverConfig(&taskCfg))
+
+			recorder := &callRecorder{}
+			v := &dhcpGuestMock{
+				recorder: recorder,
+				net:      &dhcpNetMock{recorder: recorder},
+				err:      tc.readyErr,
+			}
+			d := newStartTaskDriver(t, v, tempDir)
+
+			_, _, err := d.StartTask(task)
+			if tc.expectedErr != "" {
+				must.ErrorContains(t, err, tc.expectedErr)
+				must.False(t, v.net.isReserved())
+			} else {
+				must.NoError(t, err)
+			}
+			must.Eq(t, tc.expectedCalls, recorder.getCalls())
+		})
+	}
+}
+
+func TestVirtDriver_RecoverTask_RestoresHandle(t *testing.T) {
+	ci.Parallel(t)
+
+	tempDir := t.TempDir()
+
+	taskCfg := newTaskConfig(t, createUniqueRootfsImage(t, tempDir))
+	taskCfg.PVPanic = true
+	taskCfg.FailOnPanic = true
+
+	allocID := uuid.Generate()
+	task := &drivers.TaskConfig{
+		ID:        fmt.Sprintf("%s/%s/%s", allocID[:7], "task-name", "0000000"),
+		AllocID:   allocID,
+		Resources: createBasicResources(),
+	}
+	must.NoError(t, task.EncodeConcreteDriverConfig(&taskCfg))
+
+	recorder := &callRecorder{}
+	v := &dhcpGuestMock{
+		mockVirtualizar: mockVirtualizar{count: 1},
+		recorder:        recorder,
+		net:             &dhcpNetMock{recorder: recorder},
+	}
+	started, _, err := newStartTaskDriver(t, v, tempDir).StartTask(task)
+	must.NoError(t, err)
+
+	// The client state does not keep the raw driver config of the task, so
+	// the handle is recovered from its driver state alone.
+	var buf []byte
+	must.NoError(t, base.MsgPackEncode(&buf, started))
+	handle := &drivers.TaskHandle{}
+	must.NoError(t, base.MsgPackDecode(buf, handle))
+	must.ErrorIs(t, handle.Config.DecodeDriverConfig(&TaskConfig{}), io.EOF)
+
+	// The VM rebooted twice before the plugin restarted.
+	d := newStartTaskDriver(t, v, tempDir)
+	rebootsPath := d.rebootsPath(domainNameFromTaskID(task.ID))
+	must.NoError(t, os.WriteFile(rebootsPath, []byte("2"), 0o600))
+
+	must.NoError(t, d.RecoverTask(handle))
+
+	h, ok := d.tasks.Get(task.ID)
+	must.True(t, ok)
+	must.True(t, h.failOnPanic)
+	must.Eq(t, "2", h.TaskStatus().DriverAttributes["reboots"])
+
+	// Reboots of the recovered VM are added to the restored count.
+	h.handleEvent(domain.Event{Source: "vm", Event: "rebooted"}, nil)
+	reboots, err := loadReboots(rebootsPath)
+	must.NoError(t, err)
+	must.Eq(t, 3, reboots)
+
+	must.NoError(t, d.DestroyTask(task.ID, true))
+	_, err = os.Stat(rebootsPath)
+	must.ErrorIs(t, err, os.ErrNotExist)
+}
+
 func TestVirtDriver_ImageOptions(t *testing.T) {
 	ci.Parallel(t)
 
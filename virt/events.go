@@ -0,0 +1,82 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package virt
+
+import (
+	"fmt"
+	"time"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// phaseDescriptions are the task event messages of the phases of starting a
+// VM, once completed.
+var phaseDescriptions = map[domain.Phase]string{
+	domain.PhaseImageResolved:       "Image resolved",
+	domain.PhaseThinCopyCreated:     "Thin copy created",
+	domain.PhaseCloudInitBuilt:      "Cloud-init built",
+	domain.PhaseTAPCreated:          "TAP created",
+	domain.PhaseVirtiofsdStarted:    "Virtiofsd started",
+	domain.PhaseVMMStarted:          "VMM started",
+	domain.PhaseVMBooted:            "VM booted",
+	domain.PhaseNetworkRulesApplied: "Network rules applied",
+	domain.PhaseGuestReady:          "Guest ready",
+}
+
+// phaseReporter returns the reporter emitting a task event as each phase of
+// starting the VM of the task completes, carrying its duration, or the error
+// it failed with.
+func (d *VirtDriverPlugin) phaseReporter(cfg *drivers.TaskConfig) domain.PhaseReporter {
+	return func(phase domain.Phase, duration time.Duration, err error) {
+		description, ok := phaseDescriptions[phase]
+		if !ok {
+			description = string(phase)
+		}
+
+		// Durations are rounded, as sub-millisecond precision is noise
+		// within the task events.
+		duration = duration.Round(time.Millisecond)
+
+		event := &drivers.TaskEvent{
+			TaskID:    cfg.ID,
+			AllocID:   cfg.AllocID,
+			TaskName:  cfg.Name,
+			Timestamp: time.Now(),
+			Annotations: map[string]string{
+				"phase":    string(phase),
+				"duration": duration.String(),
+			},
+		}
+		if err != nil {
+			event.Message = fmt.Sprintf("Failed at phase %q after %s: %v", description, duration, err)
+			event.Err = err
+		} else {
+			event.Message = fmt.Sprintf("%s in %s", description, duration)
+		}
+
+		if err := d.eventer.EmitEvent(event); err != nil {
+			d.logger.Warn("failed to emit task event", "task", cfg.Name, "phase", phase, "error", err)
+		}
+	}
+}
+
+// emitEvent emits a task event of the task of the handle.
+func (h *taskHandle) emitEvent(message string, annotations map[string]string) {
+	if h.eventer == nil {
+		return
+	}
+
+	event := &drivers.TaskEvent{
+		TaskID:      h.taskConfig.ID,
+		AllocID:     h.taskConfig.AllocID,
+		TaskName:    h.taskConfig.Name,
+		Timestamp:   time.Now(),
+		Message:     message,
+		Annotations: annotations,
+	}
+	if err := h.eventer.EmitEvent(event); err != nil {
+		h.logger.Warn("failed to emit task event", "task", h.name, "error", err)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package virt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/shoenig/test/must"
+)
+
+func Test_PhaseReporter(t *testing.T) {
+	d := NewPlugin(hclog.NewNullLogger()).(*VirtDriverPlugin)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := d.TaskEvents(ctx)
+	must.NoError(t, err)
+
+	cfg := &drivers.TaskConfig{ID: "task-id", AllocID: "alloc-id", Name: "web"}
+	report := d.phaseReporter(cfg)
+
+	nextEvent := func() *drivers.TaskEvent {
+		t.Helper()
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for task event")
+			return nil
+		}
+	}
+
+	report(domain.PhaseVMBooted, 1234567*time.Microsecond, nil)
+	event := nextEvent()
+	must.Eq(t, "task-id", event.TaskID)
+	must.Eq(t, "alloc-id", event.AllocID)
+	must.Eq(t, "web", event.TaskName)
+	must.Eq(t, "VM booted in 1.235s", event.Message)
+	must.Eq(t, "vm_booted", event.Annotations["phase"])
+	must.Eq(t, "1.235s", event.Annotations["duration"])
+	must.NoError(t, event.Err)
+
+	// Failures name the phase which failed.
+	bootErr := errors.New("no space left on device")
+	err = report.Run(domain.PhaseCloudInitBuilt, func() error { return bootErr })
+	must.ErrorIs(t, err, bootErr)
+	event = nextEvent()
+	must.StrHasPrefix(t, `Failed at phase "Cloud-init built" after `, event.Message)
+	must.StrContains(t, event.Message, "no space left on device")
+	must.ErrorIs(t, event.Err, bootErr)
+}
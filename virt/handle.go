@@ -5,7 +5,11 @@ package virt
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,13 +17,24 @@ import (
 	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
 
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/client/lib/cpustats"
 	"github.com/hashicorp/nomad/client/structs"
+	"github.com/hashicorp/nomad/drivers/shared/eventer"
 	"github.com/hashicorp/nomad/plugins/drivers"
 )
 
 var (
 	defaultMonitorInterval = time.Second
 	defaultStatsInterval   = time.Second
+
+	// defaultReconcileInterval is the interval the state of a VM is polled
+	// at when its events are available, as a safety net for missed events.
+	defaultReconcileInterval = 30 * time.Second
+
+	// measuredMemStats and measuredCPUStats are the stats sampled from the
+	// host processes backing a VM.
+	measuredMemStats = []string{"RSS", "Swap", "Usage", "Max Usage"}
+	measuredCPUStats = []string{"System Mode", "User Mode", "Percent", "Total Ticks"}
 )
 
 // taskHandle should store all relevant runtime information
@@ -39,9 +54,43 @@ type taskHandle struct {
 
 	taskGetter DomainGetter
 
+	// eventSource reports the events of the VM, if supported by the
+	// virtualizer, which trigger an immediate check of its state.
+	eventSource DomainEventSource
+
+	// eventer emits the task events of reboots and guest panics, which fail
+	// the task if failOnPanic is set. reboots counts the reboots of the VM,
+	// and is guarded by stateLock. It is saved at rebootsPath, so the count
+	// survives restarts of the plugin.
+	eventer     *eventer.Eventer
+	failOnPanic bool
+	reboots     int
+	rebootsPath string
+
+	// description describes the host resources backing the VM, if supported
+	// by the virtualizer, taken once the task has started. imagePath is the
+	// image the VM was started from, and imageDigest its digest once
+	// computed, guarded by stateLock.
+	description *domain.Description
+	imagePath   string
+	imageDigest string
+
 	// netTeardown is the specification used to delete all the network
 	// configuration associated to a VM.
 	netTeardown *net.TeardownSpec
+
+	// compute is the CPU capacity of the node, which CPU usage is reported
+	// against. cpuTrackers tracks the CPU usage of each host process of the
+	// VM between samples, keyed by PID, and is guarded by statsLock.
+	compute     cpustats.Compute
+	statsLock   sync.Mutex
+	cpuTrackers map[string]*cpuTracker
+
+	// counters is the last sample of the VM device counters, and usage the
+	// last resource usage, which are exported as metrics. They are guarded
+	// by statsLock.
+	counters map[string]map[string]uint64
+	usage    *structs.ResourceUsage
 }
 
 func (h *taskHandle) TaskStatus() *drivers.TaskStatus {
@@ -54,7 +103,7 @@ func (h *taskHandle) TaskStatus() *drivers.TaskStatus {
 		State:            h.procState,
 		StartedAt:        h.startedAt,
 		CompletedAt:      h.completedAt,
-		DriverAttributes: map[string]string{},
+		DriverAttributes: h.driverAttributes(),
 		ExitResult:       h.exitResult.Copy(),
 	}
 }
@@ -69,7 +118,15 @@ func (h *taskHandle) GetStats() (*drivers.TaskResourceUsage, error) {
 		return nil, fmt.Errorf("virt: task not found %s: %w", h.name, drivers.ErrTaskNotFound)
 	}
 
-	return fillStats(domain), nil
+	return h.fillStats(domain), nil
+}
+
+// lastSample returns the resource usage and device counters of the VM last
+// sampled by its task stats.
+func (h *taskHandle) lastSample() (*structs.ResourceUsage, map[string]map[string]uint64) {
+	h.statsLock.Lock()
+	defer h.statsLock.Unlock()
+	return h.usage, h.counters
 }
 
 func (h *taskHandle) IsRunning() bool {
@@ -80,41 +137,132 @@ func (h *taskHandle) IsRunning() bool {
 
 // Run is in charge of monitoring and updating the task status. It  will only return
 // when the task is stopped or no longer present or when the context is cancelled.
+// The task state is checked on each event of the VM, and polled as a safety
+// net, or at the monitor interval when its events are not available.
 func (h *taskHandle) monitor(ctx context.Context, exitCh chan<- *drivers.ExitResult) {
+	interval := defaultMonitorInterval
+
+	var events <-chan domain.Event
+	if h.eventSource != nil {
+		if ch, unsubscribe := h.eventSource.SubscribeDomain(h.name); ch != nil {
+			defer unsubscribe()
+			events = ch
+			interval = defaultReconcileInterval
+		}
+	}
 
-	ticker := time.NewTicker(defaultMonitorInterval)
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			domain, err := h.taskGetter.GetDomain(h.name)
-			if err != nil {
-				h.logger.Error("virt: unable to get task state", "task", h.name, "error", err)
-				h.stateLock.Lock()
-				h.procState = drivers.TaskStateUnknown
-				h.stateLock.Unlock()
-
-				continue
+		case event, ok := <-events:
+			if !ok {
+				// The events end once the VMM exits, so only polling remains.
+				events = nil
+				ticker.Reset(defaultMonitorInterval)
+			} else {
+				h.logger.Debug("received VM event", "task", h.name, "source", event.Source, "event", event.Event)
+				if h.handleEvent(event, exitCh) {
+					return
+				}
 			}
+		case <-ctx.Done():
+			return
+		}
 
-			if domain == nil || domain.State != "running" {
-				er := fillExitResult(domain)
+		if h.checkDomain(exitCh) {
+			return
+		}
+	}
+}
 
-				h.stateLock.Lock()
-				h.procState = drivers.TaskStateExited
-				h.completedAt = time.Now()
-				h.exitResult = er
-				h.stateLock.Unlock()
+// checkDomain updates the task state from the state of the VM, and sends the
+// exit result if it is no longer running, in which case it returns true.
+func (h *taskHandle) checkDomain(exitCh chan<- *drivers.ExitResult) bool {
+	domain, err := h.taskGetter.GetDomain(h.name)
+	if err != nil {
+		h.logger.Error("virt: unable to get task state", "task", h.name, "error", err)
+		h.stateLock.Lock()
+		h.procState = drivers.TaskStateUnknown
+		h.stateLock.Unlock()
 
-				exitCh <- er
-				return
-			}
+		return false
+	}
 
-		case <-ctx.Done():
-			return
+	if domain == nil || domain.State != "running" {
+		er := fillExitResult(domain)
+
+		h.stateLock.Lock()
+		h.procState = drivers.TaskStateExited
+		h.completedAt = time.Now()
+		h.exitResult = er
+		h.stateLock.Unlock()
+
+		exitCh <- er
+		return true
+	}
+
+	return false
+}
+
+// handleEvent reacts to a lifecycle event of the VM, emitting task events for
+// reboots and guest panics. It returns true if the task has exited, which
+// happens on a guest panic if the task fails on panics.
+func (h *taskHandle) handleEvent(event domain.Event, exitCh chan<- *drivers.ExitResult) bool {
+	switch {
+	case event.Source == "vm" && event.Event == "rebooted":
+		h.stateLock.Lock()
+		h.reboots++
+		reboots := h.reboots
+		h.stateLock.Unlock()
+
+		h.saveReboots(reboots)
+		h.emitEvent("VM rebooted", map[string]string{"reboots": strconv.Itoa(reboots)})
+
+	case event.Source == "guest" && event.Event == "panic":
+		h.logger.Warn("guest kernel panicked", "task", h.name, "event", event.Properties["event"])
+		h.emitEvent("Guest kernel panicked", map[string]string{"event": event.Properties["event"]})
+
+		if h.failOnPanic {
+			er := &drivers.ExitResult{ExitCode: 1, Err: ErrTaskCrashed}
+
+			h.stateLock.Lock()
+			h.procState = drivers.TaskStateExited
+			h.completedAt = time.Now()
+			h.exitResult = er
+			h.stateLock.Unlock()
+
+			exitCh <- er
+			return true
 		}
 	}
+
+	return false
+}
+
+// saveReboots saves the reboot count of the VM, so it can be restored once
+// the task is recovered.
+func (h *taskHandle) saveReboots(reboots int) {
+	if h.rebootsPath == "" {
+		return
+	}
+	if err := os.WriteFile(h.rebootsPath, []byte(strconv.Itoa(reboots)), 0o600); err != nil {
+		h.logger.Warn("failed to save VM reboots", "task", h.name, "error", err)
+	}
+}
+
+// loadReboots returns the reboot count saved at the path, which is zero if
+// the VM has not rebooted.
+func loadReboots(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
 }
 
 func fillExitResult(info *domain.Info) *drivers.ExitResult {
@@ -130,8 +278,23 @@ func fillExitResult(info *domain.Info) *drivers.ExitResult {
 	case "crashed":
 		er.ExitCode = 1
 		er.Err = ErrTaskCrashed
+
+		// A VMM which exited on its own reports how it exited.
+		if exit := info.Exit; exit != nil && !exit.Stopped {
+			if exit.ExitCode > 0 {
+				er.ExitCode = exit.ExitCode
+			}
+			er.Signal = exit.Signal
+			er.OOMKilled = exit.OOMKilled
+		}
 	case "shutdown", "shutoff":
 		er.ExitCode = 0
+
+		// The guest may report the exit code of its workload, so batch
+		// jobs can fail.
+		if info.GuestExitCode != nil {
+			er.ExitCode = *info.GuestExitCode
+		}
 	default:
 		er.ExitCode = 1
 		er.Err = fmt.Errorf("unexpected state: %s", info.State)
@@ -140,17 +303,99 @@ func fillExitResult(info *domain.Info) *drivers.ExitResult {
 	return er
 }
 
-func fillStats(info *domain.Info) *structs.TaskResourceUsage {
-	return &structs.TaskResourceUsage{
-		Timestamp: time.Now().UnixNano(),
-		ResourceUsage: &structs.ResourceUsage{
+// fillStats converts the usage of the host processes backing the VM into
+// the usage of the task, which is their sum, and of each process. CPU usage
+// is computed from the change in CPU time since the previous sample. If the
+// processes could not be read, the guest memory is reported instead.
+func (h *taskHandle) fillStats(info *domain.Info) *structs.TaskResourceUsage {
+	h.statsLock.Lock()
+	defer h.statsLock.Unlock()
+
+	if h.cpuTrackers == nil {
+		h.cpuTrackers = make(map[string]*cpuTracker)
+	}
+
+	usage := &structs.ResourceUsage{
+		MemoryStats: &structs.MemoryStats{},
+		CpuStats:    &structs.CpuStats{},
+	}
+	pids := make(map[string]*structs.ResourceUsage, len(info.Processes))
+
+	for pid, proc := range info.Processes {
+		tracker, ok := h.cpuTrackers[pid]
+		if !ok {
+			tracker = newCPUTracker(h.compute)
+			h.cpuTrackers[pid] = tracker
+		}
+
+		pids[pid] = &structs.ResourceUsage{
 			MemoryStats: &structs.MemoryStats{
-				Usage:    info.Memory,
-				MaxUsage: info.MaxMemory,
+				RSS:      proc.RSS,
+				Swap:     proc.Swap,
+				Usage:    proc.RSS,
+				MaxUsage: proc.MaxRSS,
+				Measured: measuredMemStats,
 			},
-			CpuStats: &structs.CpuStats{
-				ThrottledTime: info.CPUTime,
-			},
-		},
+			CpuStats: tracker.stats(proc.UserTime, proc.SystemTime),
+		}
+		usage.Add(pids[pid])
+	}
+
+	// Forget processes which have exited, such as a restarted virtiofsd.
+	for pid := range h.cpuTrackers {
+		if _, ok := info.Processes[pid]; !ok {
+			delete(h.cpuTrackers, pid)
+		}
+	}
+
+	if len(pids) == 0 {
+		usage.MemoryStats.Usage = info.Memory
+		usage.MemoryStats.MaxUsage = info.MaxMemory
+		usage.MemoryStats.Measured = []string{"Usage", "Max Usage"}
+	}
+
+	// The device counters are only exported as metrics, as Nomad does not
+	// forward the device statistics of driver plugins.
+	h.counters = info.Counters
+	h.usage = usage
+
+	return &structs.TaskResourceUsage{
+		Timestamp:     time.Now().UnixNano(),
+		ResourceUsage: usage,
+		Pids:          pids,
+	}
+}
+
+// cpuTracker tracks the CPU usage of a process between samples.
+type cpuTracker struct {
+	compute cpustats.Compute
+	total   *cpustats.Tracker
+	user    *cpustats.Tracker
+	system  *cpustats.Tracker
+}
+
+func newCPUTracker(compute cpustats.Compute) *cpuTracker {
+	return &cpuTracker{
+		compute: compute,
+		total:   cpustats.New(compute),
+		user:    cpustats.New(compute),
+		system:  cpustats.New(compute),
+	}
+}
+
+// stats returns the CPU usage of the process since the previous sample,
+// given its CPU times in nanoseconds. The first sample reports no usage.
+func (t *cpuTracker) stats(userTime, systemTime uint64) *structs.CpuStats {
+	cs := &structs.CpuStats{
+		SystemMode: t.system.Percent(float64(systemTime)),
+		UserMode:   t.user.Percent(float64(userTime)),
+		Percent:    t.total.Percent(float64(userTime + systemTime)),
+		Measured:   measuredCPUStats,
+	}
+
+	// Ticks can only be computed once the node compute is known.
+	if t.compute.NumCores > 0 {
+		cs.TotalTicks = t.total.TicksConsumed(cs.Percent)
 	}
+	return cs
 }
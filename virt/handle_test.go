@@ -13,6 +13,7 @@ import (
 	domain "github.com/ccheshirecat/nomad-driver-ch/internal/shared"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad/client/structs"
+	"github.com/hashicorp/nomad/drivers/shared/eventer"
 	"github.com/hashicorp/nomad/plugins/drivers"
 	"github.com/shoenig/test/must"
 )
@@ -62,8 +63,37 @@ func Test_GetStats(t *testing.T) {
 			},
 			expectedResult: &drivers.TaskResourceUsage{
 				ResourceUsage: &structs.ResourceUsage{
-					MemoryStats: &structs.MemoryStats{Usage: 666, MaxUsage: 6666},
-					CpuStats:    &structs.CpuStats{ThrottledTime: 66},
+					MemoryStats: &structs.MemoryStats{
+						Usage:    666,
+						MaxUsage: 6666,
+						Measured: []string{"Usage", "Max Usage"},
+					},
+					CpuStats: &structs.CpuStats{},
+				},
+			},
+		},
+		{
+			name: "process_stats_returned",
+			info: &domain.Info{
+				State:   "running",
+				Memory:  666,
+				CPUTime: 66,
+				Processes: map[string]domain.ProcessStats{
+					"100": {UserTime: 40, SystemTime: 20, RSS: 600, MaxRSS: 700, Swap: 10},
+					"101": {UserTime: 4, SystemTime: 2, RSS: 60, MaxRSS: 70},
+				},
+			},
+			expectedResult: &drivers.TaskResourceUsage{
+				ResourceUsage: &structs.ResourceUsage{
+					MemoryStats: &structs.MemoryStats{
+						RSS:      660,
+						Swap:     10,
+						Usage:    660,
+						MaxUsage: 770,
+						Measured: measuredMemStats,
+					},
+					// The first sample has no previous CPU time to compare.
+					CpuStats: &structs.CpuStats{Measured: measuredCPUStats},
 				},
 			},
 		},
@@ -165,3 +195,217 @@ func Test_Monitor(t *testing.T) {
 	must.Eq(t, drivers.TaskStateExited, th.procState)
 	th.stateLock.Unlock()
 }
+
+type eventSourceMock struct {
+	events       chan domain.Event
+	unsubscribed chan struct{}
+}
+
+func (esm *eventSourceMock) SubscribeDomain(name string) (<-chan domain.Event, func()) {
+	return esm.events, func() { close(esm.unsubscribed) }
+}
+
+func Test_Monitor_Events(t *testing.T) {
+	dgm := &domainGetterMock{
+		info: &domain.Info{
+			State: "running",
+		},
+	}
+	esm := &eventSourceMock{
+		events:       make(chan domain.Event, 1),
+		unsubscribed: make(chan struct{}),
+	}
+
+	th := &taskHandle{
+		logger:      hclog.NewNullLogger(),
+		name:        "test-domain",
+		taskGetter:  dgm,
+		eventSource: esm,
+		procState:   drivers.TaskStateRunning,
+	}
+
+	exitChannel := make(chan *drivers.ExitResult, 1)
+	defer close(exitChannel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go th.monitor(ctx, exitChannel)
+
+	// An event which leaves the VM running does not end the task.
+	esm.events <- domain.Event{Source: "vm", Event: "rebooted"}
+	time.Sleep(100 * time.Millisecond)
+	must.Zero(t, len(exitChannel))
+
+	// The state is checked on each event, well before the next poll.
+	dgm.lock.Lock()
+	dgm.info.State = "shutoff"
+	dgm.lock.Unlock()
+	esm.events <- domain.Event{Source: "vm", Event: "shutdown"}
+
+	select {
+	case res := <-exitChannel:
+		must.Zero(t, res.ExitCode)
+	case <-time.After(defaultMonitorInterval / 2):
+		t.Fatal("expected exit result after event")
+	}
+
+	select {
+	case <-esm.unsubscribed:
+	case <-time.After(time.Second):
+		t.Fatal("expected subscription to end")
+	}
+}
+
+func Test_Monitor_EventsEnd(t *testing.T) {
+	dgm := &domainGetterMock{
+		info: &domain.Info{
+			State: "crashed",
+		},
+	}
+	esm := &eventSourceMock{
+		events:       make(chan domain.Event),
+		unsubscribed: make(chan struct{}),
+	}
+
+	th := &taskHandle{
+		logger:      hclog.NewNullLogger(),
+		name:        "test-domain",
+		taskGetter:  dgm,
+		eventSource: esm,
+		procState:   drivers.TaskStateRunning,
+	}
+
+	exitChannel := make(chan *drivers.ExitResult, 1)
+	defer close(exitChannel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go th.monitor(ctx, exitChannel)
+
+	// The events ending, as the VMM exited, triggers a check of the state.
+	close(esm.events)
+
+	select {
+	case res := <-exitChannel:
+		must.Eq(t, ErrTaskCrashed, res.Err)
+	case <-time.After(defaultMonitorInterval / 2):
+		t.Fatal("expected exit result after events ended")
+	}
+}
+
+func Test_Monitor_RebootsAndPanics(t *testing.T) {
+	dgm := &domainGetterMock{
+		info: &domain.Info{
+			State: "running",
+		},
+	}
+	esm := &eventSourceMock{
+		events:       make(chan domain.Event, 1),
+		unsubscribed: make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	e := eventer.NewEventer(ctx, hclog.NewNullLogger())
+	taskEvents, err := e.TaskEvents(ctx)
+	must.NoError(t, err)
+
+	th := &taskHandle{
+		logger:      hclog.NewNullLogger(),
+		taskConfig:  &drivers.TaskConfig{ID: "task-id", AllocID: "alloc-id", Name: "web"},
+		name:        "test-domain",
+		taskGetter:  dgm,
+		eventSource: esm,
+		eventer:     e,
+		failOnPanic: true,
+		procState:   drivers.TaskStateRunning,
+	}
+
+	exitChannel := make(chan *drivers.ExitResult, 1)
+	defer close(exitChannel)
+
+	go th.monitor(ctx, exitChannel)
+
+	nextEvent := func() *drivers.TaskEvent {
+		t.Helper()
+		select {
+		case event := <-taskEvents:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for task event")
+			return nil
+		}
+	}
+
+	// Reboots are counted, leaving the task running.
+	esm.events <- domain.Event{Source: "vm", Event: "rebooted"}
+	event := nextEvent()
+	must.Eq(t, "VM rebooted", event.Message)
+	must.Eq(t, "1", event.Annotations["reboots"])
+
+	esm.events <- domain.Event{Source: "vm", Event: "rebooted"}
+	event = nextEvent()
+	must.Eq(t, "2", event.Annotations["reboots"])
+
+	status := th.TaskStatus()
+	must.Eq(t, drivers.TaskStateRunning, status.State)
+	must.Eq(t, "2", status.DriverAttributes["reboots"])
+	must.Zero(t, len(exitChannel))
+
+	// A guest panic fails the task.
+	esm.events <- domain.Event{Source: "guest", Event: "panic", Properties: map[string]string{"event": "panicked"}}
+	event = nextEvent()
+	must.Eq(t, "Guest kernel panicked", event.Message)
+	must.Eq(t, "panicked", event.Annotations["event"])
+
+	select {
+	case res := <-exitChannel:
+		must.Eq(t, ErrTaskCrashed, res.Err)
+		must.One(t, res.ExitCode)
+	case <-time.After(defaultMonitorInterval / 2):
+		t.Fatal("expected exit result after guest panic")
+	}
+	must.Eq(t, drivers.TaskStateExited, th.TaskStatus().State)
+}
+
+func Test_FillExitResult(t *testing.T) {
+	// A VMM killed by the OOM killer reports the signal it received.
+	er := fillExitResult(&domain.Info{
+		State: "crashed",
+		Exit:  &domain.ProcessExit{ExitCode: 137, Signal: 9, OOMKilled: true},
+	})
+	must.Eq(t, 137, er.ExitCode)
+	must.Eq(t, 9, er.Signal)
+	must.True(t, er.OOMKilled)
+	must.Eq(t, ErrTaskCrashed, er.Err)
+
+	// A VMM which crashed without exiting non-zero still fails the task.
+	er = fillExitResult(&domain.Info{
+		State: "crashed",
+		Exit:  &domain.ProcessExit{},
+	})
+	must.One(t, er.ExitCode)
+
+	// A VMM killed by the driver is not reported as crashing.
+	er = fillExitResult(&domain.Info{
+		State: "shutoff",
+		Exit:  &domain.ProcessExit{ExitCode: 137, Signal: 9, Stopped: true},
+	})
+	must.Zero(t, er.ExitCode)
+	must.Zero(t, er.Signal)
+	must.NoError(t, er.Err)
+
+	// A guest which powered off reports the exit code of its workload.
+	exitCode := 3
+	er = fillExitResult(&domain.Info{
+		State:         "shutoff",
+		Exit:          &domain.ProcessExit{},
+		GuestExitCode: &exitCode,
+	})
+	must.Eq(t, 3, er.ExitCode)
+	must.NoError(t, er.Err)
+	must.False(t, er.Successful())
+}
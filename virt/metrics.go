@@ -0,0 +1,303 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package virt
+
+import (
+	"errors"
+	"fmt"
+	stdnet "net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// metricsNamespace prefixes the names of all the metrics of the driver.
+	metricsNamespace = "nomad_driver_ch"
+
+	// metricsUnixPrefix prefixes metrics addresses which are Unix sockets.
+	metricsUnixPrefix = "unix:"
+
+	// metricsPath is the HTTP path the metrics are served on.
+	metricsPath = "/metrics"
+)
+
+var (
+	// vmLabels are the labels of the per-VM metrics, and vmDeviceLabels
+	// those of the per-VM device metrics.
+	vmLabels       = []string{"alloc_id", "task", "vm"}
+	vmDeviceLabels = append(vmLabels[:len(vmLabels):len(vmLabels)], "device", "direction")
+
+	vmsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "vms"),
+		"Number of VMs tracked by the driver, by task state.",
+		[]string{"state"}, nil,
+	)
+	firewallRulesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "firewall", "rules"),
+		"Number of firewall rules installed for running VMs, by firewall backend.",
+		[]string{"backend"}, nil,
+	)
+	vmCPUPercentDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "vm", "cpu_percent"),
+		"CPU usage of the host processes of the VM, as a percentage of a core.",
+		vmLabels, nil,
+	)
+	vmMemoryRSSDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "vm", "memory_rss_bytes"),
+		"Resident set size of the host processes of the VM.",
+		vmLabels, nil,
+	)
+	vmMemoryUsageDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "vm", "memory_usage_bytes"),
+		"Memory usage of the VM.",
+		vmLabels, nil,
+	)
+
+	// vmTaskStates are the task states VMs are counted by, so each is
+	// reported even when no VM is in the state.
+	vmTaskStates = []drivers.TaskState{drivers.TaskStateRunning, drivers.TaskStateExited, drivers.TaskStateUnknown}
+
+	// durationBuckets are the buckets of the VM lifecycle duration
+	// histograms, in seconds.
+	durationBuckets = []float64{.1, .25, .5, 1, 2.5, 5, 10, 20, 30, 60, 120}
+)
+
+// pluginMetrics are the metrics recorded by the plugin as it operates, in
+// addition to those computed from its state when collected.
+type pluginMetrics struct {
+	bootDuration prometheus.Histogram
+	stopDuration prometheus.Histogram
+}
+
+func newPluginMetrics() *pluginMetrics {
+	return &pluginMetrics{
+		bootDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "vm",
+			Name:      "boot_duration_seconds",
+			Help:      "Time taken to create and boot VMs.",
+			Buckets:   durationBuckets,
+		}),
+		stopDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "vm",
+			Name:      "stop_duration_seconds",
+			Help:      "Time taken to stop VMs.",
+			Buckets:   durationBuckets,
+		}),
+	}
+}
+
+// newMetricsRegistry returns the registry of the metrics of the plugin,
+// which collects those of the virtualizer in use when scraped.
+func newMetricsRegistry(d *VirtDriverPlugin) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		newVMCollector(d.tasks),
+		d.pluginMetrics.bootDuration,
+		d.pluginMetrics.stopDuration,
+		&virtualizerCollector{d: d},
+	)
+	return registry
+}
+
+// virtualizerCollector collects the metrics of the virtualizer and network
+// controller, which are replaced each time the plugin is configured. As the
+// metrics are unknown until then, it is registered as an unchecked collector.
+type virtualizerCollector struct {
+	d *VirtDriverPlugin
+}
+
+// Describe implements prometheus.Collector.
+func (c *virtualizerCollector) Describe(chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (c *virtualizerCollector) Collect(ch chan<- prometheus.Metric) {
+	if collector, ok := c.d.virtualizer.(prometheus.Collector); ok {
+		collector.Collect(ch)
+	}
+	if collector, ok := c.d.networkController.(prometheus.Collector); ok {
+		collector.Collect(ch)
+	}
+}
+
+// vmCollector exports the state of the VMs and the resource usage last
+// sampled by their task stats.
+type vmCollector struct {
+	tasks *taskStore
+
+	// deviceMetrics are the metrics the VM device counters are exported as,
+	// keyed by their name within the VMM counters. Other counters, such as
+	// latencies, are not cumulative and are ignored.
+	deviceMetrics map[string]deviceMetric
+}
+
+// deviceMetric is the metric a VM device counter is exported as, and the
+// direction it counts.
+type deviceMetric struct {
+	desc      *prometheus.Desc
+	direction string
+}
+
+func newVMCollector(tasks *taskStore) *vmCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "vm", name), help, vmDeviceLabels, nil)
+	}
+	diskBytes := desc("disk_bytes_total", "Bytes read from and written to the VM disks.")
+	diskOps := desc("disk_ops_total", "Read and write operations performed on the VM disks.")
+	netBytes := desc("network_bytes_total", "Bytes received and transmitted by the VM network interfaces.")
+	netFrames := desc("network_frames_total", "Frames received and transmitted by the VM network interfaces.")
+
+	return &vmCollector{
+		tasks: tasks,
+		deviceMetrics: map[string]deviceMetric{
+			"read_bytes":  {desc: diskBytes, direction: "read"},
+			"write_bytes": {desc: diskBytes, direction: "write"},
+			"read_ops":    {desc: diskOps, direction: "read"},
+			"write_ops":   {desc: diskOps, direction: "write"},
+			"rx_bytes":    {desc: netBytes, direction: "rx"},
+			"tx_bytes":    {desc: netBytes, direction: "tx"},
+			"rx_frames":   {desc: netFrames, direction: "rx"},
+			"tx_frames":   {desc: netFrames, direction: "tx"},
+		},
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *vmCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- vmsDesc
+	ch <- firewallRulesDesc
+	ch <- vmCPUPercentDesc
+	ch <- vmMemoryRSSDesc
+	ch <- vmMemoryUsageDesc
+
+	seen := make(map[*prometheus.Desc]bool)
+	for _, metric := range c.deviceMetrics {
+		if !seen[metric.desc] {
+			seen[metric.desc] = true
+			ch <- metric.desc
+		}
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *vmCollector) Collect(ch chan<- prometheus.Metric) {
+	states := make(map[drivers.TaskState]int, len(vmTaskStates))
+	for _, state := range vmTaskStates {
+		states[state] = 0
+	}
+	rules := make(map[string]int)
+
+	for _, h := range c.tasks.List() {
+		var allocID, task string
+		if h.taskConfig != nil {
+			allocID, task = h.taskConfig.AllocID, h.taskConfig.Name
+		}
+
+		h.stateLock.RLock()
+		state := h.procState
+		h.stateLock.RUnlock()
+		states[state]++
+
+		if state == drivers.TaskStateRunning && h.netTeardown != nil {
+			// Specs which predate the firewall backend used iptables.
+			backend := h.netTeardown.FirewallBackend
+			if backend == "" {
+				backend = "iptables"
+			}
+			rules[backend] += len(h.netTeardown.IPTablesRules)
+		}
+
+		usage, counters := h.lastSample()
+		if usage != nil {
+			ch <- prometheus.MustNewConstMetric(vmCPUPercentDesc, prometheus.GaugeValue, usage.CpuStats.Percent, allocID, task, h.name)
+			ch <- prometheus.MustNewConstMetric(vmMemoryRSSDesc, prometheus.GaugeValue, float64(usage.MemoryStats.RSS), allocID, task, h.name)
+			ch <- prometheus.MustNewConstMetric(vmMemoryUsageDesc, prometheus.GaugeValue, float64(usage.MemoryStats.Usage), allocID, task, h.name)
+		}
+
+		for id, values := range counters {
+			for name, value := range values {
+				metric, ok := c.deviceMetrics[name]
+				if !ok {
+					continue
+				}
+				ch <- prometheus.MustNewConstMetric(metric.desc, prometheus.CounterValue, float64(value),
+					allocID, task, h.name, id, metric.direction)
+			}
+		}
+	}
+
+	for state, n := range states {
+		ch <- prometheus.MustNewConstMetric(vmsDesc, prometheus.GaugeValue, float64(n), string(state))
+	}
+	for backend, n := range rules {
+		ch <- prometheus.MustNewConstMetric(firewallRulesDesc, prometheus.GaugeValue, float64(n), backend)
+	}
+}
+
+// metricsListener opens the listener of the metrics endpoint. TCP addresses
+// must be on a loopback interface, as the endpoint is unauthenticated.
+func metricsListener(address string) (stdnet.Listener, error) {
+	if path, ok := strings.CutPrefix(address, metricsUnixPrefix); ok {
+		path = strings.TrimPrefix(path, "//")
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("metrics socket path %q must be absolute", path)
+		}
+
+		// Remove the socket left behind by a previous run of the plugin.
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove stale metrics socket: %w", err)
+		}
+		return stdnet.Listen("unix", path)
+	}
+
+	host, _, err := stdnet.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics address %q: %w", address, err)
+	}
+	if host != "localhost" {
+		if addr, err := netip.ParseAddr(host); err != nil || !addr.IsLoopback() {
+			return nil, fmt.Errorf("metrics address %q must be a loopback address or a Unix socket", address)
+		}
+	}
+	return stdnet.Listen("tcp", address)
+}
+
+// startMetricsServer serves the metrics of the plugin on the configured
+// address until the plugin is shut down. It only starts the server once,
+// as the plugin may be configured multiple times.
+func (d *VirtDriverPlugin) startMetricsServer() error {
+	if d.config.Metrics.Address == "" || d.metricsServer != nil {
+		return nil
+	}
+
+	listener, err := metricsListener(d.config.Metrics.Address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, promhttp.HandlerFor(d.metrics, promhttp.HandlerOpts{}))
+	d.metricsServer = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := d.metricsServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			d.logger.Error("metrics server failed", "error", err)
+		}
+	}()
+	go func() {
+		<-d.baseCtx.Done()
+		d.metricsServer.Close()
+	}()
+
+	d.logger.Info("serving metrics", "address", d.config.Metrics.Address)
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package virt
+
+import (
+	"io"
+	stdnet "net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ccheshirecat/nomad-driver-ch/virt/net"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/client/structs"
+	"github.com/hashicorp/nomad/plugins/drivers"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/shoenig/test/must"
+)
+
+// gatherMetrics returns the values of the metrics of the registry, keyed by
+// name followed by the label values, sorted by label name.
+func gatherMetrics(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	families, err := registry.Gather()
+	must.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			key := []string{family.GetName()}
+			for _, label := range metric.GetLabel() {
+				key = append(key, label.GetValue())
+			}
+
+			switch {
+			case metric.GetCounter() != nil:
+				values[strings.Join(key, "/")] = metric.GetCounter().GetValue()
+			case metric.GetGauge() != nil:
+				values[strings.Join(key, "/")] = metric.GetGauge().GetValue()
+			case metric.GetHistogram() != nil:
+				values[strings.Join(key, "/")] = float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return values
+}
+
+func Test_VMCollector(t *testing.T) {
+	tasks := newTaskStore()
+	tasks.Set("alloc-1/web/1", &taskHandle{
+		name:       "web-1",
+		taskConfig: &drivers.TaskConfig{AllocID: "alloc-1", Name: "web"},
+		procState:  drivers.TaskStateRunning,
+		netTeardown: &net.TeardownSpec{
+			IPTablesRules:   [][]string{{"nat", "PREROUTING"}, {"filter", "FORWARD"}},
+			FirewallBackend: "nftables",
+		},
+		usage: &structs.ResourceUsage{
+			MemoryStats: &structs.MemoryStats{RSS: 2048, Usage: 4096},
+			CpuStats:    &structs.CpuStats{Percent: 12.5},
+		},
+		counters: map[string]map[string]uint64{
+			"_disk0": {"read_bytes": 4096, "write_bytes": 1024, "read_latency_avg": 3},
+			"_net1":  {"rx_frames": 7},
+		},
+	})
+	tasks.Set("alloc-2/db/1", &taskHandle{
+		name:        "db-1",
+		taskConfig:  &drivers.TaskConfig{AllocID: "alloc-2", Name: "db"},
+		procState:   drivers.TaskStateExited,
+		netTeardown: &net.TeardownSpec{IPTablesRules: [][]string{{"nat", "PREROUTING"}}},
+	})
+
+	registry := prometheus.NewRegistry()
+	must.NoError(t, registry.Register(newVMCollector(tasks)))
+
+	must.Eq(t, map[string]float64{
+		"nomad_driver_ch_vms/running":                                        1,
+		"nomad_driver_ch_vms/exited":                                         1,
+		"nomad_driver_ch_vms/unknown":                                        0,
+		"nomad_driver_ch_firewall_rules/nftables":                            2,
+		"nomad_driver_ch_vm_cpu_percent/alloc-1/web/web-1":                   12.5,
+		"nomad_driver_ch_vm_memory_rss_bytes/alloc-1/web/web-1":              2048,
+		"nomad_driver_ch_vm_memory_usage_bytes/alloc-1/web/web-1":            4096,
+		"nomad_driver_ch_vm_disk_bytes_total/alloc-1/_disk0/read/web/web-1":  4096,
+		"nomad_driver_ch_vm_disk_bytes_total/alloc-1/_disk0/write/web/web-1": 1024,
+		"nomad_driver_ch_vm_network_frames_total/alloc-1/_net1/rx/web/web-1": 7,
+	}, gatherMetrics(t, registry))
+}
+
+func Test_MetricsRegistry(t *testing.T) {
+	d := NewPlugin(hclog.NewNullLogger()).(*VirtDriverPlugin)
+	d.pluginMetrics.bootDuration.Observe(1.5)
+
+	values := gatherMetrics(t, d.metrics)
+	must.Eq(t, 1, values["nomad_driver_ch_vm_boot_duration_seconds"])
+	must.Eq(t, 0, values["nomad_driver_ch_vm_stop_duration_seconds"])
+}
+
+func Test_MetricsListener(t *testing.T) {
+	for _, address := range []string{"0.0.0.0:0", "192.0.2.1:9100", "example.com:9100", "unix:relative.sock", "127.0.0.1"} {
+		t.Run(address, func(t *testing.T) {
+			_, err := metricsListener(address)
+			must.Error(t, err)
+		})
+	}
+
+	listener, err := metricsListener("127.0.0.1:0")
+	must.NoError(t, err)
+	must.NoError(t, listener.Close())
+
+	// Stale sockets are replaced.
+	path := filepath.Join(t.TempDir(), "metrics.sock")
+	for i := 0; i < 2; i++ {
+		listener, err = metricsListener("unix://" + path)
+		must.NoError(t, err)
+		must.Eq(t, "unix", listener.Addr().Network())
+		if ul, ok := listener.(*stdnet.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		must.NoError(t, listener.Close())
+	}
+}
+
+func Test_MetricsServer(t *testing.T) {
+	d := NewPlugin(hclog.NewNullLogger()).(*VirtDriverPlugin)
+	defer d.signalShutdown()
+
+	path := filepath.Join(t.TempDir(), "metrics.sock")
+	d.config.Metrics.Address = "unix:" + path
+	must.NoError(t, d.startMetricsServer())
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(string, string) (stdnet.Conn, error) { return stdnet.Dial("unix", path) },
+	}}
+	resp, err := client.Get("http://localhost" + metricsPath)
+	must.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	must.NoError(t, err)
+	must.Eq(t, http.StatusOK, resp.StatusCode)
+	must.StrContains(t, string(body), "nomad_driver_ch_vms{state=\"running\"} 0")
+}
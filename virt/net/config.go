@@ -4,10 +4,18 @@
 package net
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	stdnet "net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
 	"github.com/hashicorp/nomad/plugins/shared/hclspec"
 )
 
@@ -22,7 +30,272 @@ type NetworkInterfacesConfig []*NetworkInterfaceConfig
 // NetworkInterfaceConfig contains all the possible network interface options
 // that a VM currently supports via the Nomad driver.
 type NetworkInterfaceConfig struct {
-	Bridge *NetworkInterfaceBridgeConfig `codec:"bridge"`
+	Bridge  *NetworkInterfaceBridgeConfig `codec:"bridge"`
+	CNI     *NetworkInterfaceCNIConfig    `codec:"cni"`
+	Macvtap *NetworkInterfaceVtapConfig   `codec:"macvtap"`
+	IPVtap  *NetworkInterfaceVtapConfig   `codec:"ipvtap"`
+
+	// MAC is the MAC address of the guest interface, for software licensed
+	// to a specific address. It cannot be specified for CNI and ipvtap
+	// interfaces, whose address is chosen by the plugins or parent. If not
+	// specified, an address is allocated by the driver.
+	MAC string `codec:"mac"`
+
+	// RateLimit limits the traffic of the interface, whatever its type.
+	RateLimit *NetworkInterfaceRateLimitConfig `codec:"rate_limit"`
+
+	// NumQueues is the number of queue pairs of the virtio-net device, which
+	// is best matched to the number of vCPUs of high throughput VMs. If not
+	// specified, the device has a single queue pair.
+	NumQueues int `codec:"num_queues"`
+
+	// QueueSize is the size of each queue, which must be a power of two. If
+	// not specified, the hypervisor default is used.
+	QueueSize int `codec:"queue_size"`
+
+	// MTU is the MTU of the interface, which is set on the host device, any
+	// bridge it is attached to, and the guest. If not specified, the host
+	// device MTU is used.
+	MTU int `codec:"mtu"`
+
+	// OffloadTSO and OffloadCsum toggle TCP segmentation and checksum
+	// offload. If not specified, both are enabled.
+	OffloadTSO  *bool `codec:"offload_tso"`
+	OffloadCsum *bool `codec:"offload_csum"`
+}
+
+const (
+	// MaxQueueSize is the largest virtio-net queue size.
+	MaxQueueSize = 32768
+
+	// MinMTU and MaxMTU bound the MTU of an interface.
+	MinMTU = 68
+	MaxMTU = 65535
+)
+
+// validateTuning ensures the device queue, MTU and offload settings are
+// valid for the interface type.
+func (n *NetworkInterfaceConfig) validateTuning() error {
+	var mErr multierror.Error
+
+	if n.NumQueues < 0 {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("num_queues %d must not be negative", n.NumQueues))
+	}
+	if kind, vtap := n.Vtap(); vtap != nil && n.NumQueues > 1 {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("num_queues is not supported by %s interfaces", kind))
+	}
+	if n.QueueSize != 0 && (n.QueueSize < 2 || n.QueueSize > MaxQueueSize || n.QueueSize&(n.QueueSize-1) != 0) {
+		mErr.Errors = append(mErr.Errors,
+			fmt.Errorf("queue_size %d must be a power of two between 2 and %d", n.QueueSize, MaxQueueSize))
+	}
+	if n.MTU != 0 && (n.MTU < MinMTU || n.MTU > MaxMTU) {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("mtu %d must be between %d and %d", n.MTU, MinMTU, MaxMTU))
+	}
+	if n.OffloadTSO != nil && *n.OffloadTSO && n.OffloadCsum != nil && !*n.OffloadCsum {
+		mErr.Errors = append(mErr.Errors, errors.New("offload_tso requires offload_csum"))
+	}
+
+	return mErr.ErrorOrNil()
+}
+
+// validateMAC ensures the MAC address is a unicast Ethernet address, which
+// can be set on the interface type.
+func (n *NetworkInterfaceConfig) validateMAC() error {
+	if n.MAC == "" {
+		return nil
+	}
+	if n.CNI != nil || n.IPVtap != nil {
+		return errors.New("mac cannot be set on cni or ipvtap interfaces")
+	}
+
+	hw, err := stdnet.ParseMAC(n.MAC)
+	if err != nil {
+		return err
+	}
+	if len(hw) != 6 {
+		return fmt.Errorf("%q is not an Ethernet address", n.MAC)
+	}
+	if hw[0]&0x01 != 0 || bytes.Equal(hw, make([]byte, 6)) {
+		return fmt.Errorf("%q is not a unicast address", n.MAC)
+	}
+	return nil
+}
+
+// NetworkInterfaceRateLimitConfig limits the traffic a VM interface can send
+// and receive using token buckets, which are refilled over time. Traffic is
+// delayed, rather than dropped, while a bucket is empty.
+type NetworkInterfaceRateLimitConfig struct {
+
+	// Bandwidth limits the bytes transferred. If not specified, it defaults
+	// to the bandwidth reserved by the task network block, if any.
+	Bandwidth *TokenBucketConfig `codec:"bandwidth"`
+
+	// Ops limits the packets transferred.
+	Ops *TokenBucketConfig `codec:"ops"`
+}
+
+// TokenBucketConfig is a token bucket of a rate limit, holding bytes or
+// packets depending on its use.
+type TokenBucketConfig struct {
+
+	// Size is the number of tokens the bucket holds, which is refilled every
+	// RefillTime.
+	Size int64 `codec:"size"`
+
+	// OneTimeBurst is an initial number of tokens available in addition to
+	// Size, which are not refilled once used.
+	OneTimeBurst int64 `codec:"one_time_burst"`
+
+	// RefillTime is the time taken to refill the bucket, with millisecond
+	// precision. If not specified, DefaultRefillTime is used.
+	RefillTime string `codec:"refill_time"`
+}
+
+// DefaultRefillTime is the refill time of token buckets which do not
+// configure one.
+const DefaultRefillTime = time.Second
+
+// RefillDuration returns the parsed RefillTime, or DefaultRefillTime if not
+// specified.
+func (t *TokenBucketConfig) RefillDuration() (time.Duration, error) {
+	if t.RefillTime == "" {
+		return DefaultRefillTime, nil
+	}
+	d, err := time.ParseDuration(t.RefillTime)
+	if err != nil {
+		return 0, fmt.Errorf("invalid refill_time %q: %w", t.RefillTime, err)
+	}
+	if d < time.Millisecond {
+		return 0, fmt.Errorf("invalid refill_time %q: must be at least 1ms", t.RefillTime)
+	}
+	return d, nil
+}
+
+// validate ensures the token bucket can be configured.
+func (t *TokenBucketConfig) validate() error {
+	var mErr multierror.Error
+
+	if t.Size <= 0 {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("size %d must be positive", t.Size))
+	}
+	if t.OneTimeBurst < 0 {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("one_time_burst %d must not be negative", t.OneTimeBurst))
+	}
+	if _, err := t.RefillDuration(); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
+	}
+
+	return mErr.ErrorOrNil()
+}
+
+// Validate ensures the configured token buckets are valid.
+func (r *NetworkInterfaceRateLimitConfig) Validate() error {
+	if r == nil {
+		return nil
+	}
+
+	var mErr multierror.Error
+
+	if r.Bandwidth != nil {
+		if err := r.Bandwidth.validate(); err != nil {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("bandwidth is invalid: %w", err))
+		}
+	}
+	if r.Ops != nil {
+		if err := r.Ops.validate(); err != nil {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("ops is invalid: %w", err))
+		}
+	}
+
+	return mErr.ErrorOrNil()
+}
+
+// DefaultBandwidth limits the bandwidth of the interfaces which do not
+// configure a bandwidth limit to mbits, such as reserved by the task network
+// block. A zero mbits leaves the interfaces unchanged.
+func (n NetworkInterfacesConfig) DefaultBandwidth(mbits int) {
+	if mbits <= 0 {
+		return
+	}
+	for _, iface := range n {
+		if iface.RateLimit == nil {
+			iface.RateLimit = &NetworkInterfaceRateLimitConfig{}
+		}
+		if iface.RateLimit.Bandwidth == nil {
+			// Megabits per second are refilled each second, as bytes.
+			iface.RateLimit.Bandwidth = &TokenBucketConfig{Size: int64(mbits) * 1000 * 1000 / 8}
+		}
+	}
+}
+
+// types returns the names of the interface types which are configured.
+func (n *NetworkInterfaceConfig) types() []string {
+	var types []string
+	if n.Bridge != nil {
+		types = append(types, "bridge")
+	}
+	if n.CNI != nil {
+		types = append(types, "cni")
+	}
+	if n.Macvtap != nil {
+		types = append(types, "macvtap")
+	}
+	if n.IPVtap != nil {
+		types = append(types, "ipvtap")
+	}
+	return types
+}
+
+// Vtap returns the kind, "macvtap" or "ipvtap", and configuration of the
+// interface if it is attached directly to a host interface.
+func (n *NetworkInterfaceConfig) Vtap() (string, *NetworkInterfaceVtapConfig) {
+	switch {
+	case n.Macvtap != nil:
+		return "macvtap", n.Macvtap
+	case n.IPVtap != nil:
+		return "ipvtap", n.IPVtap
+	default:
+		return "", nil
+	}
+}
+
+// NetworkInterfaceVtapConfig is the network object when a VM is attached
+// directly to the network of a host interface, through a macvtap or ipvtap
+// device created on it. The guest sits on the same L2 network as the host,
+// and is addressed by the network unless a static IP is configured.
+type NetworkInterfaceVtapConfig struct {
+
+	// Parent is the name of the host interface to create the device on.
+	Parent string `codec:"parent"`
+
+	// Mode is the macvtap or ipvtap mode of the device; see the
+	// MacvtapMode and IPVtapMode constants. If not specified, "bridge" is
+	// used for macvtap and "l2" for ipvtap.
+	Mode string `codec:"mode"`
+
+	// StaticIP, Gateway, Netmask and DNS configure the guest address. If
+	// StaticIP is not specified, the guest uses DHCP.
+	StaticIP string   `codec:"static_ip"`
+	Gateway  string   `codec:"gateway"`
+	Netmask  string   `codec:"netmask"`
+	DNS      []string `codec:"dns"`
+}
+
+// NetworkInterfaceCNIConfig is the network object when a VM is attached to a
+// network by CNI plugins. The plugin chain must create a TAP device for the
+// VM, such as by using the "tap" or "tc-redirect-tap" plugins.
+type NetworkInterfaceCNIConfig struct {
+
+	// Network is the name of the CNI network configuration to use, which is
+	// loaded from the driver's CNI configuration directory.
+	Network string `codec:"network"`
+
+	// Args are passed to the plugins within CNI_ARGS.
+	Args hclutils.MapStrStr `codec:"args"`
+
+	// DNS specifies custom DNS servers for this interface. If not specified,
+	// the servers returned by the plugins, or the defaults, are used.
+	DNS []string `codec:"dns"`
 }
 
 // NetworkInterfaceBridgeConfig is the network object when a VM is attached to
@@ -31,8 +304,20 @@ type NetworkInterfaceBridgeConfig struct {
 
 	// Name is the name of the bridge interface to use. This relates to the
 	// output seen from commands such as "ip addr show" or "virsh net-info".
+	// It may be omitted when Network is specified.
 	Name string `codec:"name"`
 
+	// Network is the name of a network configured within the driver to
+	// attach to. The VM uses the bridge of the network, and is allocated an
+	// address from its pool. If not specified, the driver network is used.
+	Network string `codec:"network"`
+
+	// GroupNetwork attaches the VM to a private network shared by the VMs of
+	// its allocation, whose bridge and subnet are created by the driver when
+	// the first VM starts and removed once the last is destroyed. It cannot
+	// be combined with Name or Network.
+	GroupNetwork bool `codec:"group_network"`
+
 	// Ports contains a list of port labels which will be exposed on the host
 	// via mapping to the network interface. These labels must exist within the
 	// job specification network block.
@@ -53,6 +338,232 @@ type NetworkInterfaceBridgeConfig struct {
 	// DNS specifies custom DNS servers for this interface
 	// If not specified, default DNS servers will be used
 	DNS []string `codec:"dns"`
+
+	// Isolation is the policy controlling which other VMs on the bridge this
+	// VM can exchange traffic with; see the Isolation constants. Setting any
+	// policy also enables MAC and IP anti-spoofing rules. If not specified,
+	// no rules are added.
+	Isolation string `codec:"isolation"`
+
+	// VLAN is the VLAN the VM is a member of, untagged, on a bridge with
+	// VLAN filtering enabled. If not specified, the port keeps the bridge
+	// default VLAN, unless Trunk is specified.
+	VLAN int `codec:"vlan"`
+
+	// Trunk is a list of VLANs the VM is a member of, tagged, on a bridge
+	// with VLAN filtering enabled. Untagged traffic uses VLAN, and is dropped
+	// if not specified.
+	Trunk []int `codec:"trunk"`
+
+	// Firewall restricts the traffic the VM can send and receive. If not
+	// specified, traffic is unrestricted.
+	Firewall *NetworkInterfaceFirewallConfig `codec:"firewall"`
+}
+
+// NetworkInterfaceFirewallConfig lists the traffic allowed to and from a VM.
+// Replies to allowed traffic are always permitted.
+type NetworkInterfaceFirewallConfig struct {
+
+	// EgressCIDRs are the IPv4 destinations the VM can open connections to.
+	// Entries may be a CIDR or a single address. If empty, and EgressPorts is
+	// also empty, egress is unrestricted.
+	EgressCIDRs []string `codec:"egress_cidrs"`
+
+	// EgressPorts are the destination ports the VM can open connections to,
+	// in the form "PORT[-PORT][/PROTOCOL]", e.g. "443/tcp" or "8000-8100".
+	// Entries without a protocol apply to both TCP and UDP. When combined with
+	// EgressCIDRs, only the ports of the listed destinations are allowed.
+	EgressPorts []string `codec:"egress_ports"`
+
+	// IngressCIDRs are the IPv4 sources which can open connections to the
+	// VM, including via forwarded ports. If empty, ingress is unrestricted.
+	IngressCIDRs []string `codec:"ingress_cidrs"`
+}
+
+// FirewallPort is a parsed NetworkInterfaceFirewallConfig.EgressPorts entry.
+type FirewallPort struct {
+	Protocols []string
+	Start     uint16
+	End       uint16
+}
+
+// ParseFirewallPort parses a port entry of the form
+// "PORT[-PORT][/PROTOCOL]".
+func ParseFirewallPort(s string) (FirewallPort, error) {
+	p := FirewallPort{Protocols: []string{"tcp", "udp"}}
+
+	ports, proto, hasProto := strings.Cut(s, "/")
+	if hasProto {
+		proto = strings.ToLower(proto)
+		if proto != "tcp" && proto != "udp" {
+			return p, fmt.Errorf("invalid protocol %q in port %q: must be tcp or udp", proto, s)
+		}
+		p.Protocols = []string{proto}
+	}
+
+	start, end, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		end = start
+	}
+	startPort, err := strconv.ParseUint(start, 10, 16)
+	if err != nil || startPort == 0 {
+		return p, fmt.Errorf("invalid port %q", s)
+	}
+	endPort, err := strconv.ParseUint(end, 10, 16)
+	if err != nil || endPort < startPort {
+		return p, fmt.Errorf("invalid port range %q", s)
+	}
+	p.Start, p.End = uint16(startPort), uint16(endPort)
+
+	return p, nil
+}
+
+// ParseFirewallCIDR parses a CIDR entry, which may also be a single IPv4
+// address.
+func ParseFirewallCIDR(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		addr, addrErr := netip.ParseAddr(s)
+		if addrErr != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR %q", s)
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	if !prefix.Addr().Is4() {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR %q: only IPv4 is supported", s)
+	}
+	return prefix.Masked(), nil
+}
+
+// Validate ensures the firewall configuration can be parsed.
+func (f *NetworkInterfaceFirewallConfig) Validate() error {
+	if f == nil {
+		return nil
+	}
+
+	var mErr multierror.Error
+
+	for _, cidr := range append(slices.Clone(f.EgressCIDRs), f.IngressCIDRs...) {
+		if _, err := ParseFirewallCIDR(cidr); err != nil {
+			mErr.Errors = append(mErr.Errors, err)
+		}
+	}
+	for _, port := range f.EgressPorts {
+		if _, err := ParseFirewallPort(port); err != nil {
+			mErr.Errors = append(mErr.Errors, err)
+		}
+	}
+
+	return mErr.ErrorOrNil()
+}
+
+const (
+	// IsolationAllowAll allows traffic with all other VMs on the bridge.
+	IsolationAllowAll = "allow-all"
+
+	// IsolationSameJob only allows traffic with other VMs of the same job and
+	// namespace which also use this policy.
+	IsolationSameJob = "same-job-only"
+
+	// IsolationNone allows traffic with none of the other VMs on the bridge,
+	// which is the strictest policy. Traffic with the host and any uplink is
+	// unaffected.
+	IsolationNone = "none"
+)
+
+const (
+	// MacvtapModeBridge allows the VM to reach other macvtap devices in
+	// bridge mode on the same parent, as well as the network.
+	MacvtapModeBridge = "bridge"
+
+	// MacvtapModeVEPA sends all traffic to the upstream switch, including
+	// traffic between devices on the same parent.
+	MacvtapModeVEPA = "vepa"
+
+	// MacvtapModePrivate blocks traffic between devices on the same parent.
+	MacvtapModePrivate = "private"
+
+	// MacvtapModePassthru gives the VM exclusive use of the parent.
+	MacvtapModePassthru = "passthru"
+
+	// IPVtapModeL2 switches traffic by MAC address on the parent, whose
+	// address is shared by the VM.
+	IPVtapModeL2 = "l2"
+
+	// IPVtapModeL3 routes traffic by IP address on the parent.
+	IPVtapModeL3 = "l3"
+
+	// IPVtapModeL3S routes traffic by IP address, passing it through the
+	// host netfilter hooks.
+	IPVtapModeL3S = "l3s"
+)
+
+// validate ensures the vtap configuration is correct for the device kind,
+// either "macvtap" or "ipvtap".
+func (v *NetworkInterfaceVtapConfig) validate(kind string) error {
+	var mErr multierror.Error
+
+	if v.Parent == "" {
+		mErr.Errors = append(mErr.Errors, errors.New("requires parent parameter"))
+	}
+
+	var modes []string
+	if kind == "macvtap" {
+		modes = []string{MacvtapModeBridge, MacvtapModeVEPA, MacvtapModePrivate, MacvtapModePassthru}
+	} else {
+		modes = []string{IPVtapModeL2, IPVtapModeL3, IPVtapModeL3S}
+	}
+	if v.Mode != "" && !slices.Contains(modes, v.Mode) {
+		mErr.Errors = append(mErr.Errors,
+			fmt.Errorf("invalid mode %q: must be one of %s", v.Mode, strings.Join(modes, ", ")))
+	}
+
+	if v.StaticIP != "" {
+		if addr, err := netip.ParseAddr(v.StaticIP); err != nil || !addr.Is4() {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("invalid static_ip %q", v.StaticIP))
+		}
+	} else if v.Gateway != "" || v.Netmask != "" {
+		mErr.Errors = append(mErr.Errors, errors.New("gateway and netmask require static_ip"))
+	}
+	if v.Netmask != "" {
+		if bits, err := strconv.Atoi(v.Netmask); err != nil || bits < 0 || bits > 32 {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("invalid netmask %q", v.Netmask))
+		}
+	}
+
+	return mErr.ErrorOrNil()
+}
+
+// MaxVLAN is the highest valid VLAN ID.
+const MaxVLAN = 4094
+
+// HasVLANs reports whether the bridge port of the VM is configured with VLAN
+// membership.
+func (b *NetworkInterfaceBridgeConfig) HasVLANs() bool {
+	return b != nil && (b.VLAN != 0 || len(b.Trunk) > 0)
+}
+
+// validateVLANs ensures the VLAN IDs are in range and the VM is a member of
+// each once.
+func (b *NetworkInterfaceBridgeConfig) validateVLANs() error {
+	var mErr multierror.Error
+
+	if b.VLAN < 0 || b.VLAN > MaxVLAN {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("vlan %d must be between 1 and %d", b.VLAN, MaxVLAN))
+	}
+
+	seen := map[int]bool{b.VLAN: true}
+	for _, vlan := range b.Trunk {
+		switch {
+		case vlan < 1 || vlan > MaxVLAN:
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("trunk vlan %d must be between 1 and %d", vlan, MaxVLAN))
+		case seen[vlan]:
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("trunk vlan %d is configured more than once", vlan))
+		}
+		seen[vlan] = true
+	}
+
+	return mErr.ErrorOrNil()
 }
 
 // Validate ensures the NetworkInterfaces is a valid object supported by the
@@ -77,9 +588,68 @@ func (n *NetworkInterfacesConfig) Validate() error {
 	// Iterate the network interfaces and validate each object to be correct
 	// according to their type.
 	for i, netInterface := range *n {
-		if netInterface.Bridge != nil && netInterface.Bridge.Name == "" {
+		if types := netInterface.types(); len(types) > 1 {
+			mErr.Errors = append(mErr.Errors,
+				fmt.Errorf("network interface '%v' can only configure one of %s", i, strings.Join(types, ", ")))
+		}
+		if netInterface.Macvtap != nil {
+			if err := netInterface.Macvtap.validate("macvtap"); err != nil {
+				mErr.Errors = append(mErr.Errors,
+					fmt.Errorf("network interface macvtap '%v' is invalid: %w", i, err))
+			}
+		}
+		if netInterface.IPVtap != nil {
+			if err := netInterface.IPVtap.validate("ipvtap"); err != nil {
+				mErr.Errors = append(mErr.Errors,
+					fmt.Errorf("network interface ipvtap '%v' is invalid: %w", i, err))
+			}
+		}
+		if err := netInterface.validateTuning(); err != nil {
+			mErr.Errors = append(mErr.Errors,
+				fmt.Errorf("network interface '%v' has invalid tuning: %w", i, err))
+		}
+		if err := netInterface.validateMAC(); err != nil {
+			mErr.Errors = append(mErr.Errors,
+				fmt.Errorf("network interface '%v' has invalid mac: %w", i, err))
+		}
+		if err := netInterface.RateLimit.Validate(); err != nil {
+			mErr.Errors = append(mErr.Errors,
+				fmt.Errorf("network interface '%v' has invalid rate_limit: %w", i, err))
+		}
+		if netInterface.CNI != nil && netInterface.CNI.Network == "" {
 			mErr.Errors = append(mErr.Errors,
-				fmt.Errorf("network interface bridge '%v' requires name parameter", i))
+				fmt.Errorf("network interface cni '%v' requires network parameter", i))
+		}
+		if netInterface.Bridge != nil {
+			bridge := netInterface.Bridge
+			switch {
+			case bridge.GroupNetwork && (bridge.Name != "" || bridge.Network != ""):
+				mErr.Errors = append(mErr.Errors,
+					fmt.Errorf("network interface bridge '%v' cannot combine group_network with name or network", i))
+			case !bridge.GroupNetwork && bridge.Name == "" && bridge.Network == "":
+				mErr.Errors = append(mErr.Errors,
+					fmt.Errorf("network interface bridge '%v' requires name, network or group_network parameter", i))
+			}
+			switch netInterface.Bridge.Isolation {
+			case "", IsolationAllowAll, IsolationSameJob, IsolationNone:
+			default:
+				mErr.Errors = append(mErr.Errors,
+					fmt.Errorf("network interface bridge '%v' has invalid isolation %q", i, netInterface.Bridge.Isolation))
+			}
+			// The addresses within tagged frames cannot be checked, so the
+			// anti-spoofing rules of isolated VMs drop them.
+			if netInterface.Bridge.Isolation != "" && len(netInterface.Bridge.Trunk) > 0 {
+				mErr.Errors = append(mErr.Errors,
+					fmt.Errorf("network interface bridge '%v' cannot combine isolation with trunk", i))
+			}
+			if err := netInterface.Bridge.validateVLANs(); err != nil {
+				mErr.Errors = append(mErr.Errors,
+					fmt.Errorf("network interface bridge '%v' has invalid vlan: %w", i, err))
+			}
+			if err := netInterface.Bridge.Firewall.Validate(); err != nil {
+				mErr.Errors = append(mErr.Errors,
+					fmt.Errorf("network interface bridge '%v' has invalid firewall: %w", i, err))
+			}
 		}
 	}
 
@@ -91,12 +661,61 @@ func (n *NetworkInterfacesConfig) Validate() error {
 func NetworkInterfaceHCLSpec() *hclspec.Spec {
 	return hclspec.NewBlockList("network_interface", hclspec.NewObject(map[string]*hclspec.Spec{
 		"bridge": hclspec.NewBlock("bridge", false, hclspec.NewObject(map[string]*hclspec.Spec{
-			"name":      hclspec.NewAttr("name", "string", true),
-			"ports":     hclspec.NewAttr("ports", "list(string)", false),
-			"static_ip": hclspec.NewAttr("static_ip", "string", false),
-			"gateway":   hclspec.NewAttr("gateway", "string", false),
-			"netmask":   hclspec.NewAttr("netmask", "string", false),
-			"dns":       hclspec.NewAttr("dns", "list(string)", false),
+			"name":          hclspec.NewAttr("name", "string", false),
+			"network":       hclspec.NewAttr("network", "string", false),
+			"group_network": hclspec.NewAttr("group_network", "bool", false),
+			"ports":         hclspec.NewAttr("ports", "list(string)", false),
+			"static_ip":     hclspec.NewAttr("static_ip", "string", false),
+			"gateway":       hclspec.NewAttr("gateway", "string", false),
+			"netmask":       hclspec.NewAttr("netmask", "string", false),
+			"dns":           hclspec.NewAttr("dns", "list(string)", false),
+			"isolation":     hclspec.NewAttr("isolation", "string", false),
+			"vlan":          hclspec.NewAttr("vlan", "number", false),
+			"trunk":         hclspec.NewAttr("trunk", "list(number)", false),
+			"firewall": hclspec.NewBlock("firewall", false, hclspec.NewObject(map[string]*hclspec.Spec{
+				"egress_cidrs":  hclspec.NewAttr("egress_cidrs", "list(string)", false),
+				"egress_ports":  hclspec.NewAttr("egress_ports", "list(string)", false),
+				"ingress_cidrs": hclspec.NewAttr("ingress_cidrs", "list(string)", false),
+			})),
+		})),
+		"mac":          hclspec.NewAttr("mac", "string", false),
+		"num_queues":   hclspec.NewAttr("num_queues", "number", false),
+		"queue_size":   hclspec.NewAttr("queue_size", "number", false),
+		"mtu":          hclspec.NewAttr("mtu", "number", false),
+		"offload_tso":  hclspec.NewAttr("offload_tso", "bool", false),
+		"offload_csum": hclspec.NewAttr("offload_csum", "bool", false),
+		"rate_limit": hclspec.NewBlock("rate_limit", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"bandwidth": tokenBucketHCLSpec("bandwidth"),
+			"ops":       tokenBucketHCLSpec("ops"),
+		})),
+		"macvtap": vtapHCLSpec("macvtap"),
+		"ipvtap":  vtapHCLSpec("ipvtap"),
+		"cni": hclspec.NewBlock("cni", false, hclspec.NewObject(map[string]*hclspec.Spec{
+			"network": hclspec.NewAttr("network", "string", true),
+			"args":    hclspec.NewAttr("args", "list(map(string))", false),
+			"dns":     hclspec.NewAttr("dns", "list(string)", false),
 		})),
 	}))
 }
+
+// vtapHCLSpec returns the HCL specification of a macvtap or ipvtap block.
+func vtapHCLSpec(name string) *hclspec.Spec {
+	return hclspec.NewBlock(name, false, hclspec.NewObject(map[string]*hclspec.Spec{
+		"parent":    hclspec.NewAttr("parent", "string", true),
+		"mode":      hclspec.NewAttr("mode", "string", false),
+		"static_ip": hclspec.NewAttr("static_ip", "string", false),
+		"gateway":   hclspec.NewAttr("gateway", "string", false),
+		"netmask":   hclspec.NewAttr("netmask", "string", false),
+		"dns":       hclspec.NewAttr("dns", "list(string)", false),
+	}))
+}
+
+// tokenBucketHCLSpec returns the HCL specification of a rate limit token
+// bucket block.
+func tokenBucketHCLSpec(name string) *hclspec.Spec {
+	return hclspec.NewBlock(name, false, hclspec.NewObject(map[string]*hclspec.Spec{
+		"size":           hclspec.NewAttr("size", "number", true),
+		"one_time_burst": hclspec.NewAttr("one_time_burst", "number", false),
+		"refill_time":    hclspec.NewAttr("refill_time", "string", false),
+	}))
+}
@@ -6,8 +6,10 @@ package net
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/nomad/helper/pluginutils/hclutils"
+	"github.com/hashicorp/nomad/helper/pointer"
 	"github.com/hashicorp/nomad/plugins/shared/hclspec"
 	"github.com/shoenig/test/must"
 )
@@ -68,7 +70,239 @@ func TestNetworkInterfaces_Validate(t *testing.T) {
 					},
 				},
 			},
-			expectedOutput: errors.New(`network interface bridge '0' requires name parameter`),
+			expectedOutput: errors.New(`network interface bridge '0' requires name, network or group_network parameter`),
+		},
+		{
+			name: "named network",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					Bridge: &NetworkInterfaceBridgeConfig{
+						Network: "dmz",
+					},
+				},
+			},
+			expectedOutput: nil,
+		},
+		{
+			name: "group network",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					Bridge: &NetworkInterfaceBridgeConfig{
+						GroupNetwork: true,
+						Ports:        []string{"ssh"},
+					},
+				},
+			},
+			expectedOutput: nil,
+		},
+		{
+			name: "group network with name",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					Bridge: &NetworkInterfaceBridgeConfig{
+						Name:         "br0",
+						GroupNetwork: true,
+					},
+				},
+			},
+			expectedOutput: errors.New(`network interface bridge '0' cannot combine group_network with name or network`),
+		},
+		{
+			name: "valid isolation",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					Bridge: &NetworkInterfaceBridgeConfig{
+						Name:      "br0",
+						Isolation: IsolationSameJob,
+					},
+				},
+			},
+			expectedOutput: nil,
+		},
+		{
+			name: "invalid isolation",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					Bridge: &NetworkInterfaceBridgeConfig{
+						Name:      "br0",
+						Isolation: "same-namespace",
+					},
+				},
+			},
+			expectedOutput: errors.New(`network interface bridge '0' has invalid isolation "same-namespace"`),
+		},
+		{
+			name: "isolation with trunk",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					Bridge: &NetworkInterfaceBridgeConfig{
+						Name:      "br0",
+						Isolation: IsolationNone,
+						Trunk:     []int{200},
+					},
+				},
+			},
+			expectedOutput: errors.New(`network interface bridge '0' cannot combine isolation with trunk`),
+		},
+		{
+			name: "invalid firewall",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					Bridge: &NetworkInterfaceBridgeConfig{
+						Name: "br0",
+						Firewall: &NetworkInterfaceFirewallConfig{
+							EgressCIDRs: []string{"10.0.0.0/8", "fd00::/8"},
+							EgressPorts: []string{"443/tcp", "53/icmp"},
+						},
+					},
+				},
+			},
+			expectedOutput: errors.New(`network interface bridge '0' has invalid firewall: 2 errors occurred`),
+		},
+		{
+			name: "vlans",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					Bridge: &NetworkInterfaceBridgeConfig{Name: "br0", VLAN: 100, Trunk: []int{200, 300}},
+				},
+			},
+			expectedOutput: nil,
+		},
+		{
+			name: "invalid vlans",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					Bridge: &NetworkInterfaceBridgeConfig{Name: "br0", VLAN: 4095, Trunk: []int{200, 0, 200}},
+				},
+			},
+			expectedOutput: errors.New(`network interface bridge '0' has invalid vlan: 3 errors occurred:
+	* vlan 4095 must be between 1 and 4094
+	* trunk vlan 0 must be between 1 and 4094
+	* trunk vlan 200 is configured more than once`),
+		},
+		{
+			name: "invalid tuning",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					Macvtap:     &NetworkInterfaceVtapConfig{Parent: "eth0"},
+					NumQueues:   2,
+					QueueSize:   1000,
+					MTU:         65536,
+					OffloadTSO:  pointer.Of(true),
+					OffloadCsum: pointer.Of(false),
+				},
+			},
+			expectedOutput: errors.New(`network interface '0' has invalid tuning: 4 errors occurred:
+	* num_queues is not supported by macvtap interfaces
+	* queue_size 1000 must be a power of two between 2 and 32768
+	* mtu 65536 must be between 68 and 65535
+	* offload_tso requires offload_csum`),
+		},
+		{
+			name: "mac",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					Bridge: &NetworkInterfaceBridgeConfig{Name: "br0"},
+					MAC:    "02:43:0a:0b:0c:0d",
+				},
+			},
+			expectedOutput: nil,
+		},
+		{
+			name: "invalid mac",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					Bridge: &NetworkInterfaceBridgeConfig{Name: "br0"},
+					MAC:    "01:00:5e:00:00:01",
+				},
+			},
+			expectedOutput: errors.New(`network interface '0' has invalid mac: "01:00:5e:00:00:01" is not a unicast address`),
+		},
+		{
+			name: "mac on ipvtap",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					IPVtap: &NetworkInterfaceVtapConfig{Parent: "eth0"},
+					MAC:    "02:43:0a:0b:0c:0d",
+				},
+			},
+			expectedOutput: errors.New(`network interface '0' has invalid mac: mac cannot be set on cni or ipvtap interfaces`),
+		},
+		{
+			name: "invalid rate limit",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					Bridge: &NetworkInterfaceBridgeConfig{Name: "br0"},
+					RateLimit: &NetworkInterfaceRateLimitConfig{
+						Bandwidth: &TokenBucketConfig{Size: 1000, RefillTime: "100us"},
+						Ops:       &TokenBucketConfig{OneTimeBurst: -1},
+					},
+				},
+			},
+			expectedOutput: errors.New(`network interface '0' has invalid rate_limit: 2 errors occurred:
+	* bandwidth is invalid: 1 error occurred:
+	* invalid refill_time "100us": must be at least 1ms`),
+		},
+		{
+			name: "cni",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					CNI: &NetworkInterfaceCNIConfig{Network: "vms"},
+				},
+			},
+			expectedOutput: nil,
+		},
+		{
+			name: "no cni network",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					CNI: &NetworkInterfaceCNIConfig{},
+				},
+			},
+			expectedOutput: errors.New(`network interface cni '0' requires network parameter`),
+		},
+		{
+			name: "bridge and cni",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					Bridge: &NetworkInterfaceBridgeConfig{Name: "br0"},
+					CNI:    &NetworkInterfaceCNIConfig{Network: "vms"},
+				},
+			},
+			expectedOutput: errors.New(`network interface '0' can only configure one of bridge, cni`),
+		},
+		{
+			name: "macvtap",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					Macvtap: &NetworkInterfaceVtapConfig{
+						Parent:   "eth0",
+						Mode:     MacvtapModePrivate,
+						StaticIP: "10.0.0.50",
+						Netmask:  "24",
+					},
+				},
+			},
+			expectedOutput: nil,
+		},
+		{
+			name: "invalid macvtap",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					Macvtap: &NetworkInterfaceVtapConfig{Mode: IPVtapModeL3, Gateway: "10.0.0.1"},
+				},
+			},
+			expectedOutput: errors.New(`network interface macvtap '0' is invalid: 3 errors occurred`),
+		},
+		{
+			name: "invalid ipvtap",
+			inputNetworkInterfaces: &NetworkInterfacesConfig{
+				{
+					IPVtap: &NetworkInterfaceVtapConfig{Parent: "eth0", Mode: MacvtapModeBridge},
+				},
+			},
+			expectedOutput: errors.New(`network interface ipvtap '0' is invalid: 1 error occurred:
+	* invalid mode "bridge": must be one of l2, l3, l3s`),
 		},
 	}
 
@@ -147,6 +381,198 @@ config {
 					},
 				}},
 		},
+		{
+			name: "bridge named network",
+			inputConfig: `
+config {
+  network_interface {
+    bridge {
+      network = "dmz"
+    }
+  }
+}
+`,
+			expectedOutput: TaskConfig{
+				NetworkInterfacesConfig: []*NetworkInterfaceConfig{
+					{
+						Bridge: &NetworkInterfaceBridgeConfig{
+							Network: "dmz",
+						},
+					},
+				}},
+		},
+		{
+			name: "bridge group network",
+			inputConfig: `
+config {
+  network_interface {
+    bridge {
+      group_network = true
+    }
+  }
+}
+`,
+			expectedOutput: TaskConfig{
+				NetworkInterfacesConfig: []*NetworkInterfaceConfig{
+					{
+						Bridge: &NetworkInterfaceBridgeConfig{
+							GroupNetwork: true,
+						},
+					},
+				}},
+		},
+		{
+			name: "bridge isolation",
+			inputConfig: `
+config {
+  network_interface {
+    bridge {
+      name      = "br0"
+      isolation = "none"
+    }
+  }
+}
+`,
+			expectedOutput: TaskConfig{
+				NetworkInterfacesConfig: []*NetworkInterfaceConfig{
+					{
+						Bridge: &NetworkInterfaceBridgeConfig{
+							Name:      "br0",
+							Isolation: IsolationNone,
+						},
+					},
+				}},
+		},
+		{
+			name: "bridge vlans",
+			inputConfig: `
+config {
+  network_interface {
+    bridge {
+      name  = "br0"
+      vlan  = 100
+      trunk = [200, 300]
+    }
+  }
+}
+`,
+			expectedOutput: TaskConfig{
+				NetworkInterfacesConfig: []*NetworkInterfaceConfig{
+					{
+						Bridge: &NetworkInterfaceBridgeConfig{
+							Name:  "br0",
+							VLAN:  100,
+							Trunk: []int{200, 300},
+						},
+					},
+				}},
+		},
+		{
+			name: "tuning",
+			inputConfig: `
+config {
+  network_interface {
+    bridge {
+      name = "br0"
+    }
+    mac          = "02:43:0a:0b:0c:0d"
+    num_queues   = 4
+    queue_size   = 1024
+    mtu          = 9000
+    offload_tso  = false
+  }
+}
+`,
+			expectedOutput: TaskConfig{
+				NetworkInterfacesConfig: []*NetworkInterfaceConfig{
+					{
+						Bridge:     &NetworkInterfaceBridgeConfig{Name: "br0"},
+						MAC:        "02:43:0a:0b:0c:0d",
+						NumQueues:  4,
+						QueueSize:  1024,
+						MTU:        9000,
+						OffloadTSO: pointer.Of(false),
+					},
+				}},
+		},
+		{
+			name: "rate limit",
+			inputConfig: `
+config {
+  network_interface {
+    bridge {
+      name = "br0"
+    }
+    rate_limit {
+      bandwidth {
+        size           = 1250000
+        one_time_burst = 5000000
+        refill_time    = "100ms"
+      }
+      ops {
+        size = 1000
+      }
+    }
+  }
+}
+`,
+			expectedOutput: TaskConfig{
+				NetworkInterfacesConfig: []*NetworkInterfaceConfig{
+					{
+						Bridge: &NetworkInterfaceBridgeConfig{Name: "br0"},
+						RateLimit: &NetworkInterfaceRateLimitConfig{
+							Bandwidth: &TokenBucketConfig{Size: 1250000, OneTimeBurst: 5000000, RefillTime: "100ms"},
+							Ops:       &TokenBucketConfig{Size: 1000},
+						},
+					},
+				}},
+		},
+		{
+			name: "cni",
+			inputConfig: `
+config {
+  network_interface {
+    cni {
+      network = "vms"
+      args    = { IgnoreUnknown = "true" }
+    }
+  }
+}
+`,
+			expectedOutput: TaskConfig{
+				NetworkInterfacesConfig: []*NetworkInterfaceConfig{
+					{
+						CNI: &NetworkInterfaceCNIConfig{
+							Network: "vms",
+							Args:    hclutils.MapStrStr{"IgnoreUnknown": "true"},
+						},
+					},
+				}},
+		},
+		{
+			name: "ipvtap",
+			inputConfig: `
+config {
+  network_interface {
+    ipvtap {
+      parent    = "eth0"
+      mode      = "l3"
+      static_ip = "10.0.0.50"
+    }
+  }
+}
+`,
+			expectedOutput: TaskConfig{
+				NetworkInterfacesConfig: []*NetworkInterfaceConfig{
+					{
+						IPVtap: &NetworkInterfaceVtapConfig{
+							Parent:   "eth0",
+							Mode:     IPVtapModeL3,
+							StaticIP: "10.0.0.50",
+						},
+					},
+				}},
+		},
 		{
 			name:           "no interface",
 			inputConfig:    `config {}`,
@@ -164,3 +590,71 @@ config {
 		})
 	}
 }
+
+func TestParseFirewallPort(t *testing.T) {
+	testCases := []struct {
+		input          string
+		expectedOutput FirewallPort
+		expectedErr    string
+	}{
+		{input: "443", expectedOutput: FirewallPort{Protocols: []string{"tcp", "udp"}, Start: 443, End: 443}},
+		{input: "53/UDP", expectedOutput: FirewallPort{Protocols: []string{"udp"}, Start: 53, End: 53}},
+		{input: "8000-8100/tcp", expectedOutput: FirewallPort{Protocols: []string{"tcp"}, Start: 8000, End: 8100}},
+		{input: "0", expectedErr: "invalid port"},
+		{input: "http", expectedErr: "invalid port"},
+		{input: "90-80", expectedErr: "invalid port range"},
+		{input: "80/sctp", expectedErr: "invalid protocol"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			actualOutput, err := ParseFirewallPort(tc.input)
+			if tc.expectedErr != "" {
+				must.ErrorContains(t, err, tc.expectedErr)
+				return
+			}
+			must.NoError(t, err)
+			must.Eq(t, tc.expectedOutput, actualOutput)
+		})
+	}
+}
+
+func TestParseFirewallCIDR(t *testing.T) {
+	prefix, err := ParseFirewallCIDR("10.1.2.3/8")
+	must.NoError(t, err)
+	must.Eq(t, "10.0.0.0/8", prefix.String())
+
+	prefix, err = ParseFirewallCIDR("192.168.1.10")
+	must.NoError(t, err)
+	must.Eq(t, "192.168.1.10/32", prefix.String())
+
+	_, err = ParseFirewallCIDR("fd00::/8")
+	must.ErrorContains(t, err, "only IPv4")
+
+	_, err = ParseFirewallCIDR("example.com")
+	must.ErrorContains(t, err, "invalid CIDR")
+}
+
+func TestNetworkInterfaces_DefaultBandwidth(t *testing.T) {
+	n := NetworkInterfacesConfig{
+		{Bridge: &NetworkInterfaceBridgeConfig{Name: "br0"}},
+	}
+
+	n.DefaultBandwidth(0)
+	must.Nil(t, n[0].RateLimit)
+
+	// 100 Mbit/s is refilled each second.
+	n.DefaultBandwidth(100)
+	must.Eq(t, &TokenBucketConfig{Size: 12500000}, n[0].RateLimit.Bandwidth)
+
+	refill, err := n[0].RateLimit.Bandwidth.RefillDuration()
+	must.NoError(t, err)
+	must.Eq(t, time.Second, refill)
+
+	// Configured limits are kept.
+	n[0].RateLimit = &NetworkInterfaceRateLimitConfig{
+		Bandwidth: &TokenBucketConfig{Size: 1000},
+	}
+	n.DefaultBandwidth(100)
+	must.Eq(t, &TokenBucketConfig{Size: 1000}, n[0].RateLimit.Bandwidth)
+}
@@ -23,6 +23,10 @@ const (
 	NetworkStateInactive = "inactive"
 )
 
+// DefaultNameservers are the DNS servers handed to guests when neither the
+// task nor the driver configuration specify any.
+var DefaultNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
 // VMStartedBuildRequest is the request object used to ask the network
 // sub-system to perform its configuration, once a VM has been started.
 type VMStartedBuildRequest struct {
@@ -32,6 +36,28 @@ type VMStartedBuildRequest struct {
 	Resources  *drivers.Resources
 	Hwaddrs    []string
 	GuestIPs   []string
+
+	// TAPs are the host devices backing the VM interfaces, in the same order
+	// as Hwaddrs.
+	TAPs []string
+
+	// Namespace and JobID identify the job the VM belongs to, which is used
+	// to group VMs for network isolation.
+	Namespace string
+	JobID     string
+
+	// NetNS is the path of the allocation network namespace the VM is
+	// attached to when the task uses group network mode. It is empty when
+	// the VM is attached to a host bridge.
+	NetNS string
+
+	// CNI is the attachment of the VM interface made by CNI plugins, when
+	// the interface uses a CNI network.
+	CNI *CNIAttachment
+
+	// GroupNetwork is the private network of the allocation the VM is
+	// attached to, when the interface uses a group network.
+	GroupNetwork *GroupNetwork
 }
 
 // VMStartedBuildResponse is the response sent object once the network
@@ -62,6 +88,17 @@ type VMTerminatedTeardownRequest struct {
 // configuration.
 type VMTerminatedTeardownResponse struct{}
 
+// VMRecoveredRequest is the request object used to ask the network sub-system
+// to restore the configuration it holds in memory for a VM, once the driver
+// has recovered the VM's task after a restart.
+type VMRecoveredRequest struct {
+	TeardownSpec *TeardownSpec
+}
+
+// VMRecoveredResponse is the response object returned when the network
+// sub-system has restored the configuration of a recovered VM.
+type VMRecoveredResponse struct{}
+
 // TeardownSpec contains a specification which will be stored in the task
 // handle and used when stopping/killing the task. It should include
 // information which either expedites the process or is critical to the
@@ -76,13 +113,114 @@ type TeardownSpec struct {
 	//   i[2:] is the rule args.
 	IPTablesRules [][]string
 
+	// IPTablesChains specifies the chains created for the VM, which are
+	// flushed and deleted after IPTablesRules have been removed. Each entry
+	// is the table name followed by the chain name.
+	IPTablesChains [][]string
+
+	// FirewallBackend is the name of the firewall backend which applied
+	// IPTablesRules and IPTablesChains. Specs which predate its introduction
+	// leave it empty, which means iptables.
+	FirewallBackend string
+
+	// PortProxies specifies the ports forwarded by the userspace proxy,
+	// rather than by IPTablesRules.
+	PortProxies []PortProxy
+
+	// NetNS is the path of the network namespace IPTablesRules were added
+	// within, when the VM used group network mode. The rules are removed
+	// along with the namespace, so are only deleted if it still exists.
+	NetNS string
+
 	// DHCPReservation specifies the reservation string used for registering
-	// a DHCP address for a domain.
+	// a DHCP address for a domain. Specs written before DHCPLease was
+	// introduced may hold the MAC address reserved for the VM.
 	DHCPReservation string
 
+	// DHCPLease is the address reserved for the VM by the embedded DHCP
+	// server, if any, which is restored when the VM is recovered.
+	DHCPLease *DHCPReservation
+
 	// Network is the name of the network used and which provided the
 	// DHCP lease.
 	Network string
+
+	// DNSRecord is the record registered with the embedded DNS resolver for
+	// the VM, if any.
+	DNSRecord *DNSRecord
+
+	// EbtablesRules specifies the isolation and anti-spoofing rules added for
+	// the VM. The format matches IPTablesRules.
+	EbtablesRules [][]string
+
+	// EbtablesChains lists the ebtables chains shared with other VMs which
+	// should be removed once they no longer contain any rules.
+	EbtablesChains []string
+
+	// CNI is the attachment made by CNI plugins, which is deleted using the
+	// cached configuration and result.
+	CNI *CNIAttachment
+
+	// GroupNetwork is the private network of the allocation the VM was
+	// attached to. Its NAT rule is shared by the VMs of the allocation, so is
+	// only deleted once the driver has removed the network bridge.
+	GroupNetwork *GroupNetwork
+}
+
+// GroupNetwork is the private network created by the driver for the VMs of
+// an allocation which use a group network.
+type GroupNetwork struct {
+	AllocID    string
+	Bridge     string
+	SubnetCIDR string
+}
+
+// CNIAttachment describes a VM interface attached to a network by CNI
+// plugins. It holds everything needed to delete the attachment, even if the
+// network configuration has since changed.
+type CNIAttachment struct {
+	Network     string
+	ContainerID string
+	IfName      string
+	Args        map[string]string
+
+	// NetNS is the path of the network namespace the plugins were invoked
+	// within. OwnsNetNS is set when the namespace was created for the VM,
+	// and should be removed once the attachment has been deleted.
+	NetNS     string
+	OwnsNetNS bool
+
+	// Config is the network configuration list, and Result the result of
+	// the plugins, as JSON.
+	Config []byte
+	Result []byte
+}
+
+// PortProxy describes a port forwarded to a VM by the userspace proxy.
+type PortProxy struct {
+	Protocol   string
+	ListenAddr string
+	TargetAddr string
+
+	// AllowedSources are the CIDRs of the clients allowed to connect. When
+	// empty, all clients are allowed.
+	AllowedSources []string
+}
+
+// DHCPReservation is an address reserved for a VM by the embedded DHCP
+// server, along with the options served with it.
+type DHCPReservation struct {
+	MAC      string
+	IP       string
+	Hostname string
+	DNS      []string
+}
+
+// DNSRecord is a hostname to address mapping served by the embedded DNS
+// resolver.
+type DNSRecord struct {
+	Hostname string
+	IP       string
 }
 
 // IsActiveString converts the boolean response from the IsActive call of
@@ -6,6 +6,8 @@ package net
 import (
 	"testing"
 
+	"github.com/hashicorp/nomad/plugins/base"
+
 	"github.com/shoenig/test/must"
 )
 
@@ -34,3 +36,25 @@ func Test_NetworkActiveString(t *testing.T) {
 		})
 	}
 }
+
+func Test_TeardownSpecBaselineState(t *testing.T) {
+	// The teardown spec as stored within the task state of drivers which
+	// predate the embedded DHCP server.
+	baseline := struct {
+		IPTablesRules   [][]string
+		DHCPReservation string
+		Network         string
+	}{
+		IPTablesRules: [][]string{{"filter", "FORWARD", "-d", "192.168.1.10", "-j", "ACCEPT"}},
+		Network:       "br0",
+	}
+
+	var buf []byte
+	must.NoError(t, base.MsgPackEncode(&buf, &baseline))
+
+	var spec TeardownSpec
+	must.NoError(t, base.MsgPackDecode(buf, &spec))
+	must.Eq(t, baseline.IPTablesRules, spec.IPTablesRules)
+	must.Eq(t, "br0", spec.Network)
+	must.Nil(t, spec.DHCPLease)
+}
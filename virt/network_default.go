@@ -0,0 +1,22 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !linux
+
+package virt
+
+import (
+	"errors"
+
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// CreateNetwork is not supported on non-Linux platforms
+func (d *VirtDriverPlugin) CreateNetwork(allocID string, req *drivers.NetworkCreateRequest) (*drivers.NetworkIsolationSpec, bool, error) {
+	return nil, false, errors.New("group network mode is only supported on Linux")
+}
+
+// DestroyNetwork is not supported on non-Linux platforms
+func (d *VirtDriverPlugin) DestroyNetwork(allocID string, spec *drivers.NetworkIsolationSpec) error {
+	return nil
+}
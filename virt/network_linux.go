@@ -0,0 +1,61 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build linux
+
+package virt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hashicorp/nomad/client/lib/nsutil"
+	"github.com/hashicorp/nomad/plugins/drivers"
+)
+
+// CreateNetwork creates the network namespace shared by the tasks of an
+// allocation using group network mode. It satisfies the Nomad
+// drivers.DriverNetworkManager interface.
+func (d *VirtDriverPlugin) CreateNetwork(allocID string, req *drivers.NetworkCreateRequest) (*drivers.NetworkIsolationSpec, bool, error) {
+	spec := &drivers.NetworkIsolationSpec{
+		Mode:   drivers.NetIsolationModeGroup,
+		Labels: make(map[string]string),
+	}
+	if req != nil && req.Hostname != "" {
+		spec.Labels[networkSpecHostnameLabel] = req.Hostname
+	}
+
+	netns, err := nsutil.NewNS(allocID)
+	if err != nil {
+		// When the client restarts, the namespace will already exist and be
+		// in use by the VMM. Return a spec pointing at it, but indicate it was
+		// not created so Nomad does not configure it again.
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) && pathErr.Err == syscall.EPERM {
+			nsPath := filepath.Join(nsutil.NetNSRunDir, allocID)
+			if _, statErr := os.Stat(nsPath); statErr == nil {
+				spec.Path = nsPath
+				return spec, false, nil
+			}
+		}
+		return nil, false, err
+	}
+
+	spec.Path = netns.Path()
+	d.logger.Debug("created network namespace", "alloc_id", allocID, "path", spec.Path)
+
+	return spec, true, nil
+}
+
+// DestroyNetwork removes the network namespace created by CreateNetwork. It
+// satisfies the Nomad drivers.DriverNetworkManager interface.
+func (d *VirtDriverPlugin) DestroyNetwork(allocID string, spec *drivers.NetworkIsolationSpec) error {
+	if spec == nil || spec.Path == "" {
+		return nil
+	}
+
+	d.logger.Debug("destroying network namespace", "alloc_id", allocID, "path", spec.Path)
+	return nsutil.UnmountNS(spec.Path)
+}